@@ -0,0 +1,158 @@
+// Package authn checks the email and password users sign in with. Each
+// Authenticator checks them against one source of users, such as the
+// local database or an LDAP directory, and a Chain asks several in turn.
+package authn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"ccz/store"
+)
+
+// Attempt is a sign-in with an email and password.
+type Attempt struct {
+	Email    string
+	Password string
+	// IP is where the attempt came from, recorded on the profile changes
+	// it makes.
+	IP string
+}
+
+// Authenticator checks attempts against one source of users.
+type Authenticator interface {
+	// Name identifies the authenticator in AUTH_METHODS and in logs.
+	Name() string
+	// Authenticate returns nil when the password is right: the user may
+	// sign in as a.Email, who then has an account. It returns
+	// ErrUnknownUser when the source has no such user, ErrInvalidCredentials
+	// when the password is wrong and other errors when it could not tell.
+	Authenticate(ctx context.Context, a Attempt) error
+}
+
+var (
+	ErrUnknownUser        = errors.New("authn: unknown user")
+	ErrInvalidCredentials = errors.New("authn: invalid credentials")
+
+	// ErrUnavailable wraps errors of sources that could not be reached or
+	// did not answer as configured.
+	ErrUnavailable = errors.New("authn: source unavailable")
+)
+
+// Local checks the password stored in the database. Users without one,
+// such as those who sign in with Google, are unknown to it.
+type Local struct {
+	Users      store.UserStore
+	Identities store.IdentityStore
+}
+
+func (l *Local) Name() string { return "local" }
+
+func (l *Local) Authenticate(ctx context.Context, a Attempt) error {
+	u, err := l.Users.GetByEmail(ctx, a.Email)
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrUnknownUser
+	}
+	if err != nil {
+		return err
+	}
+	if !u.HasPassword {
+		return ErrUnknownUser
+	}
+	_, err = l.Identities.Authenticate(ctx, a.Email, a.Password)
+	if errors.Is(err, store.ErrNotFound) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+// Chain asks its authenticators in order. The first that knows the user
+// decides, unless Fallback is set: then an attempt one of them refuses or
+// cannot check passes on to the next, and succeeds if any accepts it.
+type Chain struct {
+	Authenticators []Authenticator
+	Fallback       bool
+}
+
+func (c *Chain) Name() string {
+	names := make([]string, 0, len(c.Authenticators))
+	for _, a := range c.Authenticators {
+		names = append(names, a.Name())
+	}
+	return strings.Join(names, ",")
+}
+
+// Authenticate returns ErrInvalidCredentials when any authenticator refused
+// the password, else the first error of those that could not tell, else
+// ErrUnknownUser.
+func (c *Chain) Authenticate(ctx context.Context, a Attempt) error {
+	var failed error
+	for _, auth := range c.Authenticators {
+		err := auth.Authenticate(ctx, a)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, ErrUnknownUser):
+			continue
+		case !c.Fallback:
+			return err
+		case errors.Is(err, ErrInvalidCredentials):
+			failed = err
+		default:
+			slog.Warn("authenticator failed, trying the next", "authenticator", auth.Name(), "error", err)
+			if failed == nil {
+				failed = err
+			}
+		}
+	}
+	if failed != nil {
+		return failed
+	}
+	return ErrUnknownUser
+}
+
+// FromEnv reads AUTH_METHODS, the authenticators to ask in order, and
+// AUTH_FALLBACK. Methods are local, the default, and ldap, which is
+// configured by LDAPFromEnv.
+func FromEnv(users store.UserStore, identities store.IdentityStore) (*Chain, error) {
+	c := &Chain{}
+	if v := os.Getenv("AUTH_FALLBACK"); v != "" {
+		fallback, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("authn: AUTH_FALLBACK must be true or false, got %q", v)
+		}
+		c.Fallback = fallback
+	}
+
+	methods := os.Getenv("AUTH_METHODS")
+	if methods == "" {
+		methods = "local"
+	}
+	var seen []string
+	for _, name := range strings.Split(methods, ",") {
+		name = strings.TrimSpace(name)
+		if slices.Contains(seen, name) {
+			return nil, fmt.Errorf("authn: AUTH_METHODS lists %s twice", name)
+		}
+		seen = append(seen, name)
+		switch name {
+		case "local":
+			c.Authenticators = append(c.Authenticators, &Local{Users: users, Identities: identities})
+		case "ldap":
+			l, err := LDAPFromEnv(identities)
+			if err != nil {
+				return nil, err
+			}
+			c.Authenticators = append(c.Authenticators, l)
+		default:
+			return nil, fmt.Errorf("authn: unknown method %q in AUTH_METHODS; use local or ldap", name)
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,291 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+	"time"
+
+	"ccz/ldap/ldaptest"
+	"ccz/store"
+	"ccz/store/storetest"
+)
+
+type fake struct {
+	name  string
+	err   error
+	calls int
+}
+
+func (f *fake) Name() string { return f.name }
+
+func (f *fake) Authenticate(context.Context, Attempt) error {
+	f.calls++
+	return f.err
+}
+
+func TestChain(t *testing.T) {
+	ctx := context.Background()
+	down := errors.New("down")
+	for _, tc := range []struct {
+		name     string
+		errs     []error
+		fallback bool
+		want     error
+		calls    []int
+	}{
+		{"first accepts", []error{nil, nil}, false, nil, []int{1, 0}},
+		{"unknown passes on", []error{ErrUnknownUser, nil}, false, nil, []int{1, 1}},
+		{"nobody knows", []error{ErrUnknownUser, ErrUnknownUser}, false, ErrUnknownUser, []int{1, 1}},
+		{"refusal decides", []error{ErrInvalidCredentials, nil}, false, ErrInvalidCredentials, []int{1, 0}},
+		{"failure decides", []error{down, nil}, false, down, []int{1, 0}},
+		{"fallback after refusal", []error{ErrInvalidCredentials, nil}, true, nil, []int{1, 1}},
+		{"fallback after failure", []error{down, nil}, true, nil, []int{1, 1}},
+		{"refusal beats failure", []error{down, ErrInvalidCredentials}, true, ErrInvalidCredentials, []int{1, 1}},
+		{"failure beats unknown", []error{down, ErrUnknownUser}, true, down, []int{1, 1}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, b := &fake{name: "a", err: tc.errs[0]}, &fake{name: "b", err: tc.errs[1]}
+			c := &Chain{Authenticators: []Authenticator{a, b}, Fallback: tc.fallback}
+			if err := c.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "pass"}); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+				t.Errorf("expected %v, got %v", tc.want, err)
+			}
+			if a.calls != tc.calls[0] || b.calls != tc.calls[1] {
+				t.Errorf("expected calls %v, got [%d %d]", tc.calls, a.calls, b.calls)
+			}
+			if c.Name() != "a,b" {
+				t.Errorf("unexpected name %q", c.Name())
+			}
+		})
+	}
+}
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(ctx, "jo@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.UpsertGoogle(ctx, "al@ex.com", "Al", store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	l := &Local{Users: st, Identities: st}
+
+	for _, tc := range []struct {
+		email, password string
+		want            error
+	}{
+		{"jo@ex.com", "pass", nil},
+		{"jo@ex.com", "wrong", ErrInvalidCredentials},
+		{"al@ex.com", "pass", ErrUnknownUser},
+		{"nobody@ex.com", "pass", ErrUnknownUser},
+	} {
+		if err := l.Authenticate(ctx, Attempt{Email: tc.email, Password: tc.password}); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+			t.Errorf("%s/%s: expected %v, got %v", tc.email, tc.password, tc.want, err)
+		}
+	}
+}
+
+const (
+	admins  = "cn=admins,ou=groups,dc=ex,dc=com"
+	readers = "cn=readers,ou=groups,dc=ex,dc=com"
+)
+
+func newDirectory(t *testing.T) (*ldaptest.Server, *LDAP, *store.SQL) {
+	t.Helper()
+	srv, err := ldaptest.Start(
+		ldaptest.Entry{DN: "cn=svc,dc=ex,dc=com", Password: "svc pass"},
+		ldaptest.Entry{DN: "uid=jo,ou=people,dc=ex,dc=com", Password: "jo pass", Attributes: map[string][]string{
+			"objectClass": {"person"}, "mail": {"jo@ex.com"}, "displayName": {"Jo Doe"},
+			"telephoneNumber": {"(202) 555-0143"}, "memberOf": {readers, admins},
+		}},
+		ldaptest.Entry{DN: "cn=admins,ou=groups,dc=ex,dc=com", Attributes: map[string][]string{
+			"objectClass": {"groupOfNames"}, "member": {"uid=jo,ou=people,dc=ex,dc=com"},
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Close() })
+	srv.RequireTLS(true)
+
+	st := storetest.SQLite(t)
+	return srv, &LDAP{
+		URL:                srv.URL,
+		StartTLS:           true,
+		TLS:                &tls.Config{RootCAs: srv.RootCAs},
+		BindDN:             "cn=svc,dc=ex,dc=com",
+		BindPassword:       "svc pass",
+		BaseDN:             "dc=ex,dc=com",
+		UserFilter:         "(&(objectClass=person)(mail={email}))",
+		FullNameAttribute:  "displayName",
+		TelephoneAttribute: "telephoneNumber",
+		GroupAttribute:     "memberOf",
+		AdminGroups:        []string{admins},
+		DefaultRegion:      "US",
+		Timeout:            5 * time.Second,
+		Identities:         st,
+	}, st
+}
+
+func TestLDAP(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Provisions", func(t *testing.T) {
+		srv, l, st := newDirectory(t)
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass", IP: "192.0.2.1"}); err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.Binds(); !slices.Equal(got, []string{"cn=svc,dc=ex,dc=com", "uid=jo,ou=people,dc=ex,dc=com"}) {
+			t.Errorf("unexpected binds %v", got)
+		}
+		u, err := st.GetByEmail(ctx, "jo@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Jo Doe" || u.Telephone != "+12025550143" || u.Role != store.RoleAdmin || u.Provider != "ldap" || u.HasPassword {
+			t.Errorf("unexpected user %+v", u)
+		}
+		revs, err := st.Revisions(ctx, "jo@ex.com", 10)
+		if err != nil || len(revs) == 0 || revs[0].Source != store.SourceLDAP || revs[0].IP != "192.0.2.1" {
+			t.Errorf("unexpected revisions %+v, %v", revs, err)
+		}
+	})
+
+	t.Run("Follows the directory", func(t *testing.T) {
+		srv, l, st := newDirectory(t)
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); err != nil {
+			t.Fatal(err)
+		}
+		srv.Add(ldaptest.Entry{DN: "uid=jo,ou=people,dc=ex,dc=com", Password: "new pass", Attributes: map[string][]string{
+			"objectClass": {"person"}, "mail": {"jo@ex.com"}, "displayName": {"Jo Smith"}, "memberOf": {readers},
+		}})
+		if err := l.Authenticate(ctx, Attempt{Email: "JO@ex.com", Password: "jo pass"}); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("expected the old password refused, got %v", err)
+		}
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "new pass"}); err != nil {
+			t.Fatal(err)
+		}
+		u, err := st.GetByEmail(ctx, "jo@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Jo Smith" || u.Telephone != "+12025550143" || u.Role != store.RoleUser {
+			t.Errorf("unexpected user %+v", u)
+		}
+	})
+
+	t.Run("Group filter", func(t *testing.T) {
+		_, l, st := newDirectory(t)
+		l.GroupAttribute, l.GroupFilter = "", "(&(objectClass=groupOfNames)(member={dn}))"
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := st.GetByEmail(ctx, "jo@ex.com"); err != nil || u.Role != store.RoleAdmin {
+			t.Errorf("expected an admin, got %+v, %v", u, err)
+		}
+	})
+
+	t.Run("Refusals", func(t *testing.T) {
+		_, l, st := newDirectory(t)
+		for _, tc := range []struct {
+			email, password string
+			want            error
+		}{
+			{"jo@ex.com", "wrong", ErrInvalidCredentials},
+			{"jo@ex.com", "", ErrInvalidCredentials},
+			{"nobody@ex.com", "jo pass", ErrUnknownUser},
+			{"*", "jo pass", ErrUnknownUser},
+		} {
+			if err := l.Authenticate(ctx, Attempt{Email: tc.email, Password: tc.password}); !errors.Is(err, tc.want) {
+				t.Errorf("%s/%s: expected %v, got %v", tc.email, tc.password, tc.want, err)
+			}
+		}
+		if _, err := st.GetByEmail(ctx, "jo@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected no account, got %v", err)
+		}
+	})
+
+	t.Run("Unavailable", func(t *testing.T) {
+		srv, l, _ := newDirectory(t)
+		l.BindPassword = "wrong"
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("expected a bad service account unavailable, got %v", err)
+		}
+		l.BindPassword, l.StartTLS = "svc pass", false
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("expected a bind without TLS unavailable, got %v", err)
+		}
+		l.StartTLS, l.TLS = true, &tls.Config{}
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("expected an untrusted certificate unavailable, got %v", err)
+		}
+		srv.Close()
+		l.TLS = &tls.Config{RootCAs: srv.RootCAs}
+		if err := l.Authenticate(ctx, Attempt{Email: "jo@ex.com", Password: "jo pass"}); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("expected a closed server unavailable, got %v", err)
+		}
+	})
+}
+
+func TestFromEnv(t *testing.T) {
+	st := store.NewMemory()
+	set := func(t *testing.T, env map[string]string) {
+		for k, v := range env {
+			t.Setenv(k, v)
+		}
+	}
+
+	t.Run("Default", func(t *testing.T) {
+		c, err := FromEnv(st, st)
+		if err != nil || c.Name() != "local" || c.Fallback {
+			t.Errorf("unexpected chain %+v, %v", c, err)
+		}
+	})
+
+	t.Run("LDAP", func(t *testing.T) {
+		set(t, map[string]string{
+			"AUTH_METHODS":      "ldap, local",
+			"AUTH_FALLBACK":     "true",
+			"LDAP_URL":          "ldaps://dc.ex.com",
+			"LDAP_BASE_DN":      "dc=ex,dc=com",
+			"LDAP_ADMIN_GROUPS": "cn=admins,dc=ex,dc=com; cn=ops,dc=ex,dc=com",
+			"LDAP_TIMEOUT":      "2s",
+		})
+		c, err := FromEnv(st, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Name() != "ldap,local" || !c.Fallback {
+			t.Errorf("unexpected chain %+v", c)
+		}
+		l := c.Authenticators[0].(*LDAP)
+		if len(l.AdminGroups) != 2 || l.AdminGroups[1] != "cn=ops,dc=ex,dc=com" || l.Timeout != 2*time.Second ||
+			!l.StartTLS || l.UserFilter != "(&(objectClass=person)(mail={email}))" || l.GroupAttribute != "memberOf" {
+			t.Errorf("unexpected authenticator %+v", l)
+		}
+	})
+
+	for name, env := range map[string]map[string]string{
+		"unknown method":    {"AUTH_METHODS": "local,kerberos"},
+		"repeated method":   {"AUTH_METHODS": "local,local"},
+		"bad fallback":      {"AUTH_FALLBACK": "sometimes"},
+		"no URL":            {"AUTH_METHODS": "ldap", "LDAP_BASE_DN": "dc=ex,dc=com"},
+		"bad URL":           {"AUTH_METHODS": "ldap", "LDAP_URL": "https://dc.ex.com", "LDAP_BASE_DN": "dc=ex,dc=com"},
+		"no base":           {"AUTH_METHODS": "ldap", "LDAP_URL": "ldap://dc.ex.com"},
+		"filter sans email": {"AUTH_METHODS": "ldap", "LDAP_URL": "ldap://dc.ex.com", "LDAP_BASE_DN": "dc=ex,dc=com", "LDAP_USER_FILTER": "(uid=*)"},
+		"no bind password":  {"AUTH_METHODS": "ldap", "LDAP_URL": "ldap://dc.ex.com", "LDAP_BASE_DN": "dc=ex,dc=com", "LDAP_BIND_DN": "cn=svc"},
+		"bad timeout":       {"AUTH_METHODS": "ldap", "LDAP_URL": "ldap://dc.ex.com", "LDAP_BASE_DN": "dc=ex,dc=com", "LDAP_TIMEOUT": "-1s"},
+		"missing CA file":   {"AUTH_METHODS": "ldap", "LDAP_URL": "ldap://dc.ex.com", "LDAP_BASE_DN": "dc=ex,dc=com", "LDAP_CA_FILE": os.DevNull + "/none"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			set(t, env)
+			if _, err := FromEnv(st, st); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
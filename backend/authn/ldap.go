@@ -0,0 +1,243 @@
+package authn
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccz/ldap"
+	"ccz/phone"
+	"ccz/store"
+)
+
+// LDAP checks passwords against an LDAP directory such as Active
+// Directory. It finds the user's entry with a service account and binds as
+// that entry with the password. Users are created on their first sign-in,
+// and their name, telephone and role follow the directory on every one.
+// An account of the same email that already exists is taken over and loses
+// its local password, so the directory must be trusted with every email its
+// filter can match.
+type LDAP struct {
+	// URL is ldap://host[:port] or ldaps://host[:port].
+	URL string
+	// StartTLS upgrades ldap:// connections before anything is sent.
+	StartTLS bool
+	TLS      *tls.Config
+	// BindDN and BindPassword are the service account that searches for
+	// users. Without them the search is anonymous.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the entry of a user; {email} stands for the email
+	// signed in with.
+	UserFilter         string
+	FullNameAttribute  string
+	TelephoneAttribute string
+	// GroupAttribute lists the DNs of the groups of a user's entry.
+	GroupAttribute string
+	// GroupFilter, when set, finds the groups of a user by searching
+	// instead; {dn} stands for the user's DN.
+	GroupFilter string
+	// AdminGroups are the DNs of the groups whose members are admins.
+	// Everyone else is a user. With none, roles are left as they are.
+	AdminGroups []string
+	// DefaultRegion reads telephone numbers without a country code.
+	DefaultRegion string
+	Timeout       time.Duration
+	Identities    store.IdentityStore
+}
+
+func (l *LDAP) Name() string { return "ldap" }
+
+func (l *LDAP) Authenticate(ctx context.Context, a Attempt) error {
+	// A bind without a password would succeed without checking anything.
+	if a.Password == "" {
+		return ErrInvalidCredentials
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.Timeout)
+	defer cancel()
+
+	conn, err := ldap.Dial(ctx, l.URL, l.TLS)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+	if l.StartTLS && strings.HasPrefix(l.URL, "ldap:") {
+		if err := conn.StartTLS(l.TLS); err != nil {
+			return fmt.Errorf("%w: %v", ErrUnavailable, err)
+		}
+	}
+
+	entry, groups, err := l.find(conn, a.Email)
+	if err != nil {
+		return err
+	}
+	err = conn.Bind(entry.DN, a.Password)
+	if ldap.IsResult(err, ldap.ResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	return l.sync(ctx, a, entry, groups)
+}
+
+// find returns the entry of the user with email and the DNs of their
+// groups, searching as the service account.
+func (l *LDAP) find(conn *ldap.Conn, email string) (*ldap.Entry, []string, error) {
+	if l.BindDN != "" {
+		if err := conn.Bind(l.BindDN, l.BindPassword); err != nil {
+			return nil, nil, fmt.Errorf("%w: service account: %v", ErrUnavailable, err)
+		}
+	}
+
+	var attrs []string
+	for _, a := range []string{l.FullNameAttribute, l.TelephoneAttribute, l.GroupAttribute} {
+		if a != "" {
+			attrs = append(attrs, a)
+		}
+	}
+	entries, err := conn.Search(&ldap.SearchRequest{
+		BaseDN:     l.BaseDN,
+		Scope:      ldap.ScopeSubtree,
+		Filter:     strings.ReplaceAll(l.UserFilter, "{email}", ldap.EscapeFilter(email)),
+		Attributes: attrs,
+		SizeLimit:  2,
+	})
+	switch {
+	case ldap.IsResult(err, ldap.ResultSizeLimitExceeded) || err == nil && len(entries) > 1:
+		return nil, nil, fmt.Errorf("%w: several entries match %s", ErrUnavailable, email)
+	case err != nil:
+		return nil, nil, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	case len(entries) == 0:
+		return nil, nil, ErrUnknownUser
+	}
+	entry := &entries[0]
+
+	if l.GroupFilter == "" {
+		return entry, entry.Values(l.GroupAttribute), nil
+	}
+	found, err := conn.Search(&ldap.SearchRequest{
+		BaseDN:     l.BaseDN,
+		Scope:      ldap.ScopeSubtree,
+		Filter:     strings.ReplaceAll(l.GroupFilter, "{dn}", ldap.EscapeFilter(entry.DN)),
+		Attributes: []string{"1.1"}, // no attributes
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: groups: %v", ErrUnavailable, err)
+	}
+	groups := make([]string, 0, len(found))
+	for _, g := range found {
+		groups = append(groups, g.DN)
+	}
+	return entry, groups, nil
+}
+
+// sync creates or updates the account of the user of entry.
+func (l *LDAP) sync(ctx context.Context, a Attempt, entry *ldap.Entry, groups []string) error {
+	var update store.ProfileUpdate
+	if name := strings.TrimSpace(entry.Value(l.FullNameAttribute)); len(name) <= 255 {
+		update.FullName = name
+	}
+	// A number the directory has wrong is not worth refusing the sign-in.
+	if n, err := phone.Parse(entry.Value(l.TelephoneAttribute), l.DefaultRegion); err == nil {
+		update.Telephone = n.E164()
+	}
+	var role string
+	if len(l.AdminGroups) > 0 {
+		role = store.RoleUser
+		if slices.ContainsFunc(groups, func(g string) bool {
+			return slices.ContainsFunc(l.AdminGroups, func(admin string) bool { return strings.EqualFold(g, admin) })
+		}) {
+			role = store.RoleAdmin
+		}
+	}
+	change := store.Change{Actor: a.Email, IP: a.IP, Source: store.SourceLDAP}
+	_, err := l.Identities.UpsertLDAP(ctx, a.Email, update, role, change)
+	return err
+}
+
+// LDAPFromEnv reads LDAP_URL, LDAP_STARTTLS, LDAP_CA_FILE, LDAP_BIND_DN,
+// LDAP_BIND_PASSWORD, LDAP_BASE_DN, LDAP_USER_FILTER,
+// LDAP_FULL_NAME_ATTRIBUTE, LDAP_TELEPHONE_ATTRIBUTE,
+// LDAP_GROUP_ATTRIBUTE, LDAP_GROUP_FILTER, LDAP_ADMIN_GROUPS and
+// LDAP_TIMEOUT. Admin groups are separated by semicolons, since DNs hold
+// commas. StartTLS is on by default for ldap:// URLs.
+func LDAPFromEnv(identities store.IdentityStore) (*LDAP, error) {
+	l := &LDAP{
+		URL:                os.Getenv("LDAP_URL"),
+		StartTLS:           true,
+		TLS:                &tls.Config{MinVersion: tls.VersionTLS12},
+		BindDN:             os.Getenv("LDAP_BIND_DN"),
+		BindPassword:       os.Getenv("LDAP_BIND_PASSWORD"),
+		BaseDN:             os.Getenv("LDAP_BASE_DN"),
+		UserFilter:         envOr("LDAP_USER_FILTER", "(&(objectClass=person)(mail={email}))"),
+		FullNameAttribute:  envOr("LDAP_FULL_NAME_ATTRIBUTE", "displayName"),
+		TelephoneAttribute: envOr("LDAP_TELEPHONE_ATTRIBUTE", "telephoneNumber"),
+		GroupAttribute:     envOr("LDAP_GROUP_ATTRIBUTE", "memberOf"),
+		GroupFilter:        os.Getenv("LDAP_GROUP_FILTER"),
+		DefaultRegion:      "US",
+		Timeout:            5 * time.Second,
+		Identities:         identities,
+	}
+	if u, err := url.Parse(l.URL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		return nil, fmt.Errorf("authn: LDAP_URL must be an ldap:// or ldaps:// URL, got %q", l.URL)
+	}
+	if l.BaseDN == "" {
+		return nil, errors.New("authn: LDAP_BASE_DN is required")
+	}
+	if !strings.Contains(l.UserFilter, "{email}") {
+		return nil, errors.New("authn: LDAP_USER_FILTER must contain {email}")
+	}
+	if l.BindDN != "" && l.BindPassword == "" {
+		return nil, errors.New("authn: LDAP_BIND_DN needs LDAP_BIND_PASSWORD")
+	}
+	if v := os.Getenv("LDAP_STARTTLS"); v != "" {
+		on, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("authn: LDAP_STARTTLS must be true or false, got %q", v)
+		}
+		l.StartTLS = on
+	}
+	if path := os.Getenv("LDAP_CA_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("authn: reading LDAP_CA_FILE: %w", err)
+		}
+		l.TLS.RootCAs = x509.NewCertPool()
+		if !l.TLS.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("authn: LDAP_CA_FILE holds no PEM certificate")
+		}
+	}
+	if region := os.Getenv("PHONE_DEFAULT_REGION"); phone.KnownRegion(region) {
+		l.DefaultRegion = region
+	}
+	for _, dn := range strings.Split(os.Getenv("LDAP_ADMIN_GROUPS"), ";") {
+		if dn = strings.TrimSpace(dn); dn != "" {
+			l.AdminGroups = append(l.AdminGroups, dn)
+		}
+	}
+	if v := os.Getenv("LDAP_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("authn: LDAP_TIMEOUT must be a positive duration like 5s, got %q", v)
+		}
+		l.Timeout = d
+	}
+	return l, nil
+}
+
+func envOr(name, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
@@ -0,0 +1,155 @@
+// Package avatar turns uploaded pictures into the square thumbnails served
+// as profile avatars, and stores them.
+package avatar
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"slices"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Sizes are the edge lengths, in pixels, of the thumbnails made for every
+// avatar.
+var Sizes = []int{256, 128, 64}
+
+const (
+	// MaxBytes bounds an uploaded or imported picture.
+	MaxBytes = 5 << 20
+	// MaxPixels bounds the decoded size, so a small file cannot expand
+	// into an image that exhausts memory.
+	MaxPixels = 25_000_000
+
+	jpegQuality = 85
+)
+
+var (
+	ErrTooLarge    = errors.New("avatar: picture is too large")
+	ErrUnsupported = errors.New("avatar: unsupported picture format")
+	ErrInvalid     = errors.New("avatar: picture could not be decoded")
+)
+
+// Thumbnail is one re-encoded avatar size.
+type Thumbnail struct {
+	Size        int
+	ContentType string
+	Data        []byte
+}
+
+// decoders maps the sniffed content types that are accepted to their
+// decoders. Formats are chosen by sniffing, never by the name or type the
+// client claims.
+var decoders = map[string]struct {
+	config func([]byte) (image.Config, error)
+	decode func([]byte) (image.Image, error)
+}{
+	"image/jpeg": {
+		func(b []byte) (image.Config, error) { return jpeg.DecodeConfig(bytes.NewReader(b)) },
+		func(b []byte) (image.Image, error) { return jpeg.Decode(bytes.NewReader(b)) },
+	},
+	"image/png": {
+		func(b []byte) (image.Config, error) { return png.DecodeConfig(bytes.NewReader(b)) },
+		func(b []byte) (image.Image, error) { return png.Decode(bytes.NewReader(b)) },
+	},
+	"image/gif": {
+		func(b []byte) (image.Config, error) { return gif.DecodeConfig(bytes.NewReader(b)) },
+		func(b []byte) (image.Image, error) { return gif.Decode(bytes.NewReader(b)) },
+	},
+	"image/webp": {
+		func(b []byte) (image.Config, error) { return webp.DecodeConfig(bytes.NewReader(b)) },
+		func(b []byte) (image.Image, error) { return webp.Decode(bytes.NewReader(b)) },
+	},
+}
+
+// Process decodes a picture and renders it at every size in Sizes, centre
+// cropped to a square. The thumbnails are freshly encoded from pixels, so
+// nothing of the original file, such as EXIF location data, survives.
+// Opaque pictures become JPEG and the rest PNG.
+func Process(data []byte) ([]Thumbnail, error) {
+	if len(data) > MaxBytes {
+		return nil, ErrTooLarge
+	}
+	codec, ok := decoders[http.DetectContentType(data)]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+	cfg, err := codec.config(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrInvalid
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+	img, err := codec.decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+
+	src := square(img.Bounds())
+	opaque := isOpaque(img)
+	thumbs := make([]Thumbnail, 0, len(Sizes))
+	for _, size := range Sizes {
+		dst := image.NewRGBA(image.Rect(0, 0, size, size))
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+
+		var buf bytes.Buffer
+		t := Thumbnail{Size: size, ContentType: "image/png"}
+		if opaque {
+			t.ContentType = "image/jpeg"
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegQuality})
+		} else {
+			err = png.Encode(&buf, dst)
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.Data = buf.Bytes()
+		thumbs = append(thumbs, t)
+	}
+	return thumbs, nil
+}
+
+// ValidSize reports whether size is one of Sizes.
+func ValidSize(size int) bool {
+	return slices.Contains(Sizes, size)
+}
+
+// NewID returns a random identifier for a new set of thumbnails. IDs are
+// never reused, so the images behind one can be cached indefinitely.
+func NewID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// square returns the largest centred square within r.
+func square(r image.Rectangle) image.Rectangle {
+	w, h := r.Dx(), r.Dy()
+	if w > h {
+		off := (w - h) / 2
+		return image.Rect(r.Min.X+off, r.Min.Y, r.Min.X+off+h, r.Max.Y)
+	}
+	off := (h - w) / 2
+	return image.Rect(r.Min.X, r.Min.Y+off, r.Max.X, r.Min.Y+off+w)
+}
+
+func isOpaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
@@ -0,0 +1,127 @@
+package avatar
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcess(t *testing.T) {
+	t.Run("Opaque Picture Becomes JPEG Squares", func(t *testing.T) {
+		src := image.NewRGBA(image.Rect(0, 0, 600, 300))
+		for x := 0; x < 600; x++ {
+			for y := 0; y < 300; y++ {
+				src.Set(x, y, color.RGBA{uint8(x), uint8(y), 0, 255})
+			}
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, src, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		thumbs, err := Process(buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(thumbs) != len(Sizes) {
+			t.Fatalf("expected %d thumbnails, got %d", len(Sizes), len(thumbs))
+		}
+		for i, th := range thumbs {
+			if th.Size != Sizes[i] || th.ContentType != "image/jpeg" {
+				t.Errorf("unexpected thumbnail %d: %dpx %s", i, th.Size, th.ContentType)
+			}
+			cfg, err := jpeg.DecodeConfig(bytes.NewReader(th.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.Width != th.Size || cfg.Height != th.Size {
+				t.Errorf("expected %dx%d, got %dx%d", th.Size, th.Size, cfg.Width, cfg.Height)
+			}
+		}
+	})
+
+	t.Run("Transparency Keeps PNG", func(t *testing.T) {
+		thumbs, err := Process(encodePNG(t, image.NewNRGBA(image.Rect(0, 0, 40, 80))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if thumbs[0].ContentType != "image/png" {
+			t.Errorf("expected PNG, got %s", thumbs[0].ContentType)
+		}
+	})
+
+	t.Run("Metadata Is Dropped", func(t *testing.T) {
+		// A JPEG with an APP1 (EXIF) segment spliced in after SOI.
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 32, 32)), nil); err != nil {
+			t.Fatal(err)
+		}
+		exif := append([]byte{0xFF, 0xE1, 0x00, 0x12}, []byte("Exif\x00\x00GPS-SECRET")...)
+		data := append(append(buf.Bytes()[:2:2], exif...), buf.Bytes()[2:]...)
+
+		thumbs, err := Process(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, th := range thumbs {
+			if bytes.Contains(th.Data, []byte("GPS-SECRET")) || bytes.Contains(th.Data, []byte("Exif")) {
+				t.Errorf("%dpx thumbnail kept the EXIF segment", th.Size)
+			}
+		}
+	})
+
+	t.Run("Rejected Input", func(t *testing.T) {
+		valid := encodePNG(t, image.NewGray(image.Rect(0, 0, 8, 8)))
+
+		// A tiny PNG whose header claims a 100000x100000 image.
+		bomb := append([]byte(nil), valid...)
+		binary.BigEndian.PutUint32(bomb[16:], 100000)
+		binary.BigEndian.PutUint32(bomb[20:], 100000)
+		binary.BigEndian.PutUint32(bomb[29:], crc32.ChecksumIEEE(bomb[12:29]))
+
+		for name, tc := range map[string]struct {
+			data []byte
+			want error
+		}{
+			"Text":         {[]byte("<svg xmlns='http://www.w3.org/2000/svg'></svg>"), ErrUnsupported},
+			"Truncated":    {valid[:40], ErrInvalid},
+			"Oversized":    {append(valid, make([]byte, MaxBytes)...), ErrTooLarge},
+			"Pixel Bomb":   {bomb, ErrTooLarge},
+			"Empty":        {nil, ErrUnsupported},
+			"Fake Picture": {append([]byte("\x89PNG\r\n\x1a\n"), "not really"...), ErrInvalid},
+		} {
+			if _, err := Process(tc.data); !errors.Is(err, tc.want) {
+				t.Errorf("%s: expected %v, got %v", name, tc.want, err)
+			}
+		}
+	})
+}
+
+func TestSquare(t *testing.T) {
+	for _, tc := range []struct {
+		in, want image.Rectangle
+	}{
+		{image.Rect(0, 0, 300, 100), image.Rect(100, 0, 200, 100)},
+		{image.Rect(0, 0, 100, 300), image.Rect(0, 100, 100, 200)},
+		{image.Rect(10, 10, 60, 60), image.Rect(10, 10, 60, 60)},
+	} {
+		if got := square(tc.in); got != tc.want {
+			t.Errorf("square(%v) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package avatar
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var ErrNotFound = errors.New("avatar: not found")
+
+// Storage keeps avatar thumbnails under opaque keys.
+type Storage interface {
+	Put(ctx context.Context, key string, data []byte, contentType string) error
+	// Get returns ErrNotFound for keys that were never stored or were
+	// deleted. The caller closes Body.
+	Get(ctx context.Context, key string) (*Object, error)
+	// Delete succeeds for keys that do not exist.
+	Delete(ctx context.Context, key string) error
+}
+
+type Object struct {
+	Body        io.ReadCloser
+	ContentType string
+	Size        int64
+}
+
+// Key is where the thumbnail of the given size for avatar id is stored.
+func Key(id string, size int) string {
+	return id + "/" + strconv.Itoa(size)
+}
+
+// Save stores every thumbnail of avatar id.
+func Save(ctx context.Context, st Storage, id string, thumbs []Thumbnail) error {
+	for _, t := range thumbs {
+		if err := st.Put(ctx, Key(id, t.Size), t.Data, t.ContentType); err != nil {
+			return fmt.Errorf("avatar: store %dpx: %w", t.Size, err)
+		}
+	}
+	return nil
+}
+
+// Remove deletes every thumbnail of avatar id.
+func Remove(ctx context.Context, st Storage, id string) error {
+	var errs []error
+	for _, size := range Sizes {
+		errs = append(errs, st.Delete(ctx, Key(id, size)))
+	}
+	return errors.Join(errs...)
+}
+
+// StorageFromEnv picks the storage driver from AVATAR_STORAGE: "local"
+// (the default) keeps files under AVATAR_DIR, "s3" uses the S3_* settings.
+func StorageFromEnv() (Storage, error) {
+	switch driver := os.Getenv("AVATAR_STORAGE"); driver {
+	case "", "local":
+		dir := os.Getenv("AVATAR_DIR")
+		if dir == "" {
+			dir = "data/avatars"
+		}
+		return &Local{Dir: dir}, nil
+	case "s3":
+		s := &S3{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY_ID"),
+			SecretKey: os.Getenv("S3_SECRET_ACCESS_KEY"),
+			PathStyle: strings.EqualFold(os.Getenv("S3_PATH_STYLE"), "true"),
+		}
+		if s.Region == "" {
+			s.Region = "us-east-1"
+		}
+		if s.Endpoint == "" {
+			s.Endpoint = "https://s3." + s.Region + ".amazonaws.com"
+		}
+		if s.Bucket == "" || s.AccessKey == "" || s.SecretKey == "" {
+			return nil, errors.New("avatar: S3_BUCKET, S3_ACCESS_KEY_ID and S3_SECRET_ACCESS_KEY are required for s3 storage")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("avatar: unknown AVATAR_STORAGE %q", driver)
+	}
+}
@@ -0,0 +1,164 @@
+package avatar
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStorage checks the behaviour every driver must share.
+func testStorage(t *testing.T, st Storage) {
+	ctx := context.Background()
+	png := []byte("\x89PNG\r\n\x1a\n fake image data")
+
+	if err := st.Put(ctx, Key("abc", 64), png, "image/png"); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	obj, err := st.Get(ctx, Key("abc", 64))
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	data, _ := io.ReadAll(obj.Body)
+	obj.Body.Close()
+	if string(data) != string(png) || obj.ContentType != "image/png" || obj.Size != int64(len(png)) {
+		t.Errorf("unexpected object %q %s %d", data, obj.ContentType, obj.Size)
+	}
+
+	if _, err := st.Get(ctx, Key("abc", 128)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if err := st.Delete(ctx, Key("abc", 64)); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := st.Get(ctx, Key("abc", 64)); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if err := st.Delete(ctx, Key("abc", 64)); err != nil {
+		t.Errorf("deleting a missing key: %v", err)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	l := &Local{Dir: t.TempDir()}
+	testStorage(t, l)
+
+	for _, key := range []string{"../escape", "/etc/passwd", `a\..\b`} {
+		if err := l.Put(context.Background(), key, []byte("x"), ""); err == nil {
+			t.Errorf("expected %q to be rejected", key)
+		}
+	}
+}
+
+// fakeS3 is a minimal in-memory stand-in for an S3 bucket. It checks each
+// request's signature by signing it again with the shared secret.
+type fakeS3 struct {
+	secret  string
+	mu      sync.Mutex
+	objects map[string]fakeObject
+}
+
+type fakeObject struct {
+	data        []byte
+	contentType string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	got := r.Header.Get("Authorization")
+	check := r.Clone(r.Context())
+	check.URL.Host = r.Host
+	check.Header = http.Header{}
+	for name, values := range r.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") || lower == "content-type" {
+			check.Header[name] = values
+		}
+	}
+	now, err := time.Parse(amzDateFormat, r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		http.Error(w, "missing date", http.StatusForbidden)
+		return
+	}
+	signV4(check, r.Header.Get("X-Amz-Content-Sha256"), "test-key", f.secret, "us-east-1", "s3", now)
+	if want := check.Header.Get("Authorization"); got != want {
+		http.Error(w, "SignatureDoesNotMatch", http.StatusForbidden)
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	if r.Method == http.MethodPut && sha256Hex(body) != r.Header.Get("X-Amz-Content-Sha256") {
+		http.Error(w, "XAmzContentSHA256Mismatch", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[r.URL.Path] = fakeObject{body, r.Header.Get("Content-Type")}
+	case http.MethodGet:
+		obj, ok := f.objects[r.URL.Path]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Write(obj.data)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3(t *testing.T) {
+	fake := &fakeS3{secret: "test-secret", objects: map[string]fakeObject{}}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+
+	s := &S3{Endpoint: srv.URL, Region: "us-east-1", Bucket: "avatars", AccessKey: "test-key", SecretKey: "test-secret", PathStyle: true}
+	testStorage(t, s)
+
+	if err := s.Put(context.Background(), "abc/64", []byte("x"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["/avatars/abc/64"]; !ok {
+		t.Errorf("expected a path-style object, got %v", fake.objects)
+	}
+
+	t.Run("Bad Credentials", func(t *testing.T) {
+		bad := *s
+		bad.SecretKey = "wrong"
+		if err := bad.Put(context.Background(), "abc/64", []byte("x"), "image/png"); err == nil || !strings.Contains(err.Error(), "403") {
+			t.Errorf("expected a 403 error, got %v", err)
+		}
+	})
+
+	t.Run("Virtual Hosted URL", func(t *testing.T) {
+		vh := &S3{Endpoint: "https://s3.eu-west-1.amazonaws.com", Bucket: "avatars"}
+		u, err := vh.objectURL("abc/64")
+		if err != nil || u.String() != "https://avatars.s3.eu-west-1.amazonaws.com/abc/64" {
+			t.Errorf("unexpected URL %v, %v", u, err)
+		}
+	})
+}
+
+// TestSignV4 checks the signer against the get-vanilla case of the AWS
+// Signature Version 4 test suite.
+func TestSignV4(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now, _ := time.Parse(amzDateFormat, "20150830T123600Z")
+	signV4(req, emptyPayloadHash, "AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "us-east-1", "service", now)
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if got := req.Header.Get("Authorization"); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"ccz/password"
+)
+
+// breachfilter builds the filter PASSWORD_BREACHED_FILE points at from a
+// list of compromised passwords. Each line of the input is either a
+// password or, as in the Have I Been Pwned downloads, an upper-case SHA-1
+// hex digest optionally followed by ":count". The input is read twice, once
+// to size the filter and once to fill it, so it must be a file.
+func main() {
+	in := flag.String("in", "", "password or SHA-1 list to read")
+	out := flag.String("out", "breached.bloom", "filter file to write")
+	fp := flag.Float64("fp", 0.001, "false positive rate")
+	flag.Parse()
+
+	if *in == "" {
+		log.Fatal("-in is required")
+	}
+	if *fp <= 0 || *fp >= 1 {
+		log.Fatal("-fp must be between 0 and 1")
+	}
+
+	n := 0
+	scan(*in, func([sha1.Size]byte) { n++ })
+	filter := password.NewBloom(n, *fp)
+	scan(*in, filter.Add)
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := filter.WriteTo(f); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d passwords to %s", n, *out)
+}
+
+// scan calls fn with the digest of every non-empty line of the file.
+func scan(path string, fn func([sha1.Size]byte)) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		fn(digest(line))
+	}
+	if err := s.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// digest reads a line as a SHA-1 hex digest when it looks like one and
+// hashes it as a password otherwise.
+func digest(line string) [sha1.Size]byte {
+	var d [sha1.Size]byte
+	hash, _, _ := strings.Cut(line, ":")
+	if len(hash) == hex.EncodedLen(sha1.Size) && hash == strings.ToUpper(hash) {
+		if _, err := hex.Decode(d[:], []byte(hash)); err == nil {
+			return d
+		}
+	}
+	return sha1.Sum([]byte(line))
+}
@@ -1,34 +1,118 @@
 package main
 
 import (
-	"ccz/utils"
-	"database/sql"
+	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"strconv"
 
-	_ "github.com/go-sql-driver/mysql"
+	"ccz/db"
+	"ccz/migrate"
+	"ccz/utils"
 )
 
+const usage = `usage: migration [flags] <command>
+
+commands:
+  up              apply all pending migrations (default)
+  down N          roll back the N most recent migrations
+  status          list migrations and whether they are applied
+  redo            roll back and re-apply the latest migration
+  create <name>   add a new empty up/down pair for every dialect under -dir
+
+flags:
+`
+
 func main() {
+	dryRun := flag.Bool("dry-run", false, "print the plan without changing the database")
+	outOfOrder := flag.Bool("out-of-order", false, "apply pending migrations older than the latest applied one")
+	dir := flag.String("dir", "migrate/migrations", "migration source root used by create")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	cmd := flag.Arg(0)
+	if cmd == "" {
+		cmd = "up"
+	}
+
+	if cmd == "create" {
+		if flag.NArg() != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		paths, err := migrate.Create(*dir, flag.Arg(1))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, p := range paths {
+			fmt.Println("created", p)
+		}
+		return
+	}
+
 	utils.LoadEnv(".env")
-	db, err := sql.Open("mysql", os.Getenv("DB_DSN"))
+	cfg, err := db.ConfigFromEnv()
 	if err != nil {
 		log.Fatal(err)
 	}
+	conn, dialect, err := db.Connect(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
 
-	_, err = db.Exec(`
-create table if not exists users (
-	id int auto_increment primary key,
-	email varchar(255) unique,
-	password varchar(255),
-	full_name varchar(255),
-	telephone varchar(50),
-	provider varchar(20)
-)
-`)
+	migrations, err := migrate.Embedded(dialect)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := migrate.New(conn, dialect, migrations, os.Stdout)
+	m.DryRun = *dryRun
+	m.OutOfOrder = *outOfOrder
+	ctx := context.Background()
+
+	switch cmd {
+	case "up":
+		err = m.Up(ctx)
+	case "down":
+		n, convErr := strconv.Atoi(flag.Arg(1))
+		if convErr != nil {
+			flag.Usage()
+			os.Exit(2)
+		}
+		err = m.Down(ctx, n)
+	case "redo":
+		err = m.Redo(ctx)
+	case "status":
+		err = printStatus(ctx, m)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+}
 
-	log.Println("migration completed")
+func printStatus(ctx context.Context, m *migrate.Migrator) error {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied " + s.AppliedAt
+		}
+		if s.Modified {
+			state += " (modified since applied)"
+		}
+		fmt.Printf("%-40s %s\n", s.Migration, state)
+	}
+	return nil
 }
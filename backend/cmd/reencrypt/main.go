@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"ccz/db"
+	"ccz/pii"
+	"ccz/store"
+	"ccz/utils"
+)
+
+// reencrypt walks the users, profile_revisions, profile_attributes,
+// phone_challenges and email_changes tables in id order and seals every PII
+// column with the current key from PII_KEY_FILE. Run it after enabling
+// encryption on an existing database and after adding a new key version.
+func main() {
+	batch := flag.Int("batch", 500, "rows per batch")
+	dryRun := flag.Bool("dry-run", false, "count rows that need re-encryption without changing them")
+	genKey := flag.Bool("genkey", false, "print a new random key for the key file and exit")
+	flag.Parse()
+
+	if *genKey {
+		key, err := pii.GenerateKey()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	utils.LoadEnv(".env")
+	keyFile := os.Getenv("PII_KEY_FILE")
+	if keyFile == "" {
+		log.Fatal("PII_KEY_FILE is not set")
+	}
+	keyring, err := pii.LoadKeyFile(keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cfg, err := db.ConfigFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	conn, dialect, err := db.Connect(context.Background(), cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	st := store.NewSQL(conn, dialect)
+	st.Cipher = keyring
+
+	ctx := context.Background()
+	total := 0
+	for _, pass := range []struct {
+		table string
+		run   func(context.Context, int64, int, bool) (int64, int, error)
+	}{
+		{"users", st.Reencrypt},
+		{"profile_revisions", st.ReencryptRevisions},
+		{"profile_attributes", st.ReencryptAttributes},
+		{"phone_challenges", st.ReencryptPhoneChallenges},
+		{"email_changes", st.ReencryptEmailChanges},
+	} {
+		var after int64
+		for {
+			last, changed, err := pass.run(ctx, after, *batch, *dryRun)
+			if err != nil {
+				log.Fatalf("%s: batch after id %d: %v", pass.table, after, err)
+			}
+			if last == 0 {
+				break
+			}
+			total += changed
+			log.Printf("%s: processed ids %d..%d, %d changed", pass.table, after+1, last, changed)
+			after = last
+		}
+	}
+
+	if *dryRun {
+		log.Printf("dry run: %d rows need re-encryption with key version %d", total, keyring.CurrentVersion())
+		return
+	}
+	log.Printf("done: %d rows re-encrypted with key version %d", total, keyring.CurrentVersion())
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"sync"
+)
+
+type message struct {
+	To   string `json:"to"`
+	From string `json:"from"`
+	Body string `json:"body"`
+}
+
+// smsstub stands in for an SMS provider during development. Point the
+// backend at it with SMS_DRIVER=http and SMS_HTTP_URL=http://localhost:8089/messages;
+// it logs every message it accepts and lists them at GET /messages.
+func main() {
+	addr := flag.String("addr", ":8089", "listen address")
+	token := flag.String("token", "", "bearer token to require, if any")
+	flag.Parse()
+
+	var (
+		mu   sync.Mutex
+		sent []message
+	)
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /messages", func(w http.ResponseWriter, r *http.Request) {
+		if *token != "" && r.Header.Get("Authorization") != "Bearer "+*token {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var m message
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil || m.To == "" {
+			http.Error(w, "Invalid message", http.StatusBadRequest)
+			return
+		}
+		log.Printf("to %s: %s", m.To, m.Body)
+		mu.Lock()
+		sent = append(sent, m)
+		mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+	})
+	mux.HandleFunc("GET /messages", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sent)
+	})
+
+	log.Printf("smsstub listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
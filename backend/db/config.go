@@ -0,0 +1,90 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	DSN             string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// ConnectTimeout bounds how long startup keeps retrying an unreachable
+	// database before giving up.
+	ConnectTimeout time.Duration
+	// HealthInterval is how often the background prober pings the database
+	// and its replicas.
+	HealthInterval time.Duration
+
+	// ReplicaDSNs are optional read replicas of DSN.
+	ReplicaDSNs []string
+	// ReplicaMaxLag takes a replica out of rotation once it falls further
+	// behind than this.
+	ReplicaMaxLag time.Duration
+	// ReadAfterWrite keeps a user's reads on the primary for this long after
+	// they write.
+	ReadAfterWrite time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		MaxOpenConns:    25,
+		MaxIdleConns:    25,
+		ConnMaxLifetime: 5 * time.Minute,
+		ConnectTimeout:  30 * time.Second,
+		HealthInterval:  5 * time.Second,
+		ReplicaMaxLag:   5 * time.Second,
+		ReadAfterWrite:  5 * time.Second,
+	}
+}
+
+// ConfigFromEnv reads DB_DSN and the DB_* pool settings, keeping defaults for
+// anything unset.
+func ConfigFromEnv() (Config, error) {
+	cfg := DefaultConfig()
+	cfg.DSN = os.Getenv("DB_DSN")
+	for _, dsn := range strings.Split(os.Getenv("DB_REPLICA_DSNS"), ",") {
+		if dsn = strings.TrimSpace(dsn); dsn != "" {
+			cfg.ReplicaDSNs = append(cfg.ReplicaDSNs, dsn)
+		}
+	}
+
+	ints := map[string]*int{
+		"DB_MAX_OPEN_CONNS": &cfg.MaxOpenConns,
+		"DB_MAX_IDLE_CONNS": &cfg.MaxIdleConns,
+	}
+	for key, dst := range ints {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return cfg, fmt.Errorf("db: %s must be a non-negative integer, got %q", key, v)
+			}
+			*dst = n
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"DB_CONN_MAX_LIFETIME":  &cfg.ConnMaxLifetime,
+		"DB_CONN_MAX_IDLE_TIME": &cfg.ConnMaxIdleTime,
+		"DB_CONNECT_TIMEOUT":    &cfg.ConnectTimeout,
+		"DB_HEALTH_INTERVAL":    &cfg.HealthInterval,
+		"DB_REPLICA_MAX_LAG":    &cfg.ReplicaMaxLag,
+		"DB_READ_AFTER_WRITE":   &cfg.ReadAfterWrite,
+	}
+	for key, dst := range durations {
+		if v := os.Getenv(key); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return cfg, fmt.Errorf("db: %s must be a duration like 30s, got %q", key, v)
+			}
+			*dst = d
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,39 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigFromEnv(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.MaxOpenConns != 25 || cfg.ConnMaxLifetime != 5*time.Minute {
+			t.Errorf("unexpected defaults %+v", cfg)
+		}
+	})
+
+	t.Run("Overrides", func(t *testing.T) {
+		t.Setenv("DB_MAX_OPEN_CONNS", "50")
+		t.Setenv("DB_MAX_IDLE_CONNS", "10")
+		t.Setenv("DB_CONN_MAX_LIFETIME", "1m")
+		t.Setenv("DB_CONNECT_TIMEOUT", "2s")
+		cfg, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.MaxOpenConns != 50 || cfg.MaxIdleConns != 10 || cfg.ConnMaxLifetime != time.Minute || cfg.ConnectTimeout != 2*time.Second {
+			t.Errorf("overrides not applied: %+v", cfg)
+		}
+	})
+
+	t.Run("Invalid Value", func(t *testing.T) {
+		t.Setenv("DB_CONN_MAX_LIFETIME", "forever")
+		if _, err := ConfigFromEnv(); err == nil {
+			t.Error("expected error for invalid duration")
+		}
+	})
+}
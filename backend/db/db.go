@@ -0,0 +1,83 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "modernc.org/sqlite"
+)
+
+// Connect opens cfg.DSN and retries the initial ping with exponential backoff
+// until the database answers or cfg.ConnectTimeout passes.
+func Connect(ctx context.Context, cfg Config) (*sql.DB, Dialect, error) {
+	conn, dialect, err := open(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, cfg.ConnectTimeout)
+	defer cancel()
+
+	if err := WaitReady(ctx, conn, 250*time.Millisecond, 5*time.Second); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, dialect, nil
+}
+
+// Open connects to dsn with the default pool settings and a single ping.
+func Open(dsn string) (*sql.DB, Dialect, error) {
+	cfg := DefaultConfig()
+	cfg.DSN = dsn
+	conn, dialect, err := open(cfg)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := conn.Ping(); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, dialect, nil
+}
+
+func open(cfg Config) (*sql.DB, Dialect, error) {
+	dialect, driverDSN, err := ParseDSN(cfg.DSN)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := sql.Open(dialect.Driver(), driverDSN)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn.SetMaxOpenConns(cfg.MaxOpenConns)
+	conn.SetMaxIdleConns(cfg.MaxIdleConns)
+	conn.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	conn.SetConnMaxIdleTime(cfg.ConnMaxIdleTime)
+	return conn, dialect, nil
+}
+
+// WaitReady pings conn until it succeeds, doubling the delay between attempts
+// from initial up to max. It returns the last ping error once ctx is done.
+func WaitReady(ctx context.Context, conn *sql.DB, initial, max time.Duration) error {
+	delay := initial
+	for attempt := 1; ; attempt++ {
+		err := conn.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		slog.Warn("database not ready", "attempt", attempt, "retry_in", delay.String(), "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, max)
+	}
+}
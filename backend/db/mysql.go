@@ -1,26 +0,0 @@
-package db
-
-import (
-	"database/sql"
-	"os"
-	"time"
-
-	_ "github.com/go-sql-driver/mysql"
-)
-
-func Connect() (*sql.DB, error) {
-	dsn := os.Getenv("DB_DSN")
-	conn, err := sql.Open("mysql", dsn)
-	if err != nil {
-		return nil, err
-	}
-
-	conn.SetMaxOpenConns(25)
-	conn.SetMaxIdleConns(25)
-	conn.SetConnMaxLifetime(5 * time.Minute)
-
-	if err := conn.Ping(); err != nil {
-		return nil, err
-	}
-	return conn, nil
-}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Prober pings the database in the background so request handlers can find
+// out it is unreachable without waiting on a connection themselves.
+type Prober struct {
+	DB       *sql.DB
+	Interval time.Duration
+	Timeout  time.Duration
+
+	healthy atomic.Bool
+
+	mu        sync.RWMutex
+	lastCheck time.Time
+	lastErr   error
+}
+
+type Stats struct {
+	Healthy        bool      `json:"healthy"`
+	LastCheck      time.Time `json:"last_check"`
+	LastError      string    `json:"last_error,omitempty"`
+	OpenConns      int       `json:"open_connections"`
+	InUse          int       `json:"in_use"`
+	Idle           int       `json:"idle"`
+	WaitCount      int64     `json:"wait_count"`
+	WaitDurationMS int64     `json:"wait_duration_ms"`
+}
+
+// NewProber returns a prober that starts out healthy, since Connect has
+// already verified the database by the time it is created.
+func NewProber(conn *sql.DB, interval time.Duration) *Prober {
+	p := &Prober{DB: conn, Interval: interval, Timeout: 2 * time.Second}
+	p.healthy.Store(true)
+	return p
+}
+
+// Run checks the database every Interval until ctx is cancelled.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Check(ctx)
+		}
+	}
+}
+
+// Check pings the database once and records the result.
+func (p *Prober) Check(ctx context.Context) bool {
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+	err := p.DB.PingContext(ctx)
+
+	p.mu.Lock()
+	p.lastCheck = time.Now()
+	p.lastErr = err
+	p.mu.Unlock()
+
+	ok := err == nil
+	if was := p.healthy.Swap(ok); was != ok {
+		if ok {
+			slog.Info("database reachable again")
+		} else {
+			slog.Error("database unreachable", "error", err)
+		}
+	}
+	return ok
+}
+
+func (p *Prober) Healthy() bool {
+	return p.healthy.Load()
+}
+
+func (p *Prober) Stats() Stats {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	pool := p.DB.Stats()
+	s := Stats{
+		Healthy:        p.healthy.Load(),
+		LastCheck:      p.lastCheck,
+		OpenConns:      pool.OpenConnections,
+		InUse:          pool.InUse,
+		Idle:           pool.Idle,
+		WaitCount:      pool.WaitCount,
+		WaitDurationMS: pool.WaitDuration.Milliseconds(),
+	}
+	if p.lastErr != nil {
+		s.LastError = p.lastErr.Error()
+	}
+	return s
+}
+
+// IsUnavailable reports whether err means the database could not be reached,
+// as opposed to a query that ran and failed.
+func IsUnavailable(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
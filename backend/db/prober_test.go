@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestProber(t *testing.T) {
+	conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer conn.Close()
+
+	p := NewProber(conn, time.Second)
+	if !p.Healthy() {
+		t.Fatal("expected new prober to start healthy")
+	}
+
+	mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+	if p.Check(context.Background()) || p.Healthy() {
+		t.Error("expected unhealthy after failed ping")
+	}
+	if stats := p.Stats(); stats.Healthy || stats.LastError == "" {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	mock.ExpectPing()
+	if !p.Check(context.Background()) || !p.Healthy() {
+		t.Error("expected healthy after successful ping")
+	}
+}
+
+func TestWaitReady(t *testing.T) {
+	conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer conn.Close()
+
+	t.Run("Succeeds After Retries", func(t *testing.T) {
+		mock.ExpectPing().WillReturnError(errors.New("starting up"))
+		mock.ExpectPing().WillReturnError(errors.New("starting up"))
+		mock.ExpectPing()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := WaitReady(ctx, conn, time.Millisecond, 5*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Gives Up At Deadline", func(t *testing.T) {
+		for i := 0; i < 100; i++ {
+			mock.ExpectPing().WillReturnError(errors.New("down"))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := WaitReady(ctx, conn, time.Millisecond, 2*time.Millisecond); err == nil {
+			t.Error("expected error once the deadline passes")
+		}
+	})
+}
+
+func TestIsUnavailable(t *testing.T) {
+	opErr := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	if !IsUnavailable(fmt.Errorf("query: %w", opErr)) {
+		t.Error("expected network error to count as unavailable")
+	}
+	if IsUnavailable(errors.New("syntax error")) || IsUnavailable(nil) {
+		t.Error("expected ordinary errors not to count as unavailable")
+	}
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Router spreads read-only queries across replicas and keeps everything
+// else on the primary. Reads for a key that was written within
+// ReadAfterWrite go to the primary as well, so a user sees their own update
+// even when replicas are behind. The write log is per process; with several
+// backend instances behind a balancer a user may briefly read stale data from
+// another instance.
+type Router struct {
+	Primary        *sql.DB
+	Dialect        Dialect
+	Replicas       []*Replica
+	MaxLag         time.Duration
+	ReadAfterWrite time.Duration
+
+	next   atomic.Uint64
+	writes sync.Map // key -> time.Time of last write
+}
+
+type Replica struct {
+	Name string
+	DB   *sql.DB
+
+	healthy atomic.Bool
+	lag     atomic.Int64 // nanoseconds
+}
+
+type ReplicaStats struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	LagMS   int64  `json:"lag_ms"`
+	InUse   int    `json:"in_use"`
+	Open    int    `json:"open_connections"`
+}
+
+func NewRouter(primary *sql.DB, dialect Dialect, replicas []*Replica, cfg Config) *Router {
+	return &Router{
+		Primary:        primary,
+		Dialect:        dialect,
+		Replicas:       replicas,
+		MaxLag:         cfg.ReplicaMaxLag,
+		ReadAfterWrite: cfg.ReadAfterWrite,
+	}
+}
+
+// ConnectReplicas opens every DSN in cfg.ReplicaDSNs with the primary's pool
+// settings. Replicas that do not answer yet start out unhealthy and are picked
+// up by Check once they do.
+func ConnectReplicas(ctx context.Context, cfg Config, primary Dialect) ([]*Replica, error) {
+	var replicas []*Replica
+	for i, dsn := range cfg.ReplicaDSNs {
+		rcfg := cfg
+		rcfg.DSN = dsn
+		conn, dialect, err := open(rcfg)
+		if err != nil {
+			return nil, err
+		}
+		if dialect != primary {
+			conn.Close()
+			return nil, fmt.Errorf("db: replica %d uses %s but primary is %s", i, dialect, primary)
+		}
+
+		r := &Replica{Name: "replica-" + strconv.Itoa(i), DB: conn}
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		r.healthy.Store(conn.PingContext(pingCtx) == nil)
+		cancel()
+		replicas = append(replicas, r)
+	}
+	return replicas, nil
+}
+
+// Reader returns the connection to use for a read on behalf of key, usually
+// the user's email.
+func (r *Router) Reader(key string) *sql.DB {
+	if r.recentlyWritten(key) {
+		return r.Primary
+	}
+	n := len(r.Replicas)
+	for i := 0; i < n; i++ {
+		rep := r.Replicas[int(r.next.Add(1)%uint64(n))]
+		if rep.healthy.Load() {
+			return rep.DB
+		}
+	}
+	return r.Primary
+}
+
+// Writer records a write for key and returns the primary.
+func (r *Router) Writer(key string) *sql.DB {
+	if key != "" && r.ReadAfterWrite > 0 {
+		r.writes.Store(key, time.Now())
+	}
+	return r.Primary
+}
+
+// MarkFailed takes the replica behind conn out of rotation until the next
+// successful Check. Used when a query on it could not reach the server.
+func (r *Router) MarkFailed(conn *sql.DB) {
+	for _, rep := range r.Replicas {
+		if rep.DB == conn && rep.healthy.Swap(false) {
+			slog.Warn("replica marked unhealthy after failed query", "replica", rep.Name)
+		}
+	}
+}
+
+func (r *Router) recentlyWritten(key string) bool {
+	v, ok := r.writes.Load(key)
+	if !ok {
+		return false
+	}
+	if time.Since(v.(time.Time)) < r.ReadAfterWrite {
+		return true
+	}
+	r.writes.Delete(key)
+	return false
+}
+
+// Run checks replicas every interval until ctx is cancelled.
+func (r *Router) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.Check(ctx)
+		}
+	}
+}
+
+// Check pings every replica and measures its replication lag. Replicas that
+// fail either check, or lag more than MaxLag, are skipped by Reader.
+func (r *Router) Check(ctx context.Context) {
+	for _, rep := range r.Replicas {
+		checkCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		lag, err := r.replicaLag(checkCtx, rep.DB)
+		cancel()
+
+		ok := err == nil && (r.MaxLag <= 0 || lag <= r.MaxLag)
+		rep.lag.Store(int64(lag))
+		if was := rep.healthy.Swap(ok); was != ok {
+			if ok {
+				slog.Info("replica back in rotation", "replica", rep.Name, "lag", lag.String())
+			} else {
+				slog.Warn("replica out of rotation", "replica", rep.Name, "lag", lag.String(), "error", err)
+			}
+		}
+	}
+}
+
+func (r *Router) Stats() []ReplicaStats {
+	out := make([]ReplicaStats, 0, len(r.Replicas))
+	for _, rep := range r.Replicas {
+		pool := rep.DB.Stats()
+		out = append(out, ReplicaStats{
+			Name:    rep.Name,
+			Healthy: rep.healthy.Load(),
+			LagMS:   time.Duration(rep.lag.Load()).Milliseconds(),
+			InUse:   pool.InUse,
+			Open:    pool.OpenConnections,
+		})
+	}
+	return out
+}
+
+func (r *Router) Close() {
+	for _, rep := range r.Replicas {
+		rep.DB.Close()
+	}
+}
+
+var errReplicationStopped = errors.New("db: replication is not running")
+
+func (r *Router) replicaLag(ctx context.Context, conn *sql.DB) (time.Duration, error) {
+	switch r.Dialect {
+	case Postgres:
+		var seconds float64
+		err := conn.QueryRowContext(ctx,
+			"SELECT COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)").Scan(&seconds)
+		return time.Duration(seconds * float64(time.Second)), err
+	case MySQL:
+		return mysqlReplicaLag(ctx, conn)
+	default:
+		return 0, conn.PingContext(ctx)
+	}
+}
+
+// mysqlReplicaLag reads Seconds_Behind_Source from SHOW REPLICA STATUS. The
+// column set differs between server versions, so it is located by name.
+func mysqlReplicaLag(ctx context.Context, conn *sql.DB) (time.Duration, error) {
+	rows, err := conn.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	if !rows.Next() {
+		// Not configured as a replica; nothing to lag behind.
+		return 0, rows.Err()
+	}
+
+	values := make([]sql.NullString, len(cols))
+	dest := make([]any, len(cols))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+
+	for i, c := range cols {
+		if c != "Seconds_Behind_Source" && c != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errReplicationStopped
+		}
+		seconds, err := strconv.ParseInt(values[i].String, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("db: SHOW REPLICA STATUS has no lag column")
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func newMockDB(t *testing.T) (*sql.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, mock
+}
+
+func newTestRouter(t *testing.T, dialect Dialect, n int) (*Router, []sqlmock.Sqlmock) {
+	t.Helper()
+	primary, _ := newMockDB(t)
+	var (
+		replicas []*Replica
+		mocks    []sqlmock.Sqlmock
+	)
+	for i := 0; i < n; i++ {
+		conn, mock := newMockDB(t)
+		r := &Replica{Name: "r", DB: conn}
+		r.healthy.Store(true)
+		replicas = append(replicas, r)
+		mocks = append(mocks, mock)
+	}
+	cfg := DefaultConfig()
+	cfg.ReadAfterWrite = time.Minute
+	return NewRouter(primary, dialect, replicas, cfg), mocks
+}
+
+func TestRouter_Reader(t *testing.T) {
+	t.Run("Round Robin", func(t *testing.T) {
+		r, _ := newTestRouter(t, SQLite, 2)
+		first, second, third := r.Reader("a"), r.Reader("a"), r.Reader("a")
+		if first == r.Primary || second == r.Primary || first == second || first != third {
+			t.Error("expected reads to alternate between replicas")
+		}
+	})
+
+	t.Run("Read After Write", func(t *testing.T) {
+		r, _ := newTestRouter(t, SQLite, 2)
+		if r.Writer("a") != r.Primary {
+			t.Fatal("writes must go to the primary")
+		}
+		if r.Reader("a") != r.Primary {
+			t.Error("expected recent writer to read from primary")
+		}
+		if r.Reader("b") == r.Primary {
+			t.Error("expected other users to read from a replica")
+		}
+	})
+
+	t.Run("Fallback When Unhealthy", func(t *testing.T) {
+		r, _ := newTestRouter(t, SQLite, 2)
+		r.MarkFailed(r.Replicas[0].DB)
+		r.MarkFailed(r.Replicas[1].DB)
+		if r.Reader("a") != r.Primary {
+			t.Error("expected primary when no replica is healthy")
+		}
+	})
+
+	t.Run("No Replicas", func(t *testing.T) {
+		r, _ := newTestRouter(t, SQLite, 0)
+		if r.Reader("a") != r.Primary {
+			t.Error("expected primary without replicas")
+		}
+	})
+}
+
+func TestRouter_Check(t *testing.T) {
+	statusCols := []string{"Replica_IO_State", "Seconds_Behind_Source"}
+
+	t.Run("MySQL Lag Within Limit", func(t *testing.T) {
+		r, mocks := newTestRouter(t, MySQL, 1)
+		mocks[0].ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows(statusCols).AddRow("Waiting", "1"))
+		r.Check(context.Background())
+		if !r.Replicas[0].healthy.Load() || r.Stats()[0].LagMS != 1000 {
+			t.Errorf("unexpected stats %+v", r.Stats())
+		}
+	})
+
+	t.Run("MySQL Lag Too High", func(t *testing.T) {
+		r, mocks := newTestRouter(t, MySQL, 1)
+		mocks[0].ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows(statusCols).AddRow("Waiting", "60"))
+		r.Check(context.Background())
+		if r.Replicas[0].healthy.Load() {
+			t.Error("expected lagging replica to leave rotation")
+		}
+	})
+
+	t.Run("MySQL Replication Stopped", func(t *testing.T) {
+		r, mocks := newTestRouter(t, MySQL, 1)
+		mocks[0].ExpectQuery("SHOW REPLICA STATUS").
+			WillReturnRows(sqlmock.NewRows(statusCols).AddRow("", nil))
+		r.Check(context.Background())
+		if r.Replicas[0].healthy.Load() {
+			t.Error("expected stopped replica to leave rotation")
+		}
+	})
+
+	t.Run("Recovers", func(t *testing.T) {
+		r, mocks := newTestRouter(t, SQLite, 1)
+		r.MarkFailed(r.Replicas[0].DB)
+		mocks[0].ExpectPing()
+		r.Check(context.Background())
+		if !r.Replicas[0].healthy.Load() {
+			t.Error("expected replica back in rotation after successful check")
+		}
+	})
+}
@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+)
+
+type AccountHandler struct {
+	Users      store.UserStore
+	Identities store.IdentityStore
+	Policy     password.Policy
+	Mail       mailer.Sender
+	// StepUp is how recently a user must have signed in to change their
+	// password without entering the current one.
+	StepUp middleware.StepUp
+}
+
+type PasswordChangeResponse struct {
+	// Token replaces the caller's session token; every other session is
+	// signed out.
+	Token string `json:"token"`
+}
+
+// ChangePassword sets the caller's password from the body
+// {"current_password": "...", "new_password": "..."}. The current password
+// may be left out within StepUp.MaxAge of signing in, and must be by users
+// who sign in with Google or single sign-on and have none yet. Directory
+// users change their password in the directory. Every other session is
+// signed out, and the user is told by email.
+func (h *AccountHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	var input struct {
+		CurrentPassword string `json:"current_password" validate:"max=255"`
+		NewPassword     string `json:"new_password" validate:"required"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	// The directory checks their password, so one set here would be a
+	// second way in that the directory cannot disable.
+	if user.Provider == store.SourceLDAP {
+		problem.Error(w, r, http.StatusConflict, problem.ExternalAccount,
+			"Accounts that sign in with "+externalSignIns[user.Provider]+" change their password there.")
+		return
+	}
+
+	auth := middleware.AuthFrom(r.Context())
+	recent := h.StepUp.Recent(r)
+	errs := validate.Errors{}
+	switch {
+	case input.CurrentPassword != "":
+		_, err := h.Identities.Authenticate(r.Context(), email, input.CurrentPassword)
+		if errors.Is(err, store.ErrNotFound) {
+			errs.Add("current_password", "Current password is incorrect")
+			break
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		auth = passwordAuth()
+	case user.HasPassword && !recent:
+		errs.Add("current_password", "Current password is required")
+	case !recent:
+		h.StepUp.Challenge(w, r, "Sign in again to set a password.")
+		return
+	}
+
+	history, err := h.Identities.PasswordHistory(r.Context(), email, h.Policy.History)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if problems := h.Policy.Check(input.NewPassword, email, history); len(problems) > 0 {
+		errs.Add("new_password", problems[0])
+	}
+	if !accepted(w, r, errs.Err()) {
+		return
+	}
+
+	err = h.Identities.SetPassword(r.Context(), email, input.NewPassword, time.Now())
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	token, err := signToken(email, auth)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// The password has changed by now, so a notice that cannot be sent
+	// is only logged.
+	if err := h.Mail.Send(r.Context(), passwordNotice(email, user.Provider, user.HasPassword)); err != nil {
+		slog.Error("sending password change notice failed", "error", err)
+	}
+
+	writeJSON(w, PasswordChangeResponse{Token: token})
+}
+
+// passwordNotice tells the user of email, whose account is of provider, that
+// their password was changed, or set for the first time.
+func passwordNotice(email, provider string, changed bool) mailer.Message {
+	m := mailer.Message{
+		To:      email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf("The password for %s was changed, and every other device signed in to the account was signed out.\n\n"+
+			"If it was not you, someone else knows your password. Contact us right away.\n", email),
+	}
+	if !changed {
+		m.Subject = "A password was added to your account"
+		m.Body = fmt.Sprintf("A password was set for %s, so you can now sign in with it.\n\n"+
+			"If it was not you, contact us right away.\n", email)
+		if via, ok := externalSignIns[provider]; ok {
+			m.Body = fmt.Sprintf("A password was set for %s, so you can now sign in with it as well as with %s.\n\n"+
+				"If it was not you, sign in with %s and change it right away.\n", email, via, via)
+		}
+	}
+	return m
+}
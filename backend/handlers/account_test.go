@@ -0,0 +1,147 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/store/storetest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAccountHandler_ChangePassword(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "test@ex.com", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.UpsertGoogle(ctx, "g@ex.com", "G", store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.UpsertSAML(ctx, "s@ex.com", store.ProfileUpdate{}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.UpsertLDAP(ctx, "d@ex.com", store.ProfileUpdate{}, "", store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	inbox := &mailbox{}
+	h := &AccountHandler{Users: st, Identities: st, Policy: password.DefaultPolicy(), Mail: inbox, StepUp: middleware.DefaultStepUp()}
+
+	// change posts body as email, who signed in at authTime.
+	change := func(email string, authTime time.Time, body string) *httptest.ResponseRecorder {
+		r := withUser(httptest.NewRequest(http.MethodPost, "/api/account/password", strings.NewReader(body)), email)
+		auth := middleware.Auth{Time: authTime, Methods: []string{middleware.MethodGoogle}}
+		r = r.WithContext(context.WithValue(r.Context(), middleware.AuthKey, auth))
+		w := httptest.NewRecorder()
+		h.ChangePassword(w, r)
+		return w
+	}
+	longAgo := time.Now().Add(-time.Hour)
+
+	t.Run("Refused", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, body, field string
+		}{
+			{"Wrong Current", `{"current_password":"wrong","new_password":"battery staple"}`, "current_password"},
+			{"Missing Current", `{"new_password":"battery staple"}`, "current_password"},
+			{"Policy", `{"current_password":"correct horse","new_password":"password123"}`, "new_password"},
+			{"Reused", `{"current_password":"correct horse","new_password":"correct horse"}`, "new_password"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				w := change("test@ex.com", longAgo, tc.body)
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"`+tc.field+`"`) {
+					t.Errorf("expected an error on %s, got %d: %s", tc.field, w.Code, w.Body.String())
+				}
+			})
+		}
+		if len(inbox.sent) != 0 {
+			t.Errorf("expected no notice for a refused change, got %+v", inbox.sent)
+		}
+	})
+
+	t.Run("Changed", func(t *testing.T) {
+		w := change("test@ex.com", longAgo, `{"current_password":"correct horse","new_password":"battery staple"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp PasswordChangeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(resp.Token, claims, func(*jwt.Token) (any, error) { return []byte("secret"), nil }); err != nil {
+			t.Fatalf("expected a valid session token: %v", err)
+		}
+		if at, _ := claims["auth_time"].(float64); time.Since(time.Unix(int64(at), 0)) > time.Minute {
+			t.Errorf("expected entering the password to count as signing in, got auth_time %v", claims["auth_time"])
+		}
+		if amr, _ := claims["amr"].([]any); len(amr) != 1 || amr[0] != middleware.MethodPassword {
+			t.Errorf("expected the password as the method, got amr %v", claims["amr"])
+		}
+		if _, err := st.Authenticate(ctx, "test@ex.com", "battery staple"); err != nil {
+			t.Errorf("expected the new password to work: %v", err)
+		}
+		revokedAt, err := st.SessionsRevokedAt(ctx, "test@ex.com")
+		if err != nil || time.Since(revokedAt) > time.Minute {
+			t.Errorf("expected other sessions to be revoked, got %v, %v", revokedAt, err)
+		}
+		if len(inbox.sent) != 1 || inbox.sent[0].To != "test@ex.com" || !strings.Contains(inbox.sent[0].Subject, "changed") {
+			t.Errorf("expected a notice to the user, got %+v", inbox.sent)
+		}
+	})
+
+	t.Run("Recent Sign-In", func(t *testing.T) {
+		w := change("test@ex.com", time.Now().Add(-time.Minute), `{"new_password":"another staple"}`)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected a recent sign-in to stand in for the current password, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("First Password", func(t *testing.T) {
+		w := change("g@ex.com", longAgo, `{"new_password":"battery staple"}`)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reauthentication_required") {
+			t.Fatalf("expected a stale session to sign in again, got %d: %s", w.Code, w.Body.String())
+		}
+		w = change("g@ex.com", time.Now(), `{"new_password":"battery staple"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if u, err := st.Authenticate(ctx, "g@ex.com", "battery staple"); err != nil || !u.HasPassword {
+			t.Errorf("expected the Google user to have a password, got %+v, %v", u, err)
+		}
+		if last := inbox.sent[len(inbox.sent)-1]; last.To != "g@ex.com" || !strings.Contains(last.Subject, "added") || !strings.Contains(last.Body, "with Google") {
+			t.Errorf("expected a notice about the new password, got %+v", last)
+		}
+
+		if w := change("s@ex.com", time.Now(), `{"new_password":"battery staple"}`); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if last := inbox.sent[len(inbox.sent)-1]; last.To != "s@ex.com" || !strings.Contains(last.Body, "with single sign-on") || strings.Contains(last.Body, "Google") {
+			t.Errorf("expected a notice naming single sign-on, got %+v", last)
+		}
+	})
+
+	t.Run("Directory Accounts", func(t *testing.T) {
+		sent := len(inbox.sent)
+		w := change("d@ex.com", time.Now(), `{"new_password":"battery staple"}`)
+		if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), string(problem.ExternalAccount)) {
+			t.Errorf("expected 409 external_account, got %d: %s", w.Code, w.Body.String())
+		}
+		if u, err := st.GetByEmail(ctx, "d@ex.com"); err != nil || u.HasPassword {
+			t.Errorf("expected no local password, got %+v, %v", u, err)
+		}
+		if len(inbox.sent) != sent {
+			t.Errorf("expected no notice, got %+v", inbox.sent[sent:])
+		}
+	})
+}
@@ -0,0 +1,231 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"ccz/middleware"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// AdminHandler serves the endpoints that manage the attribute schema and
+// the attribute values users cannot change themselves. Every endpoint
+// requires the admin role.
+type AdminHandler struct {
+	Users  store.UserStore
+	Schema store.SchemaStore
+}
+
+// requireAdmin returns the calling admin's email. It writes the error
+// response and returns false for anyone else.
+func (h *AdminHandler) requireAdmin(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return adminOnly(w, r, h.Users)
+}
+
+// adminOnly is requireAdmin for handlers other than AdminHandler.
+func adminOnly(w http.ResponseWriter, r *http.Request, users store.UserStore) (string, bool) {
+	actor, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || actor == "" {
+		unauthenticated(w, r)
+		return "", false
+	}
+	admin, err := isAdmin(r, users, actor)
+	if err != nil {
+		serverError(w, r, err)
+		return "", false
+	}
+	if !admin {
+		problem.Error(w, r, http.StatusForbidden, problem.Forbidden, "Only administrators can do this.")
+		return "", false
+	}
+	return actor, true
+}
+
+// Attributes handles GET /api/admin/attributes.
+func (h *AdminHandler) Attributes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	defs, err := h.Schema.AttributeDefinitions(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	resp := SchemaResponse{Attributes: make([]AttributeResponse, 0, len(defs))}
+	for _, def := range defs {
+		resp.Attributes = append(resp.Attributes, attributeResponse(def, true))
+	}
+	writeJSON(w, resp)
+}
+
+// PutAttribute handles PUT /api/admin/attributes/{name}, creating the
+// definition or replacing it. Values already stored are not re-checked
+// against changed rules; they are checked the next time they are saved.
+func (h *AdminHandler) PutAttribute(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	var input struct {
+		Label      string               `json:"label" validate:"trim,max=255"`
+		Type       string               `json:"type"`
+		Required   bool                 `json:"required"`
+		Visibility string               `json:"visibility"`
+		Rules      store.AttributeRules `json:"rules"`
+		SortOrder  int                  `json:"sort_order"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	if input.Visibility == "" {
+		input.Visibility = store.VisibilityUser
+	}
+
+	def := store.AttributeDefinition{
+		Name:       r.PathValue("name"),
+		Label:      input.Label,
+		Type:       input.Type,
+		Required:   input.Required,
+		Visibility: input.Visibility,
+		Rules:      input.Rules,
+		SortOrder:  input.SortOrder,
+	}
+	if !accepted(w, r, checkDefinition(def)) {
+		return
+	}
+	if err := h.Schema.PutAttributeDefinition(r.Context(), def); err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, attributeResponse(def, true))
+}
+
+// DeleteAttribute handles DELETE /api/admin/attributes/{name}. Every value
+// stored for the attribute goes with it.
+func (h *AdminHandler) DeleteAttribute(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+
+	err := h.Schema.DeleteAttributeDefinition(r.Context(), r.PathValue("name"))
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusNotFound, problem.AttributeNotFound, "No attribute has this name.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type UserAttributesResponse struct {
+	Email      string         `json:"email"`
+	Attributes map[string]any `json:"attributes"`
+}
+
+// UserAttributes handles GET /api/admin/users/{email}/attributes.
+func (h *AdminHandler) UserAttributes(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.requireAdmin(w, r); !ok {
+		return
+	}
+	h.writeUserAttributes(w, r, r.PathValue("email"))
+}
+
+// PatchUserAttributes handles PATCH /api/admin/users/{email}/attributes
+// with a JSON Merge Patch of the user's attributes, including those the
+// user cannot change.
+func (h *AdminHandler) PatchUserAttributes(w http.ResponseWriter, r *http.Request) {
+	actor, ok := h.requireAdmin(w, r)
+	if !ok {
+		return
+	}
+	email := r.PathValue("email")
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != mergePatchType {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		problem.Error(w, r, http.StatusUnsupportedMediaType, problem.UnsupportedMedia, "Content-Type must be "+mergePatchType+".")
+		return
+	}
+	var patch map[string]json.RawMessage
+	if err := validate.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), &patch); err != nil || patch == nil {
+		accepted(w, r, cmp.Or(err, validate.ErrBody))
+		return
+	}
+
+	defs, err := h.Schema.AttributeDefinitions(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	// The update carries the name and telephone it was read with, so like
+	// Patch it is conditional on that version and retried on a lost race.
+	for attempt := 1; ; attempt++ {
+		user, err := h.Users.GetByEmail(r.Context(), email)
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		current, err := h.Users.Attributes(r.Context(), email)
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		errs := validate.Errors{}
+		changes := mergeAttributes(defs, current, patch, true, false, errs)
+		if len(errs) > 0 {
+			fieldErrors(w, r, errs)
+			return
+		}
+
+		update := store.ProfileUpdate{FullName: user.FullName, Telephone: user.Telephone, Attributes: changes}
+		change := store.Change{Actor: actor, IP: middleware.ClientIP(r), Source: store.SourceAdmin, IfVersion: user.Version}
+		err = h.Users.UpdateProfile(r.Context(), email, update, change)
+		if errors.Is(err, store.ErrVersionMismatch) && attempt < maxPatchAttempts {
+			continue
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, store.ErrVersionMismatch):
+			problem.Error(w, r, http.StatusConflict, problem.VersionMismatch, "The profile was changed while saving. Try again.")
+			return
+		case errors.Is(err, store.ErrUnknownAttribute):
+			problem.Error(w, r, http.StatusBadRequest, problem.UnknownAttribute, "An attribute in the request is not defined.")
+			return
+		default:
+			serverError(w, r, err)
+			return
+		}
+		break
+	}
+	h.writeUserAttributes(w, r, email)
+}
+
+func (h *AdminHandler) writeUserAttributes(w http.ResponseWriter, r *http.Request, email string) {
+	attrs, err := profileAttributes(r.Context(), h.Users, h.Schema, email, true)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, UserAttributesResponse{Email: email, Attributes: attrs})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
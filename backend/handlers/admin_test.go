@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ccz/store"
+)
+
+func TestAdminHandler(t *testing.T) {
+	st := newProfileStore(t)
+	h := &AdminHandler{Users: st, Schema: st}
+	ctx := context.Background()
+
+	if err := st.CreateLocal(ctx, "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, pattern, target, body, email string, fn http.HandlerFunc) *httptest.ResponseRecorder {
+		mux := http.NewServeMux()
+		mux.HandleFunc(method+" "+pattern, fn)
+		req := withUser(httptest.NewRequest(method, target, bytes.NewBufferString(body)), email)
+		if method == http.MethodPatch {
+			req.Header.Set("Content-Type", mergePatchType)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Requires Admin", func(t *testing.T) {
+		w := serve(http.MethodGet, "/admin/attributes", "/admin/attributes", "", "test@ex.com", h.Attributes)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Define Attribute", func(t *testing.T) {
+		body := `{"label":"Level","type":"enum","visibility":"read_only","rules":{"options":["L1","L2"]}}`
+		w := serve(http.MethodPut, "/admin/attributes/{name}", "/admin/attributes/level", body, "admin@ex.com", h.PutAttribute)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = serve(http.MethodGet, "/admin/attributes", "/admin/attributes", "", "admin@ex.com", h.Attributes)
+		var resp SchemaResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Attributes) != 1 || resp.Attributes[0].Name != "level" || resp.Attributes[0].Visibility != store.VisibilityReadOnly {
+			t.Errorf("unexpected definitions %+v", resp.Attributes)
+		}
+	})
+
+	t.Run("Invalid Definitions", func(t *testing.T) {
+		for name, body := range map[string]string{
+			"Bad-Name": `{"label":"X","type":"string"}`,
+			"nolabel":  `{"type":"string"}`,
+			"badtype":  `{"label":"X","type":"color"}`,
+			"noopts":   `{"label":"X","type":"enum"}`,
+			"badvis":   `{"label":"X","type":"string","visibility":"public"}`,
+			"badre":    `{"label":"X","type":"string","rules":{"pattern":"("}}`,
+		} {
+			w := serve(http.MethodPut, "/admin/attributes/{name}", "/admin/attributes/"+name, body, "admin@ex.com", h.PutAttribute)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", name, w.Code)
+			}
+		}
+	})
+
+	t.Run("Set User Attributes", func(t *testing.T) {
+		w := serve(http.MethodPatch, "/admin/users/{email}/attributes", "/admin/users/test@ex.com/attributes", `{"level":"L3"}`, "admin@ex.com", h.PatchUserAttributes)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for value outside options, got %d", w.Code)
+		}
+
+		w = serve(http.MethodPatch, "/admin/users/{email}/attributes", "/admin/users/test@ex.com/attributes", `{"level":"L2"}`, "admin@ex.com", h.PatchUserAttributes)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		values, err := st.Attributes(ctx, "test@ex.com")
+		if err != nil || values["level"] != "L2" {
+			t.Errorf("unexpected attributes %v, %v", values, err)
+		}
+		u, _ := st.GetByEmail(ctx, "test@ex.com")
+		if u.FullName != "Mukul Kumar" || u.Telephone != "123456" {
+			t.Errorf("attribute update changed the profile: %+v", u)
+		}
+
+		revs, _ := st.Revisions(ctx, "test@ex.com", 1)
+		if len(revs) != 1 || revs[0].Source != store.SourceAdmin || revs[0].Actor != "admin@ex.com" {
+			t.Errorf("expected admin revision, got %+v", revs)
+		}
+
+		w = serve(http.MethodPatch, "/admin/users/{email}/attributes", "/admin/users/none@ex.com/attributes", `{"level":"L1"}`, "admin@ex.com", h.PatchUserAttributes)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for unknown user, got %d", w.Code)
+		}
+	})
+
+	t.Run("Delete Attribute", func(t *testing.T) {
+		w := serve(http.MethodDelete, "/admin/attributes/{name}", "/admin/attributes/level", "", "admin@ex.com", h.DeleteAttribute)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		w = serve(http.MethodDelete, "/admin/attributes/{name}", "/admin/attributes/level", "", "admin@ex.com", h.DeleteAttribute)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+		if values, _ := st.Attributes(ctx, "test@ex.com"); len(values) != 0 {
+			t.Errorf("expected values to go with the definition, got %v", values)
+		}
+	})
+}
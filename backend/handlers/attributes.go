@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"ccz/store"
+	"ccz/validate"
+)
+
+const dateLayout = "2006-01-02"
+
+var attributeName = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+type AttributeResponse struct {
+	Name       string               `json:"name"`
+	Label      string               `json:"label"`
+	Type       string               `json:"type"`
+	Required   bool                 `json:"required"`
+	Visibility string               `json:"visibility"`
+	Editable   bool                 `json:"editable"`
+	Rules      store.AttributeRules `json:"rules"`
+	SortOrder  int                  `json:"sort_order"`
+}
+
+func attributeResponse(def store.AttributeDefinition, admin bool) AttributeResponse {
+	return AttributeResponse{
+		Name:       def.Name,
+		Label:      def.Label,
+		Type:       def.Type,
+		Required:   def.Required,
+		Visibility: def.Visibility,
+		Editable:   editableBy(def, admin),
+		Rules:      def.Rules,
+		SortOrder:  def.SortOrder,
+	}
+}
+
+// visibleTo reports whether the caller may see values of def.
+func visibleTo(def store.AttributeDefinition, admin bool) bool {
+	return admin || def.Visibility != store.VisibilityAdmin
+}
+
+// editableBy reports whether the caller may change values of def.
+func editableBy(def store.AttributeDefinition, admin bool) bool {
+	return admin || def.Visibility == store.VisibilityUser
+}
+
+// checkDefinition rejects definitions that values could never be checked
+// against, naming each bad member.
+func checkDefinition(def store.AttributeDefinition) error {
+	errs := validate.Errors{}
+	if !attributeName.MatchString(def.Name) {
+		errs.Add("name", "name must be lower case letters, digits and underscores, starting with a letter")
+	}
+	if def.Label == "" {
+		errs.Add("label", "label is required")
+	}
+	switch def.Type {
+	case store.AttrString, store.AttrNumber, store.AttrBoolean, store.AttrDate:
+	case store.AttrEnum:
+		if len(def.Rules.Options) == 0 {
+			errs.Add("rules.options", "enum attributes need options")
+		}
+	default:
+		errs.Add("type", fmt.Sprintf("unknown type %q", def.Type))
+	}
+	switch def.Visibility {
+	case store.VisibilityUser, store.VisibilityReadOnly, store.VisibilityAdmin:
+	default:
+		errs.Add("visibility", fmt.Sprintf("unknown visibility %q", def.Visibility))
+	}
+	if def.Rules.Pattern != "" {
+		if _, err := regexp.Compile(def.Rules.Pattern); err != nil {
+			errs.Add("rules.pattern", fmt.Sprintf("invalid pattern: %v", err))
+		}
+	}
+	if def.Rules.Min != nil && def.Rules.Max != nil && *def.Rules.Min > *def.Rules.Max {
+		errs.Add("rules.min", "min must not be above max")
+	}
+	return errs.Err()
+}
+
+// parseAttribute checks a JSON value against def and returns it in the form
+// it is stored in. null, and an empty string, clear the attribute.
+func parseAttribute(def store.AttributeDefinition, raw json.RawMessage) (string, error) {
+	if string(raw) == "null" {
+		return "", nil
+	}
+
+	switch def.Type {
+	case store.AttrNumber:
+		var n float64
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return "", fmt.Errorf("%s must be a number", def.Name)
+		}
+		if def.Rules.Min != nil && n < *def.Rules.Min {
+			return "", fmt.Errorf("%s must be at least %v", def.Name, *def.Rules.Min)
+		}
+		if def.Rules.Max != nil && n > *def.Rules.Max {
+			return "", fmt.Errorf("%s must be at most %v", def.Name, *def.Rules.Max)
+		}
+		return strconv.FormatFloat(n, 'f', -1, 64), nil
+	case store.AttrBoolean:
+		var b bool
+		if err := json.Unmarshal(raw, &b); err != nil {
+			return "", fmt.Errorf("%s must be true or false", def.Name)
+		}
+		return strconv.FormatBool(b), nil
+	}
+
+	var v string
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return "", fmt.Errorf("%s must be a string", def.Name)
+	}
+	if v == "" {
+		return "", nil
+	}
+	switch def.Type {
+	case store.AttrDate:
+		if _, err := time.Parse(dateLayout, v); err != nil {
+			return "", fmt.Errorf("%s must be a date as YYYY-MM-DD", def.Name)
+		}
+	case store.AttrEnum:
+		if !slices.Contains(def.Rules.Options, v) {
+			return "", fmt.Errorf("%s must be one of %v", def.Name, def.Rules.Options)
+		}
+	default:
+		n := utf8.RuneCountInString(v)
+		if n < def.Rules.MinLength {
+			return "", fmt.Errorf("%s must be at least %d characters", def.Name, def.Rules.MinLength)
+		}
+		if def.Rules.MaxLength > 0 && n > def.Rules.MaxLength {
+			return "", fmt.Errorf("%s must be at most %d characters", def.Name, def.Rules.MaxLength)
+		}
+		if def.Rules.Pattern != "" {
+			if ok, _ := regexp.MatchString(def.Rules.Pattern, v); !ok {
+				return "", fmt.Errorf("%s has an invalid format", def.Name)
+			}
+		}
+	}
+	return v, nil
+}
+
+// attributeValue turns a stored value back into its JSON type.
+func attributeValue(def store.AttributeDefinition, stored string) any {
+	switch def.Type {
+	case store.AttrNumber:
+		if n, err := strconv.ParseFloat(stored, 64); err == nil {
+			return n
+		}
+	case store.AttrBoolean:
+		if b, err := strconv.ParseBool(stored); err == nil {
+			return b
+		}
+	}
+	return stored
+}
+
+// mergeAttributes validates input against the schema and returns the
+// attribute changes to store, adding what is wrong with each attribute to
+// errs as "attributes.<name>". With replace set, editable attributes
+// missing from input are cleared. Required attributes the caller can edit
+// must have a value once the changes are applied.
+func mergeAttributes(defs []store.AttributeDefinition, current map[string]string, input map[string]json.RawMessage, admin, replace bool, errs validate.Errors) map[string]string {
+	byName := make(map[string]store.AttributeDefinition, len(defs))
+	for _, def := range defs {
+		byName[def.Name] = def
+	}
+
+	changes := map[string]string{}
+	for name, raw := range input {
+		def, ok := byName[name]
+		if !ok || !visibleTo(def, admin) {
+			errs.Add(attributeField(name), fmt.Sprintf("unknown attribute %q", name))
+			continue
+		}
+		if !editableBy(def, admin) {
+			errs.Add(attributeField(name), fmt.Sprintf("%s cannot be changed", name))
+			continue
+		}
+		value, err := parseAttribute(def, raw)
+		if err != nil {
+			errs.Add(attributeField(name), err.Error())
+			continue
+		}
+		changes[name] = value
+	}
+
+	for _, def := range defs {
+		if !editableBy(def, admin) {
+			continue
+		}
+		if _, failed := errs[attributeField(def.Name)]; failed {
+			continue
+		}
+		value, given := changes[def.Name]
+		if !given && replace {
+			changes[def.Name] = ""
+		}
+		if !given && !replace {
+			value = current[def.Name]
+		}
+		if def.Required && value == "" {
+			errs.Add(attributeField(def.Name), fmt.Sprintf("%s is required", def.Name))
+		}
+	}
+	return changes
+}
+
+// attributeField names an attribute in field errors.
+func attributeField(name string) string {
+	return "attributes." + name
+}
+
+// profileAttributes returns the attribute values of user that the caller
+// can see, typed by their definitions.
+func profileAttributes(ctx context.Context, users store.UserStore, schema store.SchemaStore, email string, admin bool) (map[string]any, error) {
+	defs, err := schema.AttributeDefinitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := users.Attributes(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]any{}
+	for _, def := range defs {
+		if v, ok := stored[def.Name]; ok && visibleTo(def, admin) {
+			out[def.Name] = attributeValue(def, v)
+		}
+	}
+	return out, nil
+}
@@ -1,111 +1,234 @@
 package handlers
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
-	"strings"
 	"time"
 
+	"ccz/authn"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type AuthHandler struct {
-	DB *sql.DB
+	Identities store.IdentityStore
+	// Authenticator checks the passwords of Login and Reauth.
+	Authenticator authn.Authenticator
+	// Policy is what new passwords must meet.
+	Policy password.Policy
+	// Avatars, when set, imports the Google picture of new accounts.
+	Avatars *AvatarHandler
 }
 
 type loginResponse struct {
 	Token string `json:"token"`
 }
 
+// tokenTTL is how long a session token is valid.
+const tokenTTL = 24 * time.Hour
+
+// signToken issues a session token for email. Tokens name the user by
+// email, so a new one is needed whenever the email changes. auth is when
+// and how the user last proved who they are; a token issued in place of
+// another keeps the old one's.
+func signToken(email string, auth middleware.Auth) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"email": email,
+		"iat":   now.Unix(),
+		"exp":   now.Add(tokenTTL).Unix(),
+	}
+	if !auth.Time.IsZero() {
+		claims["auth_time"] = auth.Time.Unix()
+		claims["amr"] = auth.Methods
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+}
+
 func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
 		return
 	}
 
+	// Passwords are not held to the signup policy here, so accounts
+	// created before it can still sign in.
 	var creds struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required,max=255"`
 	}
 
-	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
-		}
-	} else {
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Failed to parse form", http.StatusBadRequest)
-			return
-		}
-		creds.Email = r.FormValue("email")
-		creds.Password = r.FormValue("password")
+	if !readCredentials(w, r, &creds, nil) {
+		return
 	}
 
-	if creds.Email == "" || creds.Password == "" {
-		http.Error(w, "Email and password are required", http.StatusBadRequest)
+	if !h.authenticate(w, r, creds.Email, creds.Password, "The email or password is incorrect.") {
 		return
 	}
 
-	var id int
-	err := h.DB.QueryRowContext(r.Context(), "SELECT id FROM users WHERE email=? AND password=?", creds.Email, creds.Password).Scan(&id)
+	tokenString, err := signToken(creds.Email, passwordAuth())
 	if err != nil {
-		http.Error(w, "Invalid credentials", http.StatusUnauthorized)
+		serverError(w, r, err)
 		return
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": creds.Email,
-	})
-	tokenString, _ := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
-
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(map[string]string{"token": tokenString})
 }
 
-func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
+// authenticate checks the password of email with the authenticator. It
+// writes the error response, with refused as the detail of a wrong
+// password, and returns false when the user may not sign in.
+func (h *AuthHandler) authenticate(w http.ResponseWriter, r *http.Request, email, pw, refused string) bool {
+	err := h.Authenticator.Authenticate(r.Context(), authn.Attempt{Email: email, Password: pw, IP: middleware.ClientIP(r)})
+	switch {
+	case errors.Is(err, authn.ErrUnknownUser) || errors.Is(err, authn.ErrInvalidCredentials):
+		problem.Error(w, r, http.StatusUnauthorized, problem.InvalidCredentials, refused)
+		return false
+	case errors.Is(err, authn.ErrUnavailable):
+		slog.Error("authentication source unavailable", "error", err)
+		middleware.Unavailable(w, r)
+		return false
+	case err != nil:
+		serverError(w, r, err)
+		return false
+	}
+	return true
+}
+
+// passwordAuth is the Auth of a user who just entered their password.
+func passwordAuth() middleware.Auth {
+	return middleware.Auth{Time: time.Now(), Methods: []string{middleware.MethodPassword}}
+}
+
+// Reauth is the step-up for a signed-in user: entering the password again
+// answers with a token like the caller's, recording that they just proved
+// who they are. Users of the directory enter their directory password;
+// users without a password sign in with Google again.
+func (h *AuthHandler) Reauth(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
 		return
 	}
 
 	var creds struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Password string `json:"password" validate:"required,max=255"`
+	}
+	if !readCredentials(w, r, &creds, nil) {
+		return
 	}
 
-	if strings.Contains(r.Header.Get("Content-Type"), "application/json") {
-		if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
-			http.Error(w, "Invalid JSON", http.StatusBadRequest)
-			return
+	if !h.authenticate(w, r, email, creds.Password, "The password is incorrect.") {
+		return
+	}
+
+	token, err := signToken(email, passwordAuth())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, loginResponse{Token: token})
+}
+
+// readCredentials reads creds from a JSON body or a form post and checks
+// them, then lets check add its own field errors. It writes the error
+// response and returns false when they are not acceptable.
+func readCredentials(w http.ResponseWriter, r *http.Request, creds any, check func(validate.Errors)) bool {
+	errs := validate.Errors{}
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt == "application/json" {
+		if !accepted(w, r, validate.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), creds)) {
+			return false
 		}
 	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
 		if err := r.ParseForm(); err != nil {
-			http.Error(w, "Failed to parse form", http.StatusBadRequest)
-			return
+			invalidBody(w, r, "The form could not be parsed.")
+			return false
 		}
-		creds.Email = r.FormValue("email")
-		creds.Password = r.FormValue("password")
+		// A form post always decodes, so its unknown fields are reported
+		// along with the rest.
+		errs.Merge(validate.DecodeForm(r.PostForm, creds))
+	}
+	errs.Check(creds)
+	if check != nil {
+		check(errs)
+	}
+	return accepted(w, r, errs.Err())
+}
+
+func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
 	}
 
-	if creds.Email == "" || creds.Password == "" {
-		http.Error(w, "Email and password are required", http.StatusBadRequest)
+	var creds struct {
+		Email    string `json:"email" validate:"required,email"`
+		Password string `json:"password" validate:"required"`
+	}
+
+	checkPolicy := func(errs validate.Errors) {
+		if problems := h.Policy.Check(creds.Password, creds.Email, nil); len(problems) > 0 {
+			errs.Add("password", problems[0])
+		}
+	}
+	if !readCredentials(w, r, &creds, checkPolicy) {
 		return
 	}
 
-	_, err := h.DB.ExecContext(r.Context(), "INSERT INTO users (email, password, provider) VALUES (?, ?, ?)", creds.Email, creds.Password, "local")
+	err := h.Identities.CreateLocal(r.Context(), creds.Email, creds.Password)
+	if errors.Is(err, store.ErrConflict) {
+		problem.Error(w, r, http.StatusConflict, problem.UserExists, "An account with this email already exists.")
+		return
+	}
 	if err != nil {
-		http.Error(w, "User already exists", http.StatusConflict)
+		serverError(w, r, err)
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
 
+// PasswordStrength rates a password as a new one for email, so the signup
+// page can show how strong it is while it is typed.
+func (h *AuthHandler) PasswordStrength(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	var input struct {
+		Email    string `json:"email" validate:"trim,max=255"`
+		Password string `json:"password" validate:"max=255"`
+	}
+	if !readCredentials(w, r, &input, nil) {
+		return
+	}
+	writeJSON(w, h.Policy.Rate(input.Password, input.Email))
+}
+
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -118,6 +241,12 @@ func (h *AuthHandler) Google(w http.ResponseWriter, r *http.Request) {
 	q.Set("scope", "openid email profile")
 	q.Set("access_type", "online")
 	q.Set("prompt", "select_account")
+	if r.URL.Query().Get("reauth") != "" {
+		// Stepping up: Google must ask the user to sign in, even when
+		// they already are.
+		q.Set("prompt", "login")
+		q.Set("max_age", "0")
+	}
 
 	http.Redirect(w, r, "https://accounts.google.com/o/oauth2/v2/auth?"+q.Encode(), http.StatusSeeOther)
 }
@@ -163,26 +292,37 @@ func (h *AuthHandler) GoogleCallback(w http.ResponseWriter, r *http.Request) {
 	defer profileResp.Body.Close()
 
 	var profile struct {
-		Email string `json:"email"`
-		Name  string `json:"name"`
+		Email   string `json:"email"`
+		Name    string `json:"name"`
+		Picture string `json:"picture"`
 	}
 	if err := json.NewDecoder(profileResp.Body).Decode(&profile); err != nil {
 		http.Redirect(w, r, frontendURL+"/login?error=profile_decode", http.StatusSeeOther)
 		return
 	}
 
-	query := "INSERT INTO users (email, full_name, provider) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE full_name = VALUES(full_name)"
-	_, err = h.DB.ExecContext(r.Context(), query, profile.Email, profile.Name, "google")
+	change := store.Change{Actor: profile.Email, IP: middleware.ClientIP(r), Source: store.SourceGoogle}
+	created, err := h.Identities.UpsertGoogle(r.Context(), profile.Email, profile.Name, change)
 	if err != nil {
 		http.Redirect(w, r, frontendURL+"/login?error=db_error", http.StatusSeeOther)
 		return
 	}
+	// The picture is only taken on first login, so an avatar the user has
+	// since changed or removed is never overwritten. Failing to import it
+	// does not stop the login.
+	if created && profile.Picture != "" && h.Avatars != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		if err := h.Avatars.Import(ctx, profile.Email, profile.Picture); err != nil {
+			slog.Warn("importing Google picture failed", "error", err)
+		}
+		cancel()
+	}
 
-	jwtToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"email": profile.Email,
-		"exp":   time.Now().Add(time.Hour * 24).Unix(),
-	})
-	signedToken, _ := jwtToken.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	signedToken, err := signToken(profile.Email, middleware.Auth{Time: time.Now(), Methods: []string{middleware.MethodGoogle}})
+	if err != nil {
+		http.Redirect(w, r, frontendURL+"/login?error=token", http.StatusSeeOther)
+		return
+	}
 
 	target := frontendURL + "/auth/callback?token=" + signedToken
 	http.Redirect(w, r, target, http.StatusSeeOther)
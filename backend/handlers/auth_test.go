@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -9,17 +10,25 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
-	"github.com/DATA-DOG/go-sqlmock"
+	"ccz/authn"
+	"ccz/ldap/ldaptest"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/store/storetest"
+
+	"github.com/golang-jwt/jwt/v5"
 )
 
 func TestAuthHandler_Login(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("error opening mock: %s", err)
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
 	}
-	defer db.Close()
-	h := &AuthHandler{DB: db}
+	h := &AuthHandler{Identities: st, Authenticator: &authn.Local{Users: st, Identities: st}}
 
 	t.Run("Method Not Allowed", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/login", nil)
@@ -46,10 +55,6 @@ func TestAuthHandler_Login(t *testing.T) {
 		req.Header.Set("Content-Type", "application/json")
 		w := httptest.NewRecorder()
 
-		mock.ExpectQuery("SELECT id FROM users WHERE email=\\? AND password=\\?").
-			WithArgs("test@ex.com", "pass").
-			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 		h.Login(w, req)
 
 		if w.Code != http.StatusOK {
@@ -64,35 +69,274 @@ func TestAuthHandler_Login(t *testing.T) {
 			t.Error("expected token, got empty string")
 		}
 	})
+
+	t.Run("Invalid Credentials", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"email":"test@ex.com","password":"wrong"}`)
+		req := httptest.NewRequest(http.MethodPost, "/login", body)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+
+		h.Login(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
 }
 
-func TestAuthHandler_Signup(t *testing.T) {
-	db, mock, err := sqlmock.New()
+func TestAuthHandler_LDAP(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	srv, err := ldaptest.Start(
+		ldaptest.Entry{DN: "cn=svc,dc=ex,dc=com", Password: "svc pass"},
+		ldaptest.Entry{DN: "uid=jo,dc=ex,dc=com", Password: "directory pass", Attributes: map[string][]string{
+			"objectClass": {"person"}, "mail": {"jo@ex.com"}, "displayName": {"Jo Doe"},
+		}},
+	)
 	if err != nil {
-		t.Fatalf("error opening mock: %s", err)
+		t.Fatal(err)
 	}
-	defer db.Close()
-	h := &AuthHandler{DB: db}
+	defer srv.Close()
 
-	form := url.Values{"email": {"new@ex.com"}, "password": {"pass"}}
-	req := httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	h := &AuthHandler{Identities: st, Authenticator: &authn.Chain{Authenticators: []authn.Authenticator{
+		&authn.LDAP{
+			URL: srv.URL, BindDN: "cn=svc,dc=ex,dc=com", BindPassword: "svc pass", BaseDN: "dc=ex,dc=com",
+			UserFilter: "(mail={email})", FullNameAttribute: "displayName", Timeout: 5 * time.Second, Identities: st,
+		},
+		&authn.Local{Users: st, Identities: st},
+	}}}
+	login := func(email, pw string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": email, "password": pw})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.Login(w, req)
+		return w
+	}
+
+	if w := login("jo@ex.com", "directory pass"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if u, err := st.GetByEmail(context.Background(), "jo@ex.com"); err != nil || u.FullName != "Jo Doe" || u.Provider != store.SourceLDAP {
+		t.Errorf("expected the directory user provisioned, got %+v, %v", u, err)
+	}
+	if w := login("jo@ex.com", "wrong"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", w.Code)
+	}
+	if w := login("test@ex.com", "pass"); w.Code != http.StatusOK {
+		t.Errorf("expected local users to sign in, got %d: %s", w.Code, w.Body.String())
+	}
+
+	srv.Close()
+	if w := login("jo@ex.com", "directory pass"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with the directory down, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// A local account the directory takes over keeps no password of its own,
+// so once the directory disables the user nothing here lets them in.
+func TestAuthHandler_LDAPTakeover(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	entry := ldaptest.Entry{DN: "uid=lo,dc=ex,dc=com", Password: "directory pass", Attributes: map[string][]string{
+		"objectClass": {"person"}, "mail": {"lo@ex.com"},
+	}}
+	srv, err := ldaptest.Start(ldaptest.Entry{DN: "cn=svc,dc=ex,dc=com", Password: "svc pass"}, entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "lo@ex.com", "local pass"); err != nil {
+		t.Fatal(err)
+	}
+	// With fallback, a login the directory refuses is still tried locally.
+	h := &AuthHandler{Identities: st, Authenticator: &authn.Chain{Fallback: true, Authenticators: []authn.Authenticator{
+		&authn.LDAP{
+			URL: srv.URL, BindDN: "cn=svc,dc=ex,dc=com", BindPassword: "svc pass", BaseDN: "dc=ex,dc=com",
+			UserFilter: "(mail={email})", Timeout: 5 * time.Second, Identities: st,
+		},
+		&authn.Local{Users: st, Identities: st},
+	}}}
+	login := func(pw string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"email": "lo@ex.com", "password": pw})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.Login(w, req)
+		return w
+	}
+
+	if w := login("directory pass"); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if u, err := st.GetByEmail(ctx, "lo@ex.com"); err != nil || u.Provider != store.SourceLDAP || u.HasPassword {
+		t.Errorf("expected the account taken over without its password, got %+v, %v", u, err)
+	}
+	if w := login("local pass"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the local password refused, got %d", w.Code)
+	}
+
+	// The directory disables the user.
+	entry.Attributes["mail"] = []string{"gone@ex.com"}
+	srv.Add(entry)
+	if w := login("local pass"); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the local password refused once disabled, got %d", w.Code)
+	}
+
+	account := &AccountHandler{Users: st, Identities: st, Policy: password.DefaultPolicy(), Mail: &mailbox{}, StepUp: middleware.DefaultStepUp()}
+	r := withUser(httptest.NewRequest(http.MethodPost, "/api/account/password", strings.NewReader(`{"new_password":"battery staple"}`)), "lo@ex.com")
+	r = r.WithContext(context.WithValue(r.Context(), middleware.AuthKey, middleware.Auth{Time: time.Now(), Methods: []string{middleware.MethodPassword}}))
 	w := httptest.NewRecorder()
+	account.ChangePassword(w, r)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), string(problem.ExternalAccount)) {
+		t.Errorf("expected setting a password refused, got %d: %s", w.Code, w.Body.String())
+	}
+}
 
-	mock.ExpectExec("INSERT INTO users").
-		WithArgs("new@ex.com", "pass", "local").
-		WillReturnResult(sqlmock.NewResult(1, 1))
+func TestAuthHandler_Reauth(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	h := &AuthHandler{Identities: st, Authenticator: &authn.Local{Users: st, Identities: st}}
+	reauth := func(body string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(http.MethodPost, "/api/auth/reauth", strings.NewReader(body)), "test@ex.com")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.Reauth(w, req)
+		return w
+	}
 
-	h.Signup(w, req)
-	if w.Code != http.StatusCreated {
-		t.Errorf("expected 201, got %d", w.Code)
+	t.Run("Wrong Password", func(t *testing.T) {
+		w := reauth(`{"password":"wrong"}`)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), string(problem.InvalidCredentials)) {
+			t.Errorf("expected invalid credentials, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Stepped Up", func(t *testing.T) {
+		w := reauth(`{"password":"pass"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp loginResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(resp.Token, claims, func(*jwt.Token) (any, error) { return []byte("secret"), nil }); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := claims["auth_time"]; !ok || claims["email"] != "test@ex.com" {
+			t.Errorf("expected a fresh sign-in for the caller, got %v", claims)
+		}
+		if amr, _ := claims["amr"].([]any); len(amr) != 1 || amr[0] != middleware.MethodPassword {
+			t.Errorf("expected the password as the method, got %v", claims["amr"])
+		}
+	})
+}
+
+func TestAuthHandler_Signup(t *testing.T) {
+	h := &AuthHandler{Identities: storetest.SQLite(t), Policy: password.DefaultPolicy()}
+
+	signup := func(form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		h.Signup(w, req)
+		return w
+	}
+
+	form := url.Values{"email": {"new@ex.com"}, "password": {"correct horse"}}
+	if w := signup(form); w.Code != http.StatusCreated {
+		t.Errorf("expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := signup(form); w.Code != http.StatusConflict {
+		t.Errorf("expected 409 for existing user, got %d", w.Code)
+	}
+
+	t.Run("Every Field Error", func(t *testing.T) {
+		w := signup(url.Values{"email": {"not an email"}, "password": {"a"}, "role": {"admin"}})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+		var resp problem.Problem
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		fields := map[string]bool{}
+		for _, e := range resp.Errors {
+			fields[e.Field] = true
+		}
+		if !fields["email"] || !fields["password"] || !fields["role"] {
+			t.Errorf("expected errors on email, password and role, got %+v", resp.Errors)
+		}
+	})
+
+	t.Run("Policy", func(t *testing.T) {
+		for pw, want := range map[string]string{
+			"password123":              "breached",
+			"janedoe-rocks":            "email address",
+			"\u00e9\u00e9\u00e9\u00e9": "at least 8 characters",
+		} {
+			w := signup(url.Values{"email": {"janedoe@ex.com"}, "password": {pw}})
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), want) {
+				t.Errorf("%q: expected a password error about %q, got %d: %s", pw, want, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Normalized Email", func(t *testing.T) {
+		body := strings.NewReader(`{"email":" Jane@EX.com ","password":"correct horse"}`)
+		req := httptest.NewRequest(http.MethodPost, "/signup", body)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.Signup(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		if _, err := h.Identities.Authenticate(context.Background(), "Jane@ex.com", "correct horse"); err != nil {
+			t.Errorf("expected the account under Jane@ex.com: %v", err)
+		}
+	})
+}
+
+func TestAuthHandler_PasswordStrength(t *testing.T) {
+	h := &AuthHandler{Policy: password.DefaultPolicy()}
+
+	rate := func(body string) password.Strength {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPost, "/password/strength", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.PasswordStrength(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var s password.Strength
+		if err := json.NewDecoder(w.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+
+	if s := rate(`{"password":"password123"}`); s.Score != 0 || len(s.Problems) == 0 {
+		t.Errorf("expected a breached password to rate 0 with a problem, got %+v", s)
+	}
+	if s := rate(`{"email":"jane@ex.com","password":"correct horse battery"}`); s.Score != 4 || s.Problems != nil {
+		t.Errorf("expected a strong password, got %+v", s)
 	}
 }
 
 func TestAuthHandler_GoogleCallback_Errors(t *testing.T) {
 	os.Setenv("FRONTEND_URL", "http://frontend.com")
-	db, _, _ := sqlmock.New()
-	h := &AuthHandler{DB: db}
+	h := &AuthHandler{Identities: storetest.SQLite(t)}
 
 	t.Run("Missing Code", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/callback", nil)
@@ -122,4 +366,10 @@ func TestAuthHandler_Google(t *testing.T) {
 	if w.Code != http.StatusSeeOther {
 		t.Errorf("expected 303, got %d", w.Code)
 	}
+
+	w = httptest.NewRecorder()
+	h.Google(w, httptest.NewRequest(http.MethodGet, "/google?reauth=1", nil))
+	if loc := w.Header().Get("Location"); !strings.Contains(loc, "prompt=login") || !strings.Contains(loc, "max_age=0") {
+		t.Errorf("expected Google to ask for a new sign-in, got %s", loc)
+	}
 }
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"ccz/avatar"
+	"ccz/middleware"
+	"ccz/problem"
+	"ccz/store"
+)
+
+type AvatarHandler struct {
+	Users   store.UserStore
+	Storage avatar.Storage
+	// Client fetches imported pictures; nil means a client with a short
+	// timeout.
+	Client *http.Client
+}
+
+type AvatarResponse struct {
+	Avatar map[string]string `json:"avatar"`
+}
+
+// avatarIDPattern matches the ids avatar.NewID issues.
+var avatarIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// avatarURLs maps each thumbnail size to the path it is served from, or
+// returns nil when there is no avatar.
+func avatarURLs(id string) map[string]string {
+	if id == "" {
+		return nil
+	}
+	urls := make(map[string]string, len(avatar.Sizes))
+	for _, size := range avatar.Sizes {
+		urls[strconv.Itoa(size)] = "/api/avatars/" + avatar.Key(id, size)
+	}
+	return urls
+}
+
+// Upload replaces the caller's avatar with the picture in the "avatar" part
+// of a multipart/form-data body.
+func (h *AvatarHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	// Leave room for the multipart framing around the picture.
+	r.Body = http.MaxBytesReader(w, r.Body, avatar.MaxBytes+64<<10)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		problem.Error(w, r, http.StatusUnsupportedMediaType, problem.UnsupportedMedia, "Expected a multipart/form-data body.")
+		return
+	}
+	var data []byte
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			uploadError(w, r, err)
+			return
+		}
+		if part.FormName() != "avatar" {
+			continue
+		}
+		data, err = io.ReadAll(io.LimitReader(part, avatar.MaxBytes+1))
+		if err != nil {
+			uploadError(w, r, err)
+			return
+		}
+		break
+	}
+	if data == nil {
+		fieldErrors(w, r, map[string]string{"avatar": "Choose a picture to upload"})
+		return
+	}
+
+	id, err := h.store(r.Context(), email, data)
+	if err != nil {
+		uploadError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(AvatarResponse{Avatar: avatarURLs(id)})
+}
+
+func uploadError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr), errors.Is(err, avatar.ErrTooLarge):
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.PayloadTooLarge, "The picture is too large.")
+	case errors.Is(err, avatar.ErrUnsupported):
+		problem.Error(w, r, http.StatusUnsupportedMediaType, problem.UnsupportedMedia, "The picture must be JPEG, PNG, GIF or WebP.")
+	case errors.Is(err, avatar.ErrInvalid):
+		fieldErrors(w, r, map[string]string{"avatar": "The picture could not be read"})
+	case errors.Is(err, store.ErrNotFound):
+		userNotFound(w, r)
+	default:
+		serverError(w, r, err)
+	}
+}
+
+// store makes and saves the thumbnails for a picture, points email's
+// profile at them and removes the ones they replace. It returns the new
+// avatar id.
+func (h *AvatarHandler) store(ctx context.Context, email string, data []byte) (string, error) {
+	thumbs, err := avatar.Process(data)
+	if err != nil {
+		return "", err
+	}
+	id := avatar.NewID()
+	if err := avatar.Save(ctx, h.Storage, id, thumbs); err != nil {
+		h.remove(ctx, id)
+		return "", err
+	}
+	previous, err := h.Users.SetAvatar(ctx, email, id)
+	if err != nil {
+		h.remove(ctx, id)
+		return "", err
+	}
+	if previous != "" {
+		h.remove(ctx, previous)
+	}
+	return id, nil
+}
+
+// remove deletes an avatar's thumbnails. Failures only leave unreferenced
+// files behind, so they are logged rather than reported.
+func (h *AvatarHandler) remove(ctx context.Context, id string) {
+	if err := avatar.Remove(ctx, h.Storage, id); err != nil {
+		slog.Warn("removing avatar failed", "avatar", id, "error", err)
+	}
+}
+
+// Delete clears the caller's avatar.
+func (h *AvatarHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodDelete)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	previous, err := h.Users.SetAvatar(r.Context(), email, "")
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	if previous != "" {
+		h.remove(r.Context(), previous)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Serve answers GET /api/avatars/{id}/{size}. It needs no authentication,
+// so avatars can be used directly in <img> tags. An id always names the
+// same pictures, so responses may be cached for good.
+func (h *AvatarHandler) Serve(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	size, err := strconv.Atoi(r.PathValue("size"))
+	if !avatarIDPattern.MatchString(id) || err != nil || !avatar.ValidSize(size) {
+		problem.Error(w, r, http.StatusNotFound, problem.AvatarNotFound, "No picture exists at this address.")
+		return
+	}
+
+	etag := `"` + id + "-" + strconv.Itoa(size) + `"`
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && noneMatch(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	obj, err := h.Storage.Get(r.Context(), avatar.Key(id, size))
+	if errors.Is(err, avatar.ErrNotFound) {
+		w.Header().Del("Cache-Control")
+		w.Header().Del("ETag")
+		problem.Error(w, r, http.StatusNotFound, problem.AvatarNotFound, "No picture exists at this address.")
+		return
+	}
+	if err != nil {
+		w.Header().Del("Cache-Control")
+		w.Header().Del("ETag")
+		slog.Error("reading avatar failed", "avatar", id, "error", err)
+		problem.Error(w, r, http.StatusInternalServerError, problem.Internal, "")
+		return
+	}
+	defer obj.Body.Close()
+
+	w.Header().Set("Content-Type", obj.ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if obj.Size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	}
+	_, _ = io.Copy(w, obj.Body)
+}
+
+// googleSizeSuffix matches the size option on Google profile picture URLs,
+// which default to 96px.
+var googleSizeSuffix = regexp.MustCompile(`=s\d+(-c)?$`)
+
+// Import fetches the picture at pictureURL and makes it email's avatar. It
+// is used for the picture a Google account comes with; only https URLs are
+// followed.
+func (h *AvatarHandler) Import(ctx context.Context, email, pictureURL string) error {
+	u, err := url.Parse(pictureURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("avatar import: refusing picture URL %q", pictureURL)
+	}
+	pictureURL = googleSizeSuffix.ReplaceAllString(u.String(), "=s"+strconv.Itoa(avatar.Sizes[0])+"-c")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pictureURL, nil)
+	if err != nil {
+		return err
+	}
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("avatar import: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, avatar.MaxBytes+1))
+	if err != nil {
+		return err
+	}
+	_, err = h.store(ctx, email, data)
+	return err
+}
@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"ccz/avatar"
+	"ccz/store/storetest"
+)
+
+func testPicture(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for x := 0; x < 300; x++ {
+		for y := 0; y < 200; y++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func multipartBody(t *testing.T, field string, data []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile(field, "me.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	mw.Close()
+	return &body, mw.FormDataContentType()
+}
+
+func TestAvatarHandler(t *testing.T) {
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	h := &AvatarHandler{Users: st, Storage: &avatar.Local{Dir: dir}}
+
+	upload := func(t *testing.T, field string, data []byte) *httptest.ResponseRecorder {
+		body, contentType := multipartBody(t, field, data)
+		req := withUser(httptest.NewRequest(http.MethodPost, "/api/profile/avatar", body), "test@ex.com")
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		h.Upload(w, req)
+		return w
+	}
+
+	var first string
+	t.Run("Upload", func(t *testing.T) {
+		w := upload(t, "avatar", testPicture(t))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp AvatarResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Avatar) != len(avatar.Sizes) || !strings.HasPrefix(resp.Avatar["64"], "/api/avatars/") {
+			t.Fatalf("unexpected avatar URLs %v", resp.Avatar)
+		}
+
+		user, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Avatar == "" || resp.Avatar["64"] != "/api/avatars/"+user.Avatar+"/64" {
+			t.Errorf("profile avatar %q does not match %v", user.Avatar, resp.Avatar)
+		}
+		first = user.Avatar
+	})
+
+	t.Run("Serve", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /api/avatars/{id}/{size}", h.Serve)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/avatars/"+first+"/128", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+			t.Errorf("expected image/jpeg, got %s", ct)
+		}
+		if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") || w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("unexpected headers %v", w.Header())
+		}
+		if cfg, _, err := image.DecodeConfig(w.Body); err != nil || cfg.Width != 128 {
+			t.Errorf("expected a 128px picture, got %v, %v", cfg, err)
+		}
+
+		req = httptest.NewRequest(http.MethodGet, "/api/avatars/"+first+"/128", nil)
+		req.Header.Set("If-None-Match", w.Header().Get("ETag"))
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("expected 304, got %d", w.Code)
+		}
+
+		for _, path := range []string{"/api/avatars/" + first + "/100", "/api/avatars/../128", "/api/avatars/" + strings.Repeat("0", 32) + "/64"} {
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			if w.Code == http.StatusOK {
+				t.Errorf("%s: expected an error, got 200", path)
+			}
+		}
+	})
+
+	t.Run("Replace Removes Old Thumbnails", func(t *testing.T) {
+		if w := upload(t, "avatar", testPicture(t)); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if _, err := os.Stat(dir + "/" + first); !os.IsNotExist(err) {
+			t.Errorf("expected the old avatar to be removed, got %v", err)
+		}
+	})
+
+	t.Run("Rejected Uploads", func(t *testing.T) {
+		if w := upload(t, "avatar", testPicture(t)[:100]); w.Code != http.StatusBadRequest {
+			t.Errorf("truncated picture: expected 400, got %d", w.Code)
+		}
+		if w := upload(t, "avatar", []byte("#!/bin/sh\necho hi\n")); w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("script: expected 415, got %d", w.Code)
+		}
+		if w := upload(t, "picture", testPicture(t)); w.Code != http.StatusBadRequest {
+			t.Errorf("wrong field: expected 400, got %d", w.Code)
+		}
+		if w := upload(t, "avatar", make([]byte, avatar.MaxBytes+128<<10)); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("oversized: expected 413, got %d", w.Code)
+		}
+
+		req := withUser(httptest.NewRequest(http.MethodPost, "/api/profile/avatar", strings.NewReader("{}")), "test@ex.com")
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.Upload(w, req)
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("JSON body: expected 415, got %d", w.Code)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.Delete(w, withUser(httptest.NewRequest(http.MethodDelete, "/api/profile/avatar", nil), "test@ex.com"))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		user, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Avatar != "" {
+			t.Errorf("expected no avatar, got %q", user.Avatar)
+		}
+		if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+			t.Errorf("expected no stored thumbnails, got %d", len(entries))
+		}
+	})
+
+	t.Run("Import", func(t *testing.T) {
+		var requested string
+		srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requested = r.URL.Path
+			w.Write(testPicture(t))
+		}))
+		defer srv.Close()
+		h := &AvatarHandler{Users: st, Storage: h.Storage, Client: srv.Client()}
+
+		if err := h.Import(context.Background(), "test@ex.com", srv.URL+"/a/photo=s96-c"); err != nil {
+			t.Fatal(err)
+		}
+		if requested != "/a/photo=s256-c" {
+			t.Errorf("expected the 256px picture to be requested, got %s", requested)
+		}
+		user, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Avatar == "" {
+			t.Error("expected an imported avatar")
+		}
+
+		if err := h.Import(context.Background(), "test@ex.com", "http://example.com/photo.png"); err == nil {
+			t.Error("expected plain http to be refused")
+		}
+	})
+}
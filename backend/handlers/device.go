@@ -0,0 +1,251 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/problem"
+	"ccz/store"
+)
+
+// DeviceAuthorizationResponse starts the device authorization grant (RFC
+// 8628). The device shows the user code and verification URI to its user
+// and polls the token endpoint with the device code.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceRequestResponse tells the device page which client asks for what.
+type DeviceRequestResponse struct {
+	ClientID   string   `json:"client_id"`
+	ClientName string   `json:"client_name"`
+	Scopes     []string `json:"scopes"`
+}
+
+// DeviceAuthorization handles POST /oauth/device/code for clients
+// registered for the device code grant, such as command line tools that
+// cannot receive a redirect. Public clients send only client_id.
+func (h *OAuthHandler) DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+	if !postForm(w, r) {
+		return
+	}
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if !slices.Contains(client.GrantTypes, oauth.GrantDeviceCode) {
+		oauthError(w, http.StatusBadRequest, "unauthorized_client", "This client may not use the device code grant.")
+		return
+	}
+	scopes := oauth.ParseScope(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		oauthError(w, http.StatusBadRequest, "invalid_scope", "The scope parameter is required.")
+		return
+	}
+	for _, s := range scopes {
+		if !slices.Contains(oauth.UserScopes, s) || !slices.Contains(client.Scopes, s) {
+			oauthError(w, http.StatusBadRequest, "invalid_scope", "The scope "+s+" is not available to this client.")
+			return
+		}
+	}
+
+	now := time.Now()
+	deviceCode, hash, err := oauth.NewSecret()
+	if err != nil {
+		slog.Error("creating device code failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	// A new user code is drawn when one happens to be pending already.
+	var userCode string
+	for range 3 {
+		if userCode, err = oauth.NewUserCode(); err != nil {
+			break
+		}
+		err = h.Clients.CreateDeviceCode(r.Context(), store.DeviceCode{
+			Hash:         hash,
+			UserCodeHash: oauth.Hash(userCode),
+			ClientID:     client.ID,
+			Scopes:       scopes,
+			Interval:     oauth.DeviceInterval,
+			ExpiresAt:    now.Add(oauth.DeviceCodeTTL),
+		}, now)
+		if !errors.Is(err, store.ErrConflict) {
+			break
+		}
+	}
+	if err != nil {
+		slog.Error("creating device code failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	verify := strings.TrimSuffix(os.Getenv("FRONTEND_URL"), "/") + "/device"
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         verify,
+		VerificationURIComplete: verify + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(oauth.DeviceCodeTTL / time.Second),
+		Interval:                int(oauth.DeviceInterval / time.Second),
+	})
+}
+
+// deviceCode answers a token request of the device code grant. Until the
+// user decides it is authorization_pending, or slow_down for a device
+// polling faster than it was told to.
+func (h *OAuthHandler) deviceCode(w http.ResponseWriter, r *http.Request, client *store.OAuthClient) {
+	now := time.Now()
+	c, err := h.Clients.PollDeviceCode(r.Context(), oauth.Hash(r.PostForm.Get("device_code")), now)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "The device code is unknown or was used.")
+		return
+	case errors.Is(err, store.ErrTokenExpired):
+		oauthError(w, http.StatusBadRequest, "expired_token", "The device code has expired. Start again.")
+		return
+	case err != nil:
+		slog.Error("polling device code failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if c.ClientID != client.ID {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "The device code was issued to another client.")
+		return
+	}
+	switch c.Status {
+	case store.DevicePending:
+		if c.SlowDown {
+			oauthError(w, http.StatusBadRequest, "slow_down", "Poll less often.")
+			return
+		}
+		oauthError(w, http.StatusBadRequest, "authorization_pending", "The user has not decided yet.")
+	case store.DeviceDenied:
+		oauthError(w, http.StatusBadRequest, "access_denied", "The user declined.")
+	default:
+		h.userTokens(w, r, client, c.UserID, c.Scopes, "", c.AuthTime, now)
+	}
+}
+
+// Wrong user codes allowed per user and per address within
+// userCodeGuessWindow. Pending codes are few and short, so without a limit
+// a signed-in user could guess one and approve someone else's device
+// (RFC 8628 section 5.1).
+const (
+	userCodeGuessesPerUser = 5
+	userCodeGuessesPerIP   = 20
+	userCodeGuessWindow    = 15 * time.Minute
+)
+
+// userCode reads the user code email typed and returns its hash, counting
+// it as a guess against the returned limits until settleGuess. It answers
+// the request when the code cannot be one, or when the user or their
+// address guessed wrong too often.
+func (h *OAuthHandler) userCode(w http.ResponseWriter, r *http.Request, email, typed string) (string, []guessLimit, bool) {
+	code := oauth.NormalizeUserCode(typed)
+	if code == "" {
+		fieldErrors(w, r, map[string]string{"user_code": "Enter the code shown on your device, like WDJB-MJHT"})
+		return "", nil, false
+	}
+	limits := []guessLimit{
+		{key: "user:" + email, max: userCodeGuessesPerUser},
+		{key: "ip:" + middleware.ClientIP(r), max: userCodeGuessesPerIP},
+	}
+	if wait := h.userCodeGuesses.take(limits, userCodeGuessWindow, time.Now()); wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(wait.Round(time.Second)/time.Second)))
+		problem.Error(w, r, http.StatusTooManyRequests, problem.TooManyAttempts, "Too many incorrect codes. Try again later.")
+		return "", nil, false
+	}
+	return oauth.Hash(code), limits, true
+}
+
+// settleGuess hands back the guess userCode counted unless err says the
+// code matched no device request.
+func (h *OAuthHandler) settleGuess(limits []guessLimit, err error) {
+	if !errors.Is(err, store.ErrNotFound) {
+		h.userCodeGuesses.refund(limits)
+	}
+}
+
+// deviceCodeError answers a failure to find a pending device request.
+func deviceCodeError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		fieldErrors(w, r, map[string]string{"user_code": "Incorrect code, or it was already used"})
+	case errors.Is(err, store.ErrTokenExpired):
+		fieldErrors(w, r, map[string]string{"user_code": "The code has expired, start again on your device"})
+	default:
+		serverError(w, r, err)
+	}
+}
+
+// DeviceRequest handles GET /api/oauth/device?user_code=... for the device
+// page: it says which client asks for what.
+func (h *OAuthHandler) DeviceRequest(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+	hash, limits, ok := h.userCode(w, r, email, r.URL.Query().Get("user_code"))
+	if !ok {
+		return
+	}
+	c, err := h.Clients.PendingDeviceCode(r.Context(), hash, time.Now())
+	h.settleGuess(limits, err)
+	if err != nil {
+		deviceCodeError(w, r, err)
+		return
+	}
+	client, err := h.Clients.OAuthClient(r.Context(), c.ClientID)
+	if err != nil {
+		deviceCodeError(w, r, err)
+		return
+	}
+	writeJSON(w, DeviceRequestResponse{ClientID: client.ID, ClientName: client.Name, Scopes: c.Scopes})
+}
+
+// DeviceDecision handles POST /api/oauth/device with {"user_code": "...",
+// "approve": bool} as the signed-in user, and answers 204. The device
+// learns the decision when it next polls.
+func (h *OAuthHandler) DeviceDecision(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+	var input struct {
+		UserCode string `json:"user_code"`
+		Approve  bool   `json:"approve"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	hash, limits, ok := h.userCode(w, r, email, input.UserCode)
+	if !ok {
+		return
+	}
+	authTime := middleware.AuthFrom(r.Context()).Time
+	err := h.Clients.DecideDeviceCode(r.Context(), hash, email, input.Approve, authTime, time.Now())
+	h.settleGuess(limits, err)
+	if err != nil {
+		deviceCodeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
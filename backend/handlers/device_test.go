@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"ccz/oauth"
+	"ccz/problem"
+	"ccz/store"
+)
+
+func TestDeviceGrant(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "http://localhost:8080")
+	st := newProfileStore(t)
+	ctx := context.Background()
+	h := &OAuthHandler{Users: st, Clients: st, Tokens: st, Provider: testProvider(t)}
+	for _, c := range []store.OAuthClient{
+		{ID: "cli", Name: "CLI", Scopes: []string{"openid", "email"}, GrantTypes: []string{oauth.GrantDeviceCode}},
+		{ID: "web", Name: "Web", RedirectURIs: []string{"https://web.ex.com/cb"}, Scopes: []string{"openid"}, GrantTypes: []string{"authorization_code"}},
+	} {
+		if err := st.CreateOAuthClient(ctx, &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(handler http.HandlerFunc, form url.Values) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/device/code", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	oauthErr := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Error
+	}
+	start := func(t *testing.T) DeviceAuthorizationResponse {
+		t.Helper()
+		w := post(h.DeviceAuthorization, url.Values{"client_id": {"cli"}, "scope": {"openid email"}})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp DeviceAuthorizationResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+	poll := func(deviceCode string) *httptest.ResponseRecorder {
+		return post(h.Token, url.Values{"grant_type": {oauth.GrantDeviceCode}, "client_id": {"cli"}, "device_code": {deviceCode}})
+	}
+	decide := func(userCode string, approve bool) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]any{"user_code": userCode, "approve": approve})
+		r := withUser(httptest.NewRequest(http.MethodPost, "/api/oauth/device", strings.NewReader(string(body))), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.DeviceDecision(w, r)
+		return w
+	}
+
+	t.Run("Approved", func(t *testing.T) {
+		device := start(t)
+		if device.VerificationURI != "http://localhost:8080/device" || device.Interval != 5 || device.ExpiresIn != 600 ||
+			device.VerificationURIComplete != "http://localhost:8080/device?user_code="+device.UserCode {
+			t.Errorf("unexpected response %+v", device)
+		}
+
+		if w := poll(device.DeviceCode); oauthErr(w) != "authorization_pending" {
+			t.Errorf("expected authorization_pending, got %s", w.Body.String())
+		}
+		if w := poll(device.DeviceCode); oauthErr(w) != "slow_down" {
+			t.Errorf("expected an early poll to slow down, got %s", w.Body.String())
+		}
+
+		r := withUser(httptest.NewRequest(http.MethodGet, "/api/oauth/device?user_code="+strings.ToLower(device.UserCode), nil), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.DeviceRequest(w, r)
+		var req DeviceRequestResponse
+		if err := json.NewDecoder(w.Body).Decode(&req); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || req.ClientName != "CLI" || len(req.Scopes) != 2 {
+			t.Errorf("unexpected request %d %+v", w.Code, req)
+		}
+
+		if w := decide(device.UserCode, true); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := decide(device.UserCode, false); w.Code != http.StatusBadRequest {
+			t.Errorf("expected a decided code to be refused, got %d", w.Code)
+		}
+		w = poll(device.DeviceCode)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected tokens, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp TokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.AccessToken == "" || resp.IDToken == "" || resp.Scope != "openid email" {
+			t.Errorf("unexpected tokens %+v", resp)
+		}
+		if w := poll(device.DeviceCode); oauthErr(w) != "invalid_grant" {
+			t.Errorf("expected a used device code to be refused, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		device := start(t)
+		if w := decide(device.UserCode, false); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := poll(device.DeviceCode); oauthErr(w) != "access_denied" {
+			t.Errorf("expected access_denied, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		for name, tc := range map[string]struct {
+			form url.Values
+			want string
+		}{
+			"Not Registered": {url.Values{"client_id": {"web"}, "scope": {"openid"}}, "unauthorized_client"},
+			"Other Scope":    {url.Values{"client_id": {"cli"}, "scope": {"openid phone"}}, "invalid_scope"},
+			"No Scope":       {url.Values{"client_id": {"cli"}}, "invalid_scope"},
+			"Unknown Client": {url.Values{"client_id": {"nope"}, "scope": {"openid"}}, "invalid_client"},
+		} {
+			if w := post(h.DeviceAuthorization, tc.form); oauthErr(w) != tc.want {
+				t.Errorf("%s: expected %s, got %s", name, tc.want, w.Body.String())
+			}
+		}
+		if w := poll("unknown"); oauthErr(w) != "invalid_grant" {
+			t.Errorf("expected an unknown device code to be refused, got %s", w.Body.String())
+		}
+		for _, code := range []string{"", "ABCD-EFGH", "WDJB-MJHT"} {
+			if w := decide(code, true); w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "user_code") {
+				t.Errorf("%q: expected a field error on user_code, got %d: %s", code, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Guessing", func(t *testing.T) {
+		device := start(t)
+		decideAs := func(email, userCode string) *httptest.ResponseRecorder {
+			body, _ := json.Marshal(map[string]any{"user_code": userCode, "approve": true})
+			r := withUser(httptest.NewRequest(http.MethodPost, "/api/oauth/device", strings.NewReader(string(body))), email)
+			w := httptest.NewRecorder()
+			h.DeviceDecision(w, r)
+			return w
+		}
+		for i := range userCodeGuessesPerUser {
+			if w := decideAs("guesser@ex.com", "BCDF-GHJK"); w.Code != http.StatusBadRequest {
+				t.Fatalf("guess %d: expected 400, got %d", i+1, w.Code)
+			}
+		}
+		w := decideAs("guesser@ex.com", device.UserCode)
+		if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), string(problem.TooManyAttempts)) || w.Header().Get("Retry-After") == "" {
+			t.Errorf("expected 429 too_many_attempts with Retry-After, got %d %v: %s", w.Code, w.Header(), w.Body.String())
+		}
+		r := withUser(httptest.NewRequest(http.MethodGet, "/api/oauth/device?user_code="+device.UserCode, nil), "guesser@ex.com")
+		w = httptest.NewRecorder()
+		h.DeviceRequest(w, r)
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected looking up codes refused too, got %d", w.Code)
+		}
+		if w := decide(device.UserCode, true); w.Code != http.StatusNoContent {
+			t.Errorf("expected other users unaffected, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// slowDecisions counts device decisions and holds each one briefly, so
+// guesses made at once are all in flight together.
+type slowDecisions struct {
+	store.OAuthStore
+	calls atomic.Int32
+}
+
+func (s *slowDecisions) DecideDeviceCode(ctx context.Context, userCodeHash, email string, approve bool, authTime, now time.Time) error {
+	s.calls.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return s.OAuthStore.DecideDeviceCode(ctx, userCodeHash, email, approve, authTime, now)
+}
+
+func TestDeviceDecision_ParallelGuesses(t *testing.T) {
+	st := newProfileStore(t)
+	clients := &slowDecisions{OAuthStore: st}
+	h := &OAuthHandler{Users: st, Clients: clients, Tokens: st, Provider: testProvider(t)}
+
+	const guesses = 3 * userCodeGuessesPerUser
+	var (
+		wg      sync.WaitGroup
+		limited atomic.Int32
+	)
+	for range guesses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := withUser(httptest.NewRequest(http.MethodPost, "/api/oauth/device", strings.NewReader(`{"user_code":"BCDF-GHJK","approve":true}`)), "test@ex.com")
+			w := httptest.NewRecorder()
+			h.DeviceDecision(w, r)
+			if w.Code == http.StatusTooManyRequests {
+				limited.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := clients.calls.Load(); n > userCodeGuessesPerUser {
+		t.Errorf("expected at most %d guesses checked, got %d", userCodeGuessesPerUser, n)
+	}
+	if n := limited.Load(); n != guesses-userCodeGuessesPerUser {
+		t.Errorf("expected %d guesses refused, got %d", guesses-userCodeGuessesPerUser, n)
+	}
+}
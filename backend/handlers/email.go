@@ -0,0 +1,256 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/problem"
+	"ccz/store"
+)
+
+type EmailHandler struct {
+	Users  store.UserStore
+	Emails store.EmailStore
+	Mail   mailer.Sender
+}
+
+const (
+	// emailConfirmTTL is how long the link sent to the new address works.
+	emailConfirmTTL = 24 * time.Hour
+	// emailRevertTTL is how long the link sent to the old address works,
+	// and so how long the old address is kept for its owner.
+	emailRevertTTL = 7 * 24 * time.Hour
+)
+
+type EmailChangeResponse struct {
+	Email     string    `json:"email"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type EmailConfirmResponse struct {
+	Email string `json:"email"`
+	// Token replaces the caller's session token, which names the old
+	// address.
+	Token string `json:"token"`
+}
+
+// newLinkToken returns a random token for an emailed link and the hash
+// that is stored in its place.
+func newLinkToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, linkTokenHash(token), nil
+}
+
+func linkTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// frontendLink is an absolute link to path on the frontend with token in
+// its query.
+func frontendLink(path, token string) string {
+	return strings.TrimSuffix(os.Getenv("FRONTEND_URL"), "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// readLinkToken reads the body {"token": "..."} shared by the confirm and
+// revert endpoints.
+func readLinkToken(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var input struct {
+		Token string `json:"token" validate:"trim,required,max=128"`
+	}
+	if !decodeBody(w, r, &input) {
+		return "", false
+	}
+	return input.Token, true
+}
+
+// linkError answers for an email change link that could not be used.
+func linkError(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		problem.Error(w, r, http.StatusNotFound, problem.LinkInvalid, "This link is not valid or was already used.")
+	case errors.Is(err, store.ErrTokenExpired):
+		problem.Error(w, r, http.StatusGone, problem.LinkExpired, "This link has expired.")
+	case errors.Is(err, store.ErrConflict):
+		problem.Error(w, r, http.StatusConflict, problem.EmailTaken, "Another account uses this email.")
+	default:
+		serverError(w, r, err)
+	}
+}
+
+// Request starts moving the caller to the address in the body
+// {"email": "..."}. The new address gets a link to confirm the change, the
+// current one a notice with a link to cancel or undo it.
+func (h *EmailHandler) Request(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	var input struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	newEmail := input.Email
+	if strings.EqualFold(newEmail, email) {
+		fieldErrors(w, r, map[string]string{"email": "This is already your email address"})
+		return
+	}
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+	if isExternal(user.Provider) {
+		problem.Error(w, r, http.StatusConflict, problem.ExternalAccount,
+			"Accounts that sign in with "+externalSignIns[user.Provider]+" change their email there.")
+		return
+	}
+
+	token, tokenHash, err := newLinkToken()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	revertToken, revertHash, err := newLinkToken()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	change := store.EmailChange{
+		NewEmail:        newEmail,
+		TokenHash:       tokenHash,
+		RevertTokenHash: revertHash,
+		CreatedAt:       now,
+		ExpiresAt:       now.Add(emailConfirmTTL),
+		RevertExpiresAt: now.Add(emailRevertTTL),
+	}
+	if err := h.Emails.RequestEmailChange(r.Context(), email, change); err != nil {
+		switch {
+		case errors.Is(err, store.ErrConflict):
+			problem.Error(w, r, http.StatusConflict, problem.EmailTaken, "Another account uses this email.")
+		case errors.Is(err, store.ErrNotFound):
+			userNotFound(w, r)
+		default:
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	messages := []mailer.Message{{
+		To:      newEmail,
+		Subject: "Confirm your new email address",
+		Body: fmt.Sprintf("Someone asked to use this address to sign in instead of %s.\n\n"+
+			"If it was you, confirm the change within 24 hours:\n%s\n\n"+
+			"If it was not, ignore this message.\n",
+			email, frontendLink("/profile/email/confirm", token)),
+	}, {
+		To:      email,
+		Subject: "Your email address is being changed",
+		Body: fmt.Sprintf("Someone asked to change the email address you sign in with to %s.\n\n"+
+			"If it was not you, cancel the change, or undo it for the next 7 days:\n%s\n",
+			newEmail, frontendLink("/email/revert", revertToken)),
+	}}
+	for _, m := range messages {
+		if err := h.Mail.Send(r.Context(), m); err != nil {
+			slog.Error("sending email change message failed", "error", err)
+			problem.Error(w, r, http.StatusBadGateway, problem.DeliveryFailed, "The confirmation could not be sent. Try again later.")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(EmailChangeResponse{Email: newEmail, ExpiresAt: change.ExpiresAt})
+}
+
+// Confirm completes the caller's pending email change with the token from
+// the link sent to the new address, and answers with a session token for
+// that address.
+func (h *EmailHandler) Confirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+	token, ok := readLinkToken(w, r)
+	if !ok {
+		return
+	}
+
+	change, err := h.Emails.ConfirmEmailChange(r.Context(), email, linkTokenHash(token), time.Now())
+	if err != nil {
+		linkError(w, r, err)
+		return
+	}
+	session, err := signToken(change.NewEmail, middleware.AuthFrom(r.Context()))
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(EmailConfirmResponse{Email: change.NewEmail, Token: session})
+}
+
+// Revert cancels or undoes an email change with the token from the link
+// sent to the old address. It needs no session: the owner of the old
+// address may have lost theirs with the change.
+func (h *EmailHandler) Revert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+	token, ok := readLinkToken(w, r)
+	if !ok {
+		return
+	}
+
+	change, err := h.Emails.RevertEmailChange(r.Context(), linkTokenHash(token), time.Now())
+	if err != nil {
+		linkError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{"email": change.OldEmail})
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"ccz/mailer"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/store/storetest"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mailbox records messages instead of sending them.
+type mailbox struct {
+	sent []mailer.Message
+}
+
+func (m *mailbox) Send(ctx context.Context, msg mailer.Message) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+var linkTokenPattern = regexp.MustCompile(`\?token=([A-Za-z0-9_-]+)`)
+
+// token returns the link token in the last message sent to addr.
+func (m *mailbox) token(t *testing.T, addr string) string {
+	t.Helper()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == addr {
+			if match := linkTokenPattern.FindStringSubmatch(m.sent[i].Body); match != nil {
+				return match[1]
+			}
+		}
+	}
+	t.Fatalf("no link sent to %s", addr)
+	return ""
+}
+
+func TestEmailHandler(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("FRONTEND_URL", "http://localhost:8080")
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	for _, email := range []string{"test@ex.com", "other@ex.com"} {
+		if err := st.CreateLocal(ctx, email, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	inbox := &mailbox{}
+	h := &EmailHandler{Users: st, Emails: st, Mail: inbox}
+
+	request := func(email, newEmail string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"email":"` + newEmail + `"}`)
+		w := httptest.NewRecorder()
+		h.Request(w, withUser(httptest.NewRequest(http.MethodPost, "/api/profile/email", body), email))
+		return w
+	}
+
+	t.Run("Invalid Requests", func(t *testing.T) {
+		for _, tc := range []struct {
+			email string
+			code  int
+		}{
+			{"not an address", http.StatusBadRequest},
+			{"Test <new@ex.com>", http.StatusBadRequest},
+			{"TEST@ex.com", http.StatusBadRequest},
+			{"other@ex.com", http.StatusConflict},
+		} {
+			if w := request("test@ex.com", tc.email); w.Code != tc.code {
+				t.Errorf("%q: expected %d, got %d: %s", tc.email, tc.code, w.Code, w.Body.String())
+			}
+		}
+		if len(inbox.sent) != 0 {
+			t.Errorf("expected no mail, got %d messages", len(inbox.sent))
+		}
+	})
+
+	t.Run("Request", func(t *testing.T) {
+		w := request("test@ex.com", "new@ex.com")
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+		}
+		if len(inbox.sent) != 2 {
+			t.Fatalf("expected 2 messages, got %d", len(inbox.sent))
+		}
+		if !strings.Contains(inbox.sent[0].Body, "http://localhost:8080/profile/email/confirm?token=") {
+			t.Errorf("expected a confirm link to the new address, got %q", inbox.sent[0].Body)
+		}
+		if inbox.sent[1].To != "test@ex.com" || !strings.Contains(inbox.sent[1].Body, "/email/revert?token=") {
+			t.Errorf("expected a revert link to the old address, got %+v", inbox.sent[1])
+		}
+	})
+
+	confirm := func(email, token string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"token":"` + token + `"}`)
+		w := httptest.NewRecorder()
+		h.Confirm(w, withUser(httptest.NewRequest(http.MethodPost, "/api/profile/email/confirm", body), email))
+		return w
+	}
+
+	t.Run("Confirm", func(t *testing.T) {
+		if w := confirm("test@ex.com", "bogus"); w.Code != http.StatusNotFound {
+			t.Errorf("unknown token: expected 404, got %d", w.Code)
+		}
+		token := inbox.token(t, "new@ex.com")
+		if w := confirm("other@ex.com", token); w.Code != http.StatusNotFound {
+			t.Errorf("another user's token: expected 404, got %d", w.Code)
+		}
+
+		w := confirm("test@ex.com", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp EmailConfirmResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(resp.Token, claims, func(*jwt.Token) (any, error) { return []byte("secret"), nil }); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Email != "new@ex.com" || claims["email"] != "new@ex.com" {
+			t.Errorf("expected a token for the new address, got %+v with %v", resp, claims)
+		}
+		if _, err := st.GetByEmail(ctx, "new@ex.com"); err != nil {
+			t.Errorf("expected the user under the new address, got %v", err)
+		}
+		if w := confirm("new@ex.com", token); w.Code != http.StatusNotFound {
+			t.Errorf("used token: expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("Revert", func(t *testing.T) {
+		// Nobody else can take the old address while it can be reverted.
+		if w := request("other@ex.com", "test@ex.com"); w.Code != http.StatusConflict {
+			t.Errorf("held address: expected 409, got %d", w.Code)
+		}
+
+		body := strings.NewReader(`{"token":"` + inbox.token(t, "test@ex.com") + `"}`)
+		w := httptest.NewRecorder()
+		h.Revert(w, httptest.NewRequest(http.MethodPost, "/api/email/revert", body))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if _, err := st.GetByEmail(ctx, "test@ex.com"); err != nil {
+			t.Errorf("expected the user back under the old address, got %v", err)
+		}
+		if _, err := st.GetByEmail(ctx, "new@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected the new address to be free again, got %v", err)
+		}
+	})
+
+	t.Run("Google Accounts", func(t *testing.T) {
+		if _, err := st.UpsertGoogle(ctx, "g@ex.com", "G", store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if w := request("g@ex.com", "new@ex.com"); w.Code != http.StatusConflict {
+			t.Errorf("expected 409, got %d", w.Code)
+		}
+	})
+
+	t.Run("SAML Accounts", func(t *testing.T) {
+		if _, err := st.UpsertSAML(ctx, "s@ex.com", store.ProfileUpdate{}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if w := request("s@ex.com", "new@ex.com"); w.Code != http.StatusConflict {
+			t.Errorf("expected 409, got %d", w.Code)
+		}
+	})
+	t.Run("LDAP Accounts", func(t *testing.T) {
+		if _, err := st.UpsertLDAP(ctx, "d@ex.com", store.ProfileUpdate{}, "", store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if w := request("d@ex.com", "new@ex.com"); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), string(problem.ExternalAccount)) {
+			t.Errorf("expected 409 external_account, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
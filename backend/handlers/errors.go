@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"ccz/middleware"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// maxBodyBytes bounds JSON request bodies; none of them needs more.
+const maxBodyBytes = 1 << 20
+
+// serverError answers 503 when the store could not reach the database and
+// 500 for anything else. The cause is logged rather than shown, with the
+// request id the problem carries so reports can be matched with the log.
+func serverError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, store.ErrUnavailable) {
+		middleware.Unavailable(w, r)
+		return
+	}
+	slog.Error("request failed", "method", r.Method, "path", r.URL.Path,
+		"request_id", w.Header().Get(problem.RequestIDHeader), "error", err)
+	problem.Error(w, r, http.StatusInternalServerError, problem.Internal, "")
+}
+
+// fieldErrors answers 400 with what is wrong with individual fields of the
+// request body, keyed by field name, so forms can show each message next
+// to its input.
+func fieldErrors(w http.ResponseWriter, r *http.Request, fields map[string]string) {
+	problem.Fields(w, r, fields)
+}
+
+// unauthenticated answers 401 when a handler behind AuthMiddleware finds
+// no identity in the request context.
+func unauthenticated(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusUnauthorized, problem.Unauthenticated, "Sign in to continue.")
+}
+
+// userNotFound answers 404 for a signed-in user whose profile is gone.
+func userNotFound(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusNotFound, problem.UserNotFound, "No profile exists for this account.")
+}
+
+// invalidBody answers 400 for a body that cannot be decoded at all.
+func invalidBody(w http.ResponseWriter, r *http.Request, detail string) {
+	problem.Error(w, r, http.StatusBadRequest, problem.InvalidBody, detail)
+}
+
+// methodNotAllowed answers 405; callers set Allow first.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+}
+
+// decodeBody reads the JSON object in r's body into v, a pointer to a
+// struct, and checks it against v's validate tags. It writes the error
+// response and returns false when the body is not acceptable.
+func decodeBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	err := validate.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), v)
+	if err == nil {
+		err = validate.Struct(v)
+	}
+	return accepted(w, r, err)
+}
+
+// accepted reports whether input passed the checks that returned err, and
+// otherwise answers: field errors name their fields, an oversized body
+// gets 413 and anything else is an invalid body.
+func accepted(w http.ResponseWriter, r *http.Request, err error) bool {
+	var errs validate.Errors
+	var maxErr *http.MaxBytesError
+	switch {
+	case err == nil:
+		return true
+	case errors.As(err, &errs):
+		fieldErrors(w, r, errs)
+	case errors.As(err, &maxErr):
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.PayloadTooLarge, "The request body is too large.")
+	default:
+		invalidBody(w, r, "The request body must be a JSON object.")
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"strconv"
+	"strings"
+)
+
+// profileETag is the strong validator for a profile at version.
+func profileETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// noneMatch reports whether an If-None-Match header matches etag. The
+// comparison is weak, as RFC 9110 requires for If-None-Match.
+func noneMatch(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersions reads the profile versions an If-Match header lists. It
+// returns nil for "*" (any current version) and ok=false when the header
+// names no tag this server could have issued, which can never match.
+func ifMatchVersions(header string) (versions []int64, ok bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return nil, true
+	}
+	// If-Match uses strong comparison, so weak tags never match.
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if !strings.HasPrefix(tag, `"`) || !strings.HasSuffix(tag, `"`) || len(tag) < 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+		if err == nil && v > 0 {
+			versions = append(versions, v)
+		}
+	}
+	return versions, len(versions) > 0
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+)
+
+// guessLimiter counts guesses of a secret, such as device user codes, per
+// key in fixed windows. Its zero value is ready to use. Counts are kept in
+// memory, so each instance of the backend keeps its own.
+type guessLimiter struct {
+	mu      sync.Mutex
+	windows map[string]*guessWindow
+	// sweepAt is when windows is next cleared of windows that are over.
+	sweepAt time.Time
+}
+
+type guessWindow struct {
+	start   time.Time
+	guesses int
+}
+
+// guessLimit allows max guesses by key per window.
+type guessLimit struct {
+	key string
+	max int
+}
+
+// take counts a guess against every limit, unless one of them is used up:
+// then it counts nothing and returns how long until that one allows a
+// guess again. Checking and counting under one lock keeps parallel
+// guesses within the limits. A guess that turns out right is handed back
+// with refund, so only wrong ones use up a limit.
+func (l *guessLimiter) take(limits []guessLimit, per time.Duration, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.windows == nil {
+		l.windows = map[string]*guessWindow{}
+	}
+	// Windows are dropped at most once per window length, so the map holds
+	// only recent keys without a sweep on every guess.
+	if !now.Before(l.sweepAt) {
+		for k, w := range l.windows {
+			if !now.Before(w.start.Add(per)) {
+				delete(l.windows, k)
+			}
+		}
+		l.sweepAt = now.Add(per)
+	}
+
+	var wait time.Duration
+	for _, limit := range limits {
+		w, ok := l.windows[limit.key]
+		if ok && now.Before(w.start.Add(per)) && w.guesses >= limit.max {
+			wait = max(wait, w.start.Add(per).Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, limit := range limits {
+		w, ok := l.windows[limit.key]
+		if !ok || !now.Before(w.start.Add(per)) {
+			w = &guessWindow{start: now}
+			l.windows[limit.key] = w
+		}
+		w.guesses++
+	}
+	return 0
+}
+
+// refund hands back a guess counted by take.
+func (l *guessLimiter) refund(limits []guessLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, limit := range limits {
+		if w, ok := l.windows[limit.key]; ok && w.guesses > 0 {
+			w.guesses--
+		}
+	}
+}
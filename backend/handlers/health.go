@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"ccz/db"
+	"ccz/middleware"
+)
+
+type HealthHandler struct {
+	Prober *db.Prober
+	Router *db.Router
+}
+
+type dbHealthResponse struct {
+	db.Stats
+	Replicas []db.ReplicaStats `json:"replicas,omitempty"`
+}
+
+// Live reports that the process is up, regardless of the database.
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// DB reports database reachability and connection pool statistics for the
+// primary and any replicas.
+func (h *HealthHandler) DB(w http.ResponseWriter, r *http.Request) {
+	stats := h.Prober.Stats()
+	resp := dbHealthResponse{Stats: stats}
+	if h.Router != nil {
+		resp.Replicas = h.Router.Stats()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !stats.Healthy {
+		w.Header().Set("Retry-After", strconv.Itoa(int(middleware.RetryAfter.Seconds())))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
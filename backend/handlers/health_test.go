@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"ccz/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+func TestHealthHandler_DB(t *testing.T) {
+	conn, mock, err := sqlmock.New(sqlmock.MonitorPingsOption(true))
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer conn.Close()
+
+	h := &HealthHandler{Prober: db.NewProber(conn, time.Second)}
+
+	t.Run("Healthy", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.DB(w, httptest.NewRequest(http.MethodGet, "/health/db", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		var stats db.Stats
+		if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+		if !stats.Healthy {
+			t.Error("expected healthy stats")
+		}
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		mock.ExpectPing().WillReturnError(errors.New("connection refused"))
+		h.Prober.Check(t.Context())
+
+		w := httptest.NewRecorder()
+		h.DB(w, httptest.NewRequest(http.MethodGet, "/health/db", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"ccz/introspect"
+	"ccz/oauth"
+	"ccz/pat"
+	"ccz/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// introspectionMaxAge is how long services may cache what the
+// introspection endpoint says of a token. A revoked token can be accepted
+// for this long afterwards.
+const introspectionMaxAge = time.Minute
+
+// errInactiveToken is returned for tokens that are not good: malformed,
+// expired, revoked or naming what no longer exists.
+var errInactiveToken = errors.New("token is not active")
+
+// accessToken checks an access token the provider issued and returns its
+// claims. Tokens that were revoked, or whose client was removed, are
+// inactive.
+func (h *OAuthHandler) accessToken(ctx context.Context, token string) (*oauth.AccessClaims, error) {
+	claims, err := h.Provider.ParseAccessToken(token)
+	if err != nil {
+		return nil, errInactiveToken
+	}
+	revoked, err := h.Clients.OAuthTokenRevoked(ctx, claims.ID)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errInactiveToken
+	}
+	if _, err := h.Clients.OAuthClient(ctx, claims.ClientID); err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			return nil, errInactiveToken
+		}
+		return nil, err
+	}
+	return claims, nil
+}
+
+// sessionClaims checks a session token the way middleware.Authenticate
+// does, short of whether its user signed out every session.
+func sessionClaims(token string) (jwt.MapClaims, bool) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		return []byte(os.Getenv("JWT_SECRET")), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, false
+	}
+	if email, _ := claims["email"].(string); email == "" {
+		return nil, false
+	}
+	return claims, true
+}
+
+// introspector reports whether client may use the introspection endpoint.
+func introspector(client *store.OAuthClient) bool {
+	return client.SecretHash != "" && slices.Contains(client.Scopes, oauth.ScopeIntrospect)
+}
+
+// Introspect handles POST /oauth/introspect (RFC 7662) for confidential
+// clients with the introspect scope. It says whether the token in the
+// form is active and, when it is, who it names, what it may do and when
+// it expires. Session tokens, personal access tokens and the provider's
+// access tokens are all understood. Cache-Control says how long the answer
+// may be reused.
+func (h *OAuthHandler) Introspect(w http.ResponseWriter, r *http.Request) {
+	if !postForm(w, r) {
+		return
+	}
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	if !introspector(client) {
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "This client may not introspect tokens.")
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "The token parameter is required.")
+		return
+	}
+
+	now := time.Now()
+	resp, err := h.inspect(r, token, now)
+	if errors.Is(err, errInactiveToken) {
+		resp, err = &introspect.Response{}, nil
+	}
+	if err != nil {
+		slog.Error("introspecting token failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+
+	maxAge := introspectionMaxAge
+	if resp.Active && resp.ExpiresAt != 0 {
+		maxAge = min(maxAge, time.Unix(resp.ExpiresAt, 0).Sub(now))
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(max(int(maxAge/time.Second), 0)))
+	writeJSON(w, resp)
+}
+
+// inspect describes an active token, or returns errInactiveToken.
+func (h *OAuthHandler) inspect(r *http.Request, token string, now time.Time) (*introspect.Response, error) {
+	ctx := r.Context()
+	if pat.Is(token) {
+		t, err := h.Tokens.GetAccessToken(ctx, pat.Hash(token), now)
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, store.ErrTokenExpired) {
+			return nil, errInactiveToken
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp, err := h.userResponse(ctx, t.Email)
+		if err != nil {
+			return nil, err
+		}
+		resp.Scope = oauth.FormatScope(t.Scopes)
+		resp.IssuedAt = t.CreatedAt.Unix()
+		if !t.ExpiresAt.IsZero() {
+			resp.ExpiresAt = t.ExpiresAt.Unix()
+		}
+		return resp, nil
+	}
+
+	claims, err := h.accessToken(ctx, token)
+	if err == nil {
+		return h.accessTokenResponse(ctx, claims)
+	}
+	if !errors.Is(err, errInactiveToken) {
+		return nil, err
+	}
+
+	session, ok := sessionClaims(token)
+	if !ok {
+		return nil, errInactiveToken
+	}
+	email := session["email"].(string)
+	revokedAt, err := h.Users.SessionsRevokedAt(ctx, email)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, errInactiveToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	iat, _ := session.GetIssuedAt()
+	if !revokedAt.IsZero() && (iat == nil || iat.Unix() < revokedAt.Unix()) {
+		return nil, errInactiveToken
+	}
+	resp, err := h.userResponse(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	if iat != nil {
+		resp.IssuedAt = iat.Unix()
+	}
+	exp, _ := session.GetExpirationTime()
+	resp.ExpiresAt = exp.Unix()
+	return resp, nil
+}
+
+// userResponse is the start of the answer for a session or personal
+// access token of the user with email.
+func (h *OAuthHandler) userResponse(ctx context.Context, email string) (*introspect.Response, error) {
+	u, err := h.Users.GetByEmail(ctx, email)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, errInactiveToken
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &introspect.Response{Active: true, TokenType: "Bearer", Username: u.Email, Subject: oauth.Subject(u)}, nil
+}
+
+// accessTokenResponse describes an access token of the provider. Tokens
+// naming a user who no longer exists are inactive. The email is left
+// out: the client may not have been granted it.
+func (h *OAuthHandler) accessTokenResponse(ctx context.Context, claims *oauth.AccessClaims) (*introspect.Response, error) {
+	if claims.Subject != claims.ClientID {
+		id, err := strconv.ParseInt(claims.Subject, 10, 64)
+		if err != nil {
+			return nil, errInactiveToken
+		}
+		if _, err := h.Users.GetByID(ctx, id); err != nil {
+			if errors.Is(err, store.ErrNotFound) {
+				return nil, errInactiveToken
+			}
+			return nil, err
+		}
+	}
+	resp := &introspect.Response{
+		Active:    true,
+		Scope:     claims.Scope,
+		ClientID:  claims.ClientID,
+		TokenType: "Bearer",
+		ExpiresAt: claims.ExpiresAt.Unix(),
+		Subject:   claims.Subject,
+		Issuer:    claims.Issuer,
+		ID:        claims.ID,
+	}
+	if claims.IssuedAt != nil {
+		resp.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return resp, nil
+}
+
+// Revoke handles POST /oauth/revoke (RFC 7009). Clients revoke the access
+// tokens issued to them, and clients with the introspect scope any access
+// token. As the RFC asks, tokens that are unknown, expired or already
+// revoked are answered as if they were revoked now. Sessions sign out
+// through the API and personal access tokens are revoked by their owner,
+// so both are refused with unsupported_token_type.
+func (h *OAuthHandler) Revoke(w http.ResponseWriter, r *http.Request) {
+	if !postForm(w, r) {
+		return
+	}
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	token := r.PostForm.Get("token")
+	if token == "" {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "The token parameter is required.")
+		return
+	}
+
+	claims, err := h.Provider.ParseAccessToken(token)
+	if err != nil {
+		if _, session := sessionClaims(token); session || pat.Is(token) {
+			oauthError(w, http.StatusBadRequest, "unsupported_token_type", "Only OAuth access tokens can be revoked here.")
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if claims.ClientID != client.ID && !introspector(client) {
+		oauthError(w, http.StatusBadRequest, "unauthorized_client", "The token was issued to another client.")
+		return
+	}
+	if err := h.Clients.RevokeOAuthToken(r.Context(), claims.ID, claims.ExpiresAt.Time, time.Now()); err != nil {
+		slog.Error("revoking token failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,224 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"ccz/introspect"
+	"ccz/oauth"
+	"ccz/pat"
+	"ccz/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestIntrospection(t *testing.T) {
+	t.Setenv("JWT_SECRET", "secret")
+	st := newProfileStore(t)
+	ctx := context.Background()
+	h := &OAuthHandler{Users: st, Clients: st, Tokens: st, Provider: testProvider(t)}
+	user, err := st.GetByEmail(ctx, "test@ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secrets := map[string]string{}
+	for _, c := range []store.OAuthClient{
+		{ID: "api", Name: "API", Scopes: []string{oauth.ScopeIntrospect}, GrantTypes: []string{"client_credentials"}},
+		{ID: "wiki", Name: "Wiki", RedirectURIs: []string{"https://wiki.ex.com/cb"}, Scopes: []string{"openid", "reports:read"}, GrantTypes: []string{"authorization_code", "client_credentials"}},
+		{ID: "gone", Name: "Gone", Scopes: []string{"reports:read"}, GrantTypes: []string{"client_credentials"}},
+	} {
+		secret, hash, err := oauth.NewSecret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SecretHash, secrets[c.ID] = hash, secret
+		if err := st.CreateOAuthClient(ctx, &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	call := func(handler http.HandlerFunc, client, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(url.Values{"token": {token}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.SetBasicAuth(client, secrets[client])
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	inspect := func(t *testing.T, token string) introspect.Response {
+		t.Helper()
+		w := call(h.Introspect, "api", token)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp introspect.Response
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	now := time.Now()
+	userToken, err := h.Provider.AccessToken(oauth.Subject(user), "wiki", []string{"openid"}, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Access Token", func(t *testing.T) {
+		w := call(h.Introspect, "api", userToken)
+		if cc := w.Header().Get("Cache-Control"); cc != "private, max-age=60" {
+			t.Errorf("expected a minute of caching, got %q", cc)
+		}
+		resp := inspect(t, userToken)
+		if !resp.Active || resp.Subject != oauth.Subject(user) || resp.ClientID != "wiki" || resp.Scope != "openid" ||
+			resp.Username != "" || resp.ExpiresAt != now.Add(time.Hour).Unix() {
+			t.Errorf("unexpected answer %+v", resp)
+		}
+	})
+
+	t.Run("Session", func(t *testing.T) {
+		resp := inspect(t, testToken(t, "test@ex.com"))
+		if !resp.Active || resp.Username != "test@ex.com" || resp.Subject != oauth.Subject(user) || resp.Scope != "" {
+			t.Errorf("unexpected answer %+v", resp)
+		}
+
+		if err := st.SetPassword(ctx, "test@ex.com", "newpass", time.Now().Add(time.Second)); err != nil {
+			t.Fatal(err)
+		}
+		if resp := inspect(t, testToken(t, "test@ex.com")); resp.Active {
+			t.Error("expected a signed out session to be inactive")
+		}
+	})
+
+	t.Run("Personal Access Token", func(t *testing.T) {
+		token, prefix, hash, err := pat.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		created := now.Truncate(time.Second)
+		if err := st.CreateAccessToken(ctx, "test@ex.com", &store.AccessToken{Name: "ci", Prefix: prefix, Hash: hash,
+			Scopes: []string{pat.ScopeProfileRead}, CreatedAt: created, ExpiresAt: created.Add(24 * time.Hour)}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := st.UseAccessToken(ctx, hash, "192.0.2.7", created); err != nil {
+			t.Fatal(err)
+		}
+		resp := inspect(t, token)
+		if !resp.Active || resp.Username != "test@ex.com" || resp.Scope != pat.ScopeProfileRead || resp.IssuedAt != created.Unix() {
+			t.Errorf("unexpected answer %+v", resp)
+		}
+		// The resource server asking is not the token being used.
+		tokens, err := st.AccessTokens(ctx, "test@ex.com")
+		if err != nil || len(tokens) == 0 {
+			t.Fatalf("listing tokens: %v", err)
+		}
+		if !tokens[0].LastUsedAt.Equal(created) || tokens[0].LastUsedIP != "192.0.2.7" {
+			t.Errorf("expected the last use left alone, got %v from %q", tokens[0].LastUsedAt, tokens[0].LastUsedIP)
+		}
+	})
+
+	t.Run("Inactive", func(t *testing.T) {
+		expired, err := h.Provider.AccessToken(oauth.Subject(user), "wiki", nil, time.Time{}, now.Add(-2*time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"email": "test@ex.com", "exp": now.Add(time.Hour).Unix()}).SignedString([]byte("other"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, token := range map[string]string{
+			"Expired":  expired,
+			"Forged":   forged,
+			"Unknown":  "ccz_pat_unknown",
+			"Garbage":  "abc",
+			"No Email": mustSign(t, jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}),
+		} {
+			w := call(h.Introspect, "api", token)
+			if w.Body.String() != "{\"active\":false}\n" {
+				t.Errorf("%s: expected only active false, got %s", name, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Refused Clients", func(t *testing.T) {
+		if w := call(h.Introspect, "wiki", userToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a client without the introspect scope to be refused, got %d", w.Code)
+		}
+		secret := secrets["api"]
+		secrets["api"] = "wrong"
+		defer func() { secrets["api"] = secret }()
+		if w := call(h.Introspect, "api", userToken); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a wrong secret to be refused, got %d", w.Code)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		wikiToken, err := h.Provider.AccessToken("wiki", "wiki", []string{"reports:read"}, time.Time{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if w := call(h.Revoke, "gone", wikiToken); w.Code != http.StatusBadRequest {
+			t.Errorf("expected revoking another client's token to be refused, got %d", w.Code)
+		}
+		if w := call(h.Revoke, "wiki", wikiToken); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := call(h.Revoke, "wiki", wikiToken); w.Code != http.StatusOK {
+			t.Errorf("expected revoking twice to answer 200, got %d", w.Code)
+		}
+		if w := call(h.Revoke, "wiki", "abc"); w.Code != http.StatusOK {
+			t.Errorf("expected an unknown token to answer 200, got %d", w.Code)
+		}
+		if w := call(h.Revoke, "wiki", testToken(t, "test@ex.com")); !strings.Contains(w.Body.String(), "unsupported_token_type") {
+			t.Errorf("expected sessions to be refused, got %s", w.Body.String())
+		}
+		if resp := inspect(t, wikiToken); resp.Active {
+			t.Error("expected a revoked token to be inactive")
+		}
+
+		// The introspect scope may revoke tokens of any client, and
+		// userinfo refuses them too.
+		if w := call(h.Revoke, "api", userToken); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		r := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+userToken)
+		w := httptest.NewRecorder()
+		h.UserInfo(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected userinfo to refuse a revoked token, got %d", w.Code)
+		}
+	})
+
+	t.Run("Removed Client", func(t *testing.T) {
+		token, err := h.Provider.AccessToken("gone", "gone", []string{"reports:read"}, time.Time{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp := inspect(t, token); !resp.Active {
+			t.Fatal("expected the token to be active")
+		}
+		if err := st.DeleteOAuthClient(ctx, "gone"); err != nil {
+			t.Fatal(err)
+		}
+		if resp := inspect(t, token); resp.Active {
+			t.Error("expected the token of a removed client to be inactive")
+		}
+	})
+}
+
+func mustSign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
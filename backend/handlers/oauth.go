@@ -0,0 +1,484 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccz/avatar"
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/problem"
+	"ccz/store"
+)
+
+// OAuthHandler serves the OAuth 2.0 / OpenID Connect provider. The
+// endpoints that clients call directly answer errors in the RFC 6749 form
+// clients expect rather than as problem details; the API the consent page
+// calls answers like the rest of the API.
+type OAuthHandler struct {
+	Users    store.UserStore
+	Clients  store.OAuthStore
+	Tokens   store.TokenStore
+	Provider *oauth.Provider
+
+	// userCodeGuesses counts wrong device user codes.
+	userCodeGuesses guessLimiter
+}
+
+// AuthorizeResponse tells the consent page what a client asks for. When
+// RedirectTo is set there is nothing to ask: the browser goes there.
+type AuthorizeResponse struct {
+	ClientID   string   `json:"client_id,omitempty"`
+	ClientName string   `json:"client_name,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	RedirectTo string   `json:"redirect_to,omitempty"`
+}
+
+// TokenResponse is a successful answer of the token endpoint.
+type TokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	Scope       string `json:"scope,omitempty"`
+	IDToken     string `json:"id_token,omitempty"`
+}
+
+// authorization is an authorization request that names a registered
+// client and one of its redirect URIs, so faults can be sent back there.
+type authorization struct {
+	client      *store.OAuthClient
+	redirectURI string
+	state       string
+	params      url.Values
+}
+
+// redirect returns the client's redirect URI with params and the state,
+// and the issuer so the client can tell providers apart (RFC 9207).
+func (a *authorization) redirect(issuer string, params url.Values) string {
+	u, _ := url.Parse(a.redirectURI)
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if a.state != "" {
+		q.Set("state", a.state)
+	}
+	q.Set("iss", issuer)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// fail returns where to send the browser for an error of the request.
+func (a *authorization) fail(issuer, code, description string) string {
+	return a.redirect(issuer, url.Values{"error": {code}, "error_description": {description}})
+}
+
+// authorization checks the client and redirect URI of the request in r's
+// query. It answers the request itself when either is wrong, since there
+// is then nowhere safe to send the error.
+func (h *OAuthHandler) authorization(w http.ResponseWriter, r *http.Request) (*authorization, bool) {
+	q := r.URL.Query()
+	client, err := h.Clients.OAuthClient(r.Context(), q.Get("client_id"))
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusBadRequest, problem.InvalidClient, "The client_id names no registered client.")
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+	redirectURI := q.Get("redirect_uri")
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		problem.Error(w, r, http.StatusBadRequest, problem.InvalidClient, "The redirect_uri is not registered for this client.")
+		return nil, false
+	}
+	return &authorization{client: client, redirectURI: redirectURI, state: q.Get("state"), params: q}, true
+}
+
+// check returns the error to send back to the client for a request it may
+// not make, or "" when the request is sound. PKCE with S256 is required of
+// every client.
+func (a *authorization) check() (code, description string) {
+	switch {
+	case !slices.Contains(a.client.GrantTypes, oauth.GrantAuthorizationCode):
+		return "unauthorized_client", "This client may not use the authorization code grant."
+	case a.params.Get("response_type") != "code":
+		return "unsupported_response_type", "Only the code response type is supported."
+	case a.params.Get("code_challenge") == "" || a.params.Get("code_challenge_method") != "S256":
+		return "invalid_request", "A PKCE code_challenge with the S256 method is required."
+	}
+	scopes := a.scopes()
+	if len(scopes) == 0 {
+		return "invalid_scope", "The scope parameter is required."
+	}
+	for _, s := range scopes {
+		if !slices.Contains(oauth.UserScopes, s) || !slices.Contains(a.client.Scopes, s) {
+			return "invalid_scope", "The scope " + s + " is not available to this client."
+		}
+	}
+	return "", ""
+}
+
+func (a *authorization) scopes() []string {
+	return oauth.ParseScope(a.params.Get("scope"))
+}
+
+// Authorize handles GET /oauth/authorize, where clients send the browser.
+// Once the client and redirect URI check out, the browser goes on to the
+// frontend consent page with the same query; the user signs in there if
+// they have not yet.
+func (h *OAuthHandler) Authorize(w http.ResponseWriter, r *http.Request) {
+	if _, ok := h.authorization(w, r); !ok {
+		return
+	}
+	consent := strings.TrimSuffix(os.Getenv("FRONTEND_URL"), "/") + "/oauth/consent?" + r.URL.RawQuery
+	http.Redirect(w, r, consent, http.StatusFound)
+}
+
+// AuthorizeRequest handles GET /api/oauth/authorize for the consent page:
+// it checks the authorization request in the query and says which client
+// asks for what.
+func (h *OAuthHandler) AuthorizeRequest(w http.ResponseWriter, r *http.Request) {
+	a, ok := h.authorization(w, r)
+	if !ok {
+		return
+	}
+	if code, description := a.check(); code != "" {
+		writeJSON(w, AuthorizeResponse{RedirectTo: a.fail(h.Provider.Issuer, code, description)})
+		return
+	}
+	writeJSON(w, AuthorizeResponse{ClientID: a.client.ID, ClientName: a.client.Name, Scopes: a.scopes()})
+}
+
+// Consent handles POST /api/oauth/authorize with {"approve": bool} for the
+// request in the query, as the signed-in user. Either way the answer says
+// where to send the browser: back to the client with a code, or with
+// access_denied.
+func (h *OAuthHandler) Consent(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+	var input struct {
+		Approve bool `json:"approve"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	a, ok := h.authorization(w, r)
+	if !ok {
+		return
+	}
+	if code, description := a.check(); code != "" {
+		writeJSON(w, AuthorizeResponse{RedirectTo: a.fail(h.Provider.Issuer, code, description)})
+		return
+	}
+	if !input.Approve {
+		writeJSON(w, AuthorizeResponse{RedirectTo: a.fail(h.Provider.Issuer, "access_denied", "The user declined.")})
+		return
+	}
+
+	code, hash, err := oauth.NewSecret()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	err = h.Clients.CreateAuthorizationCode(r.Context(), email, store.AuthorizationCode{
+		Hash:          hash,
+		ClientID:      a.client.ID,
+		RedirectURI:   a.redirectURI,
+		Scopes:        a.scopes(),
+		Nonce:         a.params.Get("nonce"),
+		CodeChallenge: a.params.Get("code_challenge"),
+		AuthTime:      middleware.AuthFrom(r.Context()).Time,
+		ExpiresAt:     time.Now().Add(oauth.CodeTTL),
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, AuthorizeResponse{RedirectTo: a.redirect(h.Provider.Issuer, url.Values{"code": {code}})})
+}
+
+// oauthError answers an OAuth endpoint with an RFC 6749 error.
+func oauthError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": code, "error_description": description})
+}
+
+// authenticateClient returns the client calling r, which authenticates
+// with HTTP Basic or, failing that, with client_id and client_secret form
+// values. Public clients send only client_id. It answers invalid_client
+// when the client is unknown or its secret is wrong.
+func (h *OAuthHandler) authenticateClient(w http.ResponseWriter, r *http.Request) (*store.OAuthClient, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 has both form-encoded before they go in the header.
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := h.Clients.OAuthClient(r.Context(), id)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		slog.Error("loading OAuth client failed", "client_id", id, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return nil, false
+	}
+	if err != nil || (client.SecretHash != "" || secret != "") && !oauth.SecretMatches(secret, client.SecretHash) {
+		if basic {
+			w.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+		oauthError(w, http.StatusUnauthorized, "invalid_client", "Client authentication failed.")
+		return nil, false
+	}
+	return client, true
+}
+
+// postForm reads the form body of a POST to an endpoint clients call. It
+// answers the request when there is none.
+func postForm(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		oauthError(w, http.StatusMethodNotAllowed, "invalid_request", "Use POST.")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		oauthError(w, http.StatusBadRequest, "invalid_request", "The body must be form encoded.")
+		return false
+	}
+	return true
+}
+
+// Token handles POST /oauth/token for the authorization code, client
+// credentials and device code grants.
+func (h *OAuthHandler) Token(w http.ResponseWriter, r *http.Request) {
+	if !postForm(w, r) {
+		return
+	}
+	client, ok := h.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	grant := r.PostForm.Get("grant_type")
+	if !slices.Contains(oauth.GrantTypes, grant) {
+		oauthError(w, http.StatusBadRequest, "unsupported_grant_type", "Only "+strings.Join(oauth.GrantTypes, ", ")+" are supported.")
+		return
+	}
+	if !slices.Contains(client.GrantTypes, grant) {
+		oauthError(w, http.StatusBadRequest, "unauthorized_client", "This client may not use the "+grant+" grant.")
+		return
+	}
+	switch grant {
+	case oauth.GrantClientCredentials:
+		h.clientCredentials(w, r, client)
+	case oauth.GrantDeviceCode:
+		h.deviceCode(w, r, client)
+	default:
+		h.authorizationCode(w, r, client)
+	}
+}
+
+func (h *OAuthHandler) authorizationCode(w http.ResponseWriter, r *http.Request, client *store.OAuthClient) {
+	now := time.Now()
+	code, err := h.Clients.RedeemAuthorizationCode(r.Context(), oauth.Hash(r.PostForm.Get("code")), now)
+	switch {
+	case errors.Is(err, store.ErrNotFound), errors.Is(err, store.ErrTokenExpired):
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "The code is unknown, used or expired.")
+		return
+	case err != nil:
+		slog.Error("redeeming authorization code failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	if code.ClientID != client.ID || code.RedirectURI != r.PostForm.Get("redirect_uri") {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "The code was issued to another client or redirect_uri.")
+		return
+	}
+	if !oauth.VerifyPKCE(r.PostForm.Get("code_verifier"), code.CodeChallenge) {
+		oauthError(w, http.StatusBadRequest, "invalid_grant", "The code_verifier does not match the code_challenge.")
+		return
+	}
+
+	h.userTokens(w, r, client, code.UserID, code.Scopes, code.Nonce, code.AuthTime, now)
+}
+
+// userTokens answers a token request with what the user with userID
+// granted client: an access token and, with the openid scope, an ID token.
+func (h *OAuthHandler) userTokens(w http.ResponseWriter, r *http.Request, client *store.OAuthClient, userID int64, scopes []string, nonce string, authTime, now time.Time) {
+	user, err := h.Users.GetByID(r.Context(), userID)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			oauthError(w, http.StatusBadRequest, "invalid_grant", "The user no longer exists.")
+			return
+		}
+		slog.Error("loading user failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	resp, err := h.issue(oauth.Subject(user), client.ID, scopes, authTime, now)
+	if err == nil && slices.Contains(scopes, oauth.ScopeOpenID) {
+		claims := oauth.Claims(user, scopes, h.picture(user))
+		resp.IDToken, err = h.Provider.IDToken(client.ID, nonce, claims, authTime, now)
+	}
+	if err != nil {
+		slog.Error("signing tokens failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writeToken(w, resp)
+}
+
+// clientCredentials issues a token naming the client itself. Confidential
+// clients only: a public client has no secret to prove who it is. The
+// scopes are those asked for, or all of the client's but the user scopes.
+func (h *OAuthHandler) clientCredentials(w http.ResponseWriter, r *http.Request, client *store.OAuthClient) {
+	if client.SecretHash == "" {
+		oauthError(w, http.StatusBadRequest, "unauthorized_client", "Public clients cannot use the client_credentials grant.")
+		return
+	}
+	scopes := oauth.ParseScope(r.PostForm.Get("scope"))
+	if len(scopes) == 0 {
+		for _, s := range client.Scopes {
+			if !slices.Contains(oauth.UserScopes, s) {
+				scopes = append(scopes, s)
+			}
+		}
+	}
+	for _, s := range scopes {
+		if slices.Contains(oauth.UserScopes, s) || !slices.Contains(client.Scopes, s) {
+			oauthError(w, http.StatusBadRequest, "invalid_scope", "The scope "+s+" is not available to this client.")
+			return
+		}
+	}
+
+	resp, err := h.issue(client.ID, client.ID, scopes, time.Time{}, time.Now())
+	if err != nil {
+		slog.Error("signing tokens failed", "client_id", client.ID, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	writeToken(w, resp)
+}
+
+func (h *OAuthHandler) issue(subject, clientID string, scopes []string, authTime, now time.Time) (TokenResponse, error) {
+	token, err := h.Provider.AccessToken(subject, clientID, scopes, authTime, now)
+	return TokenResponse{
+		AccessToken: token,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(h.Provider.AccessTokenTTL / time.Second),
+		Scope:       oauth.FormatScope(scopes),
+	}, err
+}
+
+func writeToken(w http.ResponseWriter, resp TokenResponse) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	writeJSON(w, resp)
+}
+
+// picture is the URL of user's largest avatar, or "".
+func (h *OAuthHandler) picture(u *store.User) string {
+	if u.Avatar == "" {
+		return ""
+	}
+	return h.Provider.Issuer + "/api/avatars/" + avatar.Key(u.Avatar, avatar.Sizes[0])
+}
+
+// UserInfo handles GET and POST /oauth/userinfo, answering with the claims
+// the access token's scopes release. Tokens need the openid scope.
+func (h *OAuthHandler) UserInfo(w http.ResponseWriter, r *http.Request) {
+	bearerError := func(status int, code, description string) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="`+code+`", error_description="`+description+`"`)
+		oauthError(w, status, code, description)
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		oauthError(w, http.StatusUnauthorized, "invalid_token", "An access token is required.")
+		return
+	}
+	claims, err := h.accessToken(r.Context(), token)
+	if errors.Is(err, errInactiveToken) {
+		bearerError(http.StatusUnauthorized, "invalid_token", "The access token is not valid.")
+		return
+	}
+	if err != nil {
+		slog.Error("checking access token failed", "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	scopes := claims.Scopes()
+	if !slices.Contains(scopes, oauth.ScopeOpenID) {
+		bearerError(http.StatusForbidden, "insufficient_scope", "The access token lacks the openid scope.")
+		return
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	var user *store.User
+	if err == nil {
+		user, err = h.Users.GetByID(r.Context(), id)
+	}
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) || errors.Is(err, strconv.ErrSyntax) {
+			bearerError(http.StatusUnauthorized, "invalid_token", "The user no longer exists.")
+			return
+		}
+		slog.Error("loading user failed", "sub", claims.Subject, "error", err)
+		oauthError(w, http.StatusInternalServerError, "server_error", "")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, oauth.Claims(user, scopes, h.picture(user)))
+}
+
+// Discovery handles GET /.well-known/openid-configuration.
+func (h *OAuthHandler) Discovery(w http.ResponseWriter, r *http.Request) {
+	iss := h.Provider.Issuer
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, map[string]any{
+		"issuer":                                         iss,
+		"authorization_endpoint":                         iss + "/oauth/authorize",
+		"token_endpoint":                                 iss + "/oauth/token",
+		"userinfo_endpoint":                              iss + "/oauth/userinfo",
+		"jwks_uri":                                       iss + "/oauth/jwks",
+		"introspection_endpoint":                         iss + "/oauth/introspect",
+		"revocation_endpoint":                            iss + "/oauth/revoke",
+		"device_authorization_endpoint":                  iss + "/oauth/device/code",
+		"scopes_supported":                               oauth.UserScopes,
+		"response_types_supported":                       []string{"code"},
+		"grant_types_supported":                          oauth.GrantTypes,
+		"subject_types_supported":                        []string{"public"},
+		"id_token_signing_alg_values_supported":          []string{"RS256"},
+		"token_endpoint_auth_methods_supported":          []string{"client_secret_basic", "client_secret_post", "none"},
+		"introspection_endpoint_auth_methods_supported":  []string{"client_secret_basic", "client_secret_post"},
+		"revocation_endpoint_auth_methods_supported":     []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":               []string{"S256"},
+		"claims_supported":                               []string{"sub", "name", "picture", "email", "phone_number", "phone_number_verified"},
+		"authorization_response_iss_parameter_supported": true,
+	})
+}
+
+// JWKS handles GET /oauth/jwks, the keys tokens are signed with.
+func (h *OAuthHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	writeJSON(w, h.Provider.JWKS())
+}
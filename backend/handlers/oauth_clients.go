@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"ccz/oauth"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// OAuthClientHandler lets admins register the clients of the OAuth
+// provider. Every endpoint requires the admin role.
+type OAuthClientHandler struct {
+	Users   store.UserStore
+	Clients store.OAuthStore
+}
+
+// OAuthClientResponse describes a registered client. The secret is only in
+// the response that registers it; it cannot be read again.
+type OAuthClientResponse struct {
+	ID           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	Public       bool      `json:"public"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	GrantTypes   []string  `json:"grant_types"`
+	CreatedAt    time.Time `json:"created_at"`
+	Secret       string    `json:"client_secret,omitempty"`
+}
+
+// OAuthClientListResponse is every registered client, by name.
+type OAuthClientListResponse struct {
+	Clients []OAuthClientResponse `json:"clients"`
+}
+
+func oauthClientResponse(c store.OAuthClient) OAuthClientResponse {
+	return OAuthClientResponse{
+		ID:           c.ID,
+		Name:         c.Name,
+		Public:       c.SecretHash == "",
+		RedirectURIs: c.RedirectURIs,
+		Scopes:       c.Scopes,
+		GrantTypes:   c.GrantTypes,
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+// scopeToken is the form of a scope a client may be registered with: the
+// user scopes, and others for the client credentials grant.
+var scopeToken = regexp.MustCompile(`^[a-z][a-z0-9:._-]{0,63}$`)
+
+// List handles GET /api/admin/oauth/clients.
+func (h *OAuthClientHandler) List(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+	clients, err := h.Clients.OAuthClients(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	resp := OAuthClientListResponse{Clients: make([]OAuthClientResponse, 0, len(clients))}
+	for _, c := range clients {
+		resp.Clients = append(resp.Clients, oauthClientResponse(c))
+	}
+	writeJSON(w, resp)
+}
+
+// Create handles POST /api/admin/oauth/clients with {"name": "...",
+// "redirect_uris": [...], "scopes": [...], "grant_types": [...],
+// "public": bool} and answers 201 with the client id and, unless the
+// client is public, its secret.
+func (h *OAuthClientHandler) Create(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+
+	var input struct {
+		Name         string   `json:"name" validate:"trim,required,max=100"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		GrantTypes   []string `json:"grant_types"`
+		Public       bool     `json:"public"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	input.Scopes = slices.Compact(slices.Sorted(slices.Values(input.Scopes)))
+	input.GrantTypes = slices.Compact(slices.Sorted(slices.Values(input.GrantTypes)))
+
+	errs := validate.Errors{}
+	switch {
+	case len(input.GrantTypes) == 0:
+		errs.Add("grant_types", "Pick at least one grant type")
+	case slices.ContainsFunc(input.GrantTypes, func(g string) bool { return !slices.Contains(oauth.GrantTypes, g) }):
+		errs.Add("grant_types", "Grant types must be among "+strings.Join(oauth.GrantTypes, ", "))
+	case input.Public && slices.Contains(input.GrantTypes, oauth.GrantClientCredentials):
+		errs.Add("grant_types", "Public clients cannot use client_credentials")
+	}
+	switch {
+	case len(input.Scopes) == 0:
+		errs.Add("scopes", "Pick at least one scope")
+	case slices.ContainsFunc(input.Scopes, func(s string) bool { return !scopeToken.MatchString(s) }):
+		errs.Add("scopes", "Scopes are lowercase letters, digits and : . _ -")
+	case len(oauth.FormatScope(input.Scopes)) > 255:
+		errs.Add("scopes", "Too many scopes")
+	}
+	if slices.Contains(input.GrantTypes, oauth.GrantAuthorizationCode) && len(input.RedirectURIs) == 0 {
+		errs.Add("redirect_uris", "Clients using authorization_code need a redirect URI")
+	}
+	for _, uri := range input.RedirectURIs {
+		if msg := checkRedirectURI(uri); msg != "" {
+			errs.Add("redirect_uris", msg)
+			break
+		}
+	}
+	if !accepted(w, r, errs.Err()) {
+		return
+	}
+
+	id, err := oauth.NewClientID()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	c := store.OAuthClient{
+		ID:           id,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		GrantTypes:   input.GrantTypes,
+		CreatedAt:    time.Now().UTC().Truncate(time.Second),
+	}
+	var secret string
+	if !input.Public {
+		if secret, c.SecretHash, err = oauth.NewSecret(); err != nil {
+			serverError(w, r, err)
+			return
+		}
+	}
+	if err := h.Clients.CreateOAuthClient(r.Context(), &c); err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	resp := oauthClientResponse(c)
+	resp.Secret = secret
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Delete handles DELETE /api/admin/oauth/clients/{id}. Codes the client
+// has not redeemed and tokens it holds stop working.
+func (h *OAuthClientHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+	err := h.Clients.DeleteOAuthClient(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusNotFound, problem.ClientNotFound, "No OAuth client has this id.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkRedirectURI returns what is wrong with uri as a redirect URI, or "".
+// They must be absolute, without a fragment, and use https unless they
+// point at the loopback interface, as native apps' do (RFC 8252).
+func checkRedirectURI(uri string) string {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Host == "" || strings.ContainsAny(uri, " \t\n") {
+		return "Redirect URIs must be absolute URLs"
+	}
+	if u.Fragment != "" || strings.Contains(uri, "#") {
+		return "Redirect URIs cannot have a fragment"
+	}
+	host := u.Hostname()
+	loopback := host == "localhost"
+	if ip := net.ParseIP(host); ip != nil {
+		loopback = ip.IsLoopback()
+	}
+	if u.Scheme != "https" && !(u.Scheme == "http" && loopback) {
+		return "Redirect URIs must use https, or http on localhost"
+	}
+	return ""
+}
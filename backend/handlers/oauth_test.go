@@ -0,0 +1,437 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testProvider(t *testing.T) *oauth.Provider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return oauth.NewProvider("https://id.ex.com", key)
+}
+
+func TestOAuthHandler(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "http://localhost:8080")
+	st := newProfileStore(t)
+	ctx := context.Background()
+	h := &OAuthHandler{Users: st, Clients: st, Provider: testProvider(t)}
+
+	secret, hash, err := oauth.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []store.OAuthClient{
+		{ID: "wiki", Name: "Wiki", SecretHash: hash, RedirectURIs: []string{"https://wiki.ex.com/cb"},
+			Scopes: []string{"openid", "profile", "email", "reports:read"}, GrantTypes: []string{"authorization_code", "client_credentials"}},
+		{ID: "cli", Name: "CLI", RedirectURIs: []string{"http://127.0.0.1/cb"},
+			Scopes: []string{"openid"}, GrantTypes: []string{"authorization_code"}},
+	} {
+		if err := st.CreateOAuthClient(ctx, &c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	verifier := strings.Repeat("v", 43)
+	sum := sha256.Sum256([]byte(verifier))
+	challenge := base64.RawURLEncoding.EncodeToString(sum[:])
+	request := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"wiki"},
+		"redirect_uri":          {"https://wiki.ex.com/cb"},
+		"scope":                 {"openid email"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6"},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	with := func(changes map[string]string) url.Values {
+		q := url.Values{}
+		for k, v := range request {
+			q[k] = v
+		}
+		for k, v := range changes {
+			q.Set(k, v)
+		}
+		return q
+	}
+	authTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+
+	// consent posts the user's decision on the request in q.
+	consent := func(q url.Values, approve bool) *httptest.ResponseRecorder {
+		body := `{"approve":false}`
+		if approve {
+			body = `{"approve":true}`
+		}
+		r := withUser(httptest.NewRequest(http.MethodPost, "/api/oauth/authorize?"+q.Encode(), strings.NewReader(body)), "test@ex.com")
+		auth := middleware.Auth{Time: authTime, Methods: []string{middleware.MethodPassword}}
+		r = r.WithContext(context.WithValue(r.Context(), middleware.AuthKey, auth))
+		w := httptest.NewRecorder()
+		h.Consent(w, r)
+		return w
+	}
+	redirectTo := func(t *testing.T, w *httptest.ResponseRecorder) url.Values {
+		t.Helper()
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp AuthorizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(resp.RedirectTo)
+		if err != nil || !strings.HasPrefix(resp.RedirectTo, "https://wiki.ex.com/cb?") {
+			t.Fatalf("expected a redirect to the client, got %q", resp.RedirectTo)
+		}
+		return u.Query()
+	}
+	token := func(form url.Values, basic bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if basic {
+			r.SetBasicAuth("wiki", secret)
+		}
+		w := httptest.NewRecorder()
+		h.Token(w, r)
+		return w
+	}
+	oauthErr := func(w *httptest.ResponseRecorder) string {
+		var resp struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(w.Body).Decode(&resp)
+		return resp.Error
+	}
+	// grant runs the request through consent and returns the code.
+	grant := func(t *testing.T) string {
+		t.Helper()
+		q := redirectTo(t, consent(request, true))
+		if q.Get("state") != "xyz" || q.Get("iss") != "https://id.ex.com" || q.Get("code") == "" {
+			t.Fatalf("unexpected redirect %v", q)
+		}
+		return q.Get("code")
+	}
+	exchange := url.Values{"grant_type": {"authorization_code"}, "redirect_uri": {"https://wiki.ex.com/cb"}, "code_verifier": {verifier}}
+	withCode := func(code string, changes map[string]string) url.Values {
+		form := url.Values{"code": {code}}
+		for k, v := range exchange {
+			form[k] = v
+		}
+		for k, v := range changes {
+			form.Set(k, v)
+		}
+		return form
+	}
+
+	t.Run("Authorize", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.Authorize(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+request.Encode(), nil))
+		if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "http://localhost:8080/oauth/consent?") {
+			t.Errorf("expected a redirect to the consent page, got %d %q", w.Code, w.Header().Get("Location"))
+		}
+
+		for name, q := range map[string]url.Values{
+			"Unknown Client":   with(map[string]string{"client_id": "nope"}),
+			"Unknown Redirect": with(map[string]string{"redirect_uri": "https://evil.ex.com/cb"}),
+		} {
+			w := httptest.NewRecorder()
+			h.Authorize(w, httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+q.Encode(), nil))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400 rather than a redirect, got %d", name, w.Code)
+			}
+		}
+	})
+
+	t.Run("Authorize Request", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.AuthorizeRequest(w, withUser(httptest.NewRequest(http.MethodGet, "/api/oauth/authorize?"+request.Encode(), nil), "test@ex.com"))
+		var resp AuthorizeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ClientName != "Wiki" || strings.Join(resp.Scopes, " ") != "openid email" || resp.RedirectTo != "" {
+			t.Errorf("unexpected response %+v", resp)
+		}
+	})
+
+	t.Run("Refused Requests", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			changes map[string]string
+			error   string
+		}{
+			{"No PKCE", map[string]string{"code_challenge": ""}, "invalid_request"},
+			{"Plain PKCE", map[string]string{"code_challenge_method": "plain"}, "invalid_request"},
+			{"Token Response", map[string]string{"response_type": "token"}, "unsupported_response_type"},
+			{"Unregistered Scope", map[string]string{"scope": "openid phone"}, "invalid_scope"},
+			{"Client Scope", map[string]string{"scope": "openid reports:read"}, "invalid_scope"},
+			{"No Scope", map[string]string{"scope": ""}, "invalid_scope"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				q := redirectTo(t, consent(with(tc.changes), true))
+				if q.Get("error") != tc.error || q.Get("code") != "" || q.Get("state") != "xyz" {
+					t.Errorf("expected %s, got %v", tc.error, q)
+				}
+			})
+		}
+	})
+
+	t.Run("Denied", func(t *testing.T) {
+		if q := redirectTo(t, consent(request, false)); q.Get("error") != "access_denied" || q.Get("code") != "" {
+			t.Errorf("expected access_denied, got %v", q)
+		}
+	})
+
+	t.Run("Authorization Code", func(t *testing.T) {
+		code := grant(t)
+		w := token(withCode(code, nil), true)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w.Header().Get("Cache-Control") != "no-store" {
+			t.Error("expected the tokens not to be cached")
+		}
+		var resp TokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.TokenType != "Bearer" || resp.Scope != "openid email" || resp.ExpiresIn != 3600 || resp.IDToken == "" {
+			t.Fatalf("unexpected response %+v", resp)
+		}
+
+		user, err := st.GetByEmail(ctx, "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims := jwt.MapClaims{}
+		_, err = jwt.ParseWithClaims(resp.IDToken, claims, func(*jwt.Token) (any, error) { return &h.Provider.Key.PublicKey, nil },
+			jwt.WithAudience("wiki"), jwt.WithIssuer("https://id.ex.com"))
+		if err != nil {
+			t.Fatalf("expected a valid ID token: %v", err)
+		}
+		if claims["sub"] != oauth.Subject(user) || claims["email"] != "test@ex.com" || claims["nonce"] != "n-0S6" ||
+			claims["auth_time"] != float64(authTime.Unix()) || claims["name"] != nil {
+			t.Errorf("unexpected ID token claims %v", claims)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+		w = httptest.NewRecorder()
+		h.UserInfo(w, r)
+		var info map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || info["sub"] != oauth.Subject(user) || info["email"] != "test@ex.com" || info["name"] != nil {
+			t.Errorf("unexpected userinfo %d %v", w.Code, info)
+		}
+
+		if w := token(withCode(code, nil), true); w.Code != http.StatusBadRequest || oauthErr(w) != "invalid_grant" {
+			t.Errorf("expected a used code to be refused, got %d", w.Code)
+		}
+	})
+
+	t.Run("Refused Exchanges", func(t *testing.T) {
+		for _, tc := range []struct {
+			name    string
+			changes map[string]string
+			basic   bool
+			status  int
+			error   string
+		}{
+			{"Wrong Verifier", map[string]string{"code_verifier": strings.Repeat("w", 43)}, true, http.StatusBadRequest, "invalid_grant"},
+			{"Wrong Redirect", map[string]string{"redirect_uri": "https://wiki.ex.com/other"}, true, http.StatusBadRequest, "invalid_grant"},
+			{"Wrong Secret", map[string]string{"client_id": "wiki", "client_secret": "nope"}, false, http.StatusUnauthorized, "invalid_client"},
+			{"Other Client", map[string]string{"client_id": "cli"}, false, http.StatusBadRequest, "invalid_grant"},
+			{"Unknown Grant", map[string]string{"grant_type": "password"}, true, http.StatusBadRequest, "unsupported_grant_type"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				w := token(withCode(grant(t), tc.changes), tc.basic)
+				if w.Code != tc.status || oauthErr(w) != tc.error {
+					t.Errorf("expected %d %s, got %d: %s", tc.status, tc.error, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Client Credentials", func(t *testing.T) {
+		w := token(url.Values{"grant_type": {"client_credentials"}}, true)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp TokenResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Scope != "reports:read" || resp.IDToken != "" {
+			t.Errorf("expected the client's own scopes and no ID token, got %+v", resp)
+		}
+		claims, err := h.Provider.ParseAccessToken(resp.AccessToken)
+		if err != nil || claims.Subject != "wiki" {
+			t.Errorf("expected a token naming the client, got %+v, %v", claims, err)
+		}
+
+		r := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+		r.Header.Set("Authorization", "Bearer "+resp.AccessToken)
+		w = httptest.NewRecorder()
+		h.UserInfo(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected userinfo to need openid, got %d", w.Code)
+		}
+
+		if w := token(url.Values{"grant_type": {"client_credentials"}, "scope": {"openid"}}, true); oauthErr(w) != "invalid_scope" {
+			t.Errorf("expected user scopes to be refused, got %s", w.Body.String())
+		}
+		public := url.Values{"grant_type": {"client_credentials"}, "client_id": {"cli"}}
+		if w := token(public, false); oauthErr(w) != "unauthorized_client" {
+			t.Errorf("expected a public client to be refused, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("UserInfo Refused", func(t *testing.T) {
+		for name, header := range map[string]string{
+			"Missing":    "",
+			"Session":    "Bearer " + testToken(t, "test@ex.com"),
+			"Mangled":    "Bearer abc.def.ghi",
+			"Not Bearer": "Basic abc",
+		} {
+			r := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+			if header != "" {
+				r.Header.Set("Authorization", header)
+			}
+			w := httptest.NewRecorder()
+			h.UserInfo(w, r)
+			if w.Code != http.StatusUnauthorized || !strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Bearer") {
+				t.Errorf("%s: expected 401 with a Bearer challenge, got %d", name, w.Code)
+			}
+		}
+	})
+}
+
+func testToken(t *testing.T, email string) string {
+	t.Helper()
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"email": email, "exp": time.Now().Add(time.Hour).Unix()}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestOAuthClientHandler(t *testing.T) {
+	st := newProfileStore(t)
+	h := &OAuthClientHandler{Users: st, Clients: st}
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(email, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.Create(w, withUser(httptest.NewRequest(http.MethodPost, "/api/admin/oauth/clients", strings.NewReader(body)), email))
+		return w
+	}
+
+	t.Run("Requires Admin", func(t *testing.T) {
+		w := create("test@ex.com", `{"name":"Wiki","redirect_uris":["https://wiki.ex.com/cb"],"scopes":["openid"],"grant_types":["authorization_code"]}`)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, body, field string
+		}{
+			{"No Grant", `{"name":"x","scopes":["openid"],"grant_types":[]}`, "grant_types"},
+			{"Unknown Grant", `{"name":"x","scopes":["openid"],"grant_types":["password"]}`, "grant_types"},
+			{"Public Machine", `{"name":"x","scopes":["jobs"],"grant_types":["client_credentials"],"public":true}`, "grant_types"},
+			{"No Redirect", `{"name":"x","scopes":["openid"],"grant_types":["authorization_code"]}`, "redirect_uris"},
+			{"Plain HTTP", `{"name":"x","redirect_uris":["http://wiki.ex.com/cb"],"scopes":["openid"],"grant_types":["authorization_code"]}`, "redirect_uris"},
+			{"Fragment", `{"name":"x","redirect_uris":["https://wiki.ex.com/cb#a"],"scopes":["openid"],"grant_types":["authorization_code"]}`, "redirect_uris"},
+			{"Bad Scope", `{"name":"x","scopes":["Open ID"],"grant_types":["client_credentials"]}`, "scopes"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				w := create("admin@ex.com", tc.body)
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"`+tc.field+`"`) {
+					t.Errorf("expected an error on %s, got %d: %s", tc.field, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Create And Delete", func(t *testing.T) {
+		w := create("admin@ex.com", `{"name":"CLI","redirect_uris":["http://127.0.0.1:7777/cb"],"scopes":["openid"],"grant_types":["authorization_code"],"public":true}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var public OAuthClientResponse
+		if err := json.NewDecoder(w.Body).Decode(&public); err != nil {
+			t.Fatal(err)
+		}
+		if !public.Public || public.Secret != "" || public.ID == "" {
+			t.Errorf("expected a public client without a secret, got %+v", public)
+		}
+
+		w = create("admin@ex.com", `{"name":"Reports","scopes":["reports:read"],"grant_types":["client_credentials"]}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var confidential OAuthClientResponse
+		if err := json.NewDecoder(w.Body).Decode(&confidential); err != nil {
+			t.Fatal(err)
+		}
+		stored, err := st.OAuthClient(ctx, confidential.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !oauth.SecretMatches(confidential.Secret, stored.SecretHash) {
+			t.Error("expected only the hash of the secret to be stored")
+		}
+
+		w = httptest.NewRecorder()
+		h.List(w, withUser(httptest.NewRequest(http.MethodGet, "/api/admin/oauth/clients", nil), "admin@ex.com"))
+		var list OAuthClientListResponse
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Clients) != 2 || list.Clients[0].Name != "CLI" || list.Clients[1].Secret != "" {
+			t.Errorf("expected both clients without secrets, got %+v", list.Clients)
+		}
+
+		del := func(id string) int {
+			mux := http.NewServeMux()
+			mux.HandleFunc("DELETE /api/admin/oauth/clients/{id}", h.Delete)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, withUser(httptest.NewRequest(http.MethodDelete, "/api/admin/oauth/clients/"+id, nil), "admin@ex.com"))
+			return w.Code
+		}
+		if code := del(public.ID); code != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", code)
+		}
+		if code := del(public.ID); code != http.StatusNotFound {
+			t.Errorf("expected 404 once deleted, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"ccz/middleware"
+	"ccz/phone"
+	"ccz/problem"
+	"ccz/sms"
+	"ccz/store"
+)
+
+type PhoneHandler struct {
+	Users  store.UserStore
+	Phones store.PhoneStore
+	SMS    sms.Sender
+}
+
+// phoneCodeTTL is how long a code can be entered after it was sent.
+const phoneCodeTTL = 10 * time.Minute
+
+var phoneLimits = store.PhoneLimits{
+	ResendAfter: time.Minute,
+	MaxSends:    5,
+	Window:      time.Hour,
+	MaxAttempts: 5,
+}
+
+type PhoneChallengeResponse struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	// ResendAfter is how many seconds to wait before asking for another
+	// code.
+	ResendAfter int `json:"resend_after"`
+}
+
+// newPhoneCode returns six random digits.
+func newPhoneCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+// phoneCodeHash binds a code to the number it was sent to, so it cannot
+// verify any other.
+func phoneCodeHash(telephone, code string) string {
+	sum := sha256.Sum256([]byte(telephone + ":" + code))
+	return hex.EncodeToString(sum[:])
+}
+
+// Request texts a new code to the caller's telephone.
+func (h *PhoneHandler) Request(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+	switch {
+	case user.Telephone == "":
+		problem.Error(w, r, http.StatusBadRequest, problem.TelephoneRequired, "Add a telephone number before verifying it.")
+		return
+	case !user.TelephoneVerifiedAt.IsZero():
+		problem.Error(w, r, http.StatusConflict, problem.AlreadyVerified, "The telephone is already verified.")
+		return
+	}
+	// Numbers saved before they were normalized may not be diallable.
+	if _, err := phone.Parse(user.Telephone, ""); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.TelephoneRequired, "Save the telephone number with its country code before verifying it.")
+		return
+	}
+
+	code, err := newPhoneCode()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	challenge := store.PhoneChallenge{
+		Telephone: user.Telephone,
+		CodeHash:  phoneCodeHash(user.Telephone, code),
+		SentAt:    now,
+		ExpiresAt: now.Add(phoneCodeTTL),
+	}
+	retryAfter, err := h.Phones.StartPhoneChallenge(r.Context(), email, challenge, phoneLimits)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrThrottled):
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			problem.Error(w, r, http.StatusTooManyRequests, problem.Throttled, "Too many codes were requested. Try again later.")
+		case errors.Is(err, store.ErrNotFound):
+			userNotFound(w, r)
+		default:
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	body := fmt.Sprintf("%s is your verification code. It expires in %d minutes.", code, int(phoneCodeTTL.Minutes()))
+	if err := h.SMS.Send(r.Context(), user.Telephone, body); err != nil {
+		slog.Error("sending verification code failed", "error", err)
+		problem.Error(w, r, http.StatusBadGateway, problem.DeliveryFailed, "The code could not be sent. Try again later.")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(PhoneChallengeResponse{
+		ExpiresAt:   challenge.ExpiresAt,
+		ResendAfter: int(phoneLimits.ResendAfter.Seconds()),
+	})
+}
+
+// Confirm checks the code from the body {"code": "123456"} and marks the
+// caller's telephone verified when it matches.
+func (h *PhoneHandler) Confirm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	var input struct {
+		Code string `json:"code" validate:"trim,required,len=6,digits" message:"Enter the 6-digit code"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	code := input.Code
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+
+	err = h.Phones.ConfirmPhone(r.Context(), email, phoneCodeHash(user.Telephone, code), phoneLimits, time.Now())
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, store.ErrCodeMismatch):
+		fieldErrors(w, r, map[string]string{"code": "Incorrect code"})
+	case errors.Is(err, store.ErrCodeExpired):
+		fieldErrors(w, r, map[string]string{"code": "The code has expired, request a new one"})
+	case errors.Is(err, store.ErrNotFound):
+		// The user exists, so no code is pending for their number.
+		fieldErrors(w, r, map[string]string{"code": "No code was sent to this number, request one first"})
+	case errors.Is(err, store.ErrTooManyAttempts):
+		problem.Error(w, r, http.StatusTooManyRequests, problem.TooManyAttempts, "Too many incorrect codes. Request a new one.")
+	default:
+		serverError(w, r, err)
+	}
+}
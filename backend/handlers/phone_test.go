@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"ccz/store"
+	"ccz/store/storetest"
+)
+
+// outbox records messages instead of sending them.
+type outbox struct {
+	to, body string
+	err      error
+}
+
+func (o *outbox) Send(ctx context.Context, to, body string) error {
+	o.to, o.body = to, body
+	return o.err
+}
+
+func (o *outbox) code() string {
+	code, _, _ := strings.Cut(o.body, " ")
+	return code
+}
+
+func TestPhoneHandler(t *testing.T) {
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	sent := &outbox{}
+	h := &PhoneHandler{Users: st, Phones: st, SMS: sent}
+
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.Request(w, withUser(httptest.NewRequest(http.MethodPost, "/api/profile/telephone/verify", nil), "test@ex.com"))
+		return w
+	}
+	confirm := func(code string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"code":"` + code + `"}`)
+		w := httptest.NewRecorder()
+		h.Confirm(w, withUser(httptest.NewRequest(http.MethodPost, "/api/profile/telephone/confirm", body), "test@ex.com"))
+		return w
+	}
+
+	t.Run("No Telephone", func(t *testing.T) {
+		if w := request(); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Test", Telephone: "+14155550132"}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Request", func(t *testing.T) {
+		w := request()
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp PhoneChallengeResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ResendAfter != 60 || resp.ExpiresAt.IsZero() {
+			t.Errorf("unexpected response %+v", resp)
+		}
+		if sent.to != "+14155550132" || len(sent.code()) != 6 {
+			t.Errorf("unexpected message to %s: %q", sent.to, sent.body)
+		}
+	})
+
+	t.Run("Resend Too Soon", func(t *testing.T) {
+		w := request()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("expected 429, got %d", w.Code)
+		}
+		if ra := w.Header().Get("Retry-After"); ra == "" || ra == "0" {
+			t.Errorf("expected a Retry-After header, got %q", ra)
+		}
+	})
+
+	t.Run("Wrong Code", func(t *testing.T) {
+		wrong := "000000"
+		if sent.code() == wrong {
+			wrong = "111111"
+		}
+		w := confirm(wrong)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"code"`) {
+			t.Errorf("expected a code field error, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := confirm("12ab"); w.Code != http.StatusBadRequest {
+			t.Errorf("malformed code: expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Confirm", func(t *testing.T) {
+		if w := confirm(sent.code()); w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+		}
+		user, err := st.GetByEmail(ctx, "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.TelephoneVerifiedAt.IsZero() {
+			t.Error("expected the telephone to be verified")
+		}
+
+		w := httptest.NewRecorder()
+		writeProfile(w, user, nil)
+		var resp ProfileResponse
+		json.NewDecoder(w.Body).Decode(&resp)
+		if !resp.TelephoneVerified || resp.TelephoneVerifiedAt == nil {
+			t.Errorf("expected the profile to show verification, got %+v", resp)
+		}
+
+		if w := request(); w.Code != http.StatusConflict {
+			t.Errorf("already verified: expected 409, got %d", w.Code)
+		}
+	})
+
+	t.Run("Too Many Attempts", func(t *testing.T) {
+		if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Test", Telephone: "+442079460018"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		// A new number gets a new code at once.
+		if w := request(); w.Code != http.StatusAccepted {
+			t.Fatalf("expected 202, got %d", w.Code)
+		}
+		right := sent.code()
+		wrong := "000000"
+		if right == wrong {
+			wrong = "111111"
+		}
+		var w *httptest.ResponseRecorder
+		for i := 0; i < phoneLimits.MaxAttempts; i++ {
+			w = confirm(wrong)
+		}
+		if w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected 429 after %d wrong codes, got %d", phoneLimits.MaxAttempts, w.Code)
+		}
+		if w := confirm(right); w.Code != http.StatusTooManyRequests {
+			t.Errorf("expected the right code to be refused too, got %d", w.Code)
+		}
+	})
+
+	t.Run("Delivery Failure", func(t *testing.T) {
+		if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Test", Telephone: "+14155550132"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		sent.err = errors.New("provider down")
+		defer func() { sent.err = nil }()
+		if w := request(); w.Code != http.StatusBadGateway {
+			t.Errorf("expected 502, got %d", w.Code)
+		}
+	})
+}
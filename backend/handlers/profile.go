@@ -1,92 +1,760 @@
 package handlers
 
 import (
-	"database/sql"
+	"cmp"
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"ccz/middleware"
+	"ccz/pat"
+	"ccz/phone"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
 )
 
 type ProfileHandler struct {
-	DB *sql.DB
+	Users  store.UserStore
+	Schema store.SchemaStore
 }
 
 type ProfileResponse struct {
-	FullName      string `json:"full_name"`
-	Telephone     string `json:"telephone"`
-	Email         string `json:"email"`
-	EmailDisabled bool   `json:"email_disabled"`
+	FullName  string `json:"full_name"`
+	Telephone string `json:"telephone"`
+	// TelephoneDisplay is the national format of the number.
+	// TelephoneInternational and TelephoneRegion are only set for numbers
+	// stored in E.164.
+	TelephoneDisplay       string     `json:"telephone_display"`
+	TelephoneInternational string     `json:"telephone_international,omitempty"`
+	TelephoneRegion        string     `json:"telephone_region,omitempty"`
+	TelephoneVerified      bool       `json:"telephone_verified"`
+	TelephoneVerifiedAt    *time.Time `json:"telephone_verified_at,omitempty"`
+	Email                  string     `json:"email"`
+	EmailDisabled          bool       `json:"email_disabled"`
+	// HasPassword is false until a user who signs in with Google sets a
+	// password.
+	HasPassword bool              `json:"has_password"`
+	Avatar      map[string]string `json:"avatar,omitempty"`
+	Version     int64             `json:"version"`
+	Attributes  map[string]any    `json:"attributes"`
 }
 
 func (h *ProfileHandler) View(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.Header().Set("Allow", http.MethodGet)
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		methodNotAllowed(w, r)
 		return
 	}
 
 	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
 	if !ok || email == "" {
-		http.Error(w, "Unauthorized: Identity not found", http.StatusUnauthorized)
+		unauthenticated(w, r)
 		return
 	}
 
-	var resp ProfileResponse
-	query := "SELECT COALESCE(full_name, ''), COALESCE(telephone, ''), email FROM users WHERE email=?"
-	err := h.DB.QueryRowContext(r.Context(), query, email).
-		Scan(&resp.FullName, &resp.Telephone, &resp.Email)
-
+	// ?at=<RFC 3339 time> shows the profile as it stood at that moment.
+	var (
+		user *store.User
+		err  error
+	)
+	if at := r.URL.Query().Get("at"); at != "" {
+		t, parseErr := time.Parse(time.RFC3339, at)
+		if parseErr != nil {
+			problem.Error(w, r, http.StatusBadRequest, problem.InvalidParameter, "at must be an RFC 3339 time.")
+			return
+		}
+		user, err = h.Users.ProfileAt(r.Context(), email, t)
+	} else {
+		user, err = h.Users.GetByEmail(r.Context(), email)
+	}
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "User profile not found", http.StatusNotFound)
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
 		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			serverError(w, r, err)
 		}
 		return
 	}
 
-	resp.EmailDisabled = true
-
-	w.Header().Set("Content-Type", "application/json")
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+	// Only the current profile is versioned; historical views are not
+	// cached or used for conditional saves, and leave out custom attributes.
+	if r.URL.Query().Get("at") != "" {
+		writeProfile(w, user, nil)
+		return
 	}
+	etag := profileETag(user.Version)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if inm := r.Header.Get("If-None-Match"); inm != "" && noneMatch(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.respond(w, r, user)
 }
 
+// Save backs the deprecated POST/PUT /api/profile/save alias. It replaces
+// the profile like Replace but keeps attributes missing from the body, and
+// answers with an empty body.
 func (h *ProfileHandler) Save(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost && r.Method != http.MethodPut {
 		w.Header().Set("Allow", "POST, PUT")
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r)
+		return
+	}
+	if _, ok := h.replace(w, r, false); ok {
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// Replace handles PUT /api/profile: the body is the complete editable
+// profile, so an omitted telephone is cleared. When the body has an
+// attributes object, editable attributes missing from it are cleared too.
+func (h *ProfileHandler) Replace(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		w.Header().Set("Allow", http.MethodPut)
+		methodNotAllowed(w, r)
 		return
 	}
+	if user, ok := h.replace(w, r, true); ok {
+		h.respond(w, r, user)
+	}
+}
 
+func (h *ProfileHandler) replace(w http.ResponseWriter, r *http.Request, replaceAttributes bool) (*store.User, bool) {
 	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
 	if !ok || email == "" {
-		http.Error(w, "Unauthorized: Identity not found", http.StatusUnauthorized)
+		unauthenticated(w, r)
+		return nil, false
+	}
+
+	var input struct {
+		profileFields
+		Attributes map[string]json.RawMessage `json:"attributes"`
+	}
+	if !accepted(w, r, validate.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), &input)) {
+		return nil, false
+	}
+
+	// Every field is checked before answering, so a form can mark all
+	// of its bad inputs at once.
+	errs := validate.Errors{}
+	errs.Check(&input.profileFields)
+	telephone := normalizeTelephone(r, input.Telephone, errs)
+	update := store.ProfileUpdate{FullName: input.FullName, Telephone: telephone}
+	if input.Attributes != nil {
+		if update.Attributes, ok = h.attributeChanges(w, r, email, input.Attributes, replaceAttributes, errs); !ok {
+			return nil, false
+		}
+	}
+	if len(errs) > 0 {
+		fieldErrors(w, r, errs)
+		return nil, false
+	}
+
+	ifVersions, ok := ifMatch(w, r)
+	if !ok {
+		return nil, false
+	}
+	// The store checks one version as it writes, so a header listing any
+	// is narrowed to the current one when that is among them.
+	var ifVersion int64
+	if ifVersions != nil {
+		current, err := h.Users.GetByEmail(r.Context(), email)
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+			return nil, false
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return nil, false
+		}
+		if !slices.Contains(ifVersions, current.Version) {
+			versionMismatch(w, r)
+			return nil, false
+		}
+		ifVersion = current.Version
+	}
+
+	change := store.Change{Actor: email, IP: middleware.ClientIP(r), Source: store.SourceProfile, IfVersion: ifVersion}
+	err := h.Users.UpdateProfile(r.Context(), email, update, change)
+	if !h.updated(w, r, err) {
+		return nil, false
+	}
+	return h.reload(w, r, email)
+}
+
+// maxPatchAttempts bounds how often an unconditional PATCH re-reads the
+// profile after losing a race with another writer.
+const maxPatchAttempts = 3
+
+// Patch handles PATCH /api/profile with an RFC 7396 JSON Merge Patch:
+// members that are absent stay untouched and null clears a field. The
+// attributes member is merged the same way, one attribute at a time.
+func (h *ProfileHandler) Patch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		w.Header().Set("Allow", http.MethodPatch)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != mergePatchType {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		problem.Error(w, r, http.StatusUnsupportedMediaType, problem.UnsupportedMedia, "Content-Type must be "+mergePatchType+".")
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := validate.DecodeJSON(http.MaxBytesReader(w, r.Body, maxBodyBytes), &patch); err != nil || patch == nil {
+		accepted(w, r, cmp.Or(err, validate.ErrBody))
+		return
+	}
+
+	// attributes: null clears every attribute the caller may edit.
+	attrPatch, patchesAttrs := patch["attributes"]
+	delete(patch, "attributes")
+	var attrInput map[string]json.RawMessage
+	if patchesAttrs {
+		if err := json.Unmarshal(attrPatch, &attrInput); err != nil {
+			fieldErrors(w, r, map[string]string{"attributes": "attributes must be an object"})
+			return
+		}
+	}
+
+	ifVersions, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	// The patch applies to whatever is stored when the write lands, so the
+	// write is conditional on the version it was merged against. Without
+	// If-Match a lost race is simply retried on the fresh profile.
+	for attempt := 1; ; attempt++ {
+		current, err := h.Users.GetByEmail(r.Context(), email)
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+			return
+		}
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		if ifVersions != nil && !slices.Contains(ifVersions, current.Version) {
+			versionMismatch(w, r)
+			return
+		}
+
+		errs := validate.Errors{}
+		fields := mergeProfile(current, patch, errs)
+		// A stored number is kept as it is, even one saved before numbers
+		// were validated; only a patched one is checked.
+		if _, patched := patch["telephone"]; patched {
+			fields.Telephone = normalizeTelephone(r, fields.Telephone, errs)
+		}
+
+		update := store.ProfileUpdate{FullName: fields.FullName, Telephone: fields.Telephone}
+		if patchesAttrs {
+			if update.Attributes, ok = h.attributeChanges(w, r, email, attrInput, attrInput == nil, errs); !ok {
+				return
+			}
+		}
+		if len(errs) > 0 {
+			fieldErrors(w, r, errs)
+			return
+		}
+
+		change := store.Change{Actor: email, IP: middleware.ClientIP(r), Source: store.SourceProfile, IfVersion: current.Version}
+		err = h.Users.UpdateProfile(r.Context(), email, update, change)
+		if errors.Is(err, store.ErrVersionMismatch) && ifVersions == nil && attempt < maxPatchAttempts {
+			continue
+		}
+		if !h.updated(w, r, err) {
+			return
+		}
+		break
+	}
+
+	if user, ok := h.reload(w, r, email); ok {
+		h.respond(w, r, user)
+	}
+}
+
+const mergePatchType = "application/merge-patch+json"
+
+// profileFields are the profile fields users edit, limited to the sizes
+// of their columns. The telephone limit applies to the number as typed.
+type profileFields struct {
+	FullName  string `json:"full_name" validate:"trim,required,max=255"`
+	Telephone string `json:"telephone" validate:"trim,max=50"`
+}
+
+// mergeProfile applies a merge patch to the editable profile fields,
+// adding what is wrong with the patched members to errs. Stored values
+// the patch leaves alone are not re-checked.
+func mergeProfile(current *store.User, patch map[string]json.RawMessage, errs validate.Errors) profileFields {
+	fields := profileFields{FullName: current.FullName, Telephone: current.Telephone}
+	for member, raw := range patch {
+		var err error
+		switch member {
+		case "full_name":
+			fields.FullName = ""
+			if string(raw) != "null" {
+				err = json.Unmarshal(raw, &fields.FullName)
+			}
+		case "telephone":
+			fields.Telephone = ""
+			if string(raw) != "null" {
+				err = json.Unmarshal(raw, &fields.Telephone)
+			}
+		default:
+			errs.Add(member, validate.Label(member)+" cannot be changed")
+			continue
+		}
+		if err != nil {
+			errs.Add(member, validate.Label(member)+" must be a string")
+		}
+	}
+	checked := validate.Errors{}
+	checked.Check(&fields)
+	for field, msg := range checked {
+		if _, patched := patch[field]; patched {
+			errs.Add(field, msg)
+		}
+	}
+	return fields
+}
+
+// normalizeTelephone turns a number as typed into E.164. Numbers without a
+// country code are read as numbers of the region in the caller's
+// Accept-Language, else PHONE_DEFAULT_REGION, else the US. Empty input
+// clears the number. What is wrong with a number that is not valid is
+// added to errs.
+func normalizeTelephone(r *http.Request, raw string, errs validate.Errors) string {
+	if strings.TrimSpace(raw) == "" {
+		return ""
+	}
+	n, err := phone.Parse(raw, defaultRegion(r))
+	if err != nil {
+		errs.Add("telephone", strings.TrimPrefix(err.Error(), "phone: "))
+		return ""
+	}
+	return n.E164()
+}
+
+func defaultRegion(r *http.Request) string {
+	if region := phone.RegionFromLanguage(r.Header.Get("Accept-Language")); region != "" {
+		return region
+	}
+	if region := os.Getenv("PHONE_DEFAULT_REGION"); phone.KnownRegion(region) {
+		return region
+	}
+	return "US"
+}
+
+// ifMatch reads the versions an If-Match header makes a write conditional
+// on, nil when there is none or it is "*". The write may go ahead when the
+// current version is any of them (RFC 9110 section 13.1.1). An unusable
+// header can never match, so it is answered with 412 and ok is false.
+func ifMatch(w http.ResponseWriter, r *http.Request) ([]int64, bool) {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return nil, true
+	}
+	versions, ok := ifMatchVersions(im)
+	if !ok {
+		versionMismatch(w, r)
+	}
+	return versions, ok
+}
+
+func versionMismatch(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusPreconditionFailed, problem.VersionMismatch, "The profile was changed since it was read. Reload it and try again.")
+}
+
+// attributeChanges checks input against the attribute schema and returns
+// the changes to store for email, adding what is wrong with input to errs.
+// It writes the error response and returns false when the checks could
+// not be made.
+func (h *ProfileHandler) attributeChanges(w http.ResponseWriter, r *http.Request, email string, input map[string]json.RawMessage, replace bool, errs validate.Errors) (map[string]string, bool) {
+	admin, err := h.isAdmin(r, email)
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+	defs, err := h.Schema.AttributeDefinitions(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+	current, err := h.Users.Attributes(r.Context(), email)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+
+	return mergeAttributes(defs, current, input, admin, replace, errs), true
+}
+
+// updated writes the error response for a failed profile update and
+// reports whether the update succeeded.
+func (h *ProfileHandler) updated(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, store.ErrVersionMismatch):
+		versionMismatch(w, r)
+	case errors.Is(err, store.ErrUnknownAttribute):
+		problem.Error(w, r, http.StatusBadRequest, problem.UnknownAttribute, "An attribute in the request is not defined.")
+	default:
+		serverError(w, r, err)
+	}
+	return false
+}
+
+// reload fetches the profile after a write and sets its new ETag.
+func (h *ProfileHandler) reload(w http.ResponseWriter, r *http.Request, email string) (*store.User, bool) {
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return nil, false
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return nil, false
+	}
+	w.Header().Set("ETag", profileETag(user.Version))
+	return user, true
+}
+
+// respond writes user's profile with the attributes they can see.
+func (h *ProfileHandler) respond(w http.ResponseWriter, r *http.Request, user *store.User) {
+	admin, err := h.isAdmin(r, user.Email)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	attrs, err := profileAttributes(r.Context(), h.Users, h.Schema, user.Email, admin)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeProfile(w, user, attrs)
+}
+
+// externalSignIns names how accounts of each provider sign in when it is
+// not with a password kept here, for messages to their users.
+var externalSignIns = map[string]string{
+	"google":         "Google",
+	"saml":           "single sign-on",
+	store.SourceLDAP: "the company directory",
+}
+
+// isExternal reports whether accounts of provider sign in elsewhere, and
+// so change their email there.
+func isExternal(provider string) bool {
+	_, ok := externalSignIns[provider]
+	return ok
+}
+
+func writeProfile(w http.ResponseWriter, user *store.User, attrs map[string]any) {
+	resp := ProfileResponse{
+		FullName:         user.FullName,
+		Telephone:        user.Telephone,
+		TelephoneDisplay: user.TelephoneDisplay,
+		Email:            user.Email,
+		EmailDisabled:    isExternal(user.Provider),
+		HasPassword:      user.HasPassword,
+		Avatar:           avatarURLs(user.Avatar),
+		Version:          user.Version,
+		Attributes:       attrs,
+	}
+
+	if resp.TelephoneDisplay == "" {
+		// Rows written before the display column existed.
+		resp.TelephoneDisplay = store.TelephoneDisplay(user.Telephone)
+	}
+	if !user.TelephoneVerifiedAt.IsZero() {
+		resp.TelephoneVerified, resp.TelephoneVerifiedAt = true, &user.TelephoneVerifiedAt
+	}
+	if strings.HasPrefix(user.Telephone, "+") {
+		if n, err := phone.Parse(user.Telephone, ""); err == nil {
+			resp.TelephoneInternational, resp.TelephoneRegion = n.InternationalFormat(), n.Region
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+type SchemaResponse struct {
+	Attributes []AttributeResponse `json:"attributes"`
+}
+
+// AttributeSchema lists the custom attributes the caller can see, in the
+// order forms should show them.
+func (h *ProfileHandler) AttributeSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	actor, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || actor == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	admin, err := h.isAdmin(r, actor)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	defs, err := h.Schema.AttributeDefinitions(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	resp := SchemaResponse{Attributes: []AttributeResponse{}}
+	for _, def := range defs {
+		if visibleTo(def, admin) {
+			resp.Attributes = append(resp.Attributes, attributeResponse(def, admin))
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+type RevisionResponse struct {
+	ID           int64     `json:"id"`
+	OldFullName  string    `json:"old_full_name"`
+	OldTelephone string    `json:"old_telephone"`
+	NewFullName  string    `json:"new_full_name"`
+	NewTelephone string    `json:"new_telephone"`
+	Actor        string    `json:"actor"`
+	IP           string    `json:"ip"`
+	Source       string    `json:"source"`
+	RestoredFrom int64     `json:"restored_from,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+
+	OldAttributes map[string]string `json:"old_attributes,omitempty"`
+	NewAttributes map[string]string `json:"new_attributes,omitempty"`
+}
+
+type HistoryResponse struct {
+	Email     string             `json:"email"`
+	Revisions []RevisionResponse `json:"revisions"`
+}
+
+// History lists the caller's profile revisions, newest first. Admins may pass
+// ?email= to see another user's history.
+func (h *ProfileHandler) History(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	actor, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || actor == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxHistoryLimit {
+			problem.Error(w, r, http.StatusBadRequest, problem.InvalidParameter, "limit must be between 1 and 100.")
+			return
+		}
+		limit = n
+	}
+
+	email, ok := h.target(w, r, actor, r.URL.Query().Get("email"))
+	if !ok {
+		return
+	}
+
+	revisions, err := h.Users.Revisions(r.Context(), email, limit)
+	if err != nil {
+		if errors.Is(err, store.ErrNotFound) {
+			userNotFound(w, r)
+		} else {
+			serverError(w, r, err)
+		}
+		return
+	}
+	visible, err := h.visibleAttributes(r, actor)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	resp := HistoryResponse{Email: email, Revisions: make([]RevisionResponse, 0, len(revisions))}
+	for _, rev := range revisions {
+		if visible != nil {
+			rev.OldAttributes = filterAttributes(rev.OldAttributes, visible)
+			rev.NewAttributes = filterAttributes(rev.NewAttributes, visible)
+		}
+		resp.Revisions = append(resp.Revisions, RevisionResponse(rev))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Restore puts the profile back to the values a revision left it with.
+// Admins may name another user's email in the body.
+func (h *ProfileHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		methodNotAllowed(w, r)
+		return
+	}
+
+	actor, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || actor == "" {
+		unauthenticated(w, r)
 		return
 	}
 
 	var input struct {
-		FullName  string `json:"full_name"`
-		Telephone string `json:"telephone"`
+		RevisionID int64  `json:"revision_id" validate:"required,min=1"`
+		Email      string `json:"email" validate:"trim,max=255"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	email, ok := h.target(w, r, actor, input.Email)
+	if !ok {
 		return
 	}
 
-	if input.FullName == "" {
-		http.Error(w, "Full name is required", http.StatusBadRequest)
+	// Users cannot restore attributes they are not allowed to edit.
+	change := store.Change{Actor: actor, IP: middleware.ClientIP(r), Source: store.SourceRestore}
+	admin, err := h.isAdmin(r, actor)
+	if err != nil {
+		serverError(w, r, err)
 		return
 	}
+	if !admin {
+		defs, err := h.Schema.AttributeDefinitions(r.Context())
+		if err != nil {
+			serverError(w, r, err)
+			return
+		}
+		change.RestoreAttributes = []string{}
+		for _, def := range defs {
+			if editableBy(def, false) {
+				change.RestoreAttributes = append(change.RestoreAttributes, def.Name)
+			}
+		}
+	}
 
-	query := "UPDATE users SET full_name=?, telephone=? WHERE email=?"
-	_, err := h.DB.ExecContext(r.Context(), query, input.FullName, input.Telephone, email)
+	err = h.Users.RestoreRevision(r.Context(), email, input.RevisionID, change)
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusNotFound, problem.RevisionNotFound, "No revision of this profile has this id.")
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to update profile", http.StatusInternalServerError)
+		serverError(w, r, err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
 }
+
+// target resolves whose profile a request acts on. Users act on their own;
+// acting on someone else's requires the admin role. It writes the error
+// response and returns false when the caller is not allowed.
+func (h *ProfileHandler) target(w http.ResponseWriter, r *http.Request, actor, requested string) (string, bool) {
+	if requested == "" || requested == actor {
+		return actor, true
+	}
+
+	admin, err := h.isAdmin(r, actor)
+	if err != nil {
+		serverError(w, r, err)
+		return "", false
+	}
+	if !admin {
+		problem.Error(w, r, http.StatusForbidden, problem.Forbidden, "Only administrators can do this.")
+		return "", false
+	}
+	return requested, true
+}
+
+// isAdmin reports whether actor has the admin role. Unknown users are not
+// admins, and neither are personal access tokens without the admin scope.
+func (h *ProfileHandler) isAdmin(r *http.Request, actor string) (bool, error) {
+	return isAdmin(r, h.Users, actor)
+}
+
+func isAdmin(r *http.Request, users store.UserStore, actor string) (bool, error) {
+	if scopes, ok := r.Context().Value(middleware.ScopesKey).([]string); ok && !slices.Contains(scopes, pat.ScopeAdmin) {
+		return false, nil
+	}
+	caller, err := users.GetByEmail(r.Context(), actor)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return caller.Role == store.RoleAdmin, nil
+}
+
+// visibleAttributes returns the names of the attributes actor may see, or
+// nil when actor is an admin and sees them all.
+func (h *ProfileHandler) visibleAttributes(r *http.Request, actor string) (map[string]bool, error) {
+	admin, err := h.isAdmin(r, actor)
+	if err != nil || admin {
+		return nil, err
+	}
+	defs, err := h.Schema.AttributeDefinitions(r.Context())
+	if err != nil {
+		return nil, err
+	}
+	visible := map[string]bool{}
+	for _, def := range defs {
+		visible[def.Name] = visibleTo(def, false)
+	}
+	return visible, nil
+}
+
+func filterAttributes(values map[string]string, visible map[string]bool) map[string]string {
+	if values == nil {
+		return nil
+	}
+	out := map[string]string{}
+	for name, v := range values {
+		if visible[name] {
+			out[name] = v
+		}
+	}
+	return out
+}
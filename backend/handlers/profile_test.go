@@ -3,25 +3,47 @@ package handlers
 import (
 	"bytes"
 	"context"
-	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"ccz/middleware"
-
-	"github.com/DATA-DOG/go-sqlmock"
+	"ccz/pat"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/store/storetest"
 )
 
-func TestProfileHandler_View(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("error opening mock: %s", err)
+type failingUsers struct {
+	store.UserStore
+	err error
+}
+
+func (f failingUsers) UpdateProfile(ctx context.Context, email string, update store.ProfileUpdate, change store.Change) error {
+	return f.err
+}
+
+func newProfileStore(t *testing.T) *store.SQL {
+	t.Helper()
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateProfile(context.Background(), "test@ex.com", store.ProfileUpdate{FullName: "Mukul Kumar", Telephone: "123456"}, store.Change{}); err != nil {
+		t.Fatal(err)
 	}
-	defer db.Close()
+	return st
+}
 
-	h := &ProfileHandler{DB: db}
+func TestProfileHandler_View(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
 
 	t.Run("Method Not Allowed", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodPost, "/profile", nil)
@@ -47,13 +69,6 @@ func TestProfileHandler_View(t *testing.T) {
 		req = req.WithContext(ctx)
 		w := httptest.NewRecorder()
 
-		rows := sqlmock.NewRows([]string{"full_name", "telephone", "email"}).
-			AddRow("Mukul Kumar", "123456", "test@ex.com")
-
-		mock.ExpectQuery("SELECT COALESCE\\(full_name, ''\\), COALESCE\\(telephone, ''\\), email FROM users WHERE email=\\?").
-			WithArgs("test@ex.com").
-			WillReturnRows(rows)
-
 		h.View(w, req)
 
 		if w.Code != http.StatusOK {
@@ -68,16 +83,43 @@ func TestProfileHandler_View(t *testing.T) {
 		}
 	})
 
+	t.Run("Point In Time", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/profile?at=2000-01-01T00:00:00Z", nil)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.UserEmailKey, "test@ex.com"))
+		w := httptest.NewRecorder()
+
+		h.View(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var resp ProfileResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.FullName != "" {
+			t.Errorf("expected the profile before its first change, got %+v", resp)
+		}
+	})
+
+	t.Run("Invalid Point In Time", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/profile?at=yesterday", nil)
+		req = req.WithContext(context.WithValue(req.Context(), middleware.UserEmailKey, "test@ex.com"))
+		w := httptest.NewRecorder()
+
+		h.View(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
 	t.Run("User Not Found", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/profile", nil)
 		ctx := context.WithValue(req.Context(), middleware.UserEmailKey, "missing@ex.com")
 		req = req.WithContext(ctx)
 		w := httptest.NewRecorder()
 
-		mock.ExpectQuery("SELECT COALESCE\\(full_name, ''\\), COALESCE\\(telephone, ''\\), email FROM users WHERE email=\\?").
-			WithArgs("missing@ex.com").
-			WillReturnError(sql.ErrNoRows)
-
 		h.View(w, req)
 
 		if w.Code != http.StatusNotFound {
@@ -87,16 +129,11 @@ func TestProfileHandler_View(t *testing.T) {
 }
 
 func TestProfileHandler_Save(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("error opening mock: %s", err)
-	}
-	defer db.Close()
-
-	h := &ProfileHandler{DB: db}
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
 
 	t.Run("Success Update", func(t *testing.T) {
-		input := map[string]string{"full_name": "Mukul", "telephone": "999"}
+		input := map[string]string{"full_name": "Mukul", "telephone": "+442079460018"}
 		body, err := json.Marshal(input)
 		if err != nil {
 			t.Fatalf("failed to marshal input: %v", err)
@@ -107,19 +144,29 @@ func TestProfileHandler_Save(t *testing.T) {
 		req = req.WithContext(ctx)
 		w := httptest.NewRecorder()
 
-		mock.ExpectExec("UPDATE users SET full_name=\\?, telephone=\\? WHERE email=\\?").
-			WithArgs("Mukul", "999", "test@ex.com").
-			WillReturnResult(sqlmock.NewResult(1, 1))
-
 		h.Save(w, req)
 
 		if w.Code != http.StatusOK {
 			t.Errorf("expected 200, got %d", w.Code)
 		}
+		u, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Mukul" || u.Telephone != "+442079460018" {
+			t.Errorf("profile not updated: %+v", u)
+		}
+		revs, err := st.Revisions(context.Background(), "test@ex.com", 1)
+		if err != nil || len(revs) != 1 {
+			t.Fatalf("expected a revision, got %+v, %v", revs, err)
+		}
+		if revs[0].Actor != "test@ex.com" || revs[0].IP != "192.0.2.1" || revs[0].Source != store.SourceProfile {
+			t.Errorf("unexpected revision %+v", revs[0])
+		}
 	})
 
 	t.Run("DB Failure", func(t *testing.T) {
-		input := map[string]string{"full_name": "Mukul", "telephone": "999"}
+		input := map[string]string{"full_name": "Mukul", "telephone": "+442079460018"}
 		body, err := json.Marshal(input)
 		if err != nil {
 			t.Fatalf("failed to marshal input: %v", err)
@@ -130,13 +177,707 @@ func TestProfileHandler_Save(t *testing.T) {
 		req = req.WithContext(ctx)
 		w := httptest.NewRecorder()
 
-		mock.ExpectExec("UPDATE users SET full_name=\\?, telephone=\\? WHERE email=\\?").
-			WillReturnError(sql.ErrConnDone)
-
-		h.Save(w, req)
+		failing := &ProfileHandler{Users: failingUsers{st, errors.New("syntax error")}, Schema: st}
+		failing.Save(w, req)
 
 		if w.Code != http.StatusInternalServerError {
 			t.Errorf("expected 500, got %d", w.Code)
 		}
 	})
+
+	t.Run("DB Unavailable", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"full_name":"Mukul","telephone":"+442079460018"}`)
+		req := httptest.NewRequest(http.MethodPost, "/profile/save", body)
+		req.Header.Set("Content-Type", "application/json")
+		ctx := context.WithValue(req.Context(), middleware.UserEmailKey, "test@ex.com")
+		req = req.WithContext(ctx)
+		w := httptest.NewRecorder()
+
+		failing := &ProfileHandler{Users: failingUsers{st, fmt.Errorf("%w: dial tcp", store.ErrUnavailable)}, Schema: st}
+		failing.Save(w, req)
+
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("expected Retry-After header")
+		}
+	})
+}
+
+func withUser(r *http.Request, email string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), middleware.UserEmailKey, email))
+}
+
+func TestProfileHandler_History(t *testing.T) {
+	st := newProfileStore(t)
+	if err := st.CreateLocal(context.Background(), "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	t.Run("Own History", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.History(w, withUser(httptest.NewRequest(http.MethodGet, "/profile/history", nil), "test@ex.com"))
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var resp HistoryResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Revisions) != 1 || resp.Revisions[0].NewFullName != "Mukul Kumar" {
+			t.Errorf("unexpected history %+v", resp)
+		}
+	})
+
+	t.Run("Other User Forbidden", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.History(w, withUser(httptest.NewRequest(http.MethodGet, "/profile/history?email=admin@ex.com", nil), "test@ex.com"))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Admin Sees Other User", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.History(w, withUser(httptest.NewRequest(http.MethodGet, "/profile/history?email=test@ex.com", nil), "admin@ex.com"))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Invalid Limit", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.History(w, withUser(httptest.NewRequest(http.MethodGet, "/profile/history?limit=0", nil), "test@ex.com"))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestProfileHandler_Restore(t *testing.T) {
+	st := newProfileStore(t)
+	ctx := context.Background()
+	if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Typo", Telephone: "000"}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	revs, err := st.Revisions(ctx, "test@ex.com", 10)
+	if err != nil || len(revs) != 2 {
+		t.Fatalf("expected 2 revisions, got %+v, %v", revs, err)
+	}
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	t.Run("Method Not Allowed", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.Restore(w, withUser(httptest.NewRequest(http.MethodGet, "/profile/history/restore", nil), "test@ex.com"))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", w.Code)
+		}
+	})
+
+	t.Run("Unknown Revision", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"revision_id": 9999}`)
+		w := httptest.NewRecorder()
+		h.Restore(w, withUser(httptest.NewRequest(http.MethodPost, "/profile/history/restore", body), "test@ex.com"))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("Success", func(t *testing.T) {
+		body := bytes.NewBufferString(fmt.Sprintf(`{"revision_id": %d}`, revs[1].ID))
+		w := httptest.NewRecorder()
+		h.Restore(w, withUser(httptest.NewRequest(http.MethodPost, "/profile/history/restore", body), "test@ex.com"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		u, err := st.GetByEmail(ctx, "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Mukul Kumar" || u.Telephone != "123456" {
+			t.Errorf("profile not restored: %+v", u)
+		}
+	})
+}
+
+func TestProfileHandler_Conditional(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	view := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(http.MethodGet, "/profile", nil), "test@ex.com")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.View(w, req)
+		return w
+	}
+	save := func(ifMatch, name string) *httptest.ResponseRecorder {
+		body := bytes.NewBufferString(`{"full_name":"` + name + `","telephone":"+442079460018"}`)
+		req := withUser(httptest.NewRequest(http.MethodPut, "/profile/save", body), "test@ex.com")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		h.Save(w, req)
+		return w
+	}
+
+	first := view("")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with ETag, got %d %q", first.Code, etag)
+	}
+
+	t.Run("Not Modified", func(t *testing.T) {
+		w := view(`"nope", ` + etag)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("expected 304, got %d", w.Code)
+		}
+		if w.Body.Len() != 0 {
+			t.Error("expected empty body on 304")
+		}
+	})
+
+	t.Run("Matching Save", func(t *testing.T) {
+		w := save(etag, "Tab One")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		next := w.Header().Get("ETag")
+		if next == "" || next == etag {
+			t.Errorf("expected a new ETag, got %q", next)
+		}
+		if w := view(etag); w.Code != http.StatusOK {
+			t.Errorf("expected old ETag to no longer match, got %d", w.Code)
+		}
+	})
+
+	t.Run("Stale Save", func(t *testing.T) {
+		w := save(etag, "Tab Two")
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412, got %d", w.Code)
+		}
+		u, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Tab One" {
+			t.Errorf("stale save overwrote profile: %+v", u)
+		}
+	})
+
+	t.Run("Unknown Tag", func(t *testing.T) {
+		if w := save(`W/"1"`, "Weak"); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412 for weak tag, got %d", w.Code)
+		}
+	})
+
+	t.Run("Several Tags", func(t *testing.T) {
+		current := view("").Header().Get("ETag")
+		if w := save(etag+`, W/`+current, "Weak"); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412 when only a weak tag is current, got %d", w.Code)
+		}
+		if w := save(etag+`, `+current, "Later Tag"); w.Code != http.StatusOK {
+			t.Errorf("expected a later tag to match, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Any Version", func(t *testing.T) {
+		if w := save("*", "Star"); w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+}
+
+// Setting a first password shows has_password, so cached profiles must go.
+func TestProfileHandler_ConditionalAfterFirstPassword(t *testing.T) {
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	if _, err := st.UpsertGoogle(ctx, "g@ex.com", "Gee", store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	h := &ProfileHandler{Users: st, Schema: st}
+	view := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(http.MethodGet, "/profile", nil), "g@ex.com")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		h.View(w, req)
+		return w
+	}
+
+	etag := view("").Header().Get("ETag")
+	if err := st.SetPassword(ctx, "g@ex.com", "first pass", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	w := view(etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var resp ProfileResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || !resp.HasPassword {
+		t.Errorf("expected has_password, got %+v, %v", resp, err)
+	}
+}
+
+func TestProfileHandler_Telephone(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	patch := func(telephone, language string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]string{"telephone": telephone})
+		req := withUser(httptest.NewRequest(http.MethodPatch, "/profile", bytes.NewReader(body)), "test@ex.com")
+		req.Header.Set("Content-Type", mergePatchType)
+		if language != "" {
+			req.Header.Set("Accept-Language", language)
+		}
+		w := httptest.NewRecorder()
+		h.Patch(w, req)
+		return w
+	}
+
+	t.Run("Stored As E.164", func(t *testing.T) {
+		w := patch("020 7946 0018", "en-GB,en;q=0.8")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp ProfileResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Telephone != "+442079460018" || resp.TelephoneDisplay != "020 7946 0018" ||
+			resp.TelephoneInternational != "+44 20 7946 0018" || resp.TelephoneRegion != "GB" {
+			t.Errorf("unexpected telephone fields %+v", resp)
+		}
+	})
+
+	t.Run("Default Region", func(t *testing.T) {
+		if w := patch("(415) 555-0132", ""); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		os.Setenv("PHONE_DEFAULT_REGION", "FR")
+		defer os.Unsetenv("PHONE_DEFAULT_REGION")
+		if w := patch("06 12 34 56 78", ""); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		u, _ := st.GetByEmail(context.Background(), "test@ex.com")
+		if u.Telephone != "+33612345678" {
+			t.Errorf("expected a French number, got %s", u.Telephone)
+		}
+	})
+
+	t.Run("Field Errors", func(t *testing.T) {
+		for _, input := range []string{"12", "call me", "+999 1234"} {
+			w := patch(input, "")
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%q: expected 400, got %d", input, w.Code)
+				continue
+			}
+			if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+				t.Errorf("%q: expected %s, got %q", input, problem.ContentType, ct)
+			}
+			var resp problem.Problem
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.Code != problem.ValidationFailed ||
+				len(resp.Errors) != 1 || resp.Errors[0].Field != "telephone" || resp.Errors[0].Detail == "" {
+				t.Errorf("%q: expected a telephone field error, got %s", input, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestProfileHandler_Patch(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	patch := func(body, contentType, ifMatch string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(http.MethodPatch, "/profile", bytes.NewBufferString(body)), "test@ex.com")
+		req.Header.Set("Content-Type", contentType)
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		w := httptest.NewRecorder()
+		h.Patch(w, req)
+		return w
+	}
+	profile := func() *store.User {
+		u, err := st.GetByEmail(context.Background(), "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+
+	t.Run("Absent Fields Untouched", func(t *testing.T) {
+		w := patch(`{"full_name":"Only Name"}`, mergePatchType, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if u := profile(); u.FullName != "Only Name" || u.Telephone != "123456" {
+			t.Errorf("unexpected profile %+v", u)
+		}
+		var resp ProfileResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || resp.FullName != "Only Name" {
+			t.Errorf("expected updated profile in response, got %+v, %v", resp, err)
+		}
+		if w.Header().Get("ETag") == "" {
+			t.Error("expected ETag")
+		}
+	})
+
+	t.Run("Null Clears", func(t *testing.T) {
+		if w := patch(`{"telephone":null}`, "application/merge-patch+json; charset=utf-8", ""); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if u := profile(); u.Telephone != "" || u.FullName != "Only Name" {
+			t.Errorf("unexpected profile %+v", u)
+		}
+	})
+
+	t.Run("Full Name Cannot Be Cleared", func(t *testing.T) {
+		if w := patch(`{"full_name":null}`, mergePatchType, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Read Only Field", func(t *testing.T) {
+		if w := patch(`{"email":"other@ex.com"}`, mergePatchType, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Not An Object", func(t *testing.T) {
+		if w := patch(`["full_name"]`, mergePatchType, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("Wrong Content Type", func(t *testing.T) {
+		w := patch(`{"full_name":"X"}`, "application/json", "")
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("expected 415, got %d", w.Code)
+		}
+		if w.Header().Get("Accept-Patch") != mergePatchType {
+			t.Errorf("expected Accept-Patch header, got %q", w.Header().Get("Accept-Patch"))
+		}
+	})
+
+	t.Run("Stale If-Match", func(t *testing.T) {
+		stale := profileETag(profile().Version - 1)
+		if w := patch(`{"full_name":"Lost"}`, mergePatchType, stale); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("expected 412, got %d", w.Code)
+		}
+		current := profileETag(profile().Version)
+		if w := patch(`{"full_name":"Won"}`, mergePatchType, current); w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		both := stale + ", " + profileETag(profile().Version)
+		if w := patch(`{"full_name":"Either"}`, mergePatchType, both); w.Code != http.StatusOK {
+			t.Errorf("expected any listed tag to match, got %d", w.Code)
+		}
+	})
+}
+
+func TestProfileHandler_Replace(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	req := withUser(httptest.NewRequest(http.MethodPut, "/profile", bytes.NewBufferString(`{"full_name":"Whole"}`)), "test@ex.com")
+	w := httptest.NewRecorder()
+	h.Replace(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	u, err := st.GetByEmail(context.Background(), "test@ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FullName != "Whole" || u.Telephone != "" {
+		t.Errorf("expected PUT to replace the whole profile, got %+v", u)
+	}
+
+	t.Run("Every Field Error", func(t *testing.T) {
+		body := `{"full_name":"` + strings.Repeat("x", 256) + `","telephone":"12","attributes":{"shoe_size":"42"}}`
+		w := httptest.NewRecorder()
+		h.Replace(w, withUser(httptest.NewRequest(http.MethodPut, "/profile", bytes.NewBufferString(body)), "test@ex.com"))
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("expected 400, got %d", w.Code)
+		}
+		var resp problem.Problem
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		var fields []string
+		for _, e := range resp.Errors {
+			fields = append(fields, e.Field)
+		}
+		if strings.Join(fields, ",") != "attributes.shoe_size,full_name,telephone" {
+			t.Errorf("expected errors on every bad field, got %+v", resp.Errors)
+		}
+	})
+
+	t.Run("Unknown Field", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.Replace(w, withUser(httptest.NewRequest(http.MethodPut, "/profile", bytes.NewBufferString(`{"full_name":"Whole","role":"admin"}`)), "test@ex.com"))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"role"`) {
+			t.Errorf("expected a role field error, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestProfileHandler_Attributes(t *testing.T) {
+	st := newProfileStore(t)
+	h := &ProfileHandler{Users: st, Schema: st}
+	ctx := context.Background()
+
+	zero := 0.0
+	for _, def := range []store.AttributeDefinition{
+		{Name: "title", Label: "Job title", Type: store.AttrString, Visibility: store.VisibilityUser, Rules: store.AttributeRules{MaxLength: 20, Pattern: `^[A-Za-z ]+$`}},
+		{Name: "height", Label: "Height", Type: store.AttrNumber, Visibility: store.VisibilityUser, Rules: store.AttributeRules{Min: &zero}},
+		{Name: "newsletter", Label: "Newsletter", Type: store.AttrBoolean, Visibility: store.VisibilityUser},
+		{Name: "birthday", Label: "Birthday", Type: store.AttrDate, Visibility: store.VisibilityUser},
+		{Name: "locale", Label: "Locale", Type: store.AttrEnum, Required: true, Visibility: store.VisibilityUser, Rules: store.AttributeRules{Options: []string{"en", "de"}}},
+		{Name: "level", Label: "Level", Type: store.AttrString, Visibility: store.VisibilityReadOnly},
+		{Name: "cost_center", Label: "Cost center", Type: store.AttrString, Visibility: store.VisibilityAdmin},
+	} {
+		if err := st.PutAttributeDefinition(ctx, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	admin := store.ProfileUpdate{FullName: "Mukul Kumar", Telephone: "123456", Attributes: map[string]string{"level": "L2", "cost_center": "CC-9"}}
+	if err := st.UpdateProfile(ctx, "test@ex.com", admin, store.Change{Source: store.SourceAdmin}); err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(body string) *httptest.ResponseRecorder {
+		req := withUser(httptest.NewRequest(http.MethodPut, "/profile", bytes.NewBufferString(body)), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.Replace(w, req)
+		return w
+	}
+	attributes := func() map[string]string {
+		values, err := st.Attributes(ctx, "test@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return values
+	}
+
+	t.Run("Schema", func(t *testing.T) {
+		req := withUser(httptest.NewRequest(http.MethodGet, "/profile/schema", nil), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.AttributeSchema(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		var resp SchemaResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		editable := map[string]bool{}
+		for _, a := range resp.Attributes {
+			editable[a.Name] = a.Editable
+		}
+		if len(editable) != 6 || !editable["title"] || editable["level"] {
+			t.Errorf("unexpected schema %+v", resp.Attributes)
+		}
+		if _, ok := editable["cost_center"]; ok {
+			t.Error("admin-only attribute in user schema")
+		}
+	})
+
+	t.Run("Typed Values", func(t *testing.T) {
+		w := replace(`{"full_name":"Typed","attributes":{"title":"Engineer","height":180.5,"newsletter":true,"birthday":"1990-02-01","locale":"de"}}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp ProfileResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Attributes["height"] != 180.5 || resp.Attributes["newsletter"] != true || resp.Attributes["level"] != "L2" {
+			t.Errorf("unexpected attributes %v", resp.Attributes)
+		}
+		if _, ok := resp.Attributes["cost_center"]; ok {
+			t.Error("admin-only attribute shown to user")
+		}
+		if got := attributes(); got["height"] != "180.5" || got["newsletter"] != "true" {
+			t.Errorf("unexpected stored values %v", got)
+		}
+	})
+
+	t.Run("Invalid Values", func(t *testing.T) {
+		for _, attrs := range []string{
+			`{"locale":"en","title":"Way too long to be a title"}`,
+			`{"locale":"en","title":"R2-D2"}`,
+			`{"locale":"en","height":-1}`,
+			`{"locale":"en","height":"tall"}`,
+			`{"locale":"en","newsletter":"yes"}`,
+			`{"locale":"en","birthday":"01/02/1990"}`,
+			`{"locale":"fr"}`,
+			`{"locale":"en","shoe_size":"42"}`,
+			`{"locale":"en","level":"L9"}`,
+			`{"locale":"en","cost_center":"CC-1"}`,
+		} {
+			if w := replace(`{"full_name":"Bad","attributes":` + attrs + `}`); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d", attrs, w.Code)
+			}
+		}
+		if got := attributes(); got["title"] != "Engineer" || got["level"] != "L2" {
+			t.Errorf("rejected save changed attributes: %v", got)
+		}
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		if w := replace(`{"full_name":"Typed","attributes":{"title":"Engineer"}}`); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 without required locale, got %d", w.Code)
+		}
+		// Clients that do not send attributes keep working.
+		if w := replace(`{"full_name":"Typed"}`); w.Code != http.StatusOK {
+			t.Errorf("expected 200 without attributes, got %d", w.Code)
+		}
+	})
+
+	t.Run("Replace Clears Missing", func(t *testing.T) {
+		if w := replace(`{"full_name":"Typed","attributes":{"locale":"en"}}`); w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		got := attributes()
+		if len(got) != 3 || got["locale"] != "en" || got["level"] != "L2" || got["cost_center"] != "CC-9" {
+			t.Errorf("expected only editable attributes cleared, got %v", got)
+		}
+	})
+
+	t.Run("Patch", func(t *testing.T) {
+		req := withUser(httptest.NewRequest(http.MethodPatch, "/profile", bytes.NewBufferString(`{"attributes":{"title":"Lead","locale":null}}`)), "test@ex.com")
+		req.Header.Set("Content-Type", mergePatchType)
+		w := httptest.NewRecorder()
+		h.Patch(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 clearing required attribute, got %d", w.Code)
+		}
+
+		req = withUser(httptest.NewRequest(http.MethodPatch, "/profile", bytes.NewBufferString(`{"attributes":{"title":"Lead"}}`)), "test@ex.com")
+		req.Header.Set("Content-Type", mergePatchType)
+		w = httptest.NewRecorder()
+		h.Patch(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if got := attributes(); got["title"] != "Lead" || got["locale"] != "en" {
+			t.Errorf("unexpected attributes after patch %v", got)
+		}
+	})
+
+	t.Run("History Hides Admin Attributes", func(t *testing.T) {
+		req := withUser(httptest.NewRequest(http.MethodGet, "/profile/history", nil), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.History(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if body := w.Body.String(); strings.Contains(body, "cost_center") || !strings.Contains(body, `"level":"L2"`) {
+			t.Errorf("unexpected history %s", body)
+		}
+	})
+
+	t.Run("Restore Skips Read Only", func(t *testing.T) {
+		revs, err := st.Revisions(ctx, "test@ex.com", 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := revs[len(revs)-1]
+		if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Typed", Attributes: map[string]string{"level": "L3"}}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		body := fmt.Sprintf(`{"revision_id":%d}`, first.ID)
+		req := withUser(httptest.NewRequest(http.MethodPost, "/profile/history/restore", bytes.NewBufferString(body)), "test@ex.com")
+		w := httptest.NewRecorder()
+		h.Restore(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", w.Code)
+		}
+		if got := attributes(); got["level"] != "L3" {
+			t.Errorf("user restore changed a read-only attribute: %v", got)
+		}
+	})
+}
+
+// An admin's token without the admin scope sees and edits the profile as
+// any user would.
+func TestProfileHandler_AccessTokenAttributes(t *testing.T) {
+	st := newProfileStore(t)
+	ctx := context.Background()
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "test@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+	for _, def := range []store.AttributeDefinition{
+		{Name: "level", Label: "Level", Type: store.AttrString, Visibility: store.VisibilityReadOnly},
+		{Name: "cost_center", Label: "Cost center", Type: store.AttrString, Visibility: store.VisibilityAdmin},
+	} {
+		if err := st.PutAttributeDefinition(ctx, def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seeded := store.ProfileUpdate{FullName: "Mukul Kumar", Attributes: map[string]string{"level": "L2", "cost_center": "CC-9"}}
+	if err := st.UpdateProfile(ctx, "test@ex.com", seeded, store.Change{Source: store.SourceAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	h := &ProfileHandler{Users: st, Schema: st}
+
+	// withToken makes r as a token of test@ex.com holding the profile scopes.
+	withToken := func(r *http.Request) *http.Request {
+		r = withUser(r, "test@ex.com")
+		return r.WithContext(context.WithValue(r.Context(), middleware.ScopesKey, []string{pat.ScopeProfileRead, pat.ScopeProfileWrite}))
+	}
+
+	t.Run("View", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		h.View(w, withToken(httptest.NewRequest(http.MethodGet, "/api/profile", nil)))
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "cost_center") || !strings.Contains(w.Body.String(), `"level":"L2"`) {
+			t.Errorf("expected only the user's attributes, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Replace", func(t *testing.T) {
+		for _, attrs := range []string{`{"level":"L9"}`, `{"cost_center":"CC-1"}`} {
+			w := httptest.NewRecorder()
+			h.Replace(w, withToken(httptest.NewRequest(http.MethodPut, "/api/profile", bytes.NewBufferString(`{"full_name":"X","attributes":`+attrs+`}`))))
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected 400, got %d: %s", attrs, w.Code, w.Body.String())
+			}
+		}
+	})
+
+	t.Run("Patch", func(t *testing.T) {
+		req := withToken(httptest.NewRequest(http.MethodPatch, "/api/profile", bytes.NewBufferString(`{"attributes":{"cost_center":"CC-1"}}`)))
+		req.Header.Set("Content-Type", mergePatchType)
+		w := httptest.NewRecorder()
+		h.Patch(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req = withToken(httptest.NewRequest(http.MethodPatch, "/api/profile", bytes.NewBufferString(`{"full_name":"Patched"}`)))
+		req.Header.Set("Content-Type", mergePatchType)
+		w = httptest.NewRecorder()
+		h.Patch(w, req)
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "cost_center") {
+			t.Errorf("expected the patched profile without admin attributes, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	if got, err := st.Attributes(ctx, "test@ex.com"); err != nil || got["level"] != "L2" || got["cost_center"] != "CC-9" {
+		t.Errorf("expected admin attributes unchanged, got %v, %v", got, err)
+	}
 }
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"ccz/middleware"
+	"ccz/phone"
+	"ccz/problem"
+	"ccz/saml"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// SAMLHandler signs the users of enterprise tenants in through their
+// organization's SAML identity provider. Each tenant is a service provider
+// of its own, at /api/auth/saml/{tenant}.
+type SAMLHandler struct {
+	Identities store.IdentityStore
+	Tenants    store.SAMLStore
+	Config     *saml.Config
+}
+
+// samlRequestTTL is how long the user has to sign in at the IdP.
+const samlRequestTTL = 10 * time.Minute
+
+// serviceProvider returns the SP of tenant t.
+func (h *SAMLHandler) serviceProvider(t *store.SAMLTenant) (*saml.ServiceProvider, error) {
+	idp, err := saml.ParseMetadata([]byte(t.Metadata))
+	if err != nil {
+		return nil, err
+	}
+	entityID, acsURL := samlURLs(h.Config, t.ID)
+	return h.Config.ServiceProvider(entityID, acsURL, idp), nil
+}
+
+// samlURLs returns the entity ID and ACS URL of the SP of tenant id.
+func samlURLs(c *saml.Config, id string) (entityID, acsURL string) {
+	base := c.BaseURL + "/api/auth/saml/" + id
+	return base + "/metadata", base + "/acs"
+}
+
+// samlFailed sends the browser back to the login page, which says single
+// sign-on failed without saying why; the reason is logged.
+func samlFailed(w http.ResponseWriter, r *http.Request, reason string, err error) {
+	slog.Warn("SAML login failed", "reason", reason, "error", err)
+	http.Redirect(w, r, os.Getenv("FRONTEND_URL")+"/login?error=sso", http.StatusSeeOther)
+}
+
+// Metadata handles GET /api/auth/saml/{tenant}/metadata: the SP metadata
+// the tenant's admins import into their IdP.
+func (h *SAMLHandler) Metadata(w http.ResponseWriter, r *http.Request) {
+	t, err := h.Tenants.SAMLTenant(r.Context(), r.PathValue("tenant"))
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusNotFound, problem.TenantNotFound, "No SSO tenant has this id.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	sp, err := h.serviceProvider(t)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	_, _ = w.Write(sp.Metadata())
+}
+
+// LoginByEmail handles GET /api/auth/saml?email=...: single sign-on with
+// the tenant that owns the domain of email.
+func (h *SAMLHandler) LoginByEmail(w http.ResponseWriter, r *http.Request) {
+	email, ok := validate.NormalizeEmail(r.URL.Query().Get("email"))
+	if !ok {
+		samlFailed(w, r, "email not valid", nil)
+		return
+	}
+	domain := email[strings.LastIndexByte(email, '@')+1:]
+	t, err := h.Tenants.SAMLTenantByDomain(r.Context(), domain)
+	if err != nil {
+		samlFailed(w, r, "no tenant for "+domain, err)
+		return
+	}
+	h.start(w, r, t)
+}
+
+// Login handles GET /api/auth/saml/{tenant}.
+func (h *SAMLHandler) Login(w http.ResponseWriter, r *http.Request) {
+	t, err := h.Tenants.SAMLTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		samlFailed(w, r, "no tenant "+r.PathValue("tenant"), err)
+		return
+	}
+	h.start(w, r, t)
+}
+
+// start sends the browser to the IdP of t with an AuthnRequest. Its ID is
+// kept until the response comes back, so that responses the SP did not
+// ask for, and replays of those it did, are refused.
+func (h *SAMLHandler) start(w http.ResponseWriter, r *http.Request, t *store.SAMLTenant) {
+	sp, err := h.serviceProvider(t)
+	if err != nil {
+		samlFailed(w, r, "metadata of "+t.ID, err)
+		return
+	}
+	id, err := saml.NewRequestID()
+	if err != nil {
+		samlFailed(w, r, "request id", err)
+		return
+	}
+	now := time.Now()
+	if err := h.Tenants.CreateSAMLRequest(r.Context(), id, t.ID, now.Add(samlRequestTTL), now); err != nil {
+		samlFailed(w, r, "storing the request", err)
+		return
+	}
+	target, err := sp.AuthnRequestURL(id, now)
+	if err != nil {
+		samlFailed(w, r, "signing the request", err)
+		return
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
+
+// ACS handles POST /api/auth/saml/{tenant}/acs, where the IdP posts its
+// response. Users are created on their first login and their name and
+// telephone follow the IdP's on every one. The IdP can only sign in users
+// whose email is in one of the tenant's domains.
+func (h *SAMLHandler) ACS(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		samlFailed(w, r, "form", err)
+		return
+	}
+	t, err := h.Tenants.SAMLTenant(r.Context(), r.PathValue("tenant"))
+	if err != nil {
+		samlFailed(w, r, "no tenant "+r.PathValue("tenant"), err)
+		return
+	}
+	sp, err := h.serviceProvider(t)
+	if err != nil {
+		samlFailed(w, r, "metadata of "+t.ID, err)
+		return
+	}
+	now := time.Now()
+	a, err := sp.ParseResponse(r.PostForm.Get("SAMLResponse"), now)
+	if err != nil {
+		samlFailed(w, r, "response", err)
+		return
+	}
+	tenant, err := h.Tenants.RedeemSAMLRequest(r.Context(), a.InResponseTo, now)
+	if err != nil || tenant != t.ID {
+		samlFailed(w, r, "request "+a.InResponseTo, err)
+		return
+	}
+
+	raw := a.NameID
+	if t.EmailAttribute != "" {
+		raw = a.Attribute(t.EmailAttribute)
+	}
+	email, ok := validate.NormalizeEmail(raw)
+	if !ok {
+		samlFailed(w, r, "email not valid", nil)
+		return
+	}
+	if domain := email[strings.LastIndexByte(email, '@')+1:]; !slices.Contains(t.Domains, domain) {
+		samlFailed(w, r, "email outside the domains of "+t.ID, nil)
+		return
+	}
+
+	var update store.ProfileUpdate
+	if t.FullNameAttribute != "" {
+		update.FullName = strings.TrimSpace(a.Attribute(t.FullNameAttribute))
+		if len(update.FullName) > 255 {
+			update.FullName = ""
+		}
+	}
+	if t.TelephoneAttribute != "" {
+		// A number the IdP has wrong is not worth failing the login.
+		if n, err := phone.Parse(a.Attribute(t.TelephoneAttribute), defaultRegion(r)); err == nil {
+			update.Telephone = n.E164()
+		}
+	}
+	change := store.Change{Actor: email, IP: middleware.ClientIP(r), Source: store.SourceSAML}
+	if _, err := h.Identities.UpsertSAML(r.Context(), email, update, change); err != nil {
+		samlFailed(w, r, "storing the user", err)
+		return
+	}
+
+	token, err := signToken(email, middleware.Auth{Time: now, Methods: []string{middleware.MethodSAML}})
+	if err != nil {
+		samlFailed(w, r, "token", err)
+		return
+	}
+	http.Redirect(w, r, os.Getenv("FRONTEND_URL")+"/auth/callback?token="+token, http.StatusSeeOther)
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"ccz/problem"
+	"ccz/saml"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// SAMLTenantHandler lets admins set up the tenants that sign in with SAML.
+// Every endpoint requires the admin role.
+type SAMLTenantHandler struct {
+	Users   store.UserStore
+	Tenants store.SAMLStore
+	Config  *saml.Config
+}
+
+// SAMLTenantResponse describes a tenant: its IdP, as read from the metadata
+// imported, and the SP URLs to configure the IdP with.
+type SAMLTenantResponse struct {
+	ID                 string    `json:"id"`
+	Name               string    `json:"name"`
+	Domains            []string  `json:"domains"`
+	EmailAttribute     string    `json:"email_attribute"`
+	FullNameAttribute  string    `json:"full_name_attribute"`
+	TelephoneAttribute string    `json:"telephone_attribute"`
+	IdPEntityID        string    `json:"idp_entity_id"`
+	IdPSSOURL          string    `json:"idp_sso_url"`
+	SPEntityID         string    `json:"sp_entity_id"`
+	ACSURL             string    `json:"acs_url"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// SAMLTenantListResponse is every tenant, by name.
+type SAMLTenantListResponse struct {
+	Tenants []SAMLTenantResponse `json:"tenants"`
+}
+
+func (h *SAMLTenantHandler) tenantResponse(t store.SAMLTenant) SAMLTenantResponse {
+	resp := SAMLTenantResponse{
+		ID:                 t.ID,
+		Name:               t.Name,
+		Domains:            t.Domains,
+		EmailAttribute:     t.EmailAttribute,
+		FullNameAttribute:  t.FullNameAttribute,
+		TelephoneAttribute: t.TelephoneAttribute,
+		CreatedAt:          t.CreatedAt,
+		UpdatedAt:          t.UpdatedAt,
+	}
+	if resp.Domains == nil {
+		resp.Domains = []string{}
+	}
+	resp.SPEntityID, resp.ACSURL = samlURLs(h.Config, t.ID)
+	// The metadata was checked when it was imported.
+	if idp, err := saml.ParseMetadata([]byte(t.Metadata)); err == nil {
+		resp.IdPEntityID, resp.IdPSSOURL = idp.EntityID, idp.SSOURL
+	}
+	return resp
+}
+
+var (
+	tenantID   = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,63}$`)
+	domainName = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+)
+
+// List handles GET /api/admin/saml/tenants.
+func (h *SAMLTenantHandler) List(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+	tenants, err := h.Tenants.SAMLTenants(r.Context())
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	resp := SAMLTenantListResponse{Tenants: make([]SAMLTenantResponse, 0, len(tenants))}
+	for _, t := range tenants {
+		resp.Tenants = append(resp.Tenants, h.tenantResponse(t))
+	}
+	writeJSON(w, resp)
+}
+
+// Put handles PUT /api/admin/saml/tenants/{id} with {"name": "...",
+// "metadata": "<md:EntityDescriptor ...>", "domains": [...],
+// "email_attribute": "...", "full_name_attribute": "...",
+// "telephone_attribute": "..."}, creating or replacing the tenant. Without
+// an email attribute the NameID is taken as the email. A domain belongs to
+// one tenant only.
+func (h *SAMLTenantHandler) Put(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+	id := r.PathValue("id")
+	if !tenantID.MatchString(id) {
+		problem.Error(w, r, http.StatusBadRequest, problem.InvalidParameter, "Tenant ids are lowercase letters, digits and -.")
+		return
+	}
+
+	var input struct {
+		Name               string   `json:"name" validate:"trim,required,max=100"`
+		Metadata           string   `json:"metadata" validate:"required,max=65536"`
+		Domains            []string `json:"domains"`
+		EmailAttribute     string   `json:"email_attribute" validate:"trim,max=255"`
+		FullNameAttribute  string   `json:"full_name_attribute" validate:"trim,max=255"`
+		TelephoneAttribute string   `json:"telephone_attribute" validate:"trim,max=255"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+	for i, d := range input.Domains {
+		input.Domains[i] = strings.ToLower(strings.TrimSpace(d))
+	}
+	input.Domains = slices.Compact(slices.Sorted(slices.Values(input.Domains)))
+
+	errs := validate.Errors{}
+	switch {
+	case len(input.Domains) == 0:
+		errs.Add("domains", "Name at least one email domain")
+	case slices.ContainsFunc(input.Domains, func(d string) bool { return len(d) > 255 || !domainName.MatchString(d) }):
+		errs.Add("domains", "Domains must be names such as example.com")
+	}
+	if input.Metadata != "" {
+		if _, err := saml.ParseMetadata([]byte(input.Metadata)); err != nil {
+			errs.Add("metadata", strings.TrimPrefix(err.Error(), "saml: "))
+		}
+	}
+	if !accepted(w, r, errs.Err()) {
+		return
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	t := store.SAMLTenant{
+		ID:                 id,
+		Name:               input.Name,
+		Metadata:           input.Metadata,
+		Domains:            input.Domains,
+		EmailAttribute:     input.EmailAttribute,
+		FullNameAttribute:  input.FullNameAttribute,
+		TelephoneAttribute: input.TelephoneAttribute,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	err := h.Tenants.PutSAMLTenant(r.Context(), t)
+	if errors.Is(err, store.ErrConflict) {
+		problem.Error(w, r, http.StatusConflict, problem.DomainTaken, "One of the domains belongs to another tenant.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	saved, err := h.Tenants.SAMLTenant(r.Context(), id)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	writeJSON(w, h.tenantResponse(*saved))
+}
+
+// Delete handles DELETE /api/admin/saml/tenants/{id}. Its users keep their
+// accounts but can no longer sign in with it.
+func (h *SAMLTenantHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	if _, ok := adminOnly(w, r, h.Users); !ok {
+		return
+	}
+	err := h.Tenants.DeleteSAMLTenant(r.Context(), r.PathValue("id"))
+	if errors.Is(err, store.ErrNotFound) {
+		problem.Error(w, r, http.StatusNotFound, problem.TenantNotFound, "No SSO tenant has this id.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
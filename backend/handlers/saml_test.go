@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"ccz/saml"
+	"ccz/saml/samltest"
+	"ccz/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testSAMLConfig(t *testing.T) *saml.Config {
+	t.Helper()
+	// A test IdP's key and certificate serve the SP as well.
+	keys, err := samltest.New("https://sp.ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &saml.Config{BaseURL: "https://sp.ex.com", Key: keys.Key, Certificate: keys.Certificate}
+}
+
+var requestID = regexp.MustCompile(` ID="([^"]+)"`)
+
+// samlRequestID returns the ID of the AuthnRequest a login redirected to.
+func samlRequestID(t *testing.T, location string) string {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflated, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	xml, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := requestID.FindSubmatch(xml)
+	if m == nil {
+		t.Fatalf("no ID in %s", xml)
+	}
+	return string(m[1])
+}
+
+func TestSAMLHandler(t *testing.T) {
+	t.Setenv("FRONTEND_URL", "http://localhost:8080")
+	t.Setenv("JWT_SECRET", "secret")
+	st := newProfileStore(t)
+	ctx := context.Background()
+	h := &SAMLHandler{Identities: st, Tenants: st, Config: testSAMLConfig(t)}
+
+	idp, err := samltest.New("https://idp.acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tenant := range []store.SAMLTenant{
+		{ID: "acme", Name: "Acme", Metadata: idp.Metadata(), Domains: []string{"acme.com"}, EmailAttribute: "mail", FullNameAttribute: "displayName", TelephoneAttribute: "phone"},
+		{ID: "beta", Name: "Beta", Metadata: idp.Metadata(), Domains: []string{"beta.com"}},
+	} {
+		if err := st.PutSAMLTenant(ctx, tenant); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	login := func(email string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.LoginByEmail(w, httptest.NewRequest(http.MethodGet, "/api/auth/saml?email="+url.QueryEscape(email), nil))
+		return w
+	}
+	start := func(t *testing.T, email string) string {
+		t.Helper()
+		w := login(email)
+		if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), idp.SSOURL+"?SAMLRequest=") {
+			t.Fatalf("expected a redirect to the IdP, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+		return samlRequestID(t, w.Header().Get("Location"))
+	}
+	acs := func(tenant, response string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/saml/"+tenant+"/acs", strings.NewReader(url.Values{"SAMLResponse": {response}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetPathValue("tenant", tenant)
+		w := httptest.NewRecorder()
+		h.ACS(w, req)
+		return w
+	}
+	respond := func(t *testing.T, id, email string) string {
+		t.Helper()
+		response, err := idp.Response(samltest.Assertion{
+			InResponseTo: id,
+			Recipient:    "https://sp.ex.com/api/auth/saml/acme/acs",
+			Audience:     "https://sp.ex.com/api/auth/saml/acme/metadata",
+			NameID:       "jdoe",
+			Attributes:   map[string]string{"mail": email, "displayName": "Jo Doe", "phone": "+44 20 7946 0958"},
+		}, samltest.SignAssertion, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+	refused := func(t *testing.T, w *httptest.ResponseRecorder) {
+		t.Helper()
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "http://localhost:8080/login?error=sso" {
+			t.Errorf("expected a redirect to the login page, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	t.Run("Metadata", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/auth/saml/acme/metadata", nil)
+		req.SetPathValue("tenant", "acme")
+		w := httptest.NewRecorder()
+		h.Metadata(w, req)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `entityID="https://sp.ex.com/api/auth/saml/acme/metadata"`) {
+			t.Errorf("expected the SP metadata, got %d: %s", w.Code, w.Body.String())
+		}
+
+		req.SetPathValue("tenant", "nobody")
+		w = httptest.NewRecorder()
+		h.Metadata(w, req)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "tenant_not_found") {
+			t.Errorf("expected 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Signs In", func(t *testing.T) {
+		response := respond(t, start(t, "Jo@Acme.com"), "jo@acme.com")
+		w := acs("acme", response)
+		location := w.Header().Get("Location")
+		if w.Code != http.StatusSeeOther || !strings.HasPrefix(location, "http://localhost:8080/auth/callback?token=") {
+			t.Fatalf("expected a redirect with a token, got %d %s", w.Code, location)
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(strings.TrimPrefix(location, "http://localhost:8080/auth/callback?token="), claims, func(*jwt.Token) (any, error) {
+			return []byte("secret"), nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if claims["email"] != "jo@acme.com" || claims["amr"].([]any)[0] != "saml" {
+			t.Errorf("unexpected claims %v", claims)
+		}
+		u, err := st.GetByEmail(ctx, "jo@acme.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Provider != "saml" || u.FullName != "Jo Doe" || u.Telephone != "+442079460958" {
+			t.Errorf("unexpected user %+v", u)
+		}
+
+		// The response is used up.
+		refused(t, acs("acme", response))
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		refused(t, login("jo@other.com"))
+		refused(t, login("not an email"))
+
+		// The IdP may only sign in users of the tenant's domains.
+		refused(t, acs("acme", respond(t, start(t, "jo@acme.com"), "boss@beta.com")))
+		if _, err := st.GetByEmail(ctx, "boss@beta.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected no user outside the domains, got %v", err)
+		}
+		// Responses must answer a request of this SP.
+		refused(t, acs("acme", respond(t, "_unsolicited", "jo@acme.com")))
+		refused(t, acs("acme", respond(t, start(t, "jo@beta.com"), "jo@acme.com")))
+		refused(t, acs("acme", "garbage"))
+		refused(t, acs("nobody", respond(t, start(t, "jo@acme.com"), "jo@acme.com")))
+	})
+}
+
+func TestSAMLTenantHandler(t *testing.T) {
+	st := newProfileStore(t)
+	h := &SAMLTenantHandler{Users: st, Tenants: st, Config: testSAMLConfig(t)}
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+	idp, err := samltest.New("https://idp.acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := json.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	put := func(email, id, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/api/admin/saml/tenants/"+id, strings.NewReader(body))
+		req.SetPathValue("id", id)
+		w := httptest.NewRecorder()
+		h.Put(w, withUser(req, email))
+		return w
+	}
+	tenant := func(domains string) string {
+		return `{"name":"Acme","metadata":` + string(metadata) + `,"domains":` + domains + `,"email_attribute":"mail"}`
+	}
+
+	t.Run("Requires Admin", func(t *testing.T) {
+		if w := put("test@ex.com", "acme", tenant(`["acme.com"]`)); w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, body, field string
+		}{
+			{"No Domain", tenant(`[]`), "domains"},
+			{"Bad Domain", tenant(`["acme"]`), "domains"},
+			{"Bad Metadata", `{"name":"Acme","metadata":"<html/>","domains":["acme.com"]}`, "metadata"},
+			{"No Metadata", `{"name":"Acme","domains":["acme.com"]}`, "metadata"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				w := put("admin@ex.com", "acme", tc.body)
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"`+tc.field+`"`) {
+					t.Errorf("expected an error on %s, got %d: %s", tc.field, w.Code, w.Body.String())
+				}
+			})
+		}
+		if w := put("admin@ex.com", "Acme_Corp", tenant(`["acme.com"]`)); w.Code != http.StatusBadRequest {
+			t.Errorf("expected a bad id refused, got %d", w.Code)
+		}
+	})
+
+	t.Run("Put List And Delete", func(t *testing.T) {
+		w := put("admin@ex.com", "acme", tenant(`["ACME.com","acme.org","acme.com"]`))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp SAMLTenantResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Domains) != 2 || resp.Domains[0] != "acme.com" || resp.IdPSSOURL != idp.SSOURL ||
+			resp.SPEntityID != "https://sp.ex.com/api/auth/saml/acme/metadata" || resp.ACSURL != "https://sp.ex.com/api/auth/saml/acme/acs" {
+			t.Errorf("unexpected tenant %+v", resp)
+		}
+
+		if w := put("admin@ex.com", "other", tenant(`["acme.org"]`)); w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "domain_taken") {
+			t.Errorf("expected 409 for a taken domain, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w = httptest.NewRecorder()
+		h.List(w, withUser(httptest.NewRequest(http.MethodGet, "/api/admin/saml/tenants", nil), "admin@ex.com"))
+		var list SAMLTenantListResponse
+		if err := json.NewDecoder(w.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		if len(list.Tenants) != 1 || list.Tenants[0].IdPEntityID != "https://idp.acme.com" {
+			t.Errorf("unexpected tenants %+v", list.Tenants)
+		}
+
+		del := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodDelete, "/api/admin/saml/tenants/acme", nil)
+			req.SetPathValue("id", "acme")
+			w := httptest.NewRecorder()
+			h.Delete(w, withUser(req, "admin@ex.com"))
+			return w
+		}
+		if w := del(); w.Code != http.StatusNoContent {
+			t.Errorf("expected 204, got %d", w.Code)
+		}
+		if w := del(); w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccz/middleware"
+	"ccz/pat"
+	"ccz/problem"
+	"ccz/store"
+	"ccz/validate"
+)
+
+// TokenHandler lets users manage their personal access tokens.
+type TokenHandler struct {
+	Users  store.UserStore
+	Tokens store.TokenStore
+}
+
+// AccessTokenResponse describes a personal access token. The token itself
+// is only in the response that creates it; it cannot be read again.
+type AccessTokenResponse struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	Token      string     `json:"token,omitempty"`
+}
+
+// AccessTokenListResponse is the caller's tokens, newest first.
+type AccessTokenListResponse struct {
+	Tokens []AccessTokenResponse `json:"tokens"`
+	// Scopes are those a new token may be granted.
+	Scopes []string `json:"scopes"`
+}
+
+func accessTokenResponse(t store.AccessToken) AccessTokenResponse {
+	resp := AccessTokenResponse{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.Scopes,
+		CreatedAt:  t.CreatedAt,
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedIP: t.LastUsedIP,
+	}
+	if !t.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &t.LastUsedAt
+	}
+	return resp
+}
+
+// List handles GET /api/account/tokens.
+func (h *TokenHandler) List(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	tokens, err := h.Tokens.AccessTokens(r.Context(), email)
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	resp := AccessTokenListResponse{Tokens: []AccessTokenResponse{}, Scopes: grantable(user)}
+	for _, t := range tokens {
+		resp.Tokens = append(resp.Tokens, accessTokenResponse(t))
+	}
+	writeJSON(w, resp)
+}
+
+// Create handles POST /api/account/tokens with {"name": "...", "scopes":
+// [...], "expires_in_days": n} and answers 201 with the new token. Tokens
+// are valid for up to a year and a day.
+func (h *TokenHandler) Create(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	var input struct {
+		Name          string   `json:"name" validate:"trim,required,max=100"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days" validate:"required,min=1,max=366"`
+	}
+	if !decodeBody(w, r, &input) {
+		return
+	}
+
+	user, err := h.Users.GetByEmail(r.Context(), email)
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	errs := validate.Errors{}
+	allowed := grantable(user)
+	switch {
+	case len(input.Scopes) == 0:
+		errs.Add("scopes", "Pick at least one scope")
+	default:
+		for _, scope := range input.Scopes {
+			if !slices.Contains(allowed, scope) {
+				errs.Add("scopes", "Scopes must be among "+strings.Join(allowed, ", "))
+				break
+			}
+		}
+	}
+	if !accepted(w, r, errs.Err()) {
+		return
+	}
+
+	token, prefix, hash, err := pat.New()
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	t := store.AccessToken{
+		Name:      input.Name,
+		Prefix:    prefix,
+		Hash:      hash,
+		Scopes:    slices.Compact(slices.Sorted(slices.Values(input.Scopes))),
+		CreatedAt: now,
+		ExpiresAt: now.AddDate(0, 0, input.ExpiresInDays),
+	}
+	err = h.Tokens.CreateAccessToken(r.Context(), email, &t)
+	if errors.Is(err, store.ErrConflict) {
+		fieldErrors(w, r, map[string]string{"name": "You already have a token with this name"})
+		return
+	}
+	if errors.Is(err, store.ErrNotFound) {
+		userNotFound(w, r)
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+
+	resp := accessTokenResponse(t)
+	resp.Token = token
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// Delete handles DELETE /api/account/tokens/{id}. The token stops working
+// at once.
+func (h *TokenHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	email, ok := r.Context().Value(middleware.UserEmailKey).(string)
+	if !ok || email == "" {
+		unauthenticated(w, r)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err == nil {
+		err = h.Tokens.DeleteAccessToken(r.Context(), email, id)
+	}
+	var numErr *strconv.NumError
+	if errors.Is(err, store.ErrNotFound) || errors.As(err, &numErr) {
+		problem.Error(w, r, http.StatusNotFound, problem.TokenNotFound, "You have no access token with this id.")
+		return
+	}
+	if err != nil {
+		serverError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// grantable is the scopes user may grant a token: admins may let it read
+// the admin routes too.
+func grantable(user *store.User) []string {
+	if user.Role == store.RoleAdmin {
+		return pat.Scopes
+	}
+	return slices.DeleteFunc(slices.Clone(pat.Scopes), func(s string) bool { return s == pat.ScopeAdmin })
+}
@@ -0,0 +1,129 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"ccz/pat"
+)
+
+func TestTokenHandler(t *testing.T) {
+	st := newProfileStore(t)
+	h := &TokenHandler{Users: st, Tokens: st}
+	ctx := context.Background()
+
+	if err := st.CreateLocal(ctx, "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(email, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		h.Create(w, withUser(httptest.NewRequest(http.MethodPost, "/api/account/tokens", strings.NewReader(body)), email))
+		return w
+	}
+	list := func(email string) AccessTokenListResponse {
+		w := httptest.NewRecorder()
+		h.List(w, withUser(httptest.NewRequest(http.MethodGet, "/api/account/tokens", nil), email))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp AccessTokenListResponse
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	var created AccessTokenResponse
+	t.Run("Create", func(t *testing.T) {
+		w := create("test@ex.com", `{"name":" ci ","scopes":["profile:write","profile:read"],"expires_in_days":30}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("expected the token not to be cached, got %q", cc)
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+		if !pat.Is(created.Token) || !strings.HasPrefix(created.Token, created.Prefix) {
+			t.Errorf("expected a token starting with %q, got %q", created.Prefix, created.Token)
+		}
+		if created.Name != "ci" || strings.Join(created.Scopes, " ") != "profile:read profile:write" {
+			t.Errorf("unexpected token: %+v", created)
+		}
+		if days := created.ExpiresAt.Sub(created.CreatedAt).Hours() / 24; days != 30 {
+			t.Errorf("expected the token to last 30 days, got %v", days)
+		}
+	})
+
+	t.Run("Refused", func(t *testing.T) {
+		for _, tc := range []struct {
+			name, body, field string
+		}{
+			{"Duplicate Name", `{"name":"ci","scopes":["profile:read"],"expires_in_days":30}`, "name"},
+			{"No Scopes", `{"name":"other","scopes":[],"expires_in_days":30}`, "scopes"},
+			{"Unknown Scope", `{"name":"other","scopes":["profile:delete"],"expires_in_days":30}`, "scopes"},
+			{"Admin Scope", `{"name":"other","scopes":["admin"],"expires_in_days":30}`, "scopes"},
+			{"No Expiry", `{"name":"other","scopes":["profile:read"]}`, "expires_in_days"},
+			{"Too Long", `{"name":"other","scopes":["profile:read"],"expires_in_days":400}`, "expires_in_days"},
+		} {
+			t.Run(tc.name, func(t *testing.T) {
+				w := create("test@ex.com", tc.body)
+				if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"field":"`+tc.field+`"`) {
+					t.Errorf("expected an error on %s, got %d: %s", tc.field, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("Admin Scope", func(t *testing.T) {
+		if w := create("admin@ex.com", `{"name":"audit","scopes":["admin"],"expires_in_days":7}`); w.Code != http.StatusCreated {
+			t.Errorf("expected an admin to grant the admin scope, got %d: %s", w.Code, w.Body.String())
+		}
+		if scopes := list("test@ex.com").Scopes; strings.Join(scopes, " ") != "profile:read profile:write" {
+			t.Errorf("expected users to be offered the profile scopes, got %v", scopes)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		resp := list("test@ex.com")
+		if len(resp.Tokens) != 1 || resp.Tokens[0].ID != created.ID {
+			t.Fatalf("expected the one token, got %+v", resp.Tokens)
+		}
+		if resp.Tokens[0].Token != "" {
+			t.Error("expected the token itself not to be listed")
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		del := func(email, id string) int {
+			mux := http.NewServeMux()
+			mux.HandleFunc("DELETE /api/account/tokens/{id}", h.Delete)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, withUser(httptest.NewRequest(http.MethodDelete, "/api/account/tokens/"+id, nil), email))
+			return w.Code
+		}
+		id := strconv.FormatInt(created.ID, 10)
+		if code := del("admin@ex.com", id); code != http.StatusNotFound {
+			t.Errorf("expected another user's token to be out of reach, got %d", code)
+		}
+		if code := del("test@ex.com", "nope"); code != http.StatusNotFound {
+			t.Errorf("expected 404 for a malformed id, got %d", code)
+		}
+		if code := del("test@ex.com", id); code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", code)
+		}
+		if tokens := list("test@ex.com").Tokens; len(tokens) != 0 {
+			t.Errorf("expected no tokens left, got %+v", tokens)
+		}
+	})
+}
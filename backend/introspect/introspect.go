@@ -0,0 +1,265 @@
+// Package introspect lets other services check the tokens users send them
+// with this backend's introspection endpoint (RFC 7662), and revoke OAuth
+// access tokens with its revocation endpoint (RFC 7009), instead of
+// verifying tokens themselves.
+//
+// A service is registered as a confidential OAuth client with the
+// introspect scope:
+//
+//	c := introspect.New("https://id.example.com", clientID, clientSecret)
+//	info, err := c.Introspect(ctx, token)
+//	if err != nil {
+//		// the backend could not be asked
+//	}
+//	if !info.Active {
+//		// refuse the request
+//	}
+//
+// Answers are cached for as long as the backend's Cache-Control allows, so
+// a revoked token can be accepted for up to that long afterwards.
+package introspect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response is what the introspection endpoint says of a token. Inactive
+// tokens carry nothing else.
+type Response struct {
+	Active bool `json:"active"`
+	// Scope is space separated. Session tokens have none: they may do
+	// everything the user may.
+	Scope string `json:"scope,omitempty"`
+	// ClientID is the OAuth client the token was issued to, if any.
+	ClientID string `json:"client_id,omitempty"`
+	// Username is the user's email, for session and personal access
+	// tokens.
+	Username  string `json:"username,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	// Subject is the user's id or, for the client credentials grant, the
+	// client's.
+	Subject string `json:"sub,omitempty"`
+	Issuer  string `json:"iss,omitempty"`
+	ID      string `json:"jti,omitempty"`
+}
+
+// Scopes are the scopes the token was granted.
+func (r *Response) Scopes() []string {
+	return strings.Fields(r.Scope)
+}
+
+// HasScope reports whether the token was granted scope.
+func (r *Response) HasScope(scope string) bool {
+	for _, s := range r.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Error is an error answer of the backend.
+type Error struct {
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *Error) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("introspect: %d %s", e.Status, e.Code)
+	}
+	return fmt.Sprintf("introspect: %d %s: %s", e.Status, e.Code, e.Description)
+}
+
+// maxEntries bounds the cache. When it is full, expired answers are
+// dropped first and, failing that, all of them.
+const maxEntries = 10000
+
+type entry struct {
+	resp  *Response
+	until time.Time
+}
+
+// Client asks the backend about tokens. It is safe for concurrent use.
+type Client struct {
+	IntrospectURL string
+	RevokeURL     string
+	ClientID      string
+	ClientSecret  string
+	HTTPClient    *http.Client
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]entry
+	now   func() time.Time
+}
+
+// New returns a client of the backend at issuer, its OAuth issuer URL,
+// that authenticates as the OAuth client clientID.
+func New(issuer, clientID, clientSecret string) *Client {
+	issuer = strings.TrimSuffix(issuer, "/")
+	return &Client{
+		IntrospectURL: issuer + "/oauth/introspect",
+		RevokeURL:     issuer + "/oauth/revoke",
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		HTTPClient:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Introspect says whether token is active and what it may do. An error
+// means the backend could not say, not that the token is bad.
+func (c *Client) Introspect(ctx context.Context, token string) (*Response, error) {
+	key := sha256.Sum256([]byte(token))
+	if resp, ok := c.cached(key); ok {
+		return resp, nil
+	}
+
+	httpResp, err := c.post(ctx, c.IntrospectURL, token)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, readError(httpResp)
+	}
+	var resp Response
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("introspect: reading the answer: %w", err)
+	}
+	c.store(key, &resp, maxAge(httpResp.Header.Get("Cache-Control")))
+	return &resp, nil
+}
+
+// Revoke revokes an OAuth access token issued to the client or, for
+// clients with the introspect scope, to any client. Revoking a token that
+// is unknown or expired is not an error.
+func (c *Client) Revoke(ctx context.Context, token string) error {
+	httpResp, err := c.post(ctx, c.RevokeURL, token)
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return readError(httpResp)
+	}
+	c.mu.Lock()
+	delete(c.cache, sha256.Sum256([]byte(token)))
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) post(ctx context.Context, endpoint, token string) (*http.Response, error) {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	// RFC 6749 has both form-encoded before they go in the header.
+	req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("introspect: %w", err)
+	}
+	return resp, nil
+}
+
+func readError(resp *http.Response) error {
+	e := &Error{Status: resp.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e.Code = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
+
+func (c *Client) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+func (c *Client) cached(key [sha256.Size]byte) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !c.clock().Before(e.until) {
+		delete(c.cache, key)
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// store keeps resp for up to maxAge, but never past the token's expiry:
+// then it is no longer active, whatever the answer said.
+func (c *Client) store(key [sha256.Size]byte, resp *Response, maxAge time.Duration) {
+	if maxAge <= 0 {
+		return
+	}
+	now := c.clock()
+	until := now.Add(maxAge)
+	if resp.Active && resp.ExpiresAt != 0 {
+		if exp := time.Unix(resp.ExpiresAt, 0); exp.Before(until) {
+			until = exp
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[[sha256.Size]byte]entry{}
+	}
+	if len(c.cache) >= maxEntries {
+		for k, e := range c.cache {
+			if !now.Before(e.until) {
+				delete(c.cache, k)
+			}
+		}
+		if len(c.cache) >= maxEntries {
+			clear(c.cache)
+		}
+	}
+	c.cache[key] = entry{resp: resp, until: until}
+}
+
+// maxAge reads the max-age of a Cache-Control header. Answers marked
+// no-store or no-cache, or without a max-age, are not cached.
+func maxAge(cacheControl string) time.Duration {
+	var age time.Duration
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-store", "no-cache":
+			return 0
+		case "max-age":
+			n, err := strconv.Atoi(strings.Trim(value, `"`))
+			if err != nil || n < 0 {
+				return 0
+			}
+			age = time.Duration(n) * time.Second
+		}
+	}
+	return age
+}
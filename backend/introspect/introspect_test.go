@@ -0,0 +1,118 @@
+package introspect
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient(t *testing.T) {
+	var calls atomic.Int32
+	cacheControl := "private, max-age=60"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, secret, _ := r.BasicAuth(); id != "api" || secret != "s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_client","error_description":"Client authentication failed."}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/oauth/introspect":
+			calls.Add(1)
+			w.Header().Set("Cache-Control", cacheControl)
+			if r.PostFormValue("token") == "good" {
+				w.Write([]byte(`{"active":true,"sub":"7","scope":"openid email","exp":4102444800}`))
+				return
+			}
+			w.Write([]byte(`{"active":false}`))
+		case "/oauth/revoke":
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer srv.Close()
+	ctx := context.Background()
+
+	c := New(srv.URL+"/", "api", "s3cret")
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	resp, err := c.Introspect(ctx, "good")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Active || resp.Subject != "7" || !resp.HasScope("email") || resp.HasScope("phone") {
+		t.Errorf("unexpected answer %+v", resp)
+	}
+	if resp, err := c.Introspect(ctx, "bad"); err != nil || resp.Active {
+		t.Errorf("expected an inactive token, got %+v, %v", resp, err)
+	}
+
+	t.Run("Cached", func(t *testing.T) {
+		calls.Store(0)
+		if _, err := c.Introspect(ctx, "good"); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 0 {
+			t.Error("expected the cached answer")
+		}
+		now = now.Add(61 * time.Second)
+		if _, err := c.Introspect(ctx, "good"); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 1 {
+			t.Error("expected the backend to be asked once max-age passed")
+		}
+	})
+
+	t.Run("Revoke Forgets", func(t *testing.T) {
+		if err := c.Revoke(ctx, "good"); err != nil {
+			t.Fatal(err)
+		}
+		calls.Store(0)
+		if _, err := c.Introspect(ctx, "good"); err != nil {
+			t.Fatal(err)
+		}
+		if calls.Load() != 1 {
+			t.Error("expected a revoked token to be asked about again")
+		}
+	})
+
+	t.Run("No Store", func(t *testing.T) {
+		cacheControl = "no-store"
+		defer func() { cacheControl = "private, max-age=60" }()
+		calls.Store(0)
+		for range 2 {
+			if _, err := c.Introspect(ctx, "other"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if calls.Load() != 2 {
+			t.Errorf("expected no caching, got %d calls", calls.Load())
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		_, err := New(srv.URL, "api", "wrong").Introspect(ctx, "good")
+		var e *Error
+		if !errors.As(err, &e) || e.Status != http.StatusUnauthorized || e.Code != "invalid_client" {
+			t.Errorf("expected invalid_client, got %v", err)
+		}
+	})
+}
+
+func TestMaxAge(t *testing.T) {
+	for header, want := range map[string]time.Duration{
+		"private, max-age=60": time.Minute,
+		"max-age=0":           0,
+		"no-cache, max-age=5": 0,
+		"":                    0,
+		"max-age=abc":         0,
+	} {
+		if got := maxAge(header); got != want {
+			t.Errorf("%q: expected %v, got %v", header, want, got)
+		}
+	}
+}
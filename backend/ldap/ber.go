@@ -0,0 +1,173 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER identifiers used by LDAPv3 (RFC 4511). Tag numbers are all below 31,
+// so an identifier is always a single octet.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	appBindRequest      = 0x60
+	appBindResponse     = 0x61
+	appUnbindRequest    = 0x42
+	appSearchRequest    = 0x63
+	appSearchEntry      = 0x64
+	appSearchDone       = 0x65
+	appSearchReference  = 0x73
+	appExtendedRequest  = 0x77
+	appExtendedResponse = 0x78
+
+	ctxSimpleAuth  = 0x80
+	ctxRequestName = 0x80
+)
+
+// maxMessage bounds the messages read from the server. Entries of users
+// are small; this leaves room for many group memberships.
+const maxMessage = 1 << 20
+
+// tlv encodes one element.
+func tlv(tag byte, content []byte) []byte {
+	b := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x83, byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+// constructed encodes an element holding the elements parts.
+func constructed(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	return tlv(tag, content)
+}
+
+// integer encodes v in the fewest octets two's complement allows.
+func integer(tag byte, v int64) []byte {
+	var content []byte
+	for {
+		content = append([]byte{byte(v)}, content...)
+		if (v < 0x80 && v >= -0x80) || len(content) == 8 {
+			break
+		}
+		v >>= 8
+	}
+	return tlv(tag, content)
+}
+
+func octets(tag byte, s string) []byte { return tlv(tag, []byte(s)) }
+
+func boolean(b bool) []byte {
+	if b {
+		return tlv(tagBoolean, []byte{0xff})
+	}
+	return tlv(tagBoolean, []byte{0})
+}
+
+// element is a decoded element whose content is not yet parsed.
+type element struct {
+	tag     byte
+	content []byte
+}
+
+// readElement reads one element from r.
+func readElement(r *bufio.Reader) (element, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return element{}, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	n := int(first)
+	if first&0x80 != 0 {
+		octets := int(first & 0x7f)
+		if octets == 0 || octets > 3 {
+			return element{}, errors.New("ldap: unsupported length encoding")
+		}
+		n = 0
+		for range octets {
+			b, err := r.ReadByte()
+			if err != nil {
+				return element{}, unexpectedEOF(err)
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxMessage {
+		return element{}, fmt.Errorf("ldap: message of %d bytes is too long", n)
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return element{}, unexpectedEOF(err)
+	}
+	return element{tag: tag, content: content}, nil
+}
+
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// children parses the content of a constructed element.
+func (e element) children() ([]element, error) {
+	var out []element
+	data := e.content
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, errMalformed
+		}
+		tag, n, header := data[0], int(data[1]), 2
+		if data[1]&0x80 != 0 {
+			octets := int(data[1] & 0x7f)
+			if octets == 0 || octets > 3 || len(data) < 2+octets {
+				return nil, errMalformed
+			}
+			n = 0
+			for _, b := range data[2 : 2+octets] {
+				n = n<<8 | int(b)
+			}
+			header += octets
+		}
+		if len(data) < header+n {
+			return nil, errMalformed
+		}
+		out = append(out, element{tag: tag, content: data[header : header+n]})
+		data = data[header+n:]
+	}
+	return out, nil
+}
+
+// int reads the content of an INTEGER or ENUMERATED.
+func (e element) int() (int64, error) {
+	if len(e.content) == 0 || len(e.content) > 8 {
+		return 0, errMalformed
+	}
+	v := int64(int8(e.content[0]))
+	for _, b := range e.content[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+var errMalformed = errors.New("ldap: malformed message")
@@ -0,0 +1,195 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// Filter choices (RFC 4511 section 4.5.1).
+const (
+	filterAnd        = 0xa0
+	filterOr         = 0xa1
+	filterNot        = 0xa2
+	filterEquality   = 0xa3
+	filterSubstrings = 0xa4
+	filterGreater    = 0xa5
+	filterLess       = 0xa6
+	filterPresent    = 0x87
+	filterApprox     = 0xa8
+
+	substringInitial = 0x80
+	substringAny     = 0x81
+	substringFinal   = 0x82
+)
+
+// EscapeFilter escapes s for use as a value in a search filter, so that
+// what a user typed matches only itself.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			b.WriteByte('\\')
+			b.WriteString(hex.EncodeToString([]byte{c}))
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter encodes the string form of a search filter (RFC 4515),
+// such as (&(objectClass=person)(mail=jo@example.com)).
+func compileFilter(s string) ([]byte, error) {
+	encoded, rest, err := parseFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errFilter
+	}
+	return encoded, nil
+}
+
+var errFilter = errors.New("ldap: filter not valid")
+
+func parseFilter(s string) (encoded []byte, rest string, err error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", errFilter
+	}
+	s = s[1:]
+	switch s[0] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[0] == '|' {
+			tag = filterOr
+		}
+		s = s[1:]
+		var parts [][]byte
+		for strings.HasPrefix(s, "(") {
+			var part []byte
+			if part, s, err = parseFilter(s); err != nil {
+				return nil, "", err
+			}
+			parts = append(parts, part)
+		}
+		if len(parts) == 0 {
+			return nil, "", errFilter
+		}
+		encoded = constructed(tag, parts...)
+	case '!':
+		var part []byte
+		if part, s, err = parseFilter(s[1:]); err != nil {
+			return nil, "", err
+		}
+		encoded = constructed(filterNot, part)
+	default:
+		end := strings.IndexByte(s, ')')
+		if end < 0 {
+			return nil, "", errFilter
+		}
+		if encoded, err = parseItem(s[:end]); err != nil {
+			return nil, "", err
+		}
+		s = s[end:]
+	}
+	if !strings.HasPrefix(s, ")") {
+		return nil, "", errFilter
+	}
+	return encoded, s[1:], nil
+}
+
+// parseItem encodes a simple filter such as mail=jo@example.com.
+func parseItem(item string) ([]byte, error) {
+	i := strings.IndexByte(item, '=')
+	if i < 1 {
+		return nil, errFilter
+	}
+	attr, raw, tag := item[:i], item[i+1:], byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		attr, tag = attr[:len(attr)-1], filterGreater
+	case '<':
+		attr, tag = attr[:len(attr)-1], filterLess
+	case '~':
+		attr, tag = attr[:len(attr)-1], filterApprox
+	}
+	if !validAttribute(attr) {
+		return nil, errFilter
+	}
+
+	if tag == filterEquality && raw == "*" {
+		return tlv(filterPresent, []byte(attr)), nil
+	}
+	if tag != filterEquality || !strings.Contains(raw, "*") {
+		value, err := unescapeFilter(raw)
+		if err != nil {
+			return nil, err
+		}
+		return constructed(tag, octets(tagOctetString, attr), octets(tagOctetString, value)), nil
+	}
+
+	// Escaped asterisks are \2a, so every * left is a wildcard.
+	pieces := strings.Split(raw, "*")
+	var subs [][]byte
+	for i, piece := range pieces {
+		if piece == "" {
+			continue
+		}
+		value, err := unescapeFilter(piece)
+		if err != nil {
+			return nil, err
+		}
+		kind := byte(substringAny)
+		switch i {
+		case 0:
+			kind = substringInitial
+		case len(pieces) - 1:
+			kind = substringFinal
+		}
+		subs = append(subs, octets(kind, value))
+	}
+	return constructed(filterSubstrings, octets(tagOctetString, attr), constructed(tagSequence, subs...)), nil
+}
+
+// validAttribute reports whether s is an attribute description: a name or
+// OID, with options after semicolons.
+func validAttribute(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+func unescapeFilter(s string) (string, error) {
+	if !strings.ContainsAny(s, `\()`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(', ')':
+			return "", errFilter
+		case '\\':
+			if i+3 > len(s) {
+				return "", errFilter
+			}
+			c, err := hex.DecodeString(s[i+1 : i+3])
+			if err != nil {
+				return "", errFilter
+			}
+			b.Write(c)
+			i += 2
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
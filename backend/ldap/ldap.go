@@ -0,0 +1,338 @@
+// Package ldap is a client of the parts of LDAPv3 (RFC 4511) that signing
+// users in needs: simple binds, searches and StartTLS.
+//
+// A Conn carries one operation at a time. The deadline of the context it
+// was dialled with bounds everything done on it.
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Search scopes.
+const (
+	ScopeBase    = 0
+	ScopeOne     = 1
+	ScopeSubtree = 2
+)
+
+// Result codes callers tell apart.
+const (
+	ResultSuccess                 = 0
+	ResultSizeLimitExceeded       = 4
+	ResultConfidentialityRequired = 13
+	ResultInvalidCredentials      = 49
+	ResultInsufficientAccess      = 50
+	ResultUnavailable             = 52
+)
+
+const oidStartTLS = "1.3.6.1.4.1.1466.20037"
+
+// Error is a result other than success.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("ldap: result %d: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("ldap: result %d", e.Code)
+}
+
+// IsResult reports whether err is an *Error with code.
+func IsResult(err error, code int) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Code == code
+}
+
+// ErrEmptyPassword refuses a bind without a password. Servers take it as
+// an unauthenticated bind and answer success without checking anything
+// (RFC 4513 section 5.1.2).
+var ErrEmptyPassword = errors.New("ldap: empty password")
+
+// Conn is a connection to a directory server.
+type Conn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	host string
+	id   int64
+}
+
+// Dial connects to the server at rawURL: ldap://host[:389] or
+// ldaps://host[:636]. config is used for ldaps, with the host as its
+// ServerName unless it has one.
+func Dial(ctx context.Context, rawURL string, config *tls.Config) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: %w", err)
+	}
+	port := u.Port()
+	switch {
+	case u.Scheme != "ldap" && u.Scheme != "ldaps":
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	case port == "" && u.Scheme == "ldap":
+		port = "389"
+	case port == "":
+		port = "636"
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("ldap: the URL has no host")
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c := &Conn{conn: conn, r: bufio.NewReader(conn), host: u.Hostname()}
+	if u.Scheme == "ldaps" {
+		if err := c.handshake(config); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// handshake switches the connection to TLS.
+func (c *Conn) handshake(config *tls.Config) error {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = c.host
+	}
+	tc := tls.Client(c.conn, config)
+	if err := tc.Handshake(); err != nil {
+		return fmt.Errorf("ldap: TLS handshake: %w", err)
+	}
+	c.conn, c.r = tc, bufio.NewReader(tc)
+	return nil
+}
+
+// StartTLS switches a plain connection to TLS, as ldaps would have begun.
+func (c *Conn) StartTLS(config *tls.Config) error {
+	op, err := c.do(constructed(appExtendedRequest, octets(ctxRequestName, oidStartTLS)), appExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err := result(op); err != nil {
+		return err
+	}
+	return c.handshake(config)
+}
+
+// Bind authenticates the connection as dn. A wrong password is an *Error
+// with ResultInvalidCredentials.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return ErrEmptyPassword
+	}
+	op, err := c.do(constructed(appBindRequest,
+		integer(tagInteger, 3),
+		octets(tagOctetString, dn),
+		octets(ctxSimpleAuth, password),
+	), appBindResponse)
+	if err != nil {
+		return err
+	}
+	return result(op)
+}
+
+// SearchRequest is what to search for.
+type SearchRequest struct {
+	BaseDN string
+	Scope  int
+	// Filter is in the string form of RFC 4515. Values from users must be
+	// escaped with EscapeFilter.
+	Filter string
+	// Attributes lists the attributes to return; none returns them all.
+	Attributes []string
+	// SizeLimit, when not 0, is the most entries to return.
+	SizeLimit int
+}
+
+// Entry is an entry a search found.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of the attribute name, whose case does not
+// matter.
+func (e *Entry) Values(name string) []string {
+	for attr, values := range e.Attributes {
+		if strings.EqualFold(attr, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the attribute name.
+func (e *Entry) Value(name string) string {
+	if values := e.Values(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Search returns the entries req finds. Continuation references to other
+// servers are not followed. A search that found more than SizeLimit
+// entries returns those it got with an *Error of ResultSizeLimitExceeded.
+func (c *Conn) Search(req *SearchRequest) ([]Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make([][]byte, 0, len(req.Attributes))
+	for _, a := range req.Attributes {
+		attrs = append(attrs, octets(tagOctetString, a))
+	}
+	id, err := c.send(constructed(appSearchRequest,
+		octets(tagOctetString, req.BaseDN),
+		integer(tagEnumerated, int64(req.Scope)),
+		integer(tagEnumerated, 0), // neverDerefAliases
+		integer(tagInteger, int64(req.SizeLimit)),
+		integer(tagInteger, 0),
+		boolean(false),
+		filter,
+		constructed(tagSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for {
+		op, err := c.read(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case appSearchEntry:
+			e, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case appSearchReference:
+		case appSearchDone:
+			return entries, result(op)
+		default:
+			return nil, fmt.Errorf("ldap: unexpected response 0x%02x to a search", op.tag)
+		}
+	}
+}
+
+func parseEntry(op element) (Entry, error) {
+	parts, err := op.children()
+	if err != nil || len(parts) != 2 {
+		return Entry{}, errMalformed
+	}
+	e := Entry{DN: string(parts[0].content), Attributes: map[string][]string{}}
+	attrs, err := parts[1].children()
+	if err != nil {
+		return Entry{}, err
+	}
+	for _, attr := range attrs {
+		fields, err := attr.children()
+		if err != nil || len(fields) != 2 {
+			return Entry{}, errMalformed
+		}
+		vals, err := fields[1].children()
+		if err != nil {
+			return Entry{}, err
+		}
+		name := string(fields[0].content)
+		for _, v := range vals {
+			e.Attributes[name] = append(e.Attributes[name], string(v.content))
+		}
+	}
+	return e, nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	_, _ = c.send(tlv(appUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+// do sends op and reads the response, which must have the tag want.
+func (c *Conn) do(op []byte, want byte) (element, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return element{}, err
+	}
+	resp, err := c.read(id)
+	if err != nil {
+		return element{}, err
+	}
+	if resp.tag != want {
+		return element{}, fmt.Errorf("ldap: unexpected response 0x%02x", resp.tag)
+	}
+	return resp, nil
+}
+
+func (c *Conn) send(op []byte) (int64, error) {
+	c.id++
+	_, err := c.conn.Write(constructed(tagSequence, integer(tagInteger, c.id), op))
+	return c.id, err
+}
+
+// read returns the operation of the next message, which must answer id.
+func (c *Conn) read(id int64) (element, error) {
+	msg, err := readElement(c.r)
+	if err != nil {
+		return element{}, err
+	}
+	parts, err := msg.children()
+	if msg.tag != tagSequence || err != nil || len(parts) < 2 || parts[0].tag != tagInteger {
+		return element{}, errMalformed
+	}
+	got, err := parts[0].int()
+	if err != nil {
+		return element{}, err
+	}
+	if got == 0 {
+		// An unsolicited notification: the server is closing the
+		// connection.
+		if err := result(parts[1]); err != nil {
+			return element{}, err
+		}
+		return element{}, errors.New("ldap: the server closed the connection")
+	}
+	if got != id {
+		return element{}, fmt.Errorf("ldap: response to message %d, not %d", got, id)
+	}
+	return parts[1], nil
+}
+
+// result reads the LDAPResult that begins a response.
+func result(op element) error {
+	parts, err := op.children()
+	if err != nil || len(parts) < 3 || parts[0].tag != tagEnumerated {
+		return errMalformed
+	}
+	code, err := parts[0].int()
+	if err != nil {
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: int(code), Message: string(parts[2].content)}
+}
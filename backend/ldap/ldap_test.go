@@ -0,0 +1,141 @@
+package ldap
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"testing"
+	"time"
+
+	"ccz/ldap/ldaptest"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	if got := EscapeFilter(`jo*)(uid=*\`); got != `jo\2a\29\28uid=\2a\5c` {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	for _, tc := range []struct {
+		filter string
+		want   []byte
+	}{
+		{"(cn=Jo)", []byte{0xa3, 0x08, 0x04, 0x02, 'c', 'n', 0x04, 0x02, 'J', 'o'}},
+		{"(cn=*)", []byte{0x87, 0x02, 'c', 'n'}},
+		{`(cn=\2a)`, []byte{0xa3, 0x07, 0x04, 0x02, 'c', 'n', 0x04, 0x01, '*'}},
+		{"(cn=J*o*)", []byte{0xa4, 0x0c, 0x04, 0x02, 'c', 'n', 0x30, 0x06, 0x80, 0x01, 'J', 0x81, 0x01, 'o'}},
+		{"(!(cn=*))", []byte{0xa2, 0x04, 0x87, 0x02, 'c', 'n'}},
+		{"(&(a=*)(b=*))", []byte{0xa0, 0x06, 0x87, 0x01, 'a', 0x87, 0x01, 'b'}},
+		{"(n>=5)", []byte{0xa5, 0x06, 0x04, 0x01, 'n', 0x04, 0x01, '5'}},
+	} {
+		got, err := compileFilter(tc.filter)
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got % x, %v", tc.filter, got, err)
+		}
+	}
+	for _, bad := range []string{"", "cn=Jo", "(cn=Jo", "(cn=Jo))", "(=Jo)", "(&)", `(cn=\2)`, `(cn=\zz)`, "(c n=Jo)", "(cn=J(o)"} {
+		if _, err := compileFilter(bad); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
+
+func TestInteger(t *testing.T) {
+	for v, want := range map[int64][]byte{
+		0:    {0x02, 0x01, 0x00},
+		127:  {0x02, 0x01, 0x7f},
+		128:  {0x02, 0x02, 0x00, 0x80},
+		256:  {0x02, 0x02, 0x01, 0x00},
+		-1:   {0x02, 0x01, 0xff},
+		-129: {0x02, 0x02, 0xff, 0x7f},
+	} {
+		got := integer(tagInteger, v)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%d: got % x", v, got)
+		}
+		if n, err := (element{content: got[2:]}).int(); err != nil || n != v {
+			t.Errorf("%d: read back %d, %v", v, n, err)
+		}
+	}
+}
+
+func TestConn(t *testing.T) {
+	srv, err := ldaptest.Start(
+		ldaptest.Entry{DN: "cn=svc,dc=ex,dc=com", Password: "svc pass"},
+		ldaptest.Entry{DN: "uid=jo,ou=people,dc=ex,dc=com", Password: "jo pass", Attributes: map[string][]string{
+			"objectClass": {"person"}, "mail": {"jo@ex.com"}, "cn": {"Jo Doe"}, "memberOf": {"cn=a,dc=ex,dc=com", "cn=b,dc=ex,dc=com"},
+		}},
+		ldaptest.Entry{DN: "uid=al,ou=people,dc=ex,dc=com", Attributes: map[string][]string{
+			"objectClass": {"person"}, "mail": {"al@ex.com"}, "cn": {"Al"},
+		}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	srv.RequireTLS(true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := Dial(ctx, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.Bind("cn=svc,dc=ex,dc=com", "svc pass"); !IsResult(err, ResultConfidentialityRequired) {
+		t.Errorf("expected a bind without TLS refused, got %v", err)
+	}
+	if err := c.StartTLS(&tls.Config{RootCAs: srv.RootCAs}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Bind("cn=svc,dc=ex,dc=com", ""); !errors.Is(err, ErrEmptyPassword) {
+		t.Errorf("expected an empty password refused, got %v", err)
+	}
+	if err := c.Bind("cn=svc,dc=ex,dc=com", "wrong"); !IsResult(err, ResultInvalidCredentials) {
+		t.Errorf("expected invalid credentials, got %v", err)
+	}
+	if err := c.Bind("cn=svc,dc=ex,dc=com", "svc pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.Search(&SearchRequest{
+		BaseDN:     "ou=people,dc=ex,dc=com",
+		Scope:      ScopeSubtree,
+		Filter:     "(&(objectClass=person)(mail=" + EscapeFilter("JO@ex.com") + "))",
+		Attributes: []string{"cn", "memberof"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DN != "uid=jo,ou=people,dc=ex,dc=com" || entries[0].Value("CN") != "Jo Doe" ||
+		len(entries[0].Values("memberOf")) != 2 || entries[0].Value("mail") != "" {
+		t.Errorf("unexpected entries %+v", entries)
+	}
+
+	entries, err = c.Search(&SearchRequest{BaseDN: "dc=ex,dc=com", Scope: ScopeSubtree, Filter: "(objectClass=person)", SizeLimit: 1})
+	if !IsResult(err, ResultSizeLimitExceeded) || len(entries) != 1 {
+		t.Errorf("expected one entry and the size limit, got %d, %v", len(entries), err)
+	}
+	if entries, err := c.Search(&SearchRequest{BaseDN: "dc=ex,dc=com", Scope: ScopeOne, Filter: "(objectClass=person)"}); err != nil || len(entries) != 0 {
+		t.Errorf("expected nothing one level down, got %v, %v", entries, err)
+	}
+	if _, err := c.Search(&SearchRequest{BaseDN: "dc=ex,dc=com", Filter: "mail=jo@ex.com"}); err == nil {
+		t.Error("expected a bad filter refused")
+	}
+
+	if err := c.Bind("uid=jo,ou=people,dc=ex,dc=com", "jo pass"); err != nil {
+		t.Errorf("binding as the user: %v", err)
+	}
+}
+
+func TestDial(t *testing.T) {
+	ctx := context.Background()
+	for _, bad := range []string{"http://ex.com", "ldap://", "::"} {
+		if _, err := Dial(ctx, bad, nil); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
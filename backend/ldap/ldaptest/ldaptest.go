@@ -0,0 +1,484 @@
+// Package ldaptest is an LDAP server for tests. It answers binds, searches
+// and StartTLS from entries held in memory, as a directory would.
+//
+// It reads and writes BER with code of its own, so package ldap is checked
+// against an independent implementation.
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry is an entry of the directory.
+type Entry struct {
+	DN string
+	// Password is what binding as DN takes; an entry without one cannot
+	// be bound as.
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is a directory listening on the loopback interface.
+type Server struct {
+	// URL is where the server listens, as ldap://127.0.0.1:port.
+	URL string
+	// RootCAs trusts the certificate the server presents after StartTLS.
+	RootCAs *x509.CertPool
+
+	ln  net.Listener
+	tls *tls.Config
+
+	mu         sync.Mutex
+	entries    []Entry
+	requireTLS bool
+	binds      []string
+	conns      sync.WaitGroup
+}
+
+// Start starts a server holding entries.
+func Start(entries ...Entry) (*Server, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		URL:     "ldap://" + ln.Addr().String(),
+		RootCAs: pool,
+		ln:      ln,
+		tls:     &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}},
+		entries: entries,
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Add adds e to the directory, replacing the entry with its DN.
+func (s *Server) Add(e Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, old := range s.entries {
+		if sameDN(old.DN, e.DN) {
+			s.entries[i] = e
+			return
+		}
+	}
+	s.entries = append(s.entries, e)
+}
+
+// RequireTLS makes the server refuse binds before StartTLS, as directories
+// that protect passwords do.
+func (s *Server) RequireTLS(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requireTLS = on
+}
+
+// Binds returns the DNs of the binds that succeeded, in order.
+func (s *Server) Binds() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.binds)
+}
+
+// Close stops the server and waits for its connections to end.
+func (s *Server) Close() error {
+	err := s.ln.Close()
+	s.conns.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(time.Minute))
+			s.serve(conn)
+		}()
+	}
+}
+
+// Result codes.
+const (
+	success                 = 0
+	protocolError           = 2
+	sizeLimitExceeded       = 4
+	confidentialityRequired = 13
+	invalidCredentials      = 49
+	insufficientAccess      = 50
+)
+
+// session is the state of one connection.
+type session struct {
+	conn  net.Conn
+	r     *bufio.Reader
+	tls   bool
+	bound string
+}
+
+func (s *Server) serve(conn net.Conn) {
+	ss := &session{conn: conn, r: bufio.NewReader(conn)}
+	for {
+		tag, msg, err := read(ss.r)
+		if err != nil || tag != 0x30 {
+			return
+		}
+		parts := children(msg)
+		if len(parts) < 2 {
+			return
+		}
+		id := parts[0].content
+		op := parts[1]
+		switch op.tag {
+		case 0x60:
+			s.bind(ss, id, children(op.content))
+		case 0x42:
+			return
+		case 0x77:
+			if !s.extended(ss, id, children(op.content)) {
+				return
+			}
+		case 0x63:
+			s.search(ss, id, children(op.content))
+		default:
+			return
+		}
+	}
+}
+
+func (s *Server) bind(ss *session, id []byte, req []node) {
+	if len(req) != 3 || req[2].tag != 0x80 {
+		ss.reply(id, 0x61, protocolError, "")
+		return
+	}
+	dn, password := string(req[1].content), string(req[2].content)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if password == "" {
+		// An unauthenticated bind: real servers let it through.
+		ss.bound = ""
+		ss.reply(id, 0x61, success, "")
+		return
+	}
+	if s.requireTLS && !ss.tls {
+		ss.reply(id, 0x61, confidentialityRequired, "TLS required")
+		return
+	}
+	for _, e := range s.entries {
+		if sameDN(e.DN, dn) && e.Password != "" && e.Password == password {
+			ss.bound = e.DN
+			s.binds = append(s.binds, e.DN)
+			ss.reply(id, 0x61, success, "")
+			return
+		}
+	}
+	ss.bound = ""
+	ss.reply(id, 0x61, invalidCredentials, "")
+}
+
+// extended answers StartTLS; it returns false when the connection is over.
+func (s *Server) extended(ss *session, id []byte, req []node) bool {
+	if len(req) == 0 || string(req[0].content) != "1.3.6.1.4.1.1466.20037" || ss.tls {
+		ss.reply(id, 0x78, protocolError, "")
+		return true
+	}
+	ss.reply(id, 0x78, success, "")
+	tc := tls.Server(ss.conn, s.tls)
+	if err := tc.Handshake(); err != nil {
+		return false
+	}
+	ss.conn, ss.r, ss.tls = tc, bufio.NewReader(tc), true
+	return true
+}
+
+func (s *Server) search(ss *session, id []byte, req []node) {
+	if len(req) != 8 {
+		ss.reply(id, 0x65, protocolError, "")
+		return
+	}
+	if ss.bound == "" {
+		ss.reply(id, 0x65, insufficientAccess, "bind first")
+		return
+	}
+	base, scope, limit := string(req[0].content), number(req[1].content), number(req[3].content)
+	filter := req[6]
+	var wanted []string
+	for _, a := range children(req[7].content) {
+		wanted = append(wanted, string(a.content))
+	}
+
+	s.mu.Lock()
+	var found []Entry
+	for _, e := range s.entries {
+		if inScope(e.DN, base, scope) && matches(e, filter) {
+			found = append(found, e)
+		}
+	}
+	s.mu.Unlock()
+
+	for i, e := range found {
+		if limit > 0 && i == limit {
+			ss.reply(id, 0x65, sizeLimitExceeded, "")
+			return
+		}
+		var attrs [][]byte
+		names := make([]string, 0, len(e.Attributes))
+		for name := range e.Attributes {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			if len(wanted) > 0 && !slices.ContainsFunc(wanted, func(w string) bool { return strings.EqualFold(w, name) }) {
+				continue
+			}
+			var vals [][]byte
+			for _, v := range e.Attributes[name] {
+				vals = append(vals, encode(0x04, []byte(v)))
+			}
+			attrs = append(attrs, encode(0x30, encode(0x04, []byte(name)), encode(0x31, vals...)))
+		}
+		ss.write(id, encode(0x64, encode(0x04, []byte(e.DN)), encode(0x30, attrs...)))
+	}
+	ss.reply(id, 0x65, success, "")
+}
+
+func (ss *session) reply(id []byte, tag byte, code int, message string) {
+	ss.write(id, encode(tag, encode(0x0a, []byte{byte(code)}), encode(0x04, nil), encode(0x04, []byte(message))))
+}
+
+func (ss *session) write(id []byte, op []byte) {
+	_, _ = ss.conn.Write(encode(0x30, encode(0x02, id), op))
+}
+
+// matches reports whether e matches the filter f.
+func matches(e Entry, f node) bool {
+	switch f.tag {
+	case 0xa0:
+		for _, c := range children(f.content) {
+			if !matches(e, c) {
+				return false
+			}
+		}
+		return true
+	case 0xa1:
+		for _, c := range children(f.content) {
+			if matches(e, c) {
+				return true
+			}
+		}
+		return false
+	case 0xa2:
+		c := children(f.content)
+		return len(c) == 1 && !matches(e, c[0])
+	case 0x87:
+		return len(values(e, string(f.content))) > 0
+	case 0xa3, 0xa5, 0xa6, 0xa8:
+		c := children(f.content)
+		if len(c) != 2 {
+			return false
+		}
+		want := strings.ToLower(string(c[1].content))
+		return slices.ContainsFunc(values(e, string(c[0].content)), func(v string) bool {
+			v = strings.ToLower(v)
+			switch f.tag {
+			case 0xa5:
+				return v >= want
+			case 0xa6:
+				return v <= want
+			}
+			return v == want
+		})
+	case 0xa4:
+		c := children(f.content)
+		if len(c) != 2 {
+			return false
+		}
+		subs := children(c[1].content)
+		return slices.ContainsFunc(values(e, string(c[0].content)), func(v string) bool {
+			v = strings.ToLower(v)
+			for _, sub := range subs {
+				part := strings.ToLower(string(sub.content))
+				switch sub.tag {
+				case 0x80:
+					if !strings.HasPrefix(v, part) {
+						return false
+					}
+					v = v[len(part):]
+				case 0x81:
+					i := strings.Index(v, part)
+					if i < 0 {
+						return false
+					}
+					v = v[i+len(part):]
+				case 0x82:
+					if !strings.HasSuffix(v, part) {
+						return false
+					}
+					v = ""
+				}
+			}
+			return true
+		})
+	}
+	return false
+}
+
+func values(e Entry, name string) []string {
+	for attr, vals := range e.Attributes {
+		if strings.EqualFold(attr, name) {
+			return vals
+		}
+	}
+	return nil
+}
+
+func sameDN(a, b string) bool { return normalDN(a) == normalDN(b) }
+
+func normalDN(dn string) string {
+	return strings.ToLower(strings.ReplaceAll(dn, ", ", ","))
+}
+
+func inScope(dn, base string, scope int) bool {
+	dn, base = normalDN(dn), normalDN(base)
+	parent := ""
+	if i := strings.IndexByte(dn, ','); i >= 0 {
+		parent = dn[i+1:]
+	}
+	switch scope {
+	case 0:
+		return dn == base
+	case 1:
+		return parent == base
+	}
+	return base == "" || dn == base || strings.HasSuffix(dn, ","+base)
+}
+
+// node is an element of a message.
+type node struct {
+	tag     byte
+	content []byte
+}
+
+func encode(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, p := range parts {
+		content = append(content, p...)
+	}
+	n := len(content)
+	b := []byte{tag}
+	switch {
+	case n < 128:
+		b = append(b, byte(n))
+	case n < 1<<16:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+	return append(b, content...)
+}
+
+func read(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		size := make([]byte, n&0x7f)
+		if len(size) == 0 || len(size) > 4 {
+			return 0, nil, errors.New("ldaptest: bad length")
+		}
+		if _, err := io.ReadFull(r, size); err != nil {
+			return 0, nil, err
+		}
+		n = 0
+		for _, b := range size {
+			n = n<<8 | int(b)
+		}
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("ldaptest: message too long")
+	}
+	content := make([]byte, n)
+	_, err := io.ReadFull(r, content)
+	return header[0], content, err
+}
+
+// children splits content into its elements, stopping at anything
+// malformed.
+func children(content []byte) []node {
+	var out []node
+	for len(content) >= 2 {
+		tag, n, header := content[0], int(content[1]), 2
+		if n&0x80 != 0 {
+			size := n & 0x7f
+			if size == 0 || size > 4 || len(content) < 2+size {
+				return out
+			}
+			n = 0
+			for _, b := range content[2 : 2+size] {
+				n = n<<8 | int(b)
+			}
+			header += size
+		}
+		if len(content) < header+n {
+			return out
+		}
+		out = append(out, node{tag: tag, content: content[header : header+n]})
+		content = content[header+n:]
+	}
+	return out
+}
+
+func number(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n = n<<8 | int(c)
+	}
+	return n
+}
@@ -0,0 +1,52 @@
+package mailer
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log delivers nothing. It appends each message to the file at Path as a
+// line of JSON, or logs it when Path is empty, so links can be read back
+// in development and tests.
+type Log struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+type logLine struct {
+	Time    time.Time `json:"time"`
+	To      string    `json:"to"`
+	Subject string    `json:"subject"`
+	Body    string    `json:"body"`
+}
+
+func (l *Log) Send(ctx context.Context, m Message) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+	if l.Path == "" {
+		slog.InfoContext(ctx, "mail", "to", m.To, "subject", m.Subject, "body", m.Body)
+		return nil
+	}
+	line, err := json.Marshal(logLine{Time: time.Now().UTC(), To: m.To, Subject: m.Subject, Body: m.Body})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,58 @@
+// Package mailer delivers plain-text email through a pluggable Sender.
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// Message is a plain-text email to a single recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+func (m Message) validate() error {
+	// Line breaks would let a value add headers of its own.
+	if strings.ContainsAny(m.To+m.Subject, "\r\n") {
+		return errors.New("mailer: line break in header value")
+	}
+	return nil
+}
+
+// Sender delivers messages.
+type Sender interface {
+	Send(ctx context.Context, m Message) error
+}
+
+// SenderFromEnv picks the driver from MAIL_DRIVER: "log" (the default)
+// writes messages to MAIL_LOG_FILE or the server log, "smtp" sends them
+// through SMTP_HOST.
+func SenderFromEnv() (Sender, error) {
+	switch driver := os.Getenv("MAIL_DRIVER"); driver {
+	case "", "log":
+		return &Log{Path: os.Getenv("MAIL_LOG_FILE")}, nil
+	case "smtp":
+		host, port := os.Getenv("SMTP_HOST"), os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		s := &SMTP{
+			Addr:     net.JoinHostPort(host, port),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+		}
+		if host == "" || s.From == "" {
+			return nil, errors.New("mailer: SMTP_HOST and MAIL_FROM are required for the smtp driver")
+		}
+		return s, nil
+	default:
+		return nil, fmt.Errorf("mailer: unknown MAIL_DRIVER %q", driver)
+	}
+}
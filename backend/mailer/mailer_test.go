@@ -0,0 +1,127 @@
+package mailer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.log")
+	l := &Log{Path: path}
+	if err := l.Send(context.Background(), Message{To: "a@ex.com", Subject: "Hi", Body: "Hello"}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got logLine
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.To != "a@ex.com" || got.Subject != "Hi" || got.Body != "Hello" {
+		t.Errorf("unexpected line %+v", got)
+	}
+
+	if err := l.Send(context.Background(), Message{To: "a@ex.com\r\nBcc: b@ex.com", Subject: "Hi"}); err == nil {
+		t.Error("expected a header injection to be refused")
+	}
+}
+
+// fakeSMTP accepts one message and hands back what it received.
+func fakeSMTP(t *testing.T) (addr string, received <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	out := make(chan string, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		var transcript strings.Builder
+		reply("220 fake ESMTP")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250-fake")
+				reply("250 8BITMIME")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				out <- transcript.String()
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func TestSMTP(t *testing.T) {
+	addr, received := fakeSMTP(t)
+	s := &SMTP{Addr: addr, From: "noreply@ex.com"}
+	m := Message{To: "a@ex.com", Subject: "Confirm your new email", Body: "Open this link:\nhttps://ex.com/confirm"}
+	if err := s.Send(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+
+	got := <-received
+	for _, want := range []string{
+		"MAIL FROM:<noreply@ex.com>",
+		"RCPT TO:<a@ex.com>",
+		"Subject: Confirm your new email\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n",
+		"Open this link:\r\nhttps://ex.com/confirm",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in the transcript:\n%s", want, got)
+		}
+	}
+}
+
+func TestSenderFromEnv(t *testing.T) {
+	t.Setenv("MAIL_DRIVER", "smtp")
+	t.Setenv("SMTP_HOST", "mail.ex.com")
+	t.Setenv("MAIL_FROM", "")
+	if _, err := SenderFromEnv(); err == nil {
+		t.Error("expected an error without MAIL_FROM")
+	}
+	t.Setenv("MAIL_FROM", "noreply@ex.com")
+	if s, err := SenderFromEnv(); err != nil || s.(*SMTP).Addr != "mail.ex.com:587" {
+		t.Errorf("unexpected sender %v, %v", s, err)
+	}
+	t.Setenv("MAIL_DRIVER", "fax")
+	if _, err := SenderFromEnv(); err == nil {
+		t.Error("expected an error for an unknown driver")
+	}
+}
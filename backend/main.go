@@ -10,8 +10,18 @@ import (
 	"syscall"
 	"time"
 
+	"ccz/authn"
+	"ccz/avatar"
 	"ccz/db"
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/password"
+	"ccz/pii"
 	"ccz/routes"
+	"ccz/saml"
+	"ccz/sms"
+	"ccz/store"
 	"ccz/utils"
 )
 
@@ -26,25 +36,104 @@ func main() {
 		port = "8081"
 	}
 
-	database, err := db.Connect()
+	dbConfig, err := db.ConfigFromEnv()
+	if err != nil {
+		slog.Error("invalid database config", "error", err)
+		os.Exit(1)
+	}
+
+	database, dialect, err := db.Connect(context.Background(), dbConfig)
 	if err != nil {
 		slog.Error("database connection failed", "error", err)
 		os.Exit(1)
 	}
 	defer database.Close()
 
-	mux := http.NewServeMux()
+	probeCtx, stopProbe := context.WithCancel(context.Background())
+	defer stopProbe()
+	prober := db.NewProber(database, dbConfig.HealthInterval)
+	go prober.Run(probeCtx)
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-	})
+	replicas, err := db.ConnectReplicas(context.Background(), dbConfig, dialect)
+	if err != nil {
+		slog.Error("replica setup failed", "error", err)
+		os.Exit(1)
+	}
+	router := db.NewRouter(database, dialect, replicas, dbConfig)
+	defer router.Close()
+	go router.Run(probeCtx, dbConfig.HealthInterval)
 
-	routes.RegisterAuthRoutes(mux, database)
-	routes.RegisterProfileRoutes(mux, database)
+	mux := http.NewServeMux()
+	routes.RegisterHealthRoutes(mux, prober, router)
+
+	api := http.NewServeMux()
+	st := store.NewSQL(database, dialect)
+	st.Router = router
+	if keyFile := os.Getenv("PII_KEY_FILE"); keyFile != "" {
+		keyring, err := pii.LoadKeyFile(keyFile)
+		if err != nil {
+			slog.Error("loading PII key file failed", "error", err)
+			os.Exit(1)
+		}
+		st.Cipher = keyring
+		slog.Info("PII encryption enabled", "key_version", keyring.CurrentVersion())
+	}
+	avatars, err := avatar.StorageFromEnv()
+	if err != nil {
+		slog.Error("invalid avatar storage config", "error", err)
+		os.Exit(1)
+	}
+	sender, err := sms.SenderFromEnv()
+	if err != nil {
+		slog.Error("invalid SMS config", "error", err)
+		os.Exit(1)
+	}
+	mail, err := mailer.SenderFromEnv()
+	if err != nil {
+		slog.Error("invalid mail config", "error", err)
+		os.Exit(1)
+	}
+	policy, err := password.PolicyFromEnv()
+	if err != nil {
+		slog.Error("invalid password policy", "error", err)
+		os.Exit(1)
+	}
+	stepUp, err := middleware.StepUpFromEnv()
+	if err != nil {
+		slog.Error("invalid reauthentication config", "error", err)
+		os.Exit(1)
+	}
+	provider, err := oauth.ProviderFromEnv()
+	if err != nil {
+		slog.Error("invalid OAuth provider config", "error", err)
+		os.Exit(1)
+	}
+	samlConfig, err := saml.ConfigFromEnv()
+	if err != nil {
+		slog.Error("invalid SAML config", "error", err)
+		os.Exit(1)
+	}
+	authenticator, err := authn.FromEnv(st, st)
+	if err != nil {
+		slog.Error("invalid authentication config", "error", err)
+		os.Exit(1)
+	}
+	routes.RegisterAuthRoutes(api, st, st, authenticator, policy, avatars)
+	routes.RegisterProfileRoutes(api, st, st, st, avatars)
+	routes.RegisterPhoneRoutes(api, st, st, sender)
+	routes.RegisterEmailRoutes(api, st, st, mail, stepUp)
+	routes.RegisterAdminRoutes(api, st, st, st, stepUp)
+	routes.RegisterAccountRoutes(api, st, st, st, policy, mail, stepUp)
+	routes.RegisterOAuthRoutes(api, st, st, st, provider, stepUp)
+	routes.RegisterSAMLRoutes(api, st, st, st, samlConfig, stepUp)
+	withDB := middleware.RequireDB(prober, middleware.RouteErrors(api))
+	mux.Handle("/api/", withDB)
+	mux.Handle("/oauth/", withDB)
+	mux.Handle("/.well-known/", withDB)
 
 	srv := &http.Server{
 		Addr:         ":" + port,
-		Handler:      mux,
+		Handler:      middleware.RequestID(middleware.RouteErrors(mux)),
 		ReadTimeout:  5 * time.Second,
 		WriteTimeout: 10 * time.Second,
 		IdleTimeout:  120 * time.Second,
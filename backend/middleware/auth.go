@@ -2,54 +2,202 @@ package middleware
 
 import (
 	"context"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"time"
+
+	"ccz/pat"
+	"ccz/problem"
+	"ccz/store"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 type contextKey string
 
-const UserEmailKey contextKey = "user_email"
+const (
+	UserEmailKey contextKey = "user_email"
+	// AuthKey holds the Auth of the session, from the token's auth_time
+	// and amr claims.
+	AuthKey contextKey = "auth"
+	// ScopesKey holds the scopes of the personal access token a request
+	// was made with. Sessions have none.
+	ScopesKey contextKey = "scopes"
+)
 
+// Sessions tells when a user last signed out every session.
+type Sessions interface {
+	SessionsRevokedAt(ctx context.Context, email string) (time.Time, error)
+}
+
+// AuthMiddleware checks the token alone. Routes for users who can sign out
+// their other sessions use Authenticate.
 func AuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		authHeader := r.Header.Get("Authorization")
-		if authHeader == "" {
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
-		}
+	return Authenticate(nil)(next)
+}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			http.Error(w, "Invalid token format", http.StatusUnauthorized)
-			return
-		}
+// Tokens looks up personal access tokens.
+type Tokens interface {
+	UseAccessToken(ctx context.Context, hash, ip string, now time.Time) (*store.AccessToken, error)
+}
 
-		tokenString := parts[1]
-		token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+// Authenticate requires a valid session token and puts its email and
+// Auth in the request context. When sessions is not nil, tokens
+// issued before their user last signed out every session are refused.
+func Authenticate(sessions Sessions) func(http.HandlerFunc) http.HandlerFunc {
+	return authenticate(sessions, nil, "")
+}
 
-		if err != nil || !token.Valid {
-			http.Error(w, "Invalid token", http.StatusUnauthorized)
-			return
-		}
+// AuthenticateScope is Authenticate for routes scripts may use too: it
+// also accepts personal access tokens granted scope. Those carry no Auth,
+// so routes that need a StepUp stay out of their reach.
+func AuthenticateScope(sessions Sessions, tokens Tokens, scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return authenticate(sessions, tokens, scope)
+}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok {
-			http.Error(w, "Invalid claims", http.StatusUnauthorized)
-			return
-		}
+func authenticate(sessions Sessions, tokens Tokens, scope string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			authHeader := r.Header.Get("Authorization")
+			if authHeader == "" {
+				problem.Error(w, r, http.StatusUnauthorized, problem.Unauthenticated, "Sign in to continue.")
+				return
+			}
+
+			parts := strings.Split(authHeader, " ")
+			if len(parts) != 2 || parts[0] != "Bearer" {
+				problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The Authorization header must be a Bearer token.")
+				return
+			}
+
+			tokenString := parts[1]
+			if pat.Is(tokenString) {
+				if t, ok := accessToken(w, r, tokens, scope, tokenString); ok {
+					ctx := context.WithValue(r.Context(), UserEmailKey, t.Email)
+					next(w, r.WithContext(context.WithValue(ctx, ScopesKey, t.Scopes)))
+				}
+				return
+			}
+
+			token, err := jwt.Parse(tokenString, func(t *jwt.Token) (interface{}, error) {
+				return []byte(os.Getenv("JWT_SECRET")), nil
+			})
+
+			if err != nil || !token.Valid {
+				problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The token is malformed, expired or not signed by this server.")
+				return
+			}
+
+			claims, ok := token.Claims.(jwt.MapClaims)
+			if !ok {
+				problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The token claims cannot be read.")
+				return
+			}
+
+			email, ok := claims["email"].(string)
+			if !ok {
+				problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The token names no email.")
+				return
+			}
+
+			if sessions != nil && !current(w, r, sessions, email, claims) {
+				return
+			}
 
-		email, ok := claims["email"].(string)
-		if !ok {
-			http.Error(w, "Invalid email in token", http.StatusUnauthorized)
-			return
+			ctx := context.WithValue(r.Context(), UserEmailKey, email)
+			ctx = context.WithValue(ctx, AuthKey, Auth{
+				Time:    claimTime(claims, "auth_time"),
+				Methods: claimStrings(claims, "amr"),
+			})
+			next(w, r.WithContext(ctx))
 		}
+	}
+}
+
+// current reports whether the token with claims was issued after its user
+// last signed out every session, and answers the request when it was not.
+// Tokens are compared by whole seconds, which is what iat holds, so one
+// issued in the same second as the sign-out still works. The handler that
+// revoked the sessions relies on that for the token it issues in their
+// place.
+func current(w http.ResponseWriter, r *http.Request, sessions Sessions, email string, claims jwt.MapClaims) bool {
+	revokedAt, err := sessions.SessionsRevokedAt(r.Context(), email)
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		// Handlers answer for users that no longer exist.
+		return true
+	case err != nil:
+		failed(w, r, "checking session revocation failed", err)
+		return false
+	}
+	if !revokedAt.IsZero() && claimTime(claims, "iat").Unix() < revokedAt.Unix() {
+		problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "This session was signed out. Sign in again.")
+		return false
+	}
+	return true
+}
+
+// accessToken checks a personal access token and returns it. It answers
+// the request when the token is not good for scope, or the route takes
+// none.
+func accessToken(w http.ResponseWriter, r *http.Request, tokens Tokens, scope, token string) (*store.AccessToken, bool) {
+	if tokens == nil {
+		problem.Error(w, r, http.StatusForbidden, problem.InsufficientScope, "Personal access tokens cannot be used here. Sign in instead.")
+		return nil, false
+	}
+	t, err := tokens.UseAccessToken(r.Context(), pat.Hash(token), ClientIP(r), time.Now())
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The access token is unknown or was revoked.")
+		return nil, false
+	case errors.Is(err, store.ErrTokenExpired):
+		problem.Error(w, r, http.StatusUnauthorized, problem.InvalidToken, "The access token has expired.")
+		return nil, false
+	case err != nil:
+		failed(w, r, "checking access token failed", err)
+		return nil, false
+	}
+	if !slices.Contains(t.Scopes, scope) {
+		w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope", scope="`+scope+`"`)
+		problem.Error(w, r, http.StatusForbidden, problem.InsufficientScope, "The access token needs the "+scope+" scope.")
+		return nil, false
+	}
+	return t, true
+}
+
+// failed answers a request whose credentials could not be checked.
+func failed(w http.ResponseWriter, r *http.Request, msg string, err error) {
+	if errors.Is(err, store.ErrUnavailable) {
+		Unavailable(w, r)
+		return
+	}
+	slog.Error(msg, "path", r.URL.Path, "request_id", w.Header().Get(problem.RequestIDHeader), "error", err)
+	problem.Error(w, r, http.StatusInternalServerError, problem.Internal, "")
+}
 
-		ctx := context.WithValue(r.Context(), UserEmailKey, email)
-		next(w, r.WithContext(ctx))
+// claimTime reads a NumericDate claim, giving the zero time when it is
+// missing.
+func claimTime(claims jwt.MapClaims, name string) time.Time {
+	v, ok := claims[name].(float64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(int64(v), 0)
+}
+
+// claimStrings reads a claim holding an array of strings, skipping
+// anything else in it.
+func claimStrings(claims jwt.MapClaims, name string) []string {
+	list, _ := claims[name].([]any)
+	var out []string
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
 	}
+	return out
 }
@@ -1,12 +1,17 @@
 package middleware
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
+	"ccz/pat"
+	"ccz/problem"
+	"ccz/store"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -31,6 +36,9 @@ func TestAuthMiddleware(t *testing.T) {
 		if w.Code != http.StatusUnauthorized {
 			t.Errorf("expected 401, got %d", w.Code)
 		}
+		if ct := w.Header().Get("Content-Type"); ct != problem.ContentType {
+			t.Errorf("expected %s, got %q", problem.ContentType, ct)
+		}
 	})
 
 	t.Run("Invalid Token Format", func(t *testing.T) {
@@ -93,3 +101,133 @@ func TestAuthMiddleware(t *testing.T) {
 		}
 	})
 }
+
+// revocations is a Sessions that knows when each user signed out.
+type revocations map[string]time.Time
+
+func (s revocations) SessionsRevokedAt(ctx context.Context, email string) (time.Time, error) {
+	at, ok := s[email]
+	if !ok {
+		return time.Time{}, store.ErrNotFound
+	}
+	return at, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	secret := "test-secret"
+	t.Setenv("JWT_SECRET", secret)
+	revokedAt := time.Now().Add(-time.Minute).Truncate(time.Second)
+	sessions := revocations{"user@test.com": revokedAt, "other@test.com": {}}
+
+	var auth Auth
+	handler := Authenticate(sessions)(func(w http.ResponseWriter, r *http.Request) {
+		auth = AuthFrom(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	serve := func(claims jwt.MapClaims) int {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+		tokenString, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenString)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	for _, tc := range []struct {
+		name   string
+		claims jwt.MapClaims
+		want   int
+	}{
+		{"Issued Before Sign-Out", jwt.MapClaims{"email": "user@test.com", "iat": revokedAt.Add(-time.Second).Unix()}, http.StatusUnauthorized},
+		{"Without Issue Time", jwt.MapClaims{"email": "user@test.com"}, http.StatusUnauthorized},
+		{"Issued With Sign-Out", jwt.MapClaims{"email": "user@test.com", "iat": revokedAt.Unix()}, http.StatusOK},
+		{"Never Signed Out", jwt.MapClaims{"email": "other@test.com"}, http.StatusOK},
+		{"Unknown User", jwt.MapClaims{"email": "gone@test.com"}, http.StatusOK},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := serve(tc.claims); code != tc.want {
+				t.Errorf("expected %d, got %d", tc.want, code)
+			}
+		})
+	}
+
+	t.Run("Auth", func(t *testing.T) {
+		signedIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+		claims := jwt.MapClaims{"email": "other@test.com", "auth_time": signedIn.Unix(), "amr": []string{MethodPassword}}
+		if code := serve(claims); code != http.StatusOK {
+			t.Fatalf("expected 200, got %d", code)
+		}
+		if !auth.Time.Equal(signedIn) || len(auth.Methods) != 1 || auth.Methods[0] != MethodPassword {
+			t.Errorf("expected the sign-in in the context, got %+v", auth)
+		}
+	})
+}
+
+func TestAuthenticateScope(t *testing.T) {
+	st := store.NewMemory()
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "user@test.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	issue := func(name string, expiresAt time.Time, scopes ...string) string {
+		token, prefix, hash, err := pat.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := &store.AccessToken{Name: name, Prefix: prefix, Hash: hash, Scopes: scopes, CreatedAt: time.Now(), ExpiresAt: expiresAt}
+		if err := st.CreateAccessToken(ctx, "user@test.com", at); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	reader := issue("reader", time.Time{}, pat.ScopeProfileRead)
+	expired := issue("expired", time.Now().Add(-time.Minute), pat.ScopeProfileRead)
+
+	var email string
+	var auth Auth
+	next := func(w http.ResponseWriter, r *http.Request) {
+		email, _ = r.Context().Value(UserEmailKey).(string)
+		auth = AuthFrom(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}
+	serve := func(mw func(http.HandlerFunc) http.HandlerFunc, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mw(next)(w, req)
+		return w
+	}
+
+	t.Run("Granted", func(t *testing.T) {
+		w := serve(AuthenticateScope(st, st, pat.ScopeProfileRead), reader)
+		if w.Code != http.StatusOK || email != "user@test.com" {
+			t.Fatalf("expected the owner to be let in, got %d for %q", w.Code, email)
+		}
+		if !auth.Time.IsZero() {
+			t.Errorf("expected an access token to carry no sign-in, got %+v", auth)
+		}
+		tokens, _ := st.AccessTokens(ctx, "user@test.com")
+		if tokens[1].LastUsedAt.IsZero() || tokens[1].LastUsedIP != "192.0.2.1" {
+			t.Errorf("expected the use to be recorded, got %+v", tokens[1])
+		}
+	})
+
+	for _, tc := range []struct {
+		name  string
+		mw    func(http.HandlerFunc) http.HandlerFunc
+		token string
+		want  int
+	}{
+		{"Missing Scope", AuthenticateScope(st, st, pat.ScopeProfileWrite), reader, http.StatusForbidden},
+		{"Sessions Only", Authenticate(st), reader, http.StatusForbidden},
+		{"Expired", AuthenticateScope(st, st, pat.ScopeProfileRead), expired, http.StatusUnauthorized},
+		{"Unknown", AuthenticateScope(st, st, pat.ScopeProfileRead), pat.Marker + "unknown", http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if w := serve(tc.mw, tc.token); w.Code != tc.want {
+				t.Errorf("expected %d, got %d: %s", tc.want, w.Code, w.Body.String())
+			}
+		})
+	}
+}
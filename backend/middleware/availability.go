@@ -0,0 +1,34 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"ccz/problem"
+)
+
+// RetryAfter is what clients are told to wait while the database is down.
+var RetryAfter = 5 * time.Second
+
+type HealthChecker interface {
+	Healthy() bool
+}
+
+// Unavailable writes a 503 with a Retry-After header.
+func Unavailable(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(RetryAfter.Seconds())))
+	problem.Error(w, r, http.StatusServiceUnavailable, problem.Unavailable, "The database is unreachable. Try again shortly.")
+}
+
+// RequireDB short-circuits requests with 503 while checker reports the
+// database as unreachable, instead of letting each one time out on the pool.
+func RequireDB(checker HealthChecker, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !checker.Healthy() {
+			Unavailable(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,36 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakeChecker bool
+
+func (f fakeChecker) Healthy() bool { return bool(f) }
+
+func TestRequireDB(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("Healthy", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RequireDB(fakeChecker(true), next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Unhealthy", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RequireDB(fakeChecker(false), next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if w.Code != http.StatusServiceUnavailable {
+			t.Errorf("expected 503, got %d", w.Code)
+		}
+		if w.Header().Get("Retry-After") != "5" {
+			t.Errorf("expected Retry-After 5, got %q", w.Header().Get("Retry-After"))
+		}
+	})
+}
@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ccz/problem"
+)
+
+func TestRequestID(t *testing.T) {
+	var seen string
+	handler := RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = r.Header.Get(problem.RequestIDHeader)
+	}))
+
+	t.Run("Generated", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		id := w.Header().Get(problem.RequestIDHeader)
+		if len(id) != 16 || id != seen {
+			t.Errorf("expected a generated id passed to the handler, got %q and %q", id, seen)
+		}
+	})
+
+	t.Run("Kept", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(problem.RequestIDHeader, "frontend-42")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if id := w.Header().Get(problem.RequestIDHeader); id != "frontend-42" || seen != id {
+			t.Errorf("expected the caller's id, got %q", id)
+		}
+	})
+
+	t.Run("Replaced", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(problem.RequestIDHeader, "bad id\nwith newline")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if id := w.Header().Get(problem.RequestIDHeader); len(id) != 16 {
+			t.Errorf("expected an unusable id to be replaced, got %q", id)
+		}
+	})
+}
+
+func TestRouteErrors(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /things", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	handler := RouteErrors(mux)
+
+	for _, tc := range []struct {
+		method, path string
+		status       int
+		contentType  string
+	}{
+		{http.MethodGet, "/things", http.StatusOK, "text/plain; charset=utf-8"},
+		{http.MethodGet, "/nothing", http.StatusNotFound, problem.ContentType},
+		{http.MethodDelete, "/things", http.StatusMethodNotAllowed, problem.ContentType},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.status || w.Header().Get("Content-Type") != tc.contentType {
+			t.Errorf("%s %s: expected %d %s, got %d %s", tc.method, tc.path, tc.status, tc.contentType, w.Code, w.Header().Get("Content-Type"))
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/things", nil))
+	if allow := w.Header().Get("Allow"); allow == "" {
+		t.Error("expected Allow to be kept")
+	}
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"net/http"
+
+	"ccz/problem"
+)
+
+// RouteErrors serves mux, turning the plain-text 404 and 405 responses it
+// writes for requests no pattern matches into problem responses.
+func RouteErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+		rw := &routeError{ResponseWriter: w}
+		h.ServeHTTP(rw, r)
+		switch rw.status {
+		case http.StatusNotFound:
+			problem.Error(w, r, http.StatusNotFound, problem.NotFound, "Nothing exists at this address.")
+		case http.StatusMethodNotAllowed:
+			problem.Error(w, r, http.StatusMethodNotAllowed, problem.MethodNotAllowed, "")
+		}
+	})
+}
+
+// routeError holds back the body of a mux error response so a problem can
+// be written in its place. Headers such as Allow pass through.
+type routeError struct {
+	http.ResponseWriter
+	status int
+}
+
+func (e *routeError) WriteHeader(status int) {
+	e.status = status
+	if !e.held() {
+		e.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (e *routeError) Write(b []byte) (int, error) {
+	if e.status == 0 {
+		e.WriteHeader(http.StatusOK)
+	}
+	if e.held() {
+		return len(b), nil
+	}
+	return e.ResponseWriter.Write(b)
+}
+
+func (e *routeError) held() bool {
+	return e.status == http.StatusNotFound || e.status == http.StatusMethodNotAllowed
+}
@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"ccz/problem"
+)
+
+// Authentication methods, as recorded in the amr claim of session tokens.
+// MethodPassword is the RFC 8176 name; the registry has none for signing
+// in with another provider.
+const (
+	MethodPassword = "pwd"
+	MethodGoogle   = "google"
+	MethodSAML     = "saml"
+)
+
+// Auth is when and how the user of a session last proved who they are.
+// Tokens issued before auth_time was recorded have the zero Auth.
+type Auth struct {
+	Time    time.Time
+	Methods []string
+}
+
+// AuthFrom returns the Auth that Authenticate put in ctx.
+func AuthFrom(ctx context.Context) Auth {
+	a, _ := ctx.Value(AuthKey).(Auth)
+	return a
+}
+
+// Recent reports whether the user proved who they are within maxAge of
+// now, with one of methods when any are given. A maxAge of zero accepts
+// any age.
+func (a Auth) Recent(maxAge time.Duration, methods ...string) bool {
+	if a.Time.IsZero() || maxAge > 0 && time.Since(a.Time) > maxAge {
+		return false
+	}
+	return len(methods) == 0 || slices.ContainsFunc(a.Methods, func(m string) bool {
+		return slices.Contains(methods, m)
+	})
+}
+
+// StepUp guards sensitive routes, which a stolen or long-lived session
+// should not be able to use on its own.
+type StepUp struct {
+	// MaxAge is how long after proving who they are a user may use them.
+	MaxAge time.Duration
+}
+
+func DefaultStepUp() StepUp {
+	return StepUp{MaxAge: 5 * time.Minute}
+}
+
+// StepUpFromEnv reads REAUTH_MAX_AGE, keeping the default when it is
+// unset.
+func StepUpFromEnv() (StepUp, error) {
+	s := DefaultStepUp()
+	if v := os.Getenv("REAUTH_MAX_AGE"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return s, fmt.Errorf("middleware: REAUTH_MAX_AGE must be a positive duration like 5m, got %q", v)
+		}
+		s.MaxAge = d
+	}
+	return s, nil
+}
+
+// Recent reports whether the session of r proved who its user is within
+// MaxAge, with one of methods when any are given.
+func (s StepUp) Recent(r *http.Request, methods ...string) bool {
+	return AuthFrom(r.Context()).Recent(s.MaxAge, methods...)
+}
+
+// Require wraps handlers behind Authenticate so they answer 401
+// reauthentication_required unless the session is Recent. The challenge
+// follows RFC 9470, so clients know to sign in again and how recently.
+func (s StepUp) Require(methods ...string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if !s.Recent(r, methods...) {
+				s.Challenge(w, r, "Confirm it is you to continue.")
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// Challenge answers r with 401 reauthentication_required and detail.
+func (s StepUp) Challenge(w http.ResponseWriter, r *http.Request, detail string) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="insufficient_user_authentication", `+
+		`error_description="A more recent authentication is required", max_age=`+
+		strconv.Itoa(int(s.MaxAge.Seconds())))
+	problem.Error(w, r, http.StatusUnauthorized, problem.ReauthRequired, detail)
+}
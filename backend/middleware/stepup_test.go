@@ -0,0 +1,75 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStepUp(t *testing.T) {
+	s := StepUp{MaxAge: 5 * time.Minute}
+	serve := func(auth Auth, methods ...string) *httptest.ResponseRecorder {
+		handler := s.Require(methods...)(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), AuthKey, auth))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	recent := Auth{Time: time.Now().Add(-time.Minute), Methods: []string{MethodGoogle}}
+
+	for _, tc := range []struct {
+		name    string
+		auth    Auth
+		methods []string
+		want    int
+	}{
+		{"Recent", recent, nil, http.StatusOK},
+		{"Recent With Method", recent, []string{MethodPassword, MethodGoogle}, http.StatusOK},
+		{"Other Method", recent, []string{MethodPassword}, http.StatusUnauthorized},
+		{"Stale", Auth{Time: time.Now().Add(-time.Hour), Methods: []string{MethodPassword}}, nil, http.StatusUnauthorized},
+		{"Never", Auth{}, nil, http.StatusUnauthorized},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(tc.auth, tc.methods...)
+			if w.Code != tc.want {
+				t.Fatalf("expected %d, got %d", tc.want, w.Code)
+			}
+			if tc.want == http.StatusUnauthorized {
+				if !strings.Contains(w.Body.String(), "reauthentication_required") {
+					t.Errorf("expected a reauthentication problem, got %s", w.Body.String())
+				}
+				if got := w.Header().Get("WWW-Authenticate"); !strings.Contains(got, "insufficient_user_authentication") || !strings.Contains(got, "max_age=300") {
+					t.Errorf("expected a step-up challenge, got %q", got)
+				}
+			}
+		})
+	}
+
+	t.Run("Any Age", func(t *testing.T) {
+		old := Auth{Time: time.Now().Add(-24 * time.Hour), Methods: []string{MethodPassword}}
+		if !old.Recent(0, MethodPassword) {
+			t.Error("expected a zero max age to require only the method")
+		}
+	})
+}
+
+func TestStepUpFromEnv(t *testing.T) {
+	t.Setenv("REAUTH_MAX_AGE", "")
+	if s, err := StepUpFromEnv(); err != nil || s.MaxAge != 5*time.Minute {
+		t.Errorf("expected the default, got %+v, %v", s, err)
+	}
+	t.Setenv("REAUTH_MAX_AGE", "15m")
+	if s, err := StepUpFromEnv(); err != nil || s.MaxAge != 15*time.Minute {
+		t.Errorf("expected 15m, got %+v, %v", s, err)
+	}
+	t.Setenv("REAUTH_MAX_AGE", "0")
+	if _, err := StepUpFromEnv(); err == nil {
+		t.Error("expected a zero max age to be refused")
+	}
+}
@@ -0,0 +1,420 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"time"
+
+	"ccz/db"
+)
+
+const lockName = "ccz_schema_migrations"
+
+var ErrLocked = errors.New("migrate: another migration is in progress")
+
+type Migrator struct {
+	DB          *sql.DB
+	Dialect     db.Dialect
+	Migrations  []Migration
+	Out         io.Writer
+	DryRun      bool
+	LockTimeout time.Duration
+	// OutOfOrder lets Up apply pending migrations numbered below the latest
+	// applied one, such as those merged from another branch, with a
+	// warning. Without it Up refuses them.
+	OutOfOrder bool
+}
+
+type Status struct {
+	Migration
+	Applied   bool
+	AppliedAt string
+	Modified  bool
+}
+
+type applied struct {
+	version   int64
+	name      string
+	checksum  string
+	appliedAt string
+}
+
+func New(conn *sql.DB, dialect db.Dialect, migrations []Migration, out io.Writer) *Migrator {
+	return &Migrator{
+		DB:          conn,
+		Dialect:     dialect,
+		Migrations:  migrations,
+		Out:         out,
+		LockTimeout: 30 * time.Second,
+	}
+}
+
+// Up applies every pending migration in version order.
+func (m *Migrator) Up(ctx context.Context) error {
+	return m.run(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		if err := m.verify(done); err != nil {
+			return err
+		}
+		if err := m.ordered(done); err != nil {
+			return err
+		}
+
+		pending := 0
+		for _, mig := range m.Migrations {
+			if _, ok := done[mig.Version]; ok {
+				continue
+			}
+			pending++
+			if err := m.apply(ctx, conn, mig); err != nil {
+				return err
+			}
+		}
+		if pending == 0 {
+			fmt.Fprintln(m.Out, "no pending migrations")
+		}
+		return nil
+	})
+}
+
+// Down rolls back the n most recently applied migrations.
+func (m *Migrator) Down(ctx context.Context, n int) error {
+	if n < 1 {
+		return fmt.Errorf("migrate: down needs a positive count, got %d", n)
+	}
+	return m.run(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		targets := m.latest(done, n)
+		if len(targets) == 0 {
+			fmt.Fprintln(m.Out, "nothing to roll back")
+			return nil
+		}
+		for _, mig := range targets {
+			if err := m.revert(ctx, conn, mig); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Redo rolls back the latest applied migration and applies it again.
+func (m *Migrator) Redo(ctx context.Context) error {
+	return m.run(ctx, func(conn *sql.Conn, done map[int64]applied) error {
+		if err := m.verify(done); err != nil {
+			return err
+		}
+		targets := m.latest(done, 1)
+		if len(targets) == 0 {
+			fmt.Fprintln(m.Out, "nothing to redo")
+			return nil
+		}
+		if err := m.revert(ctx, conn, targets[0]); err != nil {
+			return err
+		}
+		return m.apply(ctx, conn, targets[0])
+	})
+}
+
+// Status reports every known migration alongside its applied state.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	done, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]Status, 0, len(m.Migrations))
+	for _, mig := range m.Migrations {
+		s := Status{Migration: mig}
+		if a, ok := done[mig.Version]; ok {
+			s.Applied = true
+			s.AppliedAt = a.appliedAt
+			s.Modified = a.checksum != mig.Checksum
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+func (m *Migrator) run(ctx context.Context, fn func(*sql.Conn, map[int64]applied) error) (err error) {
+	conn, err := m.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if m.DryRun {
+		fmt.Fprintln(m.Out, "dry run: no changes will be made")
+	} else {
+		if err := m.lock(ctx, conn); err != nil {
+			return err
+		}
+		defer func() { m.unlock(conn, err) }()
+
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+	}
+
+	done, err := m.applied(ctx, conn)
+	if err != nil {
+		return err
+	}
+	return fn(conn, done)
+}
+
+// lock serialises migrators across processes. MySQL and PostgreSQL use
+// session-level advisory locks; SQLite takes the database write lock for the
+// whole run, which also makes the run atomic.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) error {
+	switch m.Dialect {
+	case db.Postgres:
+		deadline := time.Now().Add(m.LockTimeout)
+		for {
+			var got bool
+			if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", lockKey()).Scan(&got); err != nil {
+				return fmt.Errorf("migrate: acquire lock: %w", err)
+			}
+			if got {
+				return nil
+			}
+			if time.Now().After(deadline) {
+				return ErrLocked
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+	case db.SQLite:
+		if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+			return fmt.Errorf("%w: %v", ErrLocked, err)
+		}
+		return nil
+	default:
+		var got sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", lockName, int(m.LockTimeout.Seconds())).Scan(&got)
+		if err != nil {
+			return fmt.Errorf("migrate: acquire lock: %w", err)
+		}
+		if !got.Valid || got.Int64 != 1 {
+			return ErrLocked
+		}
+		return nil
+	}
+}
+
+func (m *Migrator) unlock(conn *sql.Conn, runErr error) {
+	ctx := context.Background()
+	switch m.Dialect {
+	case db.Postgres:
+		_, _ = conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", lockKey())
+	case db.SQLite:
+		if runErr != nil {
+			_, _ = conn.ExecContext(ctx, "ROLLBACK")
+		} else {
+			_, _ = conn.ExecContext(ctx, "COMMIT")
+		}
+	default:
+		_, _ = conn.ExecContext(ctx, "SELECT RELEASE_LOCK(?)", lockName)
+	}
+}
+
+func lockKey() int64 {
+	h := fnv.New64a()
+	h.Write([]byte(lockName))
+	return int64(h.Sum64())
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, conn *sql.Conn) error {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	checksum CHAR(64) NOT NULL,
+	applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`)
+	return err
+}
+
+func (m *Migrator) tableExists(ctx context.Context, conn *sql.Conn) (bool, error) {
+	var query string
+	switch m.Dialect {
+	case db.Postgres:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = 'schema_migrations'"
+	case db.SQLite:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'"
+	default:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = 'schema_migrations'"
+	}
+	var n int
+	err := conn.QueryRowContext(ctx, query).Scan(&n)
+	return n > 0, err
+}
+
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int64]applied, error) {
+	exists, err := m.tableExists(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	done := map[int64]applied{}
+	if !exists {
+		return done, nil
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a applied
+		if err := rows.Scan(&a.version, &a.name, &a.checksum, &a.appliedAt); err != nil {
+			return nil, err
+		}
+		done[a.version] = a
+	}
+	return done, rows.Err()
+}
+
+// verify refuses to continue when an applied migration was edited after the
+// fact, since the database no longer matches what the files describe.
+func (m *Migrator) verify(done map[int64]applied) error {
+	for _, mig := range m.Migrations {
+		if a, ok := done[mig.Version]; ok && a.checksum != mig.Checksum {
+			return fmt.Errorf("migrate: checksum mismatch for %s: applied %s, file %s", mig, a.checksum, mig.Checksum)
+		}
+	}
+	return nil
+}
+
+// ordered refuses pending migrations numbered below the latest applied one,
+// which would otherwise run after migrations written later than them. With
+// OutOfOrder it only warns.
+func (m *Migrator) ordered(done map[int64]applied) error {
+	newest := m.latest(done, 1)
+	if len(newest) == 0 {
+		return nil
+	}
+	var behind []string
+	for _, mig := range m.Migrations {
+		if _, ok := done[mig.Version]; !ok && mig.Version < newest[0].Version {
+			behind = append(behind, mig.String())
+		}
+	}
+	if len(behind) == 0 {
+		return nil
+	}
+	if !m.OutOfOrder {
+		return fmt.Errorf("migrate: pending %s older than the applied %s; renumber or run with -out-of-order",
+			strings.Join(behind, ", "), newest[0])
+	}
+	fmt.Fprintf(m.Out, "warning: applying %s after %s\n", strings.Join(behind, ", "), newest[0])
+	return nil
+}
+
+// latest returns up to n applied migrations, newest first.
+func (m *Migrator) latest(done map[int64]applied, n int) []Migration {
+	var out []Migration
+	for i := len(m.Migrations) - 1; i >= 0 && len(out) < n; i-- {
+		if _, ok := done[m.Migrations[i].Version]; ok {
+			out = append(out, m.Migrations[i])
+		}
+	}
+	return out
+}
+
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	fmt.Fprintf(m.Out, "up   %s\n", mig)
+	if err := m.check(ctx, conn, mig); err != nil {
+		return err
+	}
+	if err := m.exec(ctx, conn, mig.Up); err != nil {
+		return fmt.Errorf("migrate: apply %s: %w", mig, err)
+	}
+	if m.DryRun {
+		return nil
+	}
+	_, err := conn.ExecContext(ctx,
+		m.Dialect.Rebind("INSERT INTO schema_migrations (version, name, checksum) VALUES (?, ?, ?)"),
+		mig.Version, mig.Name, mig.Checksum)
+	return err
+}
+
+// check refuses to apply mig while its check queries return rows, listing
+// them so they can be fixed by hand first.
+func (m *Migrator) check(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	var problems []string
+	for _, query := range splitStatements(mig.Check) {
+		if m.DryRun {
+			fmt.Fprintf(m.Out, "     check: %s;\n", query)
+			continue
+		}
+		found, err := m.query(ctx, conn, query)
+		if err != nil {
+			return fmt.Errorf("migrate: check %s: %w", mig, err)
+		}
+		problems = append(problems, found...)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("migrate: %s cannot be applied until these are fixed: %s", mig, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// query returns the first column of every row of query.
+func (m *Migrator) query(ctx context.Context, conn *sql.Conn, query string) ([]string, error) {
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+func (m *Migrator) revert(ctx context.Context, conn *sql.Conn, mig Migration) error {
+	fmt.Fprintf(m.Out, "down %s\n", mig)
+	if len(splitStatements(mig.Down)) == 0 {
+		return fmt.Errorf("migrate: %s has no down script", mig)
+	}
+	if err := m.exec(ctx, conn, mig.Down); err != nil {
+		return fmt.Errorf("migrate: revert %s: %w", mig, err)
+	}
+	if m.DryRun {
+		return nil
+	}
+	_, err := conn.ExecContext(ctx, m.Dialect.Rebind("DELETE FROM schema_migrations WHERE version = ?"), mig.Version)
+	return err
+}
+
+func (m *Migrator) exec(ctx context.Context, conn *sql.Conn, script string) error {
+	for _, stmt := range splitStatements(script) {
+		if m.DryRun {
+			fmt.Fprintf(m.Out, "     %s;\n", stmt)
+			continue
+		}
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,338 @@
+package migrate
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dbpkg "ccz/db"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testMigrations = []Migration{
+	{Version: 1, Name: "init", Up: "CREATE TABLE a (id INT);", Down: "DROP TABLE a;", Checksum: "c1"},
+	{Version: 2, Name: "second", Up: "CREATE TABLE b (id INT);", Down: "DROP TABLE b;", Checksum: "c2"},
+}
+
+func expectLock(mock sqlmock.Sqlmock, got int) {
+	mock.ExpectQuery("SELECT GET_LOCK\\(\\?, \\?\\)").
+		WithArgs(lockName, 30).
+		WillReturnRows(sqlmock.NewRows([]string{"lock"}).AddRow(got))
+}
+
+func expectApplied(mock sqlmock.Sqlmock, rows *sqlmock.Rows) {
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM information_schema.tables").
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(1))
+	mock.ExpectQuery("SELECT version, name, checksum, applied_at FROM schema_migrations").
+		WillReturnRows(rows)
+}
+
+func appliedRows() *sqlmock.Rows {
+	return sqlmock.NewRows([]string{"version", "name", "checksum", "applied_at"})
+}
+
+func TestMigrator_Up(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	var out bytes.Buffer
+	m := New(db, dbpkg.MySQL, testMigrations, &out)
+
+	expectLock(mock, 1)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplied(mock, appliedRows().AddRow(1, "init", "c1", "2026-01-01 00:00:00"))
+	mock.ExpectExec("CREATE TABLE b").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(2), "second", "c2").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "up   0002_second") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrator_Locked(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	m := New(db, dbpkg.MySQL, testMigrations, &bytes.Buffer{})
+	expectLock(mock, 0)
+
+	if err := m.Up(context.Background()); err != ErrLocked {
+		t.Errorf("expected ErrLocked, got %v", err)
+	}
+}
+
+func TestMigrator_ChecksumMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	m := New(db, dbpkg.MySQL, testMigrations, &bytes.Buffer{})
+	expectLock(mock, 1)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplied(mock, appliedRows().AddRow(1, "init", "edited", "2026-01-01 00:00:00"))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = m.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+}
+
+func TestMigrator_RedoChecksumMismatch(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	m := New(db, dbpkg.MySQL, testMigrations, &bytes.Buffer{})
+	expectLock(mock, 1)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplied(mock, appliedRows().
+		AddRow(1, "init", "c1", "2026-01-01 00:00:00").
+		AddRow(2, "second", "edited", "2026-01-02 00:00:00"))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err = m.Redo(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected checksum mismatch, got %v", err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("expected nothing rolled back: %s", err)
+	}
+}
+
+func TestMigrator_OutOfOrder(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	var out bytes.Buffer
+	m := New(db, dbpkg.MySQL, testMigrations, &out)
+	expect := func() {
+		expectLock(mock, 1)
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		expectApplied(mock, appliedRows().AddRow(2, "second", "c2", "2026-01-02 00:00:00"))
+	}
+
+	expect()
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+	err = m.Up(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "0001_init") || !strings.Contains(err.Error(), "-out-of-order") {
+		t.Errorf("expected the older pending migration refused, got %v", err)
+	}
+
+	m.OutOfOrder = true
+	expect()
+	mock.ExpectExec("CREATE TABLE a").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("INSERT INTO schema_migrations").
+		WithArgs(int64(1), "init", "c1").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "warning: applying 0001_init after 0002_second") {
+		t.Errorf("expected a warning, got: %s", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrator_Down(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	m := New(db, dbpkg.MySQL, testMigrations, &bytes.Buffer{})
+	expectLock(mock, 1)
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	expectApplied(mock, appliedRows().
+		AddRow(1, "init", "c1", "2026-01-01 00:00:00").
+		AddRow(2, "second", "c2", "2026-01-02 00:00:00"))
+	mock.ExpectExec("DROP TABLE b").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DROP TABLE a").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM schema_migrations").WithArgs(int64(1)).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("SELECT RELEASE_LOCK").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := m.Down(context.Background(), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrator_DryRun(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	var out bytes.Buffer
+	m := New(db, dbpkg.MySQL, testMigrations, &out)
+	m.DryRun = true
+
+	mock.ExpectQuery("SELECT COUNT\\(\\*\\) FROM information_schema.tables").
+		WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(0))
+
+	if err := m.Up(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "CREATE TABLE a (id INT);") || !strings.Contains(out.String(), "up   0002_second") {
+		t.Errorf("expected plan in output, got: %s", out.String())
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMigrator_Status(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer db.Close()
+
+	m := New(db, dbpkg.MySQL, testMigrations, &bytes.Buffer{})
+	expectApplied(mock, appliedRows().AddRow(1, "init", "c1", "2026-01-01 00:00:00"))
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || statuses[1].Applied || statuses[0].Modified {
+		t.Errorf("unexpected statuses: %+v", statuses)
+	}
+}
+
+func TestMigrator_SQLite(t *testing.T) {
+	conn, dialect, err := dbpkg.Open("sqlite://" + filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	m := New(conn, dialect, testMigrations, &bytes.Buffer{})
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatalf("up: %v", err)
+	}
+	if _, err := conn.Exec("INSERT INTO b (id) VALUES (1)"); err != nil {
+		t.Fatalf("expected table b to exist: %v", err)
+	}
+
+	if err := m.Redo(ctx); err != nil {
+		t.Fatalf("redo: %v", err)
+	}
+	var n int
+	if err := conn.QueryRow("SELECT COUNT(*) FROM b").Scan(&n); err != nil || n != 0 {
+		t.Errorf("expected recreated empty table b, got n=%d err=%v", n, err)
+	}
+
+	if err := m.Down(ctx, 1); err != nil {
+		t.Fatalf("down: %v", err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !statuses[0].Applied || statuses[1].Applied {
+		t.Errorf("unexpected statuses after down: %+v", statuses)
+	}
+}
+
+func TestMigrator_FailedRunRollsBackOnSQLite(t *testing.T) {
+	conn, dialect, err := dbpkg.Open("sqlite://" + filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	broken := append([]Migration{}, testMigrations...)
+	broken = append(broken, Migration{Version: 3, Name: "broken", Up: "CREATE TABLE c (id INT); NOT SQL;", Checksum: "c3"})
+	m := New(conn, dialect, broken, &bytes.Buffer{})
+
+	if err := m.Up(context.Background()); err == nil {
+		t.Fatal("expected error from broken migration")
+	}
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range statuses {
+		if s.Applied {
+			t.Errorf("expected nothing applied after failed run, got %s", s.Migration)
+		}
+	}
+}
+
+func TestMigrator_DuplicateEmailsBeforeBlindIndex(t *testing.T) {
+	conn, dialect, err := dbpkg.Open("sqlite://" + filepath.Join(t.TempDir(), "migrate.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	migrations, err := Embedded(dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := New(conn, dialect, migrations[:1], &bytes.Buffer{}).Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@ex.com", "A@ex.com ", "b@ex.com"} {
+		if _, err := conn.Exec("INSERT INTO users (email, provider) VALUES (?, 'local')", email); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := New(conn, dialect, migrations, &bytes.Buffer{})
+	err = m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "0002_encrypt_pii") || !strings.Contains(err.Error(), "users 1, 2 share the email a@ex.com") {
+		t.Fatalf("expected the duplicates listed, got %v", err)
+	}
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statuses[1].Applied {
+		t.Error("expected 0002 not applied")
+	}
+
+	if _, err := conn.Exec("UPDATE users SET email = 'a2@ex.com' WHERE id = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx); err != nil {
+		t.Errorf("expected the migration to apply once fixed: %v", err)
+	}
+}
@@ -0,0 +1,7 @@
+-- Emails that differ only in case or surrounding spaces would share a
+-- blind index, and the unique index on it could not be built. Merge or
+-- rename those users before migrating.
+SELECT CONCAT('users ', GROUP_CONCAT(id ORDER BY id SEPARATOR ', '), ' share the email ', LOWER(TRIM(MIN(email))))
+FROM users
+GROUP BY LOWER(TRIM(email))
+HAVING COUNT(*) > 1;
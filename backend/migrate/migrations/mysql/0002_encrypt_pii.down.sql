@@ -0,0 +1,7 @@
+DROP INDEX users_email_bidx ON users;
+ALTER TABLE users
+	DROP COLUMN email_bidx,
+	MODIFY email VARCHAR(255),
+	MODIFY full_name VARCHAR(255),
+	MODIFY telephone VARCHAR(50);
+CREATE UNIQUE INDEX email ON users (email);
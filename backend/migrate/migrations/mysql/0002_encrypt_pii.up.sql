@@ -0,0 +1,8 @@
+ALTER TABLE users DROP INDEX email;
+ALTER TABLE users
+	ADD COLUMN email_bidx VARCHAR(255) NULL,
+	MODIFY email TEXT,
+	MODIFY full_name TEXT,
+	MODIFY telephone TEXT;
+UPDATE users SET email_bidx = LOWER(TRIM(email));
+CREATE UNIQUE INDEX users_email_bidx ON users (email_bidx);
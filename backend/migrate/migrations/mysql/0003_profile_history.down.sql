@@ -0,0 +1,2 @@
+DROP TABLE profile_revisions;
+ALTER TABLE users DROP COLUMN role;
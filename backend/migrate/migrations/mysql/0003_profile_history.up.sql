@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
+CREATE TABLE profile_revisions (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	old_full_name TEXT,
+	old_telephone TEXT,
+	new_full_name TEXT,
+	new_telephone TEXT,
+	actor TEXT,
+	ip VARCHAR(45),
+	source VARCHAR(20) NOT NULL,
+	restored_from BIGINT NULL,
+	created_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX profile_revisions_user ON profile_revisions (user_id, created_at);
@@ -0,0 +1,5 @@
+ALTER TABLE profile_revisions
+	DROP COLUMN old_attributes,
+	DROP COLUMN new_attributes;
+DROP TABLE profile_attributes;
+DROP TABLE attribute_definitions;
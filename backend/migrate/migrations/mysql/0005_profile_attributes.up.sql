@@ -0,0 +1,22 @@
+CREATE TABLE attribute_definitions (
+	id INT AUTO_INCREMENT PRIMARY KEY,
+	name VARCHAR(64) NOT NULL UNIQUE,
+	label VARCHAR(255) NOT NULL,
+	type VARCHAR(20) NOT NULL,
+	required BOOLEAN NOT NULL DEFAULT FALSE,
+	visibility VARCHAR(20) NOT NULL DEFAULT 'user',
+	rules TEXT,
+	sort_order INT NOT NULL DEFAULT 0
+);
+CREATE TABLE profile_attributes (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	attribute_id INT NOT NULL,
+	value TEXT NOT NULL,
+	UNIQUE (user_id, attribute_id),
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE,
+	FOREIGN KEY (attribute_id) REFERENCES attribute_definitions (id) ON DELETE CASCADE
+);
+ALTER TABLE profile_revisions
+	ADD COLUMN old_attributes TEXT,
+	ADD COLUMN new_attributes TEXT;
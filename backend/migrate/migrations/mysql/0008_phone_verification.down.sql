@@ -0,0 +1,2 @@
+DROP TABLE phone_challenges;
+ALTER TABLE users DROP COLUMN telephone_verified_at;
@@ -0,0 +1,13 @@
+ALTER TABLE users ADD COLUMN telephone_verified_at DATETIME(6) NULL;
+CREATE TABLE phone_challenges (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL UNIQUE,
+	telephone TEXT NOT NULL,
+	code_hash VARCHAR(64) NOT NULL,
+	attempts INT NOT NULL DEFAULT 0,
+	sends INT NOT NULL DEFAULT 0,
+	window_start DATETIME(6) NOT NULL,
+	sent_at DATETIME(6) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,18 @@
+CREATE TABLE email_changes (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	old_email TEXT NOT NULL,
+	old_email_bidx VARCHAR(255) NOT NULL,
+	new_email TEXT NOT NULL,
+	new_email_bidx VARCHAR(255) NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	revert_token_hash VARCHAR(64) NOT NULL UNIQUE,
+	created_at DATETIME(6) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	revert_expires_at DATETIME(6) NOT NULL,
+	confirmed_at DATETIME(6) NULL,
+	reverted_at DATETIME(6) NULL,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX email_changes_old_email ON email_changes (old_email_bidx);
+CREATE INDEX email_changes_new_email ON email_changes (new_email_bidx);
@@ -0,0 +1,8 @@
+CREATE TABLE password_history (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	user_id INT NOT NULL,
+	password_hash VARCHAR(255) NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
+CREATE INDEX password_history_user ON password_history (user_id, id);
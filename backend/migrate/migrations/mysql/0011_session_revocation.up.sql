@@ -0,0 +1 @@
+ALTER TABLE users ADD COLUMN sessions_revoked_at DATETIME(6) NULL;
@@ -0,0 +1,22 @@
+CREATE TABLE oauth_clients (
+	id VARCHAR(64) PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	secret_hash VARCHAR(64) NULL,
+	redirect_uris TEXT NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	grant_types VARCHAR(100) NOT NULL,
+	created_at DATETIME(6) NOT NULL
+);
+CREATE TABLE oauth_codes (
+	code_hash VARCHAR(64) PRIMARY KEY,
+	client_id VARCHAR(64) NOT NULL,
+	user_id INT NOT NULL,
+	redirect_uri TEXT NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	nonce VARCHAR(255) NULL,
+	code_challenge VARCHAR(128) NOT NULL,
+	auth_time DATETIME(6) NULL,
+	expires_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (client_id) REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,14 @@
+CREATE TABLE oauth_device_codes (
+	device_code_hash VARCHAR(64) PRIMARY KEY,
+	user_code_hash VARCHAR(64) NOT NULL UNIQUE,
+	client_id VARCHAR(64) NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	user_id INT NULL,
+	auth_time DATETIME(6) NULL,
+	poll_interval INT NOT NULL,
+	last_polled_at DATETIME(6) NULL,
+	expires_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (client_id) REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE
+);
@@ -0,0 +1,21 @@
+CREATE TABLE saml_tenants (
+	id VARCHAR(64) PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	metadata TEXT NOT NULL,
+	email_attribute VARCHAR(255) NOT NULL,
+	full_name_attribute VARCHAR(255) NOT NULL,
+	telephone_attribute VARCHAR(255) NOT NULL,
+	created_at DATETIME(6) NOT NULL,
+	updated_at DATETIME(6) NOT NULL
+);
+CREATE TABLE saml_domains (
+	domain VARCHAR(255) PRIMARY KEY,
+	tenant_id VARCHAR(64) NOT NULL,
+	FOREIGN KEY (tenant_id) REFERENCES saml_tenants (id) ON DELETE CASCADE
+);
+CREATE TABLE saml_requests (
+	id VARCHAR(64) PRIMARY KEY,
+	tenant_id VARCHAR(64) NOT NULL,
+	expires_at DATETIME(6) NOT NULL,
+	FOREIGN KEY (tenant_id) REFERENCES saml_tenants (id) ON DELETE CASCADE
+);
@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS users_email_bidx;
+ALTER TABLE users
+	DROP COLUMN email_bidx,
+	ALTER COLUMN email TYPE VARCHAR(255),
+	ALTER COLUMN full_name TYPE VARCHAR(255),
+	ALTER COLUMN telephone TYPE VARCHAR(50);
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
@@ -0,0 +1,8 @@
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+ALTER TABLE users
+	ADD COLUMN email_bidx VARCHAR(255) NULL,
+	ALTER COLUMN email TYPE TEXT,
+	ALTER COLUMN full_name TYPE TEXT,
+	ALTER COLUMN telephone TYPE TEXT;
+UPDATE users SET email_bidx = LOWER(TRIM(email));
+CREATE UNIQUE INDEX users_email_bidx ON users (email_bidx);
@@ -0,0 +1,15 @@
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user';
+CREATE TABLE profile_revisions (
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	old_full_name TEXT,
+	old_telephone TEXT,
+	new_full_name TEXT,
+	new_telephone TEXT,
+	actor TEXT,
+	ip VARCHAR(45),
+	source VARCHAR(20) NOT NULL,
+	restored_from BIGINT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX profile_revisions_user ON profile_revisions (user_id, created_at);
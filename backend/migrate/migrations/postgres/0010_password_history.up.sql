@@ -0,0 +1,7 @@
+CREATE TABLE password_history (
+	id BIGSERIAL PRIMARY KEY,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	password_hash VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX password_history_user ON password_history (user_id, id);
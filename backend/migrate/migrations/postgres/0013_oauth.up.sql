@@ -0,0 +1,20 @@
+CREATE TABLE oauth_clients (
+	id VARCHAR(64) PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	secret_hash VARCHAR(64) NULL,
+	redirect_uris TEXT NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	grant_types VARCHAR(100) NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE oauth_codes (
+	code_hash VARCHAR(64) PRIMARY KEY,
+	client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	redirect_uri TEXT NOT NULL,
+	scopes VARCHAR(255) NOT NULL,
+	nonce VARCHAR(255) NULL,
+	code_challenge VARCHAR(128) NOT NULL,
+	auth_time TIMESTAMP NULL,
+	expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS users (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	email VARCHAR(255) UNIQUE,
+	password VARCHAR(255),
+	full_name VARCHAR(255),
+	telephone VARCHAR(50),
+	provider VARCHAR(20)
+);
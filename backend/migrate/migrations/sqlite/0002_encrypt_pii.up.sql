@@ -0,0 +1,5 @@
+-- SQLite does not enforce VARCHAR lengths, so only the blind index is added.
+-- The original UNIQUE on email stays; ciphertexts never collide.
+ALTER TABLE users ADD COLUMN email_bidx VARCHAR(255) NULL;
+UPDATE users SET email_bidx = LOWER(TRIM(email));
+CREATE UNIQUE INDEX users_email_bidx ON users (email_bidx);
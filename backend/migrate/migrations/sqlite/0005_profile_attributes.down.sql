@@ -0,0 +1,4 @@
+ALTER TABLE profile_revisions DROP COLUMN old_attributes;
+ALTER TABLE profile_revisions DROP COLUMN new_attributes;
+DROP TABLE profile_attributes;
+DROP TABLE attribute_definitions;
@@ -0,0 +1,19 @@
+CREATE TABLE attribute_definitions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name VARCHAR(64) NOT NULL UNIQUE,
+	label VARCHAR(255) NOT NULL,
+	type VARCHAR(20) NOT NULL,
+	required BOOLEAN NOT NULL DEFAULT FALSE,
+	visibility VARCHAR(20) NOT NULL DEFAULT 'user',
+	rules TEXT,
+	sort_order INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE profile_attributes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	attribute_id INTEGER NOT NULL REFERENCES attribute_definitions (id) ON DELETE CASCADE,
+	value TEXT NOT NULL,
+	UNIQUE (user_id, attribute_id)
+);
+ALTER TABLE profile_revisions ADD COLUMN old_attributes TEXT;
+ALTER TABLE profile_revisions ADD COLUMN new_attributes TEXT;
@@ -0,0 +1,12 @@
+ALTER TABLE users ADD COLUMN telephone_verified_at TIMESTAMP NULL;
+CREATE TABLE phone_challenges (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL UNIQUE REFERENCES users (id) ON DELETE CASCADE,
+	telephone TEXT NOT NULL,
+	code_hash VARCHAR(64) NOT NULL,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	sends INTEGER NOT NULL DEFAULT 0,
+	window_start TIMESTAMP NOT NULL,
+	sent_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,17 @@
+CREATE TABLE email_changes (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	old_email TEXT NOT NULL,
+	old_email_bidx VARCHAR(255) NOT NULL,
+	new_email TEXT NOT NULL,
+	new_email_bidx VARCHAR(255) NOT NULL,
+	token_hash VARCHAR(64) NOT NULL UNIQUE,
+	revert_token_hash VARCHAR(64) NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL,
+	revert_expires_at TIMESTAMP NOT NULL,
+	confirmed_at TIMESTAMP NULL,
+	reverted_at TIMESTAMP NULL
+);
+CREATE INDEX email_changes_old_email ON email_changes (old_email_bidx);
+CREATE INDEX email_changes_new_email ON email_changes (new_email_bidx);
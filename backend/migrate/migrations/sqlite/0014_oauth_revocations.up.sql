@@ -0,0 +1,4 @@
+CREATE TABLE oauth_revocations (
+	jti VARCHAR(64) PRIMARY KEY,
+	expires_at TIMESTAMP NOT NULL
+);
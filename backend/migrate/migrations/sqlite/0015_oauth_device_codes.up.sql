@@ -0,0 +1,12 @@
+CREATE TABLE oauth_device_codes (
+	device_code_hash VARCHAR(64) PRIMARY KEY,
+	user_code_hash VARCHAR(64) NOT NULL UNIQUE,
+	client_id VARCHAR(64) NOT NULL REFERENCES oauth_clients (id) ON DELETE CASCADE,
+	scopes VARCHAR(255) NOT NULL,
+	status VARCHAR(16) NOT NULL,
+	user_id INTEGER NULL REFERENCES users (id) ON DELETE CASCADE,
+	auth_time TIMESTAMP NULL,
+	poll_interval INTEGER NOT NULL,
+	last_polled_at TIMESTAMP NULL,
+	expires_at TIMESTAMP NOT NULL
+);
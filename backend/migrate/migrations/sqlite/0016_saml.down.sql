@@ -0,0 +1,3 @@
+DROP TABLE saml_requests;
+DROP TABLE saml_domains;
+DROP TABLE saml_tenants;
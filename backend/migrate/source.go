@@ -0,0 +1,191 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"ccz/db"
+)
+
+//go:embed migrations/*/*.sql
+var embedded embed.FS
+
+// Dialects lists the migration subdirectories every schema change must cover.
+var Dialects = []db.Dialect{db.MySQL, db.Postgres, db.SQLite}
+
+var fileRe = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down|check)\.sql$`)
+
+var nameRe = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+type Migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+	// Check holds queries that return a row describing each thing in the
+	// database the up script would fail on. It is not part of Checksum, so
+	// checks can be added to migrations that were already applied.
+	Check    string
+	Checksum string
+}
+
+func (m Migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+// Embedded returns the migrations compiled into the binary for dialect d.
+func Embedded(d db.Dialect) ([]Migration, error) {
+	sub, err := fs.Sub(embedded, "migrations/"+string(d))
+	if err != nil {
+		return nil, err
+	}
+	return Load(sub)
+}
+
+// Load reads NNNN_name.up.sql / NNNN_name.down.sql pairs, and the optional
+// NNNN_name.check.sql, from the root of fsys and returns them ordered by
+// version.
+func Load(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*Migration{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		match := fileRe.FindStringSubmatch(e.Name())
+		if match == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(match[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s: %w", e.Name(), err)
+		}
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		} else if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has conflicting names %q and %q", version, m.Name, match[2])
+		}
+
+		switch match[3] {
+		case "up":
+			m.Up = string(body)
+		case "down":
+			m.Down = string(body)
+		default:
+			m.Check = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("migration %s has no up script", m)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Create writes an empty up/down pair into each dialect directory under root,
+// using the next free version number, and returns the paths of the new files.
+func Create(root, name string) ([]string, error) {
+	if !nameRe.MatchString(name) {
+		return nil, fmt.Errorf("invalid migration name %q: use lowercase letters, digits and underscores", name)
+	}
+
+	var next int64 = 1
+	for _, d := range Dialects {
+		dir := filepath.Join(root, string(d))
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+		existing, err := Load(os.DirFS(dir))
+		if err != nil {
+			return nil, err
+		}
+		if n := len(existing); n > 0 && existing[n-1].Version >= next {
+			next = existing[n-1].Version + 1
+		}
+	}
+
+	base := fmt.Sprintf("%04d_%s", next, name)
+	var paths []string
+	for _, d := range Dialects {
+		for _, direction := range []string{"up", "down"} {
+			path := filepath.Join(root, string(d), base+"."+direction+".sql")
+			body := fmt.Sprintf("-- %s %s (%s)\n", base, direction, d)
+			if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+				return nil, err
+			}
+			paths = append(paths, path)
+		}
+	}
+	return paths, nil
+}
+
+// splitStatements breaks a script into individual statements on semicolons,
+// ignoring semicolons inside quotes and comments.
+func splitStatements(script string) []string {
+	var (
+		stmts []string
+		cur   strings.Builder
+		quote rune
+	)
+
+	flush := func() {
+		s := strings.TrimSpace(cur.String())
+		if s != "" {
+			stmts = append(stmts, s)
+		}
+		cur.Reset()
+	}
+
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote != 0:
+			cur.WriteRune(c)
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			cur.WriteRune(c)
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			cur.WriteRune('\n')
+		case c == ';':
+			flush()
+		default:
+			cur.WriteRune(c)
+		}
+	}
+	flush()
+	return stmts
+}
@@ -0,0 +1,109 @@
+package migrate
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	t.Run("Orders And Pairs Files", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"0002_add_index.up.sql":    {Data: []byte("CREATE INDEX i ON t (c);")},
+			"0002_add_index.down.sql":  {Data: []byte("DROP INDEX i ON t;")},
+			"0002_add_index.check.sql": {Data: []byte("SELECT c FROM t GROUP BY c HAVING COUNT(*) > 1;")},
+			"0001_init.up.sql":         {Data: []byte("CREATE TABLE t (c INT);")},
+			"README.md":                {Data: []byte("ignored")},
+		}
+		migrations, err := Load(fsys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(migrations) != 2 {
+			t.Fatalf("expected 2 migrations, got %d", len(migrations))
+		}
+		if migrations[0].String() != "0001_init" || migrations[1].String() != "0002_add_index" {
+			t.Errorf("unexpected order: %s, %s", migrations[0], migrations[1])
+		}
+		if migrations[1].Down == "" || migrations[1].Check == "" || migrations[0].Checksum == "" {
+			t.Error("expected down and check scripts and checksum to be populated")
+		}
+	})
+
+	t.Run("Missing Up Script", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"0001_init.down.sql": {Data: []byte("DROP TABLE t;")},
+		}
+		if _, err := Load(fsys); err == nil {
+			t.Error("expected error for migration without up script")
+		}
+	})
+
+	t.Run("Embedded Migrations", func(t *testing.T) {
+		var versions []int64
+		for _, d := range Dialects {
+			migrations, err := Embedded(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) == 0 || migrations[0].Version != 1 {
+				t.Fatalf("expected %s migrations starting at version 1", d)
+			}
+			if versions == nil {
+				for _, m := range migrations {
+					versions = append(versions, m.Version)
+				}
+				continue
+			}
+			if len(migrations) != len(versions) {
+				t.Errorf("%s has %d migrations, expected %d", d, len(migrations), len(versions))
+			}
+		}
+	})
+}
+
+func TestCreate(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "mysql"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "mysql", "0007_existing.up.sql"), []byte("SELECT 1;"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := Create(root, "add_phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != 2*len(Dialects) {
+		t.Fatalf("expected an up/down pair per dialect, got %v", paths)
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(filepath.Base(p), "0008_add_phone.") {
+			t.Errorf("unexpected file name %s", p)
+		}
+	}
+
+	if _, err := Create(root, "Bad Name"); err == nil {
+		t.Error("expected error for invalid name")
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	script := `-- leading comment; not a statement
+CREATE TABLE a (v VARCHAR(10) DEFAULT ';');
+INSERT INTO a VALUES ("x;y");
+
+`
+	got := splitStatements(script)
+	want := []string{
+		"CREATE TABLE a (v VARCHAR(10) DEFAULT ';')",
+		`INSERT INTO a VALUES ("x;y")`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+// Package oauth holds what the OAuth 2.0 / OpenID Connect provider needs
+// besides storage: the scopes and the profile claims they release, client
+// secrets and authorization codes, PKCE, and the keys and tokens of a
+// Provider.
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ccz/store"
+)
+
+// Scopes users can grant a client. Each releases the profile claims listed
+// in Claims.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+// UserScopes lists the scopes above. Clients may be registered with other
+// scopes for the client credentials grant; those never name a user.
+var UserScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone}
+
+// ScopeIntrospect lets a confidential client, one of our own services, ask
+// about any token at the introspection endpoint and revoke any access
+// token. It is never granted to users.
+const ScopeIntrospect = "introspect"
+
+// Grant types a client can be registered for.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// GrantTypes lists the grant types above.
+var GrantTypes = []string{GrantAuthorizationCode, GrantClientCredentials, GrantDeviceCode}
+
+// ParseScope splits a space separated scope parameter, dropping repeats.
+func ParseScope(scope string) []string {
+	var out []string
+	for _, s := range strings.Fields(scope) {
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// FormatScope joins scopes for a scope parameter or claim.
+func FormatScope(scopes []string) string {
+	return strings.Join(scopes, " ")
+}
+
+// Subject is the sub claim for user. It is the user's id, which unlike
+// their email never changes.
+func Subject(u *store.User) string {
+	return strconv.FormatInt(u.ID, 10)
+}
+
+// Claims returns the claims about u that scopes release. profile gives the
+// name and picture, email the email and phone the telephone, with whether
+// it was verified. picture is the URL of the user's avatar, or "".
+func Claims(u *store.User, scopes []string, picture string) map[string]any {
+	claims := map[string]any{"sub": Subject(u)}
+	if slices.Contains(scopes, ScopeProfile) {
+		if u.FullName != "" {
+			claims["name"] = u.FullName
+		}
+		if picture != "" {
+			claims["picture"] = picture
+		}
+	}
+	if slices.Contains(scopes, ScopeEmail) {
+		claims["email"] = u.Email
+	}
+	if slices.Contains(scopes, ScopePhone) && u.Telephone != "" {
+		claims["phone_number"] = u.Telephone
+		claims["phone_number_verified"] = !u.TelephoneVerifiedAt.IsZero()
+	}
+	return claims
+}
+
+// CodeTTL is how long an authorization code can be redeemed.
+const CodeTTL = time.Minute
+
+// A device authorization request (RFC 8628) can be approved for
+// DeviceCodeTTL, and the device polls every DeviceInterval until it is.
+const (
+	DeviceCodeTTL  = 10 * time.Minute
+	DeviceInterval = 5 * time.Second
+)
+
+// userCodeAlphabet has no vowels, so user codes spell no words, and no
+// digits to mistake for letters (RFC 8628, section 6.1).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// userCodeLength gives 20^8, about 2^34, user codes.
+const userCodeLength = 8
+
+// NewUserCode returns a random code for the user to type in, in the form
+// WDJB-MJHT.
+func NewUserCode() (string, error) {
+	code := make([]byte, 0, userCodeLength+1)
+	b := make([]byte, 1)
+	for len(code) < cap(code) {
+		if len(code) == userCodeLength/2 {
+			code = append(code, '-')
+			continue
+		}
+		if _, err := rand.Read(b); err != nil {
+			return "", err
+		}
+		// Drop the bytes that would favour the first letters.
+		if int(b[0]) >= 256-256%len(userCodeAlphabet) {
+			continue
+		}
+		code = append(code, userCodeAlphabet[int(b[0])%len(userCodeAlphabet)])
+	}
+	return string(code), nil
+}
+
+// NormalizeUserCode returns code as NewUserCode made it, however the user
+// typed it: in lower case, with spaces, with or without the dash. It
+// returns "" for what cannot be a user code.
+func NormalizeUserCode(code string) string {
+	var letters []byte
+	for _, r := range strings.ToUpper(code) {
+		switch {
+		case strings.ContainsRune(userCodeAlphabet, r):
+			letters = append(letters, byte(r))
+		case r == '-' || r == ' ':
+		default:
+			return ""
+		}
+	}
+	if len(letters) != userCodeLength {
+		return ""
+	}
+	return string(letters[:userCodeLength/2]) + "-" + string(letters[userCodeLength/2:])
+}
+
+// NewSecret returns a random value for a client secret or authorization
+// code, and the hash stored in its place.
+func NewSecret() (secret, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, Hash(secret), nil
+}
+
+// NewClientID returns a random client id. It is not a secret.
+func NewClientID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Hash is what is stored for a secret or code. They are random, so a fast
+// hash is enough.
+func Hash(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// SecretMatches reports whether secret hashes to hash, in constant time.
+func SecretMatches(secret, hash string) bool {
+	return hash != "" && subtle.ConstantTimeCompare([]byte(Hash(secret)), []byte(hash)) == 1
+}
+
+// VerifyPKCE reports whether verifier answers challenge by the S256
+// method of RFC 7636, the only one accepted.
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
@@ -0,0 +1,172 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"ccz/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestVerifyPKCE(t *testing.T) {
+	// The example of RFC 7636, appendix B.
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if !VerifyPKCE(verifier, challenge) {
+		t.Error("expected the RFC example to verify")
+	}
+	if VerifyPKCE(verifier+"x", challenge) {
+		t.Error("expected another verifier to fail")
+	}
+	if VerifyPKCE("short", challenge) {
+		t.Error("expected a verifier under 43 characters to fail")
+	}
+}
+
+func TestClaims(t *testing.T) {
+	u := &store.User{ID: 7, Email: "a@ex.com", FullName: "Ann", Telephone: "+14155550100", TelephoneVerifiedAt: time.Now()}
+
+	claims := Claims(u, []string{ScopeOpenID}, "https://ex.com/a.png")
+	if len(claims) != 1 || claims["sub"] != "7" {
+		t.Errorf("expected only the subject, got %v", claims)
+	}
+	claims = Claims(u, []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone}, "https://ex.com/a.png")
+	if claims["name"] != "Ann" || claims["picture"] != "https://ex.com/a.png" || claims["email"] != "a@ex.com" ||
+		claims["phone_number"] != "+14155550100" || claims["phone_number_verified"] != true {
+		t.Errorf("unexpected claims %v", claims)
+	}
+}
+
+func TestParseScope(t *testing.T) {
+	if got := FormatScope(ParseScope(" openid  email openid ")); got != "openid email" {
+		t.Errorf("expected repeats and spaces dropped, got %q", got)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	secret, hash, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !SecretMatches(secret, hash) || SecretMatches(secret+"x", hash) || SecretMatches("", "") {
+		t.Error("expected only the secret to match its hash")
+	}
+}
+
+func TestUserCode(t *testing.T) {
+	code, err := NewUserCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(code) != 9 || code[4] != '-' || NormalizeUserCode(code) != code {
+		t.Errorf("unexpected user code %q", code)
+	}
+	for typed, want := range map[string]string{
+		"wdjb-mjht":  "WDJB-MJHT",
+		"WDJB MJHT":  "WDJB-MJHT",
+		"WDJBMJHT":   "WDJB-MJHT",
+		"WDJB-MJH":   "",
+		"WDJB-MJHA":  "",
+		"WDJB-MJHT1": "",
+		"":           "",
+	} {
+		if got := NormalizeUserCode(typed); got != want {
+			t.Errorf("%q: expected %q, got %q", typed, want, got)
+		}
+	}
+}
+
+func TestProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProvider("https://id.ex.com/", key)
+	now := time.Now()
+
+	t.Run("Access Token", func(t *testing.T) {
+		token, err := p.AccessToken("7", "wiki", []string{"openid", "email"}, now.Add(-time.Minute), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claims, err := p.ParseAccessToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claims.Subject != "7" || claims.ClientID != "wiki" || claims.Scope != "openid email" || claims.Issuer != "https://id.ex.com" || claims.ID == "" {
+			t.Errorf("unexpected claims %+v", claims)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		token, err := p.AccessToken("7", "wiki", nil, time.Time{}, now.Add(-2*p.AccessTokenTTL))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ParseAccessToken(token); err == nil {
+			t.Error("expected an expired token to be refused")
+		}
+	})
+
+	t.Run("Not Access Tokens", func(t *testing.T) {
+		id, err := p.IDToken("wiki", "n", map[string]any{"sub": "7"}, now, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ParseAccessToken(id); err == nil {
+			t.Error("expected an ID token to be refused")
+		}
+		session, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "7", "exp": now.Add(time.Hour).Unix()}).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ParseAccessToken(session); err == nil {
+			t.Error("expected an HMAC token to be refused")
+		}
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := NewProvider("https://id.ex.com", other).AccessToken("7", "wiki", nil, time.Time{}, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.ParseAccessToken(forged); err == nil {
+			t.Error("expected a token signed with another key to be refused")
+		}
+	})
+
+	t.Run("JWKS", func(t *testing.T) {
+		keys := p.JWKS()["keys"]
+		if len(keys) != 1 || keys[0].KeyID != p.KeyID || keys[0].E != "AQAB" || keys[0].KeyType != "RSA" {
+			t.Errorf("unexpected key set %+v", keys)
+		}
+	})
+
+	t.Run("Parse Key", func(t *testing.T) {
+		pkcs1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pkcs8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		for _, data := range [][]byte{pkcs1, pkcs8} {
+			parsed, err := ParseKey(data)
+			if err != nil || !parsed.Equal(key) {
+				t.Errorf("expected the key back, got %v", err)
+			}
+		}
+		small, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(small)})); err == nil {
+			t.Error("expected a 1024 bit key to be refused")
+		}
+	})
+}
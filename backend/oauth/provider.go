@@ -0,0 +1,239 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// accessTokenType is the typ header of access tokens (RFC 9068). It keeps
+// ID tokens, signed with the same key, from being used as access tokens.
+const accessTokenType = "at+jwt"
+
+// Provider issues and checks the tokens of the OAuth provider. Tokens are
+// signed with RS256 so clients can check ID tokens with the public key
+// alone; session tokens stay HMAC-signed with JWT_SECRET.
+type Provider struct {
+	// Issuer is the base URL of the provider, without a trailing slash.
+	Issuer string
+	Key    *rsa.PrivateKey
+	// KeyID names Key in the JWKS: its RFC 7638 thumbprint.
+	KeyID string
+	// AccessTokenTTL is how long access and ID tokens are valid.
+	AccessTokenTTL time.Duration
+}
+
+// NewProvider returns a Provider for issuer signing with key.
+func NewProvider(issuer string, key *rsa.PrivateKey) *Provider {
+	return &Provider{
+		Issuer:         strings.TrimSuffix(issuer, "/"),
+		Key:            key,
+		KeyID:          thumbprint(&key.PublicKey),
+		AccessTokenTTL: time.Hour,
+	}
+}
+
+// ProviderFromEnv reads OAUTH_ISSUER, OAUTH_SIGNING_KEY_FILE and
+// OAUTH_ACCESS_TOKEN_TTL. Without a key file a key is generated, and
+// tokens stop working when the server restarts.
+func ProviderFromEnv() (*Provider, error) {
+	issuer := os.Getenv("OAUTH_ISSUER")
+	if issuer == "" {
+		port := os.Getenv("APP_PORT")
+		if port == "" {
+			port = "8081"
+		}
+		issuer = "http://localhost:" + port
+	}
+
+	var key *rsa.PrivateKey
+	if path := os.Getenv("OAUTH_SIGNING_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("oauth: reading OAUTH_SIGNING_KEY_FILE: %w", err)
+		}
+		if key, err = ParseKey(data); err != nil {
+			return nil, fmt.Errorf("oauth: OAUTH_SIGNING_KEY_FILE: %w", err)
+		}
+	} else {
+		var err error
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, err
+		}
+		slog.Warn("OAUTH_SIGNING_KEY_FILE is not set; OAuth tokens are signed with a temporary key")
+	}
+
+	p := NewProvider(issuer, key)
+	if v := os.Getenv("OAUTH_ACCESS_TOKEN_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("oauth: OAUTH_ACCESS_TOKEN_TTL must be a positive duration like 1h, got %q", v)
+		}
+		p.AccessTokenTTL = d
+	}
+	return p, nil
+}
+
+// ParseKey reads a PEM encoded RSA private key of at least 2048 bits, in
+// PKCS #1 or PKCS #8 form.
+func ParseKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var key *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+	case "PRIVATE KEY":
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		rsaKey, ok := k.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("the key is not an RSA key")
+		}
+		key = rsaKey
+	default:
+		return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+	}
+	if key.N.BitLen() < 2048 {
+		return nil, fmt.Errorf("the key has %d bits; at least 2048 are needed", key.N.BitLen())
+	}
+	return key, nil
+}
+
+// AccessClaims are the claims of an access token.
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope,omitempty"`
+	// AuthTime is when the user signed in, for tokens issued to one.
+	AuthTime int64 `json:"auth_time,omitempty"`
+}
+
+// Scopes are the scopes the token was granted.
+func (c *AccessClaims) Scopes() []string {
+	return ParseScope(c.Scope)
+}
+
+// AccessToken issues an access token for subject, a user or, for the
+// client credentials grant, the client itself.
+func (p *Provider) AccessToken(subject, clientID string, scopes []string, authTime, now time.Time) (string, error) {
+	jti, _, err := NewSecret()
+	if err != nil {
+		return "", err
+	}
+	claims := AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    p.Issuer,
+			Subject:   subject,
+			Audience:  jwt.ClaimStrings{p.Issuer},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(p.AccessTokenTTL)),
+			ID:        jti,
+		},
+		ClientID: clientID,
+		Scope:    FormatScope(scopes),
+	}
+	if !authTime.IsZero() {
+		claims.AuthTime = authTime.Unix()
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["typ"] = accessTokenType
+	token.Header["kid"] = p.KeyID
+	return token.SignedString(p.Key)
+}
+
+// IDToken issues an OpenID Connect ID token for clientID holding claims,
+// which name the subject.
+func (p *Provider) IDToken(clientID, nonce string, claims map[string]any, authTime, now time.Time) (string, error) {
+	c := jwt.MapClaims{}
+	for k, v := range claims {
+		c[k] = v
+	}
+	c["iss"] = p.Issuer
+	c["aud"] = clientID
+	c["iat"] = now.Unix()
+	c["exp"] = now.Add(p.AccessTokenTTL).Unix()
+	if !authTime.IsZero() {
+		c["auth_time"] = authTime.Unix()
+	}
+	if nonce != "" {
+		c["nonce"] = nonce
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	token.Header["kid"] = p.KeyID
+	return token.SignedString(p.Key)
+}
+
+// ParseAccessToken checks an access token issued by p and returns its
+// claims.
+func (p *Provider) ParseAccessToken(token string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		if t.Header["typ"] != accessTokenType {
+			return nil, errors.New("not an access token")
+		}
+		return &p.Key.PublicKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg()}), jwt.WithIssuer(p.Issuer), jwt.WithAudience(p.Issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.Valid {
+		return nil, errors.New("oauth: invalid access token")
+	}
+	return claims, nil
+}
+
+// JWK is a public key in JSON Web Key form.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+// JWKS is the key set clients check token signatures with.
+func (p *Provider) JWKS() map[string][]JWK {
+	n, e := publicParams(&p.Key.PublicKey)
+	return map[string][]JWK{"keys": {{
+		KeyType:   "RSA",
+		Use:       "sig",
+		Algorithm: jwt.SigningMethodRS256.Alg(),
+		KeyID:     p.KeyID,
+		N:         n,
+		E:         e,
+	}}}
+}
+
+func publicParams(key *rsa.PublicKey) (n, e string) {
+	return base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())
+}
+
+// thumbprint is the RFC 7638 thumbprint of key.
+func thumbprint(key *rsa.PublicKey) string {
+	n, e := publicParams(key)
+	sum := sha256.Sum256([]byte(`{"e":"` + e + `","kty":"RSA","n":"` + n + `"}`))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,112 @@
+package password
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// bloomMagic starts every filter file. It is followed by the number of
+// hash functions as a uint32 and the number of bits as a uint64, both big
+// endian, and then the bits.
+var bloomMagic = []byte("CCZBLOOM")
+
+// Bloom is a compact, offline set of compromised passwords. It answers
+// with no false negatives and a small, fixed rate of false positives, and
+// keeps no password, only bits derived from SHA-1 digests. Those are the
+// digests breach corpora such as Have I Been Pwned publish, so a filter
+// can be built from them without ever seeing the passwords.
+type Bloom struct {
+	k    uint32
+	bits []byte
+}
+
+// NewBloom sizes an empty filter for n entries at the false positive rate
+// fp.
+func NewBloom(n int, fp float64) *Bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	k := math.Round(m / float64(n) * math.Ln2)
+	return &Bloom{k: uint32(max(k, 1)), bits: make([]byte, (uint64(m)+7)/8)}
+}
+
+// LoadBloom reads a filter written by WriteTo.
+func LoadBloom(path string) (*Bloom, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("password: reading breached password filter: %w", err)
+	}
+	header := len(bloomMagic) + 12
+	if len(data) < header || !bytes.Equal(data[:len(bloomMagic)], bloomMagic) {
+		return nil, errors.New("password: " + path + " is not a breached password filter")
+	}
+	k := binary.BigEndian.Uint32(data[len(bloomMagic):])
+	m := binary.BigEndian.Uint64(data[len(bloomMagic)+4:])
+	bits := data[header:]
+	if k == 0 || m == 0 || uint64(len(bits)) != (m+7)/8 {
+		return nil, errors.New("password: " + path + " is truncated or corrupt")
+	}
+	return &Bloom{k: k, bits: bits}, nil
+}
+
+// WriteTo writes the filter in the format LoadBloom reads.
+func (b *Bloom) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, len(bloomMagic)+12)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint32(header[len(bloomMagic):], b.k)
+	binary.BigEndian.PutUint64(header[len(bloomMagic)+4:], b.size())
+	n, err := w.Write(header)
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := w.Write(b.bits)
+	return int64(n + m), err
+}
+
+// Add puts the password with the given SHA-1 digest in the filter.
+func (b *Bloom) Add(digest [sha1.Size]byte) {
+	b.each(digest, func(i uint64) bool {
+		b.bits[i/8] |= 1 << (i % 8)
+		return true
+	})
+}
+
+// Contains reports whether pw is probably in the filter.
+func (b *Bloom) Contains(pw string) bool {
+	return b.ContainsDigest(sha1.Sum([]byte(pw)))
+}
+
+// ContainsDigest reports whether the password with the given SHA-1 digest
+// is probably in the filter.
+func (b *Bloom) ContainsDigest(digest [sha1.Size]byte) bool {
+	found := true
+	b.each(digest, func(i uint64) bool {
+		found = b.bits[i/8]&(1<<(i%8)) != 0
+		return found
+	})
+	return found
+}
+
+func (b *Bloom) size() uint64 {
+	return uint64(len(b.bits)) * 8
+}
+
+// each calls fn with the k bit positions of digest, derived from two
+// halves of it by double hashing, until fn returns false.
+func (b *Bloom) each(digest [sha1.Size]byte, fn func(uint64) bool) {
+	h1 := binary.BigEndian.Uint64(digest[0:8])
+	h2 := binary.BigEndian.Uint64(digest[8:16]) | 1
+	m := b.size()
+	for i := uint64(0); i < uint64(b.k); i++ {
+		if !fn((h1 + i*h2) % m) {
+			return
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package password
+
+// common holds passwords at the top of every breach list that are long
+// enough to pass a length rule. They are refused even without a breached
+// password filter.
+var common = map[string]bool{}
+
+func init() {
+	for _, pw := range []string{
+		"00000000", "11111111", "12121212", "12341234", "123123123",
+		"12345678", "123456789", "1234567890", "1q2w3e4r", "1qaz2wsx",
+		"87654321", "88888888", "987654321", "a1b2c3d4", "aa123456",
+		"abc12345", "abcd1234", "baseball", "computer", "football",
+		"iloveyou", "letmein1", "liverpool", "password", "password1",
+		"password12", "password123", "passw0rd", "princess", "qwerty12",
+		"qwerty123", "qwertyuiop", "starwars", "sunshine", "superman",
+		"trustno1", "welcome1", "welcome123", "whatever", "zaq12wsx",
+	} {
+		common[pw] = true
+	}
+}
@@ -0,0 +1,50 @@
+// Package password decides which new passwords are acceptable, rates how
+// hard they are to guess and hashes them for storage.
+package password
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MaxBytes is the longest password bcrypt hashes in full. Policies never
+// allow more, since anything past it would be silently ignored.
+const MaxBytes = 72
+
+// Cost is the bcrypt work factor for new hashes. Hashes made at a lower
+// cost are upgraded the next time their owner signs in.
+var Cost = bcrypt.DefaultCost
+
+// Hash returns the bcrypt hash of pw.
+func Hash(pw string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pw), Cost)
+	if err != nil {
+		return "", err
+	}
+	return string(h), nil
+}
+
+// Verify reports whether pw matches the stored hash, and whether the hash
+// should be replaced by a fresh one: because it was made at a lower cost,
+// or because it is not a hash at all but a password saved in plain text
+// before hashing was introduced.
+func Verify(hash, pw string) (ok, rehash bool) {
+	if hash == "" {
+		return false, false
+	}
+	if !IsHash(hash) {
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(pw)) == 1, true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pw)) != nil {
+		return false, false
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return true, err == nil && cost < Cost
+}
+
+// IsHash reports whether a stored password is a bcrypt hash.
+func IsHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2")
+}
@@ -0,0 +1,212 @@
+package password
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestVerify(t *testing.T) {
+	hash, err := Hash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsHash(hash) || strings.Contains(hash, "correct horse") {
+		t.Fatalf("expected a bcrypt hash, got %q", hash)
+	}
+
+	t.Run("Hash", func(t *testing.T) {
+		if ok, rehash := Verify(hash, "correct horse"); !ok || rehash {
+			t.Errorf("expected a current match, got ok=%v rehash=%v", ok, rehash)
+		}
+		if ok, _ := Verify(hash, "wrong horse"); ok {
+			t.Error("expected a wrong password to fail")
+		}
+	})
+
+	t.Run("Plain Text", func(t *testing.T) {
+		if ok, rehash := Verify("pass", "pass"); !ok || !rehash {
+			t.Errorf("expected a legacy match to need rehashing, got ok=%v rehash=%v", ok, rehash)
+		}
+		if ok, _ := Verify("pass", "Pass"); ok {
+			t.Error("expected a wrong password to fail")
+		}
+		if ok, _ := Verify("", ""); ok {
+			t.Error("an account without a password must never match")
+		}
+	})
+
+	t.Run("Low Cost", func(t *testing.T) {
+		cheap, err := bcrypt.GenerateFromPassword([]byte("pass"), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, rehash := Verify(string(cheap), "pass"); !ok || !rehash {
+			t.Errorf("expected a low-cost hash to need rehashing, got ok=%v rehash=%v", ok, rehash)
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	p := DefaultPolicy()
+
+	t.Run("Acceptable", func(t *testing.T) {
+		if problems := p.Check("correct horse", "jane@ex.com", nil); problems != nil {
+			t.Errorf("expected no problems, got %v", problems)
+		}
+	})
+
+	for _, tc := range []struct {
+		name, pw string
+		policy   func(*Policy)
+		want     string
+	}{
+		{"Too Short", "a", nil, "at least 8 characters"},
+		{"Too Long", strings.Repeat("é", 37), nil, "at most 72 bytes"},
+		{"Configured Length", "correct horse", func(p *Policy) { p.MinLength = 16 }, "at least 16 characters"},
+		{"Classes", "correct horse", func(p *Policy) { p.MinClasses = 3 }, "at least 3 of"},
+		{"Email", "Jane-is-great", nil, "email address"},
+		{"Common", "Password1", nil, "breached"},
+		{"Breached", "correct horse", func(p *Policy) { p.Breached = testBloom("correct horse") }, "breached"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			p := DefaultPolicy()
+			if tc.policy != nil {
+				tc.policy(&p)
+			}
+			problems := p.Check(tc.pw, "jane@ex.com", nil)
+			if len(problems) != 1 || !strings.Contains(problems[0], tc.want) {
+				t.Errorf("expected one problem about %q, got %v", tc.want, problems)
+			}
+		})
+	}
+
+	t.Run("Email Allowed", func(t *testing.T) {
+		p := DefaultPolicy()
+		p.AllowEmail = true
+		if problems := p.Check("Jane-is-great", "jane@ex.com", nil); problems != nil {
+			t.Errorf("expected no problems, got %v", problems)
+		}
+	})
+
+	t.Run("History", func(t *testing.T) {
+		old, err := Hash("old horse battery")
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous := []string{"current staple", "another one", old}
+		if problems := p.Check("old horse battery", "jane@ex.com", previous); len(problems) != 1 || !strings.Contains(problems[0], "last 5 passwords") {
+			t.Errorf("expected reuse to be refused, got %v", problems)
+		}
+		p := p
+		p.History = 2
+		if problems := p.Check("old horse battery", "jane@ex.com", previous); problems != nil {
+			t.Errorf("expected passwords past the history to be allowed, got %v", problems)
+		}
+	})
+}
+
+func TestRate(t *testing.T) {
+	p := DefaultPolicy()
+	for pw, want := range map[string]int{
+		"":                        0,
+		"aaaaaaaaaa":              0,
+		"password":                0,
+		"abcdefgh1234":            0,
+		"Tr0ub4dor":               3,
+		"correct horse battery":   4,
+		"jane12345678":            0,
+		"kx7Qp2mZ":                2,
+		"!kx7Qp2mZ-vR9wL#tY4nB&e": 4,
+	} {
+		if got := p.Rate(pw, "jane@ex.com"); got.Score != want {
+			t.Errorf("%q: expected score %d, got %+v", pw, want, got)
+		}
+	}
+
+	if s := p.Rate("short", ""); s.Score > 1 || len(s.Problems) == 0 || s.Label == "" {
+		t.Errorf("expected a refused password to rate weak with its problems, got %+v", s)
+	}
+}
+
+func TestBloom(t *testing.T) {
+	words := []string{"hunter2", "correct horse", "letmein"}
+	b := testBloom(words...)
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.WriteTo(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	loaded, err := LoadBloom(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range words {
+		if !loaded.Contains(w) {
+			t.Errorf("expected %q in the filter", w)
+		}
+	}
+	misses := 0
+	for i := range 1000 {
+		if loaded.Contains(strings.Repeat("x", i%50) + string(rune('a'+i%26))) {
+			misses++
+		}
+	}
+	if misses > 10 {
+		t.Errorf("expected few false positives, got %d in 1000", misses)
+	}
+
+	t.Run("Corrupt", func(t *testing.T) {
+		bad := filepath.Join(t.TempDir(), "bad.bloom")
+		if err := os.WriteFile(bad, []byte("CCZBLOOM\x00\x00\x00\x03"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadBloom(bad); err == nil {
+			t.Error("expected a truncated filter to be refused")
+		}
+	})
+}
+
+func TestPolicyFromEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.bloom")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBloom("correct horse").WriteTo(f)
+	f.Close()
+
+	t.Setenv("PASSWORD_MIN_LENGTH", "12")
+	t.Setenv("PASSWORD_HISTORY", "3")
+	t.Setenv("PASSWORD_ALLOW_EMAIL", "true")
+	t.Setenv("PASSWORD_BREACHED_FILE", path)
+	p, err := PolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.MinLength != 12 || p.MaxLength != MaxBytes || p.History != 3 || !p.AllowEmail || !p.Breached.Contains("correct horse") {
+		t.Errorf("unexpected policy %+v", p)
+	}
+
+	t.Setenv("PASSWORD_MAX_LENGTH", "100")
+	if _, err := PolicyFromEnv(); err == nil {
+		t.Error("expected a maximum past bcrypt's to be refused")
+	}
+}
+
+func testBloom(words ...string) *Bloom {
+	b := NewBloom(1000, 0.001)
+	for _, w := range words {
+		b.Add(sha1.Sum([]byte(w)))
+	}
+	return b
+}
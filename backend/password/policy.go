@@ -0,0 +1,173 @@
+package password
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// List reports whether a password is known to be compromised.
+type List interface {
+	Contains(pw string) bool
+}
+
+// Policy is what a deployment requires of new passwords.
+type Policy struct {
+	// MinLength is counted in characters, MaxLength in bytes, since that
+	// is what bcrypt limits. MaxLength is capped at MaxBytes.
+	MinLength int
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters,
+	// digits and symbols a password must mix.
+	MinClasses int
+	// AllowEmail lets a password contain the local part of the account's
+	// email address.
+	AllowEmail bool
+	// History is how many previous passwords may not be used again.
+	History int
+	// Breached, when set, lists compromised passwords to refuse on top of
+	// the built-in list of the most common ones.
+	Breached List
+}
+
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength: 8,
+		MaxLength: MaxBytes,
+		History:   5,
+	}
+}
+
+// PolicyFromEnv reads the PASSWORD_* settings, keeping defaults for
+// anything unset, and loads the filter at PASSWORD_BREACHED_FILE when one
+// is named.
+func PolicyFromEnv() (Policy, error) {
+	p := DefaultPolicy()
+	ints := map[string]*int{
+		"PASSWORD_MIN_LENGTH":  &p.MinLength,
+		"PASSWORD_MAX_LENGTH":  &p.MaxLength,
+		"PASSWORD_MIN_CLASSES": &p.MinClasses,
+		"PASSWORD_HISTORY":     &p.History,
+	}
+	for key, dst := range ints {
+		if v := os.Getenv(key); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return p, fmt.Errorf("password: %s must be a non-negative integer, got %q", key, v)
+			}
+			*dst = n
+		}
+	}
+	if p.MaxLength < 1 || p.MaxLength > MaxBytes {
+		return p, fmt.Errorf("password: PASSWORD_MAX_LENGTH must be between 1 and %d, got %d", MaxBytes, p.MaxLength)
+	}
+	if p.MinLength > p.MaxLength {
+		return p, fmt.Errorf("password: PASSWORD_MIN_LENGTH %d is above PASSWORD_MAX_LENGTH %d", p.MinLength, p.MaxLength)
+	}
+	if p.MinClasses > 4 {
+		return p, fmt.Errorf("password: PASSWORD_MIN_CLASSES must be at most 4, got %d", p.MinClasses)
+	}
+	p.AllowEmail = strings.EqualFold(os.Getenv("PASSWORD_ALLOW_EMAIL"), "true")
+
+	if path := os.Getenv("PASSWORD_BREACHED_FILE"); path != "" {
+		filter, err := LoadBloom(path)
+		if err != nil {
+			return p, err
+		}
+		p.Breached = filter
+	}
+	return p, nil
+}
+
+// Check returns what is wrong with pw as the new password of the account
+// with the given email, whose previous password hashes are previous,
+// newest first. It returns nil when pw is acceptable.
+func (p Policy) Check(pw, email string, previous []string) []string {
+	var problems []string
+	if utf8.RuneCountInString(pw) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Password must be at least %d characters", p.MinLength))
+	}
+	if limit := p.maxLength(); len(pw) > limit {
+		problems = append(problems, fmt.Sprintf("Password must be at most %d bytes", limit))
+	}
+	if p.MinClasses > 0 && classes(pw) < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+	if !p.AllowEmail && containsLocalPart(pw, email) {
+		problems = append(problems, "Password must not contain your email address")
+	}
+	if p.breached(pw) {
+		problems = append(problems, "Password is too common; it appears in lists of breached passwords")
+	}
+	if p.reused(pw, previous) {
+		if p.History == 1 {
+			problems = append(problems, "Password must differ from your current password")
+		} else {
+			problems = append(problems, fmt.Sprintf("Password must differ from your last %d passwords", p.History))
+		}
+	}
+	return problems
+}
+
+func (p Policy) maxLength() int {
+	if p.MaxLength <= 0 || p.MaxLength > MaxBytes {
+		return MaxBytes
+	}
+	return p.MaxLength
+}
+
+func (p Policy) breached(pw string) bool {
+	if common[strings.ToLower(pw)] {
+		return true
+	}
+	return p.Breached != nil && p.Breached.Contains(pw)
+}
+
+func (p Policy) reused(pw string, previous []string) bool {
+	if len(previous) > p.History {
+		previous = previous[:p.History]
+	}
+	for _, hash := range previous {
+		if ok, _ := Verify(hash, pw); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// classes counts which of lowercase letters, uppercase letters, digits
+// and everything else pw uses.
+func classes(pw string) int {
+	var lower, upper, digit, other int
+	for _, r := range pw {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+	return lower + upper + digit + other
+}
+
+// localPart is the part of email before the @, lower-cased, or empty when
+// it is too short to be worth looking for.
+func localPart(email string) string {
+	local, _, _ := strings.Cut(strings.ToLower(email), "@")
+	if utf8.RuneCountInString(local) < 3 {
+		return ""
+	}
+	return local
+}
+
+func containsLocalPart(pw, email string) bool {
+	local := localPart(email)
+	return local != "" && strings.Contains(strings.ToLower(pw), local)
+}
@@ -0,0 +1,103 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Strength is a rating of how hard a password is to guess.
+type Strength struct {
+	// Score runs from 0, guessed at once, to 4, out of reach of an offline
+	// attack.
+	Score int    `json:"score"`
+	Label string `json:"label"`
+	// Problems are the policy's objections; the password is acceptable
+	// when there are none.
+	Problems []string `json:"problems,omitempty"`
+}
+
+var labels = [...]string{"Very weak", "Weak", "Fair", "Strong", "Very strong"}
+
+// Rate scores pw as a new password for email and lists what the policy
+// has against it. Previous password hashes are not consulted, so reuse is
+// only caught by Check.
+func (p Policy) Rate(pw, email string) Strength {
+	score := 0
+	if !p.breached(pw) {
+		score = scoreBits(entropy(pw, email))
+	}
+	problems := p.Check(pw, email, nil)
+	if len(problems) > 0 && score > 1 {
+		score = 1
+	}
+	return Strength{Score: score, Label: labels[score], Problems: problems}
+}
+
+// scoreBits maps estimated bits of entropy to a score.
+func scoreBits(bits float64) int {
+	switch {
+	case bits < 28:
+		return 0
+	case bits < 36:
+		return 1
+	case bits < 50:
+		return 2
+	case bits < 64:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// entropy estimates the bits of entropy of pw as its length times the
+// bits per character of the alphabets it draws on. Characters that repeat
+// or continue a run like "abc" or "321" count for a quarter, and the
+// email's local part counts for nothing.
+func entropy(pw, email string) float64 {
+	if local := localPart(email); local != "" {
+		// Lower-casing keeps byte offsets except for a few letters outside
+		// ASCII; those passwords are rated as typed.
+		lower := strings.ToLower(pw)
+		if i := strings.Index(lower, local); i >= 0 && len(lower) == len(pw) {
+			pw = pw[:i] + pw[i+len(local):]
+		}
+	}
+	var length float64
+	var pool int
+	var lower, upper, digit, symbol, other bool
+	prev := rune(-1)
+	for _, r := range pw {
+		switch {
+		case r == prev, r == prev+1, r == prev-1:
+			length += 0.25
+		default:
+			length++
+		}
+		prev = r
+		switch {
+		case r > unicode.MaxASCII:
+			other = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	for _, c := range []struct {
+		used bool
+		size int
+	}{{lower, 26}, {upper, 26}, {digit, 10}, {symbol, 33}, {other, 100}} {
+		if c.used {
+			pool += c.size
+		}
+	}
+	if pool == 0 {
+		return 0
+	}
+	return length * math.Log2(float64(pool))
+}
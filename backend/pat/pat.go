@@ -0,0 +1,62 @@
+// Package pat makes personal access tokens: long-lived bearer tokens that
+// users create for scripts, limited to the scopes they pick. Tokens are
+// random and shown once; only their SHA-256 hash is stored, with a short
+// prefix in the clear so users can tell them apart.
+package pat
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"slices"
+	"strings"
+)
+
+// Marker starts every personal access token, so they are told apart from
+// session tokens and can be found by secret scanners.
+const Marker = "ccz_pat_"
+
+// PrefixLength is how much of a token is kept to identify it.
+const PrefixLength = len(Marker) + 6
+
+// Scopes a token may be granted. Session tokens hold them all.
+const (
+	ScopeProfileRead  = "profile:read"
+	ScopeProfileWrite = "profile:write"
+	// ScopeAdmin lets the tokens of admins read the admin routes.
+	ScopeAdmin = "admin"
+)
+
+// Scopes lists every scope, for validation and documentation.
+var Scopes = []string{ScopeProfileRead, ScopeProfileWrite, ScopeAdmin}
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// New returns a new token, the prefix that identifies it and the hash
+// stored in its place.
+func New() (token, prefix, hash string, err error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", "", err
+	}
+	token = Marker + strings.ToLower(encoding.EncodeToString(b))
+	return token, token[:PrefixLength], Hash(token), nil
+}
+
+// Hash is what is stored for token and looked up when it is used. Tokens
+// are random, so a fast hash is enough.
+func Hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Is reports whether token looks like a personal access token.
+func Is(token string) bool {
+	return strings.HasPrefix(token, Marker)
+}
+
+// Valid reports whether scope is one of Scopes.
+func Valid(scope string) bool {
+	return slices.Contains(Scopes, scope)
+}
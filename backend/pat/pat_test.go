@@ -0,0 +1,28 @@
+package pat
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	token, prefix, hash, err := New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Is(token) || len(token) != len(Marker)+32 {
+		t.Errorf("unexpected token %q", token)
+	}
+	if !strings.HasPrefix(token, prefix) || len(prefix) != PrefixLength {
+		t.Errorf("expected %q to start %q", prefix, token)
+	}
+	if hash != Hash(token) || strings.Contains(hash, token) {
+		t.Errorf("expected the hash of the token, got %q", hash)
+	}
+	if other, _, _, _ := New(); other == token {
+		t.Error("expected tokens to differ")
+	}
+	if Is("eyJhbGciOiJIUzI1NiJ9.e30.x") {
+		t.Error("expected a session token not to look like an access token")
+	}
+}
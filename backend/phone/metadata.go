@@ -0,0 +1,233 @@
+package phone
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// region is the numbering plan of one region: enough to validate national
+// significant numbers and lay them out. It covers common number types, not
+// every special range.
+type region struct {
+	code        string
+	countryCode int
+	// nationalPrefix is the trunk prefix dialled before national numbers
+	// within the region, such as "0" in most of Europe.
+	nationalPrefix string
+	// intlPrefix is dialled before a country code from within the region.
+	intlPrefix string
+	lengths    []int
+	pattern    *regexp.Regexp
+	formats    []format
+}
+
+// format lays out national significant numbers matching pattern. The
+// templates use pattern's groups, as regexp.Expand does.
+type format struct {
+	pattern       *regexp.Regexp
+	national      string
+	international string
+}
+
+func (r *region) check(nsn string) error {
+	if len(nsn) < r.lengths[0] {
+		return ErrTooShort
+	}
+	if len(nsn) > r.lengths[len(r.lengths)-1] {
+		return ErrTooLong
+	}
+	if !slices.Contains(r.lengths, len(nsn)) || !r.pattern.MatchString(nsn) {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// stripPrefix removes the trunk prefix from a nationally dialled number
+// when what is left is a valid number.
+func (r *region) stripPrefix(digits string) string {
+	if r.nationalPrefix == "" || !strings.HasPrefix(digits, r.nationalPrefix) {
+		return digits
+	}
+	if rest := digits[len(r.nationalPrefix):]; r.check(rest) == nil {
+		return rest
+	}
+	return digits
+}
+
+func seq(min, max int) []int {
+	var out []int
+	for i := min; i <= max; i++ {
+		out = append(out, i)
+	}
+	return out
+}
+
+func f(pattern, national, international string) format {
+	return format{regexp.MustCompile(pattern), national, international}
+}
+
+var nanpFormats = []format{f(`^(\d{3})(\d{3})(\d{4})$`, "($1) $2-$3", "$1-$2-$3")}
+
+var regions = map[string]*region{
+	"US": {code: "US", countryCode: 1, nationalPrefix: "1", intlPrefix: "011", lengths: []int{10},
+		pattern: regexp.MustCompile(`^[2-9]\d{2}[2-9]\d{6}$`), formats: nanpFormats},
+	"CA": {code: "CA", countryCode: 1, nationalPrefix: "1", intlPrefix: "011", lengths: []int{10},
+		pattern: regexp.MustCompile(`^[2-9]\d{2}[2-9]\d{6}$`), formats: nanpFormats},
+	"GB": {code: "GB", countryCode: 44, nationalPrefix: "0", intlPrefix: "00", lengths: []int{9, 10},
+		pattern: regexp.MustCompile(`^[1-9]\d{8,9}$`), formats: []format{
+			f(`^(2\d)(\d{4})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^(7\d{3})(\d{6})$`, "0$1 $2", "$1 $2"),
+			f(`^(\d{3})(\d{3})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^(\d{4})(\d{5})$`, "0$1 $2", "$1 $2"),
+		}},
+	"IE": {code: "IE", countryCode: 353, nationalPrefix: "0", intlPrefix: "00", lengths: seq(7, 9),
+		pattern: regexp.MustCompile(`^[1-9]\d{6,8}$`), formats: []format{
+			f(`^(1)(\d{3})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^(8\d)(\d{3})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^(\d{2})(\d{3})(\d{2,4})$`, "0$1 $2 $3", "$1 $2 $3"),
+		}},
+	"DE": {code: "DE", countryCode: 49, nationalPrefix: "0", intlPrefix: "00", lengths: seq(6, 13),
+		pattern: regexp.MustCompile(`^[1-9]\d{5,12}$`), formats: []format{
+			f(`^(1[5-7]\d)(\d{7,8})$`, "0$1 $2", "$1 $2"),
+			f(`^(30|40|69|89)(\d{4,9})$`, "0$1 $2", "$1 $2"),
+			f(`^(\d{3,4})(\d{3,9})$`, "0$1 $2", "$1 $2"),
+		}},
+	"AT": {code: "AT", countryCode: 43, nationalPrefix: "0", intlPrefix: "00", lengths: seq(4, 13),
+		pattern: regexp.MustCompile(`^[1-9]\d{3,12}$`), formats: []format{
+			f(`^(1)(\d{3,12})$`, "0$1 $2", "$1 $2"),
+			f(`^(6\d{2})(\d{3,10})$`, "0$1 $2", "$1 $2"),
+			f(`^(\d{4})(\d{2,9})$`, "0$1 $2", "$1 $2"),
+		}},
+	"CH": {code: "CH", countryCode: 41, nationalPrefix: "0", intlPrefix: "00", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[1-9]\d{8}$`), formats: []format{
+			f(`^(\d{2})(\d{3})(\d{2})(\d{2})$`, "0$1 $2 $3 $4", "$1 $2 $3 $4"),
+		}},
+	"FR": {code: "FR", countryCode: 33, nationalPrefix: "0", intlPrefix: "00", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[1-9]\d{8}$`), formats: []format{
+			f(`^(\d)(\d{2})(\d{2})(\d{2})(\d{2})$`, "0$1 $2 $3 $4 $5", "$1 $2 $3 $4 $5"),
+		}},
+	"BE": {code: "BE", countryCode: 32, nationalPrefix: "0", intlPrefix: "00", lengths: []int{8, 9},
+		pattern: regexp.MustCompile(`^[1-9]\d{7,8}$`), formats: []format{
+			f(`^(4\d{2})(\d{2})(\d{2})(\d{2})$`, "0$1 $2 $3 $4", "$1 $2 $3 $4"),
+			f(`^([23])(\d{3})(\d{2})(\d{2})$`, "0$1 $2 $3 $4", "$1 $2 $3 $4"),
+			f(`^(\d{2})(\d{2})(\d{2})(\d{2})$`, "0$1 $2 $3 $4", "$1 $2 $3 $4"),
+		}},
+	"NL": {code: "NL", countryCode: 31, nationalPrefix: "0", intlPrefix: "00", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[1-9]\d{8}$`), formats: []format{
+			f(`^(6)(\d{8})$`, "0$1 $2", "$1 $2"),
+			f(`^(\d{2})(\d{3})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+		}},
+	// Italian numbers keep their leading 0 after the country code, so
+	// there is no trunk prefix to strip.
+	"IT": {code: "IT", countryCode: 39, intlPrefix: "00", lengths: seq(6, 11),
+		pattern: regexp.MustCompile(`^(0\d{5,10}|3\d{8,9})$`), formats: []format{
+			f(`^(0[26])(\d{4})(\d{4})$`, "$1 $2 $3", "$1 $2 $3"),
+			f(`^(3\d{2})(\d{3})(\d{3,4})$`, "$1 $2 $3", "$1 $2 $3"),
+			f(`^(0\d{2,3})(\d{3,8})$`, "$1 $2", "$1 $2"),
+		}},
+	"ES": {code: "ES", countryCode: 34, intlPrefix: "00", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[5-9]\d{8}$`), formats: []format{
+			f(`^([67]\d{2})(\d{3})(\d{3})$`, "$1 $2 $3", "$1 $2 $3"),
+			f(`^(\d{3})(\d{2})(\d{2})(\d{2})$`, "$1 $2 $3 $4", "$1 $2 $3 $4"),
+		}},
+	"PL": {code: "PL", countryCode: 48, intlPrefix: "00", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[1-9]\d{8}$`), formats: []format{
+			f(`^(\d{3})(\d{3})(\d{3})$`, "$1 $2 $3", "$1 $2 $3"),
+		}},
+	"SE": {code: "SE", countryCode: 46, nationalPrefix: "0", intlPrefix: "00", lengths: seq(7, 9),
+		pattern: regexp.MustCompile(`^[1-9]\d{6,8}$`), formats: []format{
+			f(`^(7\d)(\d{3})(\d{2})(\d{2})$`, "0$1-$2 $3 $4", "$1 $2 $3 $4"),
+			f(`^(8)(\d{3})(\d{2})(\d{2,3})$`, "0$1-$2 $3 $4", "$1 $2 $3 $4"),
+			f(`^(\d{2})(\d{3})(\d{2,4})$`, "0$1-$2 $3", "$1 $2 $3"),
+		}},
+	"AU": {code: "AU", countryCode: 61, nationalPrefix: "0", intlPrefix: "0011", lengths: []int{9},
+		pattern: regexp.MustCompile(`^[2-478]\d{8}$`), formats: []format{
+			f(`^(4\d{2})(\d{3})(\d{3})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^([2378])(\d{4})(\d{4})$`, "(0$1) $2 $3", "$1 $2 $3"),
+		}},
+	"NZ": {code: "NZ", countryCode: 64, nationalPrefix: "0", intlPrefix: "00", lengths: seq(8, 10),
+		pattern: regexp.MustCompile(`^[2-9]\d{7,9}$`), formats: []format{
+			f(`^(2\d)(\d{3})(\d{3,4})$`, "0$1 $2 $3", "$1 $2 $3"),
+			f(`^([3-9])(\d{3})(\d{4})$`, "0$1 $2 $3", "$1 $2 $3"),
+		}},
+	"IN": {code: "IN", countryCode: 91, nationalPrefix: "0", intlPrefix: "00", lengths: []int{10},
+		pattern: regexp.MustCompile(`^[1-9]\d{9}$`), formats: []format{
+			f(`^([6-9]\d{4})(\d{5})$`, "0$1 $2", "$1 $2"),
+			f(`^(\d{2,4})(\d{6,8})$`, "0$1 $2", "$1 $2"),
+		}},
+	"JP": {code: "JP", countryCode: 81, nationalPrefix: "0", intlPrefix: "010", lengths: []int{9, 10},
+		pattern: regexp.MustCompile(`^[1-9]\d{8,9}$`), formats: []format{
+			f(`^([5789]0)(\d{4})(\d{4})$`, "0$1-$2-$3", "$1-$2-$3"),
+			f(`^([36])(\d{4})(\d{4})$`, "0$1-$2-$3", "$1-$2-$3"),
+			f(`^(\d{2,3})(\d{2,3})(\d{4})$`, "0$1-$2-$3", "$1-$2-$3"),
+		}},
+	"BR": {code: "BR", countryCode: 55, nationalPrefix: "0", intlPrefix: "00", lengths: []int{10, 11},
+		pattern: regexp.MustCompile(`^[1-9]{2}\d{8,9}$`), formats: []format{
+			f(`^(\d{2})(\d{4,5})(\d{4})$`, "($1) $2-$3", "$1 $2-$3"),
+		}},
+	"MX": {code: "MX", countryCode: 52, intlPrefix: "00", lengths: []int{10},
+		pattern: regexp.MustCompile(`^[1-9]\d{9}$`), formats: []format{
+			f(`^(33|55|56|81)(\d{4})(\d{4})$`, "$1 $2 $3", "$1 $2 $3"),
+			f(`^(\d{3})(\d{3})(\d{4})$`, "$1 $2 $3", "$1 $2 $3"),
+		}},
+}
+
+// primaryRegion maps country codes with metadata to their region. Country
+// code 1 is shared by the North American Numbering Plan; see nanpRegion.
+var primaryRegion = func() map[int]string {
+	m := map[int]string{}
+	for code, r := range regions {
+		if r.countryCode != 1 {
+			m[r.countryCode] = code
+		}
+	}
+	return m
+}()
+
+// canadianAreaCodes tells Canadian numbers apart from US ones. Other NANP
+// countries are treated as US.
+var canadianAreaCodes = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`204 226 236 249 250 257 263 289 306 343 354 365 367 368 382 403
+		416 418 428 431 437 438 450 468 474 506 514 519 548 579 581 584 587 604 613 639 647 672 683
+		705 709 742 753 778 780 782 807 819 825 867 873 879 902 905`) {
+		canadianAreaCodes[code] = true
+	}
+}
+
+// metaFor returns the numbering plan for a national number under country
+// code cc, or nil when there is none.
+func metaFor(cc int, nsn string) *region {
+	if cc == 1 {
+		if len(nsn) >= 3 && canadianAreaCodes[nsn[:3]] {
+			return regions["CA"]
+		}
+		return regions["US"]
+	}
+	if code, ok := primaryRegion[cc]; ok {
+		return regions[code]
+	}
+	return nil
+}
+
+// countryCodes holds the assigned ITU-T E.164 country calling codes.
+var countryCodes = map[int]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`1 7 20 27 30 31 32 33 34 36 39 40 41 43 44 45 46 47 48 49
+		51 52 53 54 55 56 57 58 60 61 62 63 64 65 66 81 82 84 86 90 91 92 93 94 95 98
+		211 212 213 216 218 220 221 222 223 224 225 226 227 228 229 230 231 232 233 234 235 236 237
+		238 239 240 241 242 243 244 245 246 247 248 249 250 251 252 253 254 255 256 257 258 260 261
+		262 263 264 265 266 267 268 269 290 291 297 298 299 350 351 352 353 354 355 356 357 358 359
+		370 371 372 373 374 375 376 377 378 380 381 382 383 385 386 387 389 420 421 423
+		500 501 502 503 504 505 506 507 508 509 590 591 592 593 594 595 596 597 598 599
+		670 672 673 674 675 676 677 678 679 680 681 682 683 685 686 687 688 689 690 691 692
+		850 852 853 855 856 880 886 960 961 962 963 964 965 966 967 968 970 971 972 973 974 975 976 977
+		992 993 994 995 996 998`) {
+		cc, _ := strconv.Atoi(code)
+		countryCodes[cc] = true
+	}
+}
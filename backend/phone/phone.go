@@ -0,0 +1,191 @@
+// Package phone parses telephone numbers as people type them, checks them
+// against per-region numbering rules and formats them as E.164, national or
+// international strings.
+package phone
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrInvalidCharacters = errors.New("phone: number contains characters other than digits, spaces and + - . ( ) /")
+	ErrMissingRegion     = errors.New("phone: number needs a country code such as +44")
+	ErrUnknownRegion     = errors.New("phone: unknown default region")
+	ErrInvalidCountry    = errors.New("phone: unknown country code")
+	ErrTooShort          = errors.New("phone: number is too short")
+	ErrTooLong           = errors.New("phone: number is too long")
+	ErrInvalid           = errors.New("phone: number is not valid for its region")
+)
+
+// Number is a parsed telephone number.
+type Number struct {
+	CountryCode int
+	// National is the national significant number: the digits after the
+	// country code, without any trunk prefix.
+	National string
+	// Region is the ISO 3166-1 alpha-2 code of the region the number
+	// belongs to, or "" for country codes without metadata.
+	Region string
+}
+
+// Parse reads a number as typed. Numbers starting with + or the
+// international dialling prefix of defaultRegion carry their own country
+// code; anything else is read as a national number of defaultRegion, which
+// may then be "" only for international input.
+func Parse(raw, defaultRegion string) (Number, error) {
+	digits, international, err := clean(raw)
+	if err != nil {
+		return Number{}, err
+	}
+
+	def, hasDefault := regions[strings.ToUpper(defaultRegion)]
+	if defaultRegion != "" && !hasDefault {
+		return Number{}, ErrUnknownRegion
+	}
+	if !international && hasDefault && def.intlPrefix != "" && strings.HasPrefix(digits, def.intlPrefix) {
+		digits, international = digits[len(def.intlPrefix):], true
+	}
+
+	var n Number
+	if international {
+		cc, rest, ok := splitCountryCode(digits)
+		if !ok {
+			return Number{}, ErrInvalidCountry
+		}
+		n.CountryCode, n.National = cc, rest
+		// People often keep the trunk prefix after the country code, as
+		// in +44 (0)20 ...; drop it where that leaves a valid length.
+		if meta := metaFor(cc, rest); meta != nil {
+			n.National = meta.stripPrefix(rest)
+		}
+	} else {
+		if !hasDefault {
+			return Number{}, ErrMissingRegion
+		}
+		n.CountryCode, n.National = def.countryCode, def.stripPrefix(digits)
+	}
+
+	meta := metaFor(n.CountryCode, n.National)
+	if meta == nil {
+		// No numbering plan is known; only E.164's own limits apply.
+		switch {
+		case len(n.National) < 4:
+			return Number{}, ErrTooShort
+		case len(n.National)+len(strconv.Itoa(n.CountryCode)) > 15:
+			return Number{}, ErrTooLong
+		}
+		return n, nil
+	}
+	n.Region = meta.code
+	if err := meta.check(n.National); err != nil {
+		return Number{}, err
+	}
+	return n, nil
+}
+
+// clean strips the punctuation people put in numbers and reports whether
+// the number started with +.
+func clean(raw string) (digits string, international bool, err error) {
+	raw = strings.TrimSpace(raw)
+	if strings.HasPrefix(raw, "+") {
+		raw, international = raw[1:], true
+	}
+	var b strings.Builder
+	for _, c := range raw {
+		switch {
+		case c >= '0' && c <= '9':
+			b.WriteRune(c)
+		case strings.ContainsRune(" -.()/\u00a0", c):
+		default:
+			return "", false, ErrInvalidCharacters
+		}
+	}
+	if b.Len() == 0 {
+		return "", false, ErrTooShort
+	}
+	return b.String(), international, nil
+}
+
+// splitCountryCode takes the country calling code off the front of digits.
+// Country codes are prefix-free, so at most one length matches.
+func splitCountryCode(digits string) (int, string, bool) {
+	for l := 1; l <= 3 && l < len(digits); l++ {
+		cc, _ := strconv.Atoi(digits[:l])
+		if countryCodes[cc] {
+			return cc, digits[l:], true
+		}
+	}
+	return 0, "", false
+}
+
+// E164 is the number as +<country code><national number>, the form it is
+// stored in.
+func (n Number) E164() string {
+	return "+" + strconv.Itoa(n.CountryCode) + n.National
+}
+
+// NationalFormat is the number as dialled within its own region, such as
+// "020 7946 0018" for a London number.
+func (n Number) NationalFormat() string {
+	meta := metaFor(n.CountryCode, n.National)
+	if meta == nil {
+		return n.National
+	}
+	for _, f := range meta.formats {
+		if f.pattern.MatchString(n.National) {
+			return f.pattern.ReplaceAllString(n.National, f.national)
+		}
+	}
+	return meta.nationalPrefix + n.National
+}
+
+// InternationalFormat is the number as dialled from abroad, such as
+// "+44 20 7946 0018".
+func (n Number) InternationalFormat() string {
+	prefix := "+" + strconv.Itoa(n.CountryCode) + " "
+	meta := metaFor(n.CountryCode, n.National)
+	if meta == nil {
+		return prefix + n.National
+	}
+	for _, f := range meta.formats {
+		if f.pattern.MatchString(n.National) {
+			return prefix + f.pattern.ReplaceAllString(n.National, f.international)
+		}
+	}
+	return prefix + n.National
+}
+
+// Format shows the number the way a viewer in viewerRegion would dial it:
+// in national format when they share its region, international otherwise.
+func (n Number) Format(viewerRegion string) string {
+	if n.Region != "" && strings.EqualFold(n.Region, viewerRegion) {
+		return n.NationalFormat()
+	}
+	return n.InternationalFormat()
+}
+
+// KnownRegion reports whether region has numbering metadata, and so can be
+// used as a default region.
+func KnownRegion(region string) bool {
+	_, ok := regions[strings.ToUpper(region)]
+	return ok
+}
+
+// RegionFromLanguage returns the first region named in an Accept-Language
+// header that has numbering metadata, such as "GB" for "en-GB,en;q=0.8",
+// or "" when there is none. Quality values are not weighed; browsers list
+// languages in order of preference.
+func RegionFromLanguage(header string) string {
+	for _, tag := range strings.Split(header, ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		parts := strings.Split(tag, "-")
+		for _, sub := range parts[1:] {
+			if len(sub) == 2 && KnownRegion(sub) {
+				return strings.ToUpper(sub)
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+package phone
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		raw, region   string
+		e164, regionW string
+	}{
+		{"(415) 555-0132", "US", "+14155550132", "US"},
+		{"1-415-555-0132", "US", "+14155550132", "US"},
+		{"+1 416 555 0132", "", "+14165550132", "CA"},
+		{"011 44 20 7946 0018", "US", "+442079460018", "GB"},
+		{"020 7946 0018", "GB", "+442079460018", "GB"},
+		{"+44 (0)20 7946 0018", "", "+442079460018", "GB"},
+		{"07700 900123", "gb", "+447700900123", "GB"},
+		{"0039 02 1234 5678", "DE", "+390212345678", "IT"},
+		{"030 123456", "DE", "+4930123456", "DE"},
+		{"06 12 34 56 78", "FR", "+33612345678", "FR"},
+		{"0412 345 678", "AU", "+61412345678", "AU"},
+		{"+234 802 123 4567", "", "+2348021234567", ""},
+	} {
+		n, err := Parse(tc.raw, tc.region)
+		if err != nil {
+			t.Errorf("Parse(%q, %q): %v", tc.raw, tc.region, err)
+			continue
+		}
+		if n.E164() != tc.e164 || n.Region != tc.regionW {
+			t.Errorf("Parse(%q, %q) = %s in %q, want %s in %q", tc.raw, tc.region, n.E164(), n.Region, tc.e164, tc.regionW)
+		}
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	for _, tc := range []struct {
+		raw, region string
+		want        error
+	}{
+		{"call me", "US", ErrInvalidCharacters},
+		{"555-0132", "US", ErrTooShort},
+		{"415 555 0132 99", "US", ErrTooLong},
+		{"(015) 555-0132", "US", ErrInvalid},
+		{"020 7946 0018", "", ErrMissingRegion},
+		{"020 7946 0018", "XX", ErrUnknownRegion},
+		{"+999 1234 5678", "", ErrInvalidCountry},
+		{"+", "", ErrTooShort},
+		{"+234 12", "", ErrTooShort},
+	} {
+		if _, err := Parse(tc.raw, tc.region); !errors.Is(err, tc.want) {
+			t.Errorf("Parse(%q, %q): expected %v, got %v", tc.raw, tc.region, tc.want, err)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		e164, national, international string
+	}{
+		{"+14155550132", "(415) 555-0132", "+1 415-555-0132"},
+		{"+442079460018", "020 7946 0018", "+44 20 7946 0018"},
+		{"+447700900123", "07700 900123", "+44 7700 900123"},
+		{"+33612345678", "06 12 34 56 78", "+33 6 12 34 56 78"},
+		{"+390212345678", "02 1234 5678", "+39 02 1234 5678"},
+		{"+61212345678", "(02) 1234 5678", "+61 2 1234 5678"},
+		{"+2348021234567", "8021234567", "+234 8021234567"},
+	} {
+		n, err := Parse(tc.e164, "")
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.e164, err)
+		}
+		if got := n.NationalFormat(); got != tc.national {
+			t.Errorf("%s national: got %q, want %q", tc.e164, got, tc.national)
+		}
+		if got := n.InternationalFormat(); got != tc.international {
+			t.Errorf("%s international: got %q, want %q", tc.e164, got, tc.international)
+		}
+	}
+
+	n, _ := Parse("+442079460018", "")
+	if got := n.Format("GB"); got != "020 7946 0018" {
+		t.Errorf("viewer in GB: got %q", got)
+	}
+	if got := n.Format("US"); got != "+44 20 7946 0018" {
+		t.Errorf("viewer in US: got %q", got)
+	}
+}
+
+func TestRegionFromLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"en-GB,en;q=0.9":       "GB",
+		"de-at":                "AT",
+		"en, fr-FR;q=0.8":      "FR",
+		"zh-Hant-TW,en-US;q=0": "US",
+		"en":                   "",
+		"":                     "",
+	} {
+		if got := RegionFromLanguage(header); got != want {
+			t.Errorf("RegionFromLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
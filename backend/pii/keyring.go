@@ -0,0 +1,231 @@
+package pii
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const keySize = 32
+
+var encoding = base64.RawStdEncoding
+
+// Keyring is the Cipher backed by master keys loaded from a key file. The
+// highest version seals new values; older versions are kept so existing rows
+// still open until they are re-encrypted.
+type Keyring struct {
+	current  int
+	masters  map[int]cipher.AEAD
+	indexKey []byte
+}
+
+// LoadKeyFile reads a key file of the form
+//
+//	# comments and blank lines are ignored
+//	index:<base64 32-byte key>
+//	1:<base64 32-byte key>
+//	2:<base64 32-byte key>
+//
+// The index key feeds the blind index and must never change once data has
+// been written, otherwise email lookups stop matching.
+func LoadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		index []byte
+		keys  = map[int][]byte{}
+	)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(text, ":")
+		if !ok {
+			return nil, fmt.Errorf("pii: %s:%d: expected name:key", path, line)
+		}
+		key, err := encoding.DecodeString(strings.TrimRight(value, "="))
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("pii: %s:%d: key must be %d base64-encoded bytes", path, line, keySize)
+		}
+		if name == "index" {
+			index = key
+			continue
+		}
+		version, err := strconv.Atoi(name)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("pii: %s:%d: key version must be a positive integer", path, line)
+		}
+		keys[version] = key
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if index == nil {
+		return nil, fmt.Errorf("pii: %s has no index key", path)
+	}
+	return NewKeyring(index, keys)
+}
+
+func NewKeyring(indexKey []byte, masters map[int][]byte) (*Keyring, error) {
+	if len(masters) == 0 {
+		return nil, fmt.Errorf("pii: at least one master key is required")
+	}
+	k := &Keyring{masters: map[int]cipher.AEAD{}, indexKey: indexKey}
+	for version, key := range masters {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.masters[version] = aead
+		if version > k.current {
+			k.current = version
+		}
+	}
+	return k, nil
+}
+
+// GenerateKey returns a random key encoded for a key file.
+func GenerateKey() (string, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(key), nil
+}
+
+func (k *Keyring) CurrentVersion() int {
+	return k.current
+}
+
+func (k *Keyring) Encrypt(column, plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+
+	dek := make([]byte, keySize)
+	if _, err := rand.Read(dek); err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(data, []byte(plaintext), []byte(column))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.masters[k.current], dek, wrapAAD(k.current))
+	if err != nil {
+		return "", err
+	}
+
+	return prefix + strconv.Itoa(k.current) + ":" +
+		encoding.EncodeToString(wrapped) + ":" +
+		encoding.EncodeToString(sealed), nil
+}
+
+func (k *Keyring) Decrypt(column, value string) (string, error) {
+	if !IsEncrypted(value) {
+		// Rows written before encryption was enabled, until re-encrypted.
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, prefix), ":")
+	if len(parts) != 3 {
+		return "", ErrCorrupt
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	master, ok := k.masters[version]
+	if !ok {
+		return "", fmt.Errorf("%w: %d", ErrUnknownKey, version)
+	}
+	wrapped, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return "", ErrCorrupt
+	}
+	sealed, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return "", ErrCorrupt
+	}
+
+	dek, err := open(master, wrapped, wrapAAD(version))
+	if err != nil {
+		return "", err
+	}
+	data, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(data, sealed, []byte(column))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func (k *Keyring) BlindIndex(value string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(Normalize(value)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (k *Keyring) Stale(value string) bool {
+	if value == "" {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	version, _, _ := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	return version != strconv.Itoa(k.current)
+}
+
+func wrapAAD(version int) []byte {
+	return []byte("dek:" + strconv.Itoa(version))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrCorrupt
+	}
+	nonce, ct := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ct, aad)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,137 @@
+package pii
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKeyring(t *testing.T, versions ...int) *Keyring {
+	t.Helper()
+	masters := map[int][]byte{}
+	for _, v := range versions {
+		masters[v] = bytes.Repeat([]byte{byte(v)}, keySize)
+	}
+	k, err := NewKeyring(bytes.Repeat([]byte{0xAA}, keySize), masters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestKeyring(t *testing.T) {
+	k := testKeyring(t, 1)
+
+	t.Run("Round Trip", func(t *testing.T) {
+		sealed, err := k.Encrypt("email", "a@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !IsEncrypted(sealed) || strings.Contains(sealed, "a@example.com") {
+			t.Fatalf("expected ciphertext, got %q", sealed)
+		}
+		got, err := k.Decrypt("email", sealed)
+		if err != nil || got != "a@example.com" {
+			t.Errorf("got %q, %v", got, err)
+		}
+	})
+
+	t.Run("Column Is Bound", func(t *testing.T) {
+		sealed, _ := k.Encrypt("email", "a@example.com")
+		if _, err := k.Decrypt("telephone", sealed); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("expected ErrCorrupt, got %v", err)
+		}
+	})
+
+	t.Run("Empty And Legacy Values", func(t *testing.T) {
+		if sealed, _ := k.Encrypt("telephone", ""); sealed != "" {
+			t.Errorf("expected empty value to stay empty, got %q", sealed)
+		}
+		if got, _ := k.Decrypt("full_name", "Legacy Name"); got != "Legacy Name" {
+			t.Errorf("expected plaintext to pass through, got %q", got)
+		}
+	})
+
+	t.Run("Blind Index", func(t *testing.T) {
+		if k.BlindIndex(" A@Example.com ") != k.BlindIndex("a@example.com") {
+			t.Error("expected blind index to ignore case and whitespace")
+		}
+		if k.BlindIndex("a@example.com") == (Plain{}).BlindIndex("a@example.com") {
+			t.Error("expected keyed blind index to differ from the plain one")
+		}
+	})
+}
+
+func TestKeyring_Rotation(t *testing.T) {
+	old := testKeyring(t, 1)
+	sealed, _ := old.Encrypt("email", "a@example.com")
+
+	rotated := testKeyring(t, 1, 2)
+	if rotated.CurrentVersion() != 2 {
+		t.Fatalf("expected current version 2, got %d", rotated.CurrentVersion())
+	}
+	if !rotated.Stale(sealed) || !rotated.Stale("plaintext") || rotated.Stale("") {
+		t.Error("unexpected Stale result")
+	}
+	if got, err := rotated.Decrypt("email", sealed); err != nil || got != "a@example.com" {
+		t.Errorf("expected old key to still decrypt, got %q, %v", got, err)
+	}
+	fresh, _ := rotated.Encrypt("email", "a@example.com")
+	if rotated.Stale(fresh) {
+		t.Error("expected value sealed with the current key not to be stale")
+	}
+
+	if _, err := testKeyring(t, 2).Decrypt("email", sealed); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		path := filepath.Join(t.TempDir(), "keys")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	key1, _ := GenerateKey()
+	key2, _ := GenerateKey()
+	index, _ := GenerateKey()
+
+	t.Run("Valid File", func(t *testing.T) {
+		k, err := LoadKeyFile(write(t, "# keys\nindex:"+index+"\n\n1:"+key1+"\n2:"+key2+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k.CurrentVersion() != 2 {
+			t.Errorf("expected current version 2, got %d", k.CurrentVersion())
+		}
+	})
+
+	t.Run("Invalid Files", func(t *testing.T) {
+		for name, content := range map[string]string{
+			"No Index":    "1:" + key1,
+			"No Master":   "index:" + index,
+			"Short Key":   "index:" + index + "\n1:c2hvcnQ",
+			"Bad Version": "index:" + index + "\nv1:" + key1,
+		} {
+			if _, err := LoadKeyFile(write(t, content)); err == nil {
+				t.Errorf("%s: expected error", name)
+			}
+		}
+	})
+}
+
+func TestPlain(t *testing.T) {
+	p := Plain{}
+	if got, _ := p.Encrypt("email", "a@example.com"); got != "a@example.com" {
+		t.Errorf("expected plaintext, got %q", got)
+	}
+	sealed, _ := testKeyring(t, 1).Encrypt("email", "a@example.com")
+	if _, err := p.Decrypt("email", sealed); !errors.Is(err, ErrNoKey) {
+		t.Errorf("expected ErrNoKey, got %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Package pii encrypts personal data columns before they reach the database.
+//
+// Values are sealed with envelope encryption: every value gets a fresh AES-256
+// data key, and that data key is itself sealed with a versioned master key.
+// The stored form records the master key version, so keys can be rotated and
+// old rows re-encrypted in the background.
+//
+//	enc:1:<key version>:<base64 nonce+wrapped data key>:<base64 nonce+ciphertext>
+//
+// Encrypted columns can no longer be searched, so lookups go through a blind
+// index: a keyed HMAC of the normalised value stored next to it.
+package pii
+
+import (
+	"errors"
+	"strings"
+)
+
+const prefix = "enc:1:"
+
+var (
+	ErrNoKey      = errors.New("pii: value is encrypted but no key is configured")
+	ErrUnknownKey = errors.New("pii: value sealed with an unknown key version")
+	ErrCorrupt    = errors.New("pii: malformed ciphertext")
+)
+
+// Cipher seals and opens column values. column is bound into the ciphertext
+// so a value cannot be copied into a different column and still decrypt.
+type Cipher interface {
+	Encrypt(column, plaintext string) (string, error)
+	Decrypt(column, value string) (string, error)
+	// BlindIndex returns the lookup token stored alongside an encrypted email.
+	BlindIndex(value string) string
+	// Stale reports whether value should be rewritten by a re-encryption run:
+	// it is plaintext, or sealed with a key that is no longer current.
+	Stale(value string) bool
+}
+
+// IsEncrypted reports whether value is in the sealed format.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, prefix)
+}
+
+// Normalize is applied before blind indexing so lookups ignore case and
+// surrounding whitespace.
+func Normalize(value string) string {
+	return strings.ToLower(strings.TrimSpace(value))
+}
+
+// Plain is the Cipher used when no key file is configured. It stores values
+// as-is and uses the normalised value itself as the blind index.
+type Plain struct{}
+
+func (Plain) Encrypt(column, plaintext string) (string, error) {
+	return plaintext, nil
+}
+
+func (Plain) Decrypt(column, value string) (string, error) {
+	if IsEncrypted(value) {
+		return "", ErrNoKey
+	}
+	return value, nil
+}
+
+func (Plain) BlindIndex(value string) string {
+	return Normalize(value)
+}
+
+func (Plain) Stale(value string) bool {
+	return false
+}
@@ -0,0 +1,107 @@
+package problem
+
+// Code identifies a kind of problem. Codes are part of the API: clients
+// branch on them, so existing ones are never renamed.
+type Code string
+
+const (
+	// Requests
+	InvalidBody      Code = "invalid_body"
+	InvalidParameter Code = "invalid_parameter"
+	ValidationFailed Code = "validation_failed"
+	UnknownAttribute Code = "unknown_attribute"
+	MethodNotAllowed Code = "method_not_allowed"
+	UnsupportedMedia Code = "unsupported_media_type"
+	PayloadTooLarge  Code = "payload_too_large"
+
+	// Authentication and authorization
+	Unauthenticated    Code = "unauthenticated"
+	InvalidToken       Code = "invalid_token"
+	InvalidCredentials Code = "invalid_credentials"
+	Forbidden          Code = "forbidden"
+	// ReauthRequired asks the user to sign in again before an operation
+	// that needs a recent sign-in.
+	ReauthRequired Code = "reauthentication_required"
+	// InsufficientScope refuses a personal access token that was not
+	// granted what the route needs.
+	InsufficientScope Code = "insufficient_scope"
+	// InvalidClient refuses an OAuth authorization request whose client or
+	// redirect URI is not registered. Other faults of such requests are
+	// sent back to the client's redirect URI instead.
+	InvalidClient Code = "invalid_client"
+
+	// Resources
+	NotFound          Code = "not_found"
+	UserNotFound      Code = "user_not_found"
+	RevisionNotFound  Code = "revision_not_found"
+	AttributeNotFound Code = "attribute_not_found"
+	AvatarNotFound    Code = "avatar_not_found"
+	TokenNotFound     Code = "token_not_found"
+	ClientNotFound    Code = "client_not_found"
+	TenantNotFound    Code = "tenant_not_found"
+	DomainTaken       Code = "domain_taken"
+	UserExists        Code = "user_exists"
+	EmailTaken        Code = "email_taken"
+	ExternalAccount   Code = "external_account"
+	VersionMismatch   Code = "version_mismatch"
+
+	// Verification codes and links
+	TelephoneRequired Code = "telephone_required"
+	AlreadyVerified   Code = "already_verified"
+	Throttled         Code = "throttled"
+	TooManyAttempts   Code = "too_many_attempts"
+	LinkInvalid       Code = "link_invalid"
+	LinkExpired       Code = "link_expired"
+	DeliveryFailed    Code = "delivery_failed"
+
+	// Server
+	Internal    Code = "internal_error"
+	Unavailable Code = "unavailable"
+)
+
+var titles = map[Code]string{
+	InvalidBody:        "Request body is not valid",
+	InvalidParameter:   "Query parameter is not valid",
+	ValidationFailed:   "Validation failed",
+	UnknownAttribute:   "Unknown attribute",
+	MethodNotAllowed:   "Method not allowed",
+	UnsupportedMedia:   "Unsupported media type",
+	PayloadTooLarge:    "Payload too large",
+	Unauthenticated:    "Authentication required",
+	InvalidToken:       "Invalid token",
+	InvalidCredentials: "Invalid credentials",
+	Forbidden:          "Forbidden",
+	ReauthRequired:     "Reauthentication required",
+	InsufficientScope:  "Insufficient scope",
+	InvalidClient:      "OAuth client not valid",
+	NotFound:           "Not found",
+	UserNotFound:       "User not found",
+	RevisionNotFound:   "Revision not found",
+	AttributeNotFound:  "Attribute not found",
+	AvatarNotFound:     "Avatar not found",
+	TokenNotFound:      "Access token not found",
+	ClientNotFound:     "OAuth client not found",
+	TenantNotFound:     "SSO tenant not found",
+	DomainTaken:        "Domain belongs to another tenant",
+	UserExists:         "User already exists",
+	EmailTaken:         "Email already in use",
+	ExternalAccount:    "Managed by the sign-in provider",
+	VersionMismatch:    "Profile was changed elsewhere",
+	TelephoneRequired:  "Telephone required",
+	AlreadyVerified:    "Already verified",
+	Throttled:          "Too many requests",
+	TooManyAttempts:    "Too many attempts",
+	LinkInvalid:        "Link not valid",
+	LinkExpired:        "Link expired",
+	DeliveryFailed:     "Message could not be delivered",
+	Internal:           "Internal server error",
+	Unavailable:        "Service unavailable",
+}
+
+// Title is the short summary shared by every problem with this code.
+func (c Code) Title() string {
+	if t, ok := titles[c]; ok {
+		return t
+	}
+	return string(c)
+}
@@ -0,0 +1,84 @@
+// Package problem writes error responses as RFC 9457 problem details, so
+// clients can tell errors apart by a stable code instead of by message.
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+// ContentType is the media type of problem responses.
+const ContentType = "application/problem+json"
+
+// RequestIDHeader carries the id of a request. Problems repeat it, so a
+// report can be matched with the server logs.
+const RequestIDHeader = "X-Request-ID"
+
+// TypeBase prefixes a problem's code to form its type URI.
+const TypeBase = "urn:ccz:problem:"
+
+// Problem is an RFC 9457 problem details object. Code, RequestID and
+// Errors are extension members.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+
+	Code      Code         `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError says what is wrong with one field of the request, named as
+// in the request body, so forms can show it next to the input.
+type FieldError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// New returns the problem for code with the given detail.
+func New(status int, code Code, detail string) *Problem {
+	return &Problem{
+		Type:   TypeBase + string(code),
+		Title:  code.Title(),
+		Status: status,
+		Detail: detail,
+		Code:   code,
+	}
+}
+
+// Write sends p in answer to r. Instance is set to the request path and
+// RequestID to the id the RequestID middleware assigned.
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" && r != nil {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = w.Header().Get(RequestIDHeader)
+	}
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", ContentType)
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	_ = json.NewEncoder(w).Encode(p)
+}
+
+// Error is the problem counterpart of http.Error.
+func Error(w http.ResponseWriter, r *http.Request, status int, code Code, detail string) {
+	Write(w, r, New(status, code, detail))
+}
+
+// Fields answers 400 with what is wrong with individual fields, keyed by
+// field name.
+func Fields(w http.ResponseWriter, r *http.Request, fields map[string]string) {
+	p := New(http.StatusBadRequest, ValidationFailed, "Some fields are not valid.")
+	for field, detail := range fields {
+		p.Errors = append(p.Errors, FieldError{Field: field, Detail: detail})
+	}
+	sort.Slice(p.Errors, func(i, j int) bool { return p.Errors[i].Field < p.Errors[j].Field })
+	Write(w, r, p)
+}
@@ -0,0 +1,70 @@
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	t.Run("Error", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		w.Header().Set(RequestIDHeader, "abc123")
+		Error(w, httptest.NewRequest(http.MethodGet, "/api/profile", nil), http.StatusNotFound, UserNotFound, "No profile.")
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ContentType {
+			t.Errorf("expected %s, got %q", ContentType, ct)
+		}
+		var p Problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		want := Problem{
+			Type:      "urn:ccz:problem:user_not_found",
+			Title:     "User not found",
+			Status:    http.StatusNotFound,
+			Detail:    "No profile.",
+			Instance:  "/api/profile",
+			Code:      UserNotFound,
+			RequestID: "abc123",
+		}
+		if p.Type != want.Type || p.Title != want.Title || p.Status != want.Status || p.Detail != want.Detail ||
+			p.Instance != want.Instance || p.Code != want.Code || p.RequestID != want.RequestID {
+			t.Errorf("expected %+v, got %+v", want, p)
+		}
+	})
+
+	t.Run("Fields", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		Fields(w, httptest.NewRequest(http.MethodPost, "/", nil), map[string]string{
+			"telephone": "too short",
+			"email":     "required",
+		})
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400, got %d", w.Code)
+		}
+		var p Problem
+		if err := json.NewDecoder(w.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		if p.Code != ValidationFailed || len(p.Errors) != 2 {
+			t.Fatalf("unexpected problem %+v", p)
+		}
+		if p.Errors[0] != (FieldError{Field: "email", Detail: "required"}) || p.Errors[1].Field != "telephone" {
+			t.Errorf("expected errors sorted by field, got %+v", p.Errors)
+		}
+	})
+
+	t.Run("Every Code Has A Title", func(t *testing.T) {
+		for code, title := range titles {
+			if title == "" || title == string(code) {
+				t.Errorf("%s: missing title", code)
+			}
+		}
+	})
+}
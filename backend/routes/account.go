@@ -0,0 +1,36 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/store"
+)
+
+// RegisterAccountRoutes registers the routes for managing how the caller
+// signs in. New passwords must meet policy; notices go through sender.
+// Within stepUp of signing in, the current password is not needed, and
+// only then can access tokens be created.
+func RegisterAccountRoutes(mux *http.ServeMux, users store.UserStore, identities store.IdentityStore, tokens store.TokenStore, policy password.Policy, sender mailer.Sender, stepUp middleware.StepUp) {
+	h := &handlers.AccountHandler{
+		Users:      users,
+		Identities: identities,
+		Policy:     policy,
+		Mail:       sender,
+		StepUp:     stepUp,
+	}
+	t := &handlers.TokenHandler{
+		Users:  users,
+		Tokens: tokens,
+	}
+	auth := middleware.Authenticate(users)
+	recent := stepUp.Require()
+
+	mux.HandleFunc("POST /api/account/password", auth(h.ChangePassword))
+	mux.HandleFunc("GET /api/account/tokens", auth(t.List))
+	mux.HandleFunc("POST /api/account/tokens", auth(recent(t.Create)))
+	mux.HandleFunc("DELETE /api/account/tokens/{id}", auth(t.Delete))
+}
@@ -0,0 +1,136 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"ccz/avatar"
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/store/storetest"
+)
+
+func TestAccountRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	mux := http.NewServeMux()
+	RegisterAccountRoutes(mux, st, st, st, password.DefaultPolicy(), &mailer.Log{Path: filepath.Join(t.TempDir(), "mail.log")}, middleware.DefaultStepUp())
+	RegisterProfileRoutes(mux, st, st, st, &avatar.Local{Dir: t.TempDir()})
+
+	profile := func(token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/api/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("ChangePassword_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/account/password", bytes.NewBufferString(`{"new_password":"battery staple"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("ChangePassword_SignsOutOthers", func(t *testing.T) {
+		old := generateTestToken("test@ex.com")
+		req := httptest.NewRequest(http.MethodPost, "/api/account/password", bytes.NewBufferString(`{"current_password":"pass","new_password":"battery staple"}`))
+		req.Header.Set("Authorization", "Bearer "+old)
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+
+		if code := profile(old); code != http.StatusUnauthorized {
+			t.Errorf("expected the old session to be signed out, got %d", code)
+		}
+		if code := profile(resp.Token); code != http.StatusOK {
+			t.Errorf("expected the new session to work, got %d", code)
+		}
+	})
+
+	t.Run("AccessTokens", func(t *testing.T) {
+		if err := st.CreateLocal(context.Background(), "pat@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		body := `{"name":"ci","scopes":["profile:read"],"expires_in_days":30}`
+		req := httptest.NewRequest(http.MethodPost, "/api/account/tokens", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("pat@ex.com"))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected a stale session to need step-up, got %d", w.Code)
+		}
+
+		req = httptest.NewRequest(http.MethodPost, "/api/account/tokens", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+generateRecentToken("pat@ex.com"))
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var created struct {
+			ID    int64  `json:"id"`
+			Token string `json:"token"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+			t.Fatal(err)
+		}
+
+		if code := profile(created.Token); code != http.StatusOK {
+			t.Errorf("expected the token to read the profile, got %d", code)
+		}
+
+		call := func(method, path, body string) int {
+			req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+created.Token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			return w.Code
+		}
+		if code := call(http.MethodPatch, "/api/profile", `{"first_name":"Ann"}`); code != http.StatusForbidden {
+			t.Errorf("expected a read-only token to be refused writes, got %d", code)
+		}
+		if code := call(http.MethodPost, "/api/account/password", `{"new_password":"correct horse"}`); code != http.StatusForbidden {
+			t.Errorf("expected the token to be refused on account routes, got %d", code)
+		}
+		if code := call(http.MethodGet, "/api/account/tokens", ""); code != http.StatusForbidden {
+			t.Errorf("expected the token to be refused on its own routes, got %d", code)
+		}
+
+		req = httptest.NewRequest(http.MethodDelete, "/api/account/tokens/"+strconv.FormatInt(created.ID, 10), nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("pat@ex.com"))
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("expected 204, got %d", w.Code)
+		}
+		if code := profile(created.Token); code != http.StatusUnauthorized {
+			t.Errorf("expected a revoked token to be refused, got %d", code)
+		}
+	})
+}
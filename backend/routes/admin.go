@@ -0,0 +1,30 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/middleware"
+	"ccz/pat"
+	"ccz/store"
+)
+
+// RegisterAdminRoutes registers the admin routes. Changes need a session
+// that stepUp finds recent; reads also take access tokens with the admin
+// scope.
+func RegisterAdminRoutes(mux *http.ServeMux, users store.UserStore, schema store.SchemaStore, tokens store.TokenStore, stepUp middleware.StepUp) {
+	h := &handlers.AdminHandler{
+		Users:  users,
+		Schema: schema,
+	}
+
+	auth := middleware.Authenticate(users)
+	read := middleware.AuthenticateScope(users, tokens, pat.ScopeAdmin)
+	recent := stepUp.Require()
+
+	mux.HandleFunc("GET /api/admin/attributes", read(h.Attributes))
+	mux.HandleFunc("PUT /api/admin/attributes/{name}", auth(recent(h.PutAttribute)))
+	mux.HandleFunc("DELETE /api/admin/attributes/{name}", auth(recent(h.DeleteAttribute)))
+	mux.HandleFunc("GET /api/admin/users/{email}/attributes", read(h.UserAttributes))
+	mux.HandleFunc("PATCH /api/admin/users/{email}/attributes", auth(recent(h.PatchUserAttributes)))
+}
@@ -0,0 +1,74 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"ccz/middleware"
+	"ccz/store/storetest"
+)
+
+func TestAdminRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	for _, email := range []string{"test@ex.com", "admin@ex.com"} {
+		if err := st.CreateLocal(context.Background(), email, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	mux := http.NewServeMux()
+	RegisterAdminRoutes(mux, st, st, st, middleware.DefaultStepUp())
+
+	t.Run("PutAttribute_Success", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"label":"Job title","type":"string"}`)
+		req := httptest.NewRequest(http.MethodPut, "/api/admin/attributes/title", body)
+		req.Header.Set("Authorization", "Bearer "+generateRecentToken("admin@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("UserAttributes_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/users/test@ex.com/attributes", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("admin@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Attributes_Forbidden", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/admin/attributes", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected 403, got %d", w.Code)
+		}
+	})
+
+	t.Run("DeleteAttribute_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/admin/attributes/title", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+}
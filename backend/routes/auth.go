@@ -1,19 +1,33 @@
 package routes
 
 import (
-	"database/sql"
 	"net/http"
 
+	"ccz/authn"
+	"ccz/avatar"
 	"ccz/handlers"
+	"ccz/middleware"
+	"ccz/password"
+	"ccz/store"
 )
 
-func RegisterAuthRoutes(mux *http.ServeMux, db *sql.DB) {
+// RegisterAuthRoutes registers the login routes. Passwords are checked by
+// authenticator and new ones must meet policy. Google pictures of new
+// accounts are imported as avatars when storage is not nil.
+func RegisterAuthRoutes(mux *http.ServeMux, identities store.IdentityStore, users store.UserStore, authenticator authn.Authenticator, policy password.Policy, storage avatar.Storage) {
 	h := &handlers.AuthHandler{
-		DB: db,
+		Identities:    identities,
+		Authenticator: authenticator,
+		Policy:        policy,
+	}
+	if storage != nil {
+		h.Avatars = &handlers.AvatarHandler{Users: users, Storage: storage}
 	}
 
 	mux.HandleFunc("/api/auth/login", h.Login)
 	mux.HandleFunc("/api/auth/signup", h.Signup)
+	mux.HandleFunc("/api/auth/password/strength", h.PasswordStrength)
+	mux.HandleFunc("/api/auth/reauth", middleware.Authenticate(users)(h.Reauth))
 	mux.HandleFunc("/api/auth/logout", h.Logout)
 	mux.HandleFunc("/api/auth/google", h.Google)
 	mux.HandleFunc("/api/auth/google/callback", h.GoogleCallback)
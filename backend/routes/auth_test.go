@@ -2,6 +2,7 @@ package routes
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -10,36 +11,25 @@ import (
 	"strings"
 	"testing"
 
-	"ccz/handlers"
-
-	"github.com/DATA-DOG/go-sqlmock"
+	"ccz/authn"
+	"ccz/password"
+	"ccz/store/storetest"
 )
 
 func TestRegisterAuthRoutes(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("error: %s", err)
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
 	}
-	defer db.Close()
 
 	secret := "testsecret"
 	os.Setenv("JWT_SECRET", secret)
 	defer os.Unsetenv("JWT_SECRET")
 
-	h := &handlers.AuthHandler{DB: db}
-
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/auth/login", h.Login)
-	mux.HandleFunc("/api/auth/signup", h.Signup)
-	mux.HandleFunc("/api/auth/logout", h.Logout)
-	mux.HandleFunc("/api/auth/google", h.Google)
-	mux.HandleFunc("/api/auth/google/callback", h.GoogleCallback)
+	RegisterAuthRoutes(mux, st, st, &authn.Local{Users: st, Identities: st}, password.DefaultPolicy(), nil)
 
 	t.Run("Login", func(t *testing.T) {
-		mock.ExpectQuery("SELECT id FROM users.*").
-			WithArgs("test@ex.com", "pass").
-			WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(1))
-
 		body, _ := json.Marshal(map[string]string{
 			"email":    "test@ex.com",
 			"password": "pass",
@@ -54,14 +44,29 @@ func TestRegisterAuthRoutes(t *testing.T) {
 		}
 	})
 
-	t.Run("Signup", func(t *testing.T) {
-		mock.ExpectExec("INSERT INTO users.*").
-			WithArgs("new@ex.com", "pass", "local").
-			WillReturnResult(sqlmock.NewResult(1, 1))
+	t.Run("Reauth", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/auth/reauth", bytes.NewBufferString(`{"password":"pass"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+		}
 
+		req = httptest.NewRequest(http.MethodPost, "/api/auth/reauth", bytes.NewBufferString(`{"password":"pass"}`))
+		req.Header.Set("Content-Type", "application/json")
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a session to be required, got %d", w.Code)
+		}
+	})
+
+	t.Run("Signup", func(t *testing.T) {
 		formData := url.Values{
 			"email":    {"new@ex.com"},
-			"password": {"pass"},
+			"password": {"correct horse"},
 		}
 
 		req := httptest.NewRequest(http.MethodPost, "/api/auth/signup", strings.NewReader(formData.Encode()))
@@ -104,8 +109,4 @@ func TestRegisterAuthRoutes(t *testing.T) {
 			t.Errorf("expected 303, got %d", w.Code)
 		}
 	})
-
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("unfulfilled expectations: %s", err)
-	}
 }
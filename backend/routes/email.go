@@ -0,0 +1,27 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/store"
+)
+
+// RegisterEmailRoutes registers the routes for changing the email. Asking
+// for a change needs a session that stepUp finds recent.
+func RegisterEmailRoutes(mux *http.ServeMux, users store.UserStore, emails store.EmailStore, sender mailer.Sender, stepUp middleware.StepUp) {
+	h := &handlers.EmailHandler{
+		Users:  users,
+		Emails: emails,
+		Mail:   sender,
+	}
+
+	auth := middleware.Authenticate(users)
+	recent := stepUp.Require()
+
+	mux.HandleFunc("POST /api/profile/email", auth(recent(h.Request)))
+	mux.HandleFunc("POST /api/profile/email/confirm", auth(h.Confirm))
+	mux.HandleFunc("POST /api/email/revert", h.Revert)
+}
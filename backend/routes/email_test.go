@@ -0,0 +1,73 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ccz/mailer"
+	"ccz/middleware"
+	"ccz/store/storetest"
+)
+
+func TestEmailRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	logFile := filepath.Join(t.TempDir(), "mail.log")
+	mux := http.NewServeMux()
+	RegisterEmailRoutes(mux, st, st, &mailer.Log{Path: logFile}, middleware.DefaultStepUp())
+
+	t.Run("Request_NotRecent", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/email", bytes.NewBufferString(`{"email":"new@ex.com"}`))
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "reauthentication_required") {
+			t.Errorf("expected a step-up challenge, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Request_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/email", bytes.NewBufferString(`{"email":"new@ex.com"}`))
+		req.Header.Set("Authorization", "Bearer "+generateRecentToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("expected 202, got %d", w.Code)
+		}
+		if data, _ := os.ReadFile(logFile); !strings.Contains(string(data), "new@ex.com") {
+			t.Errorf("expected the confirmation in the mail log, got %q", data)
+		}
+	})
+
+	t.Run("Confirm_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/email/confirm", bytes.NewBufferString(`{"token":"x"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Revert_NoSession", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/email/revert", bytes.NewBufferString(`{"token":"x"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for an unknown token, got %d", w.Code)
+		}
+	})
+}
@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/db"
+	"ccz/handlers"
+)
+
+func RegisterHealthRoutes(mux *http.ServeMux, prober *db.Prober, router *db.Router) {
+	h := &handlers.HealthHandler{
+		Prober: prober,
+		Router: router,
+	}
+
+	mux.HandleFunc("/health", h.Live)
+	mux.HandleFunc("/health/db", h.DB)
+}
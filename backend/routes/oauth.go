@@ -0,0 +1,51 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/store"
+)
+
+// RegisterOAuthRoutes registers the OAuth 2.0 / OpenID Connect provider:
+// the endpoints clients call under /oauth/ and /.well-known/, the API the
+// frontend consent and device pages call, and the admin routes that
+// register clients. Introspection also answers for personal access tokens
+// in tokens. Registering and removing clients needs a session stepUp finds
+// recent.
+func RegisterOAuthRoutes(mux *http.ServeMux, users store.UserStore, clients store.OAuthStore, tokens store.TokenStore, provider *oauth.Provider, stepUp middleware.StepUp) {
+	h := &handlers.OAuthHandler{
+		Users:    users,
+		Clients:  clients,
+		Tokens:   tokens,
+		Provider: provider,
+	}
+	admin := &handlers.OAuthClientHandler{
+		Users:   users,
+		Clients: clients,
+	}
+
+	auth := middleware.Authenticate(users)
+	recent := stepUp.Require()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", h.Discovery)
+	mux.HandleFunc("GET /oauth/jwks", h.JWKS)
+	mux.HandleFunc("GET /oauth/authorize", h.Authorize)
+	mux.HandleFunc("/oauth/token", h.Token)
+	mux.HandleFunc("GET /oauth/userinfo", h.UserInfo)
+	mux.HandleFunc("POST /oauth/userinfo", h.UserInfo)
+	mux.HandleFunc("/oauth/introspect", h.Introspect)
+	mux.HandleFunc("/oauth/revoke", h.Revoke)
+	mux.HandleFunc("/oauth/device/code", h.DeviceAuthorization)
+
+	mux.HandleFunc("GET /api/oauth/authorize", auth(h.AuthorizeRequest))
+	mux.HandleFunc("POST /api/oauth/authorize", auth(h.Consent))
+	mux.HandleFunc("GET /api/oauth/device", auth(h.DeviceRequest))
+	mux.HandleFunc("POST /api/oauth/device", auth(h.DeviceDecision))
+
+	mux.HandleFunc("GET /api/admin/oauth/clients", auth(admin.List))
+	mux.HandleFunc("POST /api/admin/oauth/clients", auth(recent(admin.Create)))
+	mux.HandleFunc("DELETE /api/admin/oauth/clients/{id}", auth(recent(admin.Delete)))
+}
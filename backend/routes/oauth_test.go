@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"ccz/middleware"
+	"ccz/oauth"
+	"ccz/store/storetest"
+)
+
+func TestOAuthRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	RegisterOAuthRoutes(mux, st, st, st, oauth.NewProvider("http://localhost:8081", key), middleware.DefaultStepUp())
+
+	t.Run("Discovery", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/.well-known/openid-configuration", nil))
+		var doc map[string]any
+		if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != http.StatusOK || doc["issuer"] != "http://localhost:8081" || doc["jwks_uri"] != "http://localhost:8081/oauth/jwks" {
+			t.Errorf("unexpected discovery document %d %v", w.Code, doc)
+		}
+
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/oauth/jwks", nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"kty":"RSA"`) {
+			t.Errorf("expected the key set, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	var client struct {
+		ID     string `json:"client_id"`
+		Secret string `json:"client_secret"`
+	}
+	t.Run("Register Client", func(t *testing.T) {
+		body := `{"name":"Reports","scopes":["reports:read"],"grant_types":["client_credentials"]}`
+		register := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodPost, "/api/admin/oauth/clients", bytes.NewBufferString(body))
+			req.Header.Set("Authorization", "Bearer "+token)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, req)
+			return w
+		}
+		if w := register(generateTestToken("admin@ex.com")); w.Code != http.StatusUnauthorized {
+			t.Errorf("expected a stale session to need step-up, got %d", w.Code)
+		}
+		w := register(generateRecentToken("admin@ex.com"))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		if err := json.NewDecoder(w.Body).Decode(&client); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(url.Values{"grant_type": {"client_credentials"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"access_token"`) {
+			t.Errorf("expected a token, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Introspect", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/oauth/introspect", strings.NewReader(url.Values{"token": {"abc"}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(client.ID, client.Secret)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized || !strings.Contains(w.Body.String(), "invalid_client") {
+			t.Errorf("expected a client without the introspect scope to be refused, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("Consent_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/oauth/authorize?client_id="+client.ID, bytes.NewBufferString(`{"approve":true}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+}
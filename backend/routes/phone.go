@@ -0,0 +1,23 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/middleware"
+	"ccz/sms"
+	"ccz/store"
+)
+
+func RegisterPhoneRoutes(mux *http.ServeMux, users store.UserStore, phones store.PhoneStore, sender sms.Sender) {
+	h := &handlers.PhoneHandler{
+		Users:  users,
+		Phones: phones,
+		SMS:    sender,
+	}
+
+	auth := middleware.Authenticate(users)
+
+	mux.HandleFunc("POST /api/profile/telephone/verify", auth(h.Request))
+	mux.HandleFunc("POST /api/profile/telephone/confirm", auth(h.Confirm))
+}
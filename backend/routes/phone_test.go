@@ -0,0 +1,57 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"ccz/sms"
+	"ccz/store"
+	"ccz/store/storetest"
+)
+
+func TestPhoneRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	if err := st.CreateLocal(ctx, "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.UpdateProfile(ctx, "test@ex.com", store.ProfileUpdate{FullName: "Test", Telephone: "+14155550132"}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	logFile := filepath.Join(t.TempDir(), "sms.log")
+	mux := http.NewServeMux()
+	RegisterPhoneRoutes(mux, st, st, &sms.Log{Path: logFile})
+
+	t.Run("Verify_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/telephone/verify", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("expected 202, got %d", w.Code)
+		}
+		if data, _ := os.ReadFile(logFile); !strings.Contains(string(data), "+14155550132") {
+			t.Errorf("expected the code in the SMS log, got %q", data)
+		}
+	})
+
+	t.Run("Confirm_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/telephone/confirm", bytes.NewBufferString(`{"code":"123456"}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+}
@@ -1,18 +1,55 @@
 package routes
 
 import (
-	"database/sql"
 	"net/http"
 
+	"ccz/avatar"
 	"ccz/handlers"
 	"ccz/middleware"
+	"ccz/pat"
+	"ccz/store"
 )
 
-func RegisterProfileRoutes(mux *http.ServeMux, db *sql.DB) {
+// saveDeprecatedAt is when /api/profile/save was superseded by PUT and
+// PATCH on /api/profile, as an RFC 9745 Deprecation date (2026-10-18).
+const saveDeprecatedAt = "@1792281600"
+
+// RegisterProfileRoutes registers the profile routes. Besides sessions,
+// they take personal access tokens from tokens with the profile scopes.
+func RegisterProfileRoutes(mux *http.ServeMux, users store.UserStore, schema store.SchemaStore, tokens store.TokenStore, storage avatar.Storage) {
 	h := &handlers.ProfileHandler{
-		DB: db,
+		Users:  users,
+		Schema: schema,
+	}
+	avatars := &handlers.AvatarHandler{
+		Users:   users,
+		Storage: storage,
 	}
 
-	mux.HandleFunc("/api/profile", middleware.AuthMiddleware(h.View))
-	mux.HandleFunc("/api/profile/save", middleware.AuthMiddleware(h.Save))
+	read := middleware.AuthenticateScope(users, tokens, pat.ScopeProfileRead)
+	write := middleware.AuthenticateScope(users, tokens, pat.ScopeProfileWrite)
+
+	mux.HandleFunc("GET /api/profile", read(h.View))
+	mux.HandleFunc("PUT /api/profile", write(h.Replace))
+	mux.HandleFunc("PATCH /api/profile", write(h.Patch))
+	mux.HandleFunc("GET /api/profile/schema", read(h.AttributeSchema))
+	mux.HandleFunc("GET /api/profile/history", read(h.History))
+	mux.HandleFunc("POST /api/profile/history/restore", write(h.Restore))
+	mux.HandleFunc("POST /api/profile/avatar", write(avatars.Upload))
+	mux.HandleFunc("DELETE /api/profile/avatar", write(avatars.Delete))
+	mux.HandleFunc("GET /api/avatars/{id}/{size}", avatars.Serve)
+
+	save := deprecated(saveDeprecatedAt, "/api/profile", write(h.Save))
+	mux.HandleFunc("POST /api/profile/save", save)
+	mux.HandleFunc("PUT /api/profile/save", save)
+}
+
+// deprecated marks responses from next with a Deprecation header and a
+// link to the route that replaces it.
+func deprecated(since, successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", since)
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		next(w, r)
+	}
 }
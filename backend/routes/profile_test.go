@@ -2,17 +2,19 @@ package routes
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
-	"ccz/handlers"
-	"ccz/middleware"
+	"ccz/avatar"
+	"ccz/pat"
+	"ccz/store"
+	"ccz/store/storetest"
 
-	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -26,20 +28,30 @@ func generateTestToken(email string) string {
 	return tokenString
 }
 
+// generateRecentToken is a token for email that signed in with a password
+// just now, as step-up routes need.
+func generateRecentToken(email string) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email":     email,
+		"exp":       time.Now().Add(time.Hour).Unix(),
+		"auth_time": time.Now().Unix(),
+		"amr":       []string{"pwd"},
+	})
+	tokenString, _ := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	return tokenString
+}
+
 func TestProfileRoutes(t *testing.T) {
-	db, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("error: %s", err)
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "test@ex.com", "pass"); err != nil {
+		t.Fatal(err)
 	}
-	defer db.Close()
 
 	os.Setenv("JWT_SECRET", "testsecret")
 	defer os.Unsetenv("JWT_SECRET")
 
-	h := &handlers.ProfileHandler{DB: db}
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/profile", middleware.AuthMiddleware(h.View))
-	mux.HandleFunc("/api/profile/save", middleware.AuthMiddleware(h.Save))
+	RegisterProfileRoutes(mux, st, st, st, &avatar.Local{Dir: t.TempDir()})
 
 	t.Run("ViewProfile_Success", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/api/profile", nil)
@@ -47,12 +59,6 @@ func TestProfileRoutes(t *testing.T) {
 		req.Header.Set("Authorization", "Bearer "+token)
 		w := httptest.NewRecorder()
 
-		rows := sqlmock.NewRows([]string{"full_name", "telephone", "email"}).
-			AddRow("Mukul", "123", "test@ex.com")
-		mock.ExpectQuery("SELECT COALESCE\\(full_name, ''\\), COALESCE\\(telephone, ''\\), email FROM users WHERE email=\\?").
-			WithArgs("test@ex.com").
-			WillReturnRows(rows)
-
 		mux.ServeHTTP(w, req)
 		if w.Code != http.StatusOK {
 			t.Errorf("expected 200, got %d", w.Code)
@@ -74,10 +80,6 @@ func TestProfileRoutes(t *testing.T) {
 		req.Header.Set("Authorization", "Bearer "+token)
 		w := httptest.NewRecorder()
 
-		mock.ExpectQuery("SELECT COALESCE\\(full_name, ''\\), COALESCE\\(telephone, ''\\), email FROM users WHERE email=\\?").
-			WithArgs("none@ex.com").
-			WillReturnError(sql.ErrNoRows)
-
 		mux.ServeHTTP(w, req)
 		if w.Code != http.StatusNotFound {
 			t.Errorf("expected 404, got %d", w.Code)
@@ -85,21 +87,64 @@ func TestProfileRoutes(t *testing.T) {
 	})
 
 	t.Run("UpdateProfile_Success", func(t *testing.T) {
-		body := bytes.NewBufferString(`{"full_name":"New Name","telephone":"999"}`)
+		body := bytes.NewBufferString(`{"full_name":"New Name","telephone":"+442079460018"}`)
 		req := httptest.NewRequest(http.MethodPost, "/api/profile/save", body)
 		token := generateTestToken("test@ex.com")
 		req.Header.Set("Authorization", "Bearer "+token)
 		req.Header.Set("Content-Type", "application/json")
 		w := httptest.NewRecorder()
 
-		mock.ExpectExec("UPDATE users SET full_name=\\?, telephone=\\? WHERE email=\\?").
-			WithArgs("New Name", "999", "test@ex.com").
-			WillReturnResult(sqlmock.NewResult(1, 1))
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if w.Header().Get("Deprecation") == "" || !strings.Contains(w.Header().Get("Link"), "successor-version") {
+			t.Errorf("expected deprecation headers, got %v", w.Header())
+		}
+	})
+
+	t.Run("ReplaceProfile_Success", func(t *testing.T) {
+		body := bytes.NewBufferString(`{"full_name":"Put Name","telephone":"(415) 555-0132"}`)
+		req := httptest.NewRequest(http.MethodPut, "/api/profile", body)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
 
 		mux.ServeHTTP(w, req)
 		if w.Code != http.StatusOK {
 			t.Errorf("expected 200, got %d", w.Code)
 		}
+		if w.Header().Get("Deprecation") != "" {
+			t.Error("PUT /api/profile must not be marked deprecated")
+		}
+	})
+
+	t.Run("PatchProfile_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPatch, "/api/profile", bytes.NewBufferString(`{"telephone":null}`))
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `"full_name":"Put Name"`) || !strings.Contains(w.Body.String(), `"telephone":""`) {
+			t.Errorf("unexpected body %s", w.Body.String())
+		}
+	})
+
+	t.Run("Profile_MethodNotAllowed", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodDelete, "/api/profile", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("expected 405, got %d", w.Code)
+		}
+		if allow := w.Header().Get("Allow"); !strings.Contains(allow, http.MethodPatch) {
+			t.Errorf("expected Allow to list PATCH, got %q", allow)
+		}
 	})
 
 	t.Run("UpdateProfile_MethodNotAllowed", func(t *testing.T) {
@@ -113,7 +158,106 @@ func TestProfileRoutes(t *testing.T) {
 		}
 	})
 
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("there were unfulfilled expectations: %s", err)
+	t.Run("Schema_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/profile/schema", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `"attributes":[]`) {
+			t.Errorf("unexpected body %s", w.Body.String())
+		}
+	})
+
+	t.Run("History_Success", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/profile/history", nil)
+		req.Header.Set("Authorization", "Bearer "+generateTestToken("test@ex.com"))
+		w := httptest.NewRecorder()
+
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("expected 200, got %d", w.Code)
+		}
+	})
+
+	t.Run("Restore_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/history/restore", bytes.NewBufferString(`{"revision_id":1}`))
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("Avatar_Unauthorized", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/profile/avatar", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("ServeAvatar_NotFound", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/api/avatars/"+strings.Repeat("a", 32)+"/64", nil)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("expected 404, got %d", w.Code)
+		}
+	})
+}
+
+// Personal access tokens of admins reach other users' profiles only with
+// the admin scope.
+func TestProfileRoutes_AccessTokenScopes(t *testing.T) {
+	st := storetest.SQLite(t)
+	ctx := context.Background()
+	for _, email := range []string{"admin@ex.com", "test@ex.com"} {
+		if err := st.CreateLocal(ctx, email, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+	newToken := func(name string, scopes ...string) string {
+		token, prefix, hash, err := pat.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := st.CreateAccessToken(ctx, "admin@ex.com", &store.AccessToken{Name: name, Prefix: prefix, Hash: hash, Scopes: scopes, CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	profileOnly := newToken("profile", pat.ScopeProfileRead, pat.ScopeProfileWrite)
+	admin := newToken("admin", pat.ScopeProfileRead, pat.ScopeAdmin)
+
+	mux := http.NewServeMux()
+	RegisterProfileRoutes(mux, st, st, st, &avatar.Local{Dir: t.TempDir()})
+	call := func(method, target, body, token string) int {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := call(http.MethodGet, "/api/profile/history?email=test@ex.com", "", profileOnly); code != http.StatusForbidden {
+		t.Errorf("history: expected 403, got %d", code)
+	}
+	if code := call(http.MethodPost, "/api/profile/history/restore", `{"revision_id": 1, "email": "test@ex.com"}`, profileOnly); code != http.StatusForbidden {
+		t.Errorf("restore: expected 403, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/profile/history", "", profileOnly); code != http.StatusOK {
+		t.Errorf("own history: expected 200, got %d", code)
+	}
+	if code := call(http.MethodGet, "/api/profile/history?email=test@ex.com", "", admin); code != http.StatusOK {
+		t.Errorf("history with the admin scope: expected 200, got %d", code)
 	}
 }
@@ -0,0 +1,38 @@
+package routes
+
+import (
+	"net/http"
+
+	"ccz/handlers"
+	"ccz/middleware"
+	"ccz/saml"
+	"ccz/store"
+)
+
+// RegisterSAMLRoutes registers single sign-on with the SAML identity
+// providers of enterprise tenants, and the admin routes that set tenants
+// up. Changing tenants needs a session stepUp finds recent.
+func RegisterSAMLRoutes(mux *http.ServeMux, identities store.IdentityStore, users store.UserStore, tenants store.SAMLStore, config *saml.Config, stepUp middleware.StepUp) {
+	h := &handlers.SAMLHandler{
+		Identities: identities,
+		Tenants:    tenants,
+		Config:     config,
+	}
+	admin := &handlers.SAMLTenantHandler{
+		Users:   users,
+		Tenants: tenants,
+		Config:  config,
+	}
+
+	auth := middleware.Authenticate(users)
+	recent := stepUp.Require()
+
+	mux.HandleFunc("GET /api/auth/saml", h.LoginByEmail)
+	mux.HandleFunc("GET /api/auth/saml/{tenant}", h.Login)
+	mux.HandleFunc("GET /api/auth/saml/{tenant}/metadata", h.Metadata)
+	mux.HandleFunc("POST /api/auth/saml/{tenant}/acs", h.ACS)
+
+	mux.HandleFunc("GET /api/admin/saml/tenants", auth(admin.List))
+	mux.HandleFunc("PUT /api/admin/saml/tenants/{id}", auth(recent(admin.Put)))
+	mux.HandleFunc("DELETE /api/admin/saml/tenants/{id}", auth(recent(admin.Delete)))
+}
@@ -0,0 +1,71 @@
+package routes
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"ccz/middleware"
+	"ccz/saml"
+	"ccz/saml/samltest"
+	"ccz/store/storetest"
+)
+
+func TestSAMLRoutes(t *testing.T) {
+	st := storetest.SQLite(t)
+	if err := st.CreateLocal(context.Background(), "admin@ex.com", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.DB.Exec("UPDATE users SET role='admin' WHERE email_bidx=?", "admin@ex.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("JWT_SECRET", "testsecret")
+	defer os.Unsetenv("JWT_SECRET")
+
+	idp, err := samltest.New("https://idp.acme.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &saml.Config{BaseURL: "http://localhost:8081", Key: idp.Key, Certificate: idp.Certificate}
+	mux := http.NewServeMux()
+	RegisterSAMLRoutes(mux, st, st, st, config, middleware.DefaultStepUp())
+
+	metadata, err := json.Marshal(idp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(token string) *httptest.ResponseRecorder {
+		body := `{"name":"Acme","metadata":` + string(metadata) + `,"domains":["acme.com"]}`
+		req := httptest.NewRequest(http.MethodPut, "/api/admin/saml/tenants/acme", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	if w := put(generateTestToken("admin@ex.com")); w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a stale session to need step-up, got %d", w.Code)
+	}
+	if w := put(generateRecentToken("admin@ex.com")); w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/auth/saml/acme/metadata", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `Location="http://localhost:8081/api/auth/saml/acme/acs"`) {
+		t.Errorf("expected the SP metadata, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for _, target := range []string{"/api/auth/saml?email=jo@acme.com", "/api/auth/saml/acme"} {
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), idp.SSOURL+"?SAMLRequest=") {
+			t.Errorf("%s: expected a redirect to the IdP, got %d %s", target, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// XML Signature, as far as SAML needs it: an enveloped signature over the
+// element it sits in, with Exclusive Canonicalization, RSA-SHA256 and a
+// SHA-256 digest. Other algorithms are refused rather than supported.
+const (
+	nsDSig       = "http://www.w3.org/2000/09/xmldsig#"
+	algEnveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	// algExcC14N is also the namespace of InclusiveNamespaces.
+	algExcC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algRSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algSHA256    = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+// errUnsigned is returned by verify for an element without a signature.
+var errUnsigned = errors.New("saml: not signed")
+
+// verify checks the enveloped signature of e against certs and returns e
+// in canonical form without the signature: the bytes that were signed,
+// which are the only ones to be read afterwards.
+func verify(e *element, certs []*x509.Certificate) ([]byte, error) {
+	sigs := e.elements(nsDSig, "Signature")
+	if len(sigs) == 0 {
+		return nil, errUnsigned
+	}
+	if len(sigs) > 1 {
+		return nil, errors.New("saml: more than one signature")
+	}
+	sig := sigs[0]
+	signedInfo, err := sig.only(nsDSig, "SignedInfo")
+	if err != nil {
+		return nil, err
+	}
+
+	c14n, err := signedInfo.only(nsDSig, "CanonicalizationMethod")
+	if err != nil {
+		return nil, err
+	}
+	if alg := c14n.attr("Algorithm"); alg != algExcC14N {
+		return nil, fmt.Errorf("saml: unsupported canonicalization %q", alg)
+	}
+	method, err := signedInfo.only(nsDSig, "SignatureMethod")
+	if err != nil {
+		return nil, err
+	}
+	if alg := method.attr("Algorithm"); alg != algRSASHA256 {
+		return nil, fmt.Errorf("saml: unsupported signature algorithm %q", alg)
+	}
+
+	// The one reference must be to e itself, so the signature cannot be
+	// moved onto another element.
+	ref, err := signedInfo.only(nsDSig, "Reference")
+	if err != nil {
+		return nil, err
+	}
+	if id := e.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return nil, errors.New("saml: the signature is not of the element it is in")
+	}
+	var (
+		enveloped bool
+		prefixes  []string
+	)
+	if transforms := ref.elements(nsDSig, "Transforms"); len(transforms) == 1 {
+		for _, t := range transforms[0].elements(nsDSig, "Transform") {
+			switch t.attr("Algorithm") {
+			case algEnveloped:
+				enveloped = true
+			case algExcC14N:
+				prefixes = inclusivePrefixes(t)
+			default:
+				return nil, fmt.Errorf("saml: unsupported transform %q", t.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped {
+		return nil, errors.New("saml: the signature is not enveloped")
+	}
+	digestMethod, err := ref.only(nsDSig, "DigestMethod")
+	if err != nil {
+		return nil, err
+	}
+	if alg := digestMethod.attr("Algorithm"); alg != algSHA256 {
+		return nil, fmt.Errorf("saml: unsupported digest algorithm %q", alg)
+	}
+	digestValue, err := ref.only(nsDSig, "DigestValue")
+	if err != nil {
+		return nil, err
+	}
+	want, err := decodeBase64(digestValue.text())
+	if err != nil {
+		return nil, fmt.Errorf("saml: digest value: %w", err)
+	}
+
+	signed := e.canonical(sig, prefixes)
+	digest := sha256.Sum256(signed)
+	if subtle.ConstantTimeCompare(digest[:], want) != 1 {
+		return nil, errors.New("saml: the digest does not match; the element was changed after it was signed")
+	}
+
+	value, err := sig.only(nsDSig, "SignatureValue")
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeBase64(value.text())
+	if err != nil {
+		return nil, fmt.Errorf("saml: signature value: %w", err)
+	}
+	hashed := sha256.Sum256(signedInfo.canonical(nil, inclusivePrefixes(c14n)))
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if ok && rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], signature) == nil {
+			return signed, nil
+		}
+	}
+	return nil, errors.New("saml: the signature does not match the identity provider's certificates")
+}
+
+// inclusivePrefixes reads the InclusiveNamespaces PrefixList of an
+// Exclusive Canonicalization method or transform.
+func inclusivePrefixes(method *element) []string {
+	var prefixes []string
+	for _, in := range method.elements(algExcC14N, "InclusiveNamespaces") {
+		prefixes = append(prefixes, strings.Fields(in.attr("PrefixList"))...)
+	}
+	return prefixes
+}
+
+// decodeBase64 decodes s, which may be broken into lines.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
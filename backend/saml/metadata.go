@@ -0,0 +1,146 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// IdentityProvider is what the SP needs to know of an IdP, as read from
+// its metadata.
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL receives AuthnRequests with the HTTP-Redirect binding.
+	SSOURL string
+	// Certificates are those the IdP signs with; there are several while
+	// it rolls its key over. Their validity dates are not checked, as
+	// metadata commonly holds self-signed certificates.
+	Certificates []*x509.Certificate
+}
+
+type xmlEntityDescriptor struct {
+	EntityID string `xml:"entityID,attr"`
+	IDP      []struct {
+		Keys []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+		SSO []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+}
+
+// ParseMetadata reads the metadata of an IdP: an EntityDescriptor, or the
+// first IdP in an EntitiesDescriptor. The IdP must take AuthnRequests
+// with the HTTP-Redirect binding.
+func ParseMetadata(data []byte) (*IdentityProvider, error) {
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	var candidates []*element
+	switch {
+	case root.is(nsMetadata, "EntityDescriptor"):
+		candidates = []*element{root}
+	case root.is(nsMetadata, "EntitiesDescriptor"):
+		candidates = root.elements(nsMetadata, "EntityDescriptor")
+	default:
+		return nil, errors.New("saml: the metadata has no EntityDescriptor")
+	}
+
+	for _, e := range candidates {
+		var ed xmlEntityDescriptor
+		if err := xml.Unmarshal(e.canonical(nil, nil), &ed); err != nil {
+			return nil, fmt.Errorf("saml: reading metadata: %w", err)
+		}
+		if len(ed.IDP) == 0 {
+			continue
+		}
+		idp := &IdentityProvider{EntityID: ed.EntityID}
+		if idp.EntityID == "" {
+			return nil, errors.New("saml: the metadata has no entityID")
+		}
+		for _, sso := range ed.IDP[0].SSO {
+			if sso.Binding == bindingRedirect {
+				idp.SSOURL = sso.Location
+				break
+			}
+		}
+		if u, err := url.Parse(idp.SSOURL); err != nil || u.Scheme != "https" && u.Scheme != "http" || u.Host == "" {
+			return nil, errors.New("saml: the IdP has no SingleSignOnService URL for the HTTP-Redirect binding")
+		}
+		for _, key := range ed.IDP[0].Keys {
+			if key.Use != "" && key.Use != "signing" {
+				continue
+			}
+			for _, c := range key.Certificates {
+				der, err := decodeBase64(c)
+				if err != nil {
+					return nil, fmt.Errorf("saml: metadata certificate: %w", err)
+				}
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, fmt.Errorf("saml: metadata certificate: %w", err)
+				}
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+		if len(idp.Certificates) == 0 {
+			return nil, errors.New("saml: the metadata has no signing certificate")
+		}
+		return idp, nil
+	}
+	return nil, errors.New("saml: the metadata has no IDPSSODescriptor")
+}
+
+type xmlSPMetadata struct {
+	XMLName  xml.Name `xml:"md:EntityDescriptor"`
+	NS       string   `xml:"xmlns:md,attr"`
+	EntityID string   `xml:"entityID,attr"`
+	SP       struct {
+		AuthnRequestsSigned bool   `xml:"AuthnRequestsSigned,attr"`
+		Protocols           string `xml:"protocolSupportEnumeration,attr"`
+		Key                 struct {
+			Use  string `xml:"use,attr"`
+			Info struct {
+				NS          string `xml:"xmlns:ds,attr"`
+				Certificate string `xml:"ds:X509Data>ds:X509Certificate"`
+			} `xml:"ds:KeyInfo"`
+		} `xml:"md:KeyDescriptor"`
+		NameIDFormat string `xml:"md:NameIDFormat"`
+		ACS          struct {
+			Binding   string `xml:"Binding,attr"`
+			Location  string `xml:"Location,attr"`
+			Index     int    `xml:"index,attr"`
+			IsDefault bool   `xml:"isDefault,attr"`
+		} `xml:"md:AssertionConsumerService"`
+	} `xml:"md:SPSSODescriptor"`
+}
+
+// Metadata describes the SP to the IdP: its entity ID, the certificate
+// its AuthnRequests are signed with and where responses go.
+func (sp *ServiceProvider) Metadata() []byte {
+	var m xmlSPMetadata
+	m.NS, m.EntityID = nsMetadata, sp.EntityID
+	m.SP.AuthnRequestsSigned, m.SP.Protocols = true, nsProtocol
+	m.SP.Key.Use = "signing"
+	m.SP.Key.Info.NS = nsDSig
+	m.SP.Key.Info.Certificate = base64.StdEncoding.EncodeToString(sp.Certificate.Raw)
+	m.SP.NameIDFormat = NameIDEmail
+	m.SP.ACS.Binding, m.SP.ACS.Location, m.SP.ACS.IsDefault = bindingPOST, sp.ACSURL, true
+
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	enc := xml.NewEncoder(&b)
+	enc.Indent("", "  ")
+	// Encoding fixed structs of strings cannot fail.
+	_ = enc.Encode(m)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
@@ -0,0 +1,361 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// NewRequestID returns a random AuthnRequest ID. IDs are XML names, which
+// cannot start with a digit.
+func NewRequestID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
+
+type xmlAuthnRequest struct {
+	XMLName      xml.Name `xml:"samlp:AuthnRequest"`
+	NSProtocol   string   `xml:"xmlns:samlp,attr"`
+	NSAssertion  string   `xml:"xmlns:saml,attr"`
+	ID           string   `xml:"ID,attr"`
+	Version      string   `xml:"Version,attr"`
+	IssueInstant string   `xml:"IssueInstant,attr"`
+	Destination  string   `xml:"Destination,attr"`
+	ACSURL       string   `xml:"AssertionConsumerServiceURL,attr"`
+	Binding      string   `xml:"ProtocolBinding,attr"`
+	Issuer       string   `xml:"saml:Issuer"`
+	NameIDPolicy struct {
+		AllowCreate bool `xml:"AllowCreate,attr"`
+	} `xml:"samlp:NameIDPolicy"`
+}
+
+// AuthnRequestURL returns where to send the user to sign in at the IdP:
+// its SSO URL with an AuthnRequest with id, signed as the HTTP-Redirect
+// binding signs, over the query.
+func (sp *ServiceProvider) AuthnRequestURL(id string, now time.Time) (string, error) {
+	req := xmlAuthnRequest{
+		NSProtocol:   nsProtocol,
+		NSAssertion:  nsAssertion,
+		ID:           id,
+		Version:      "2.0",
+		IssueInstant: now.UTC().Format(time.RFC3339),
+		Destination:  sp.IdP.SSOURL,
+		ACSURL:       sp.ACSURL,
+		Binding:      bindingPOST,
+		Issuer:       sp.EntityID,
+	}
+	req.NameIDPolicy.AllowCreate = true
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	var deflated bytes.Buffer
+	w, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	// The signature covers the parameters exactly as they are sent.
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(deflated.Bytes())) +
+		"&SigAlg=" + url.QueryEscape(algRSASHA256)
+	hashed := sha256.Sum256([]byte(query))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, sp.Key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+
+	sep := "?"
+	if strings.Contains(sp.IdP.SSOURL, "?") {
+		sep = "&"
+	}
+	return sp.IdP.SSOURL + sep + query, nil
+}
+
+// Assertion is what the IdP asserted about the user in a response the SP
+// checked.
+type Assertion struct {
+	ID string
+	// InResponseTo is the ID of the AuthnRequest the response answers.
+	InResponseTo string
+	NameID       string
+	NameIDFormat string
+	AuthnInstant time.Time
+	SessionIndex string
+	// Attributes holds the values of each attribute, by name.
+	Attributes map[string][]string
+}
+
+// Attribute returns the first value of the attribute name.
+func (a *Assertion) Attribute(name string) string {
+	if values := a.Attributes[name]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// StatusError is a response in which the IdP says it did not sign the
+// user in, as when they cancelled.
+type StatusError struct {
+	Code    string
+	Message string
+}
+
+func (e *StatusError) Error() string {
+	if e.Message != "" {
+		return "saml: the IdP answered " + e.Code + ": " + e.Message
+	}
+	return "saml: the IdP answered " + e.Code
+}
+
+type xmlStatusCode struct {
+	Value string         `xml:"Value,attr"`
+	Inner *xmlStatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+}
+
+type xmlResponse struct {
+	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	InResponseTo string   `xml:"InResponseTo,attr"`
+	Destination  string   `xml:"Destination,attr"`
+	Issuer       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Status       struct {
+		Code    xmlStatusCode `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+		Message string        `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	Assertion *xmlAssertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+}
+
+type xmlAssertion struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	ID      string   `xml:"ID,attr"`
+	Version string   `xml:"Version,attr"`
+	Issuer  string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Subject struct {
+		NameID struct {
+			Format string `xml:"Format,attr"`
+			Value  string `xml:",chardata"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+		Confirmations []struct {
+			Method string `xml:"Method,attr"`
+			Data   struct {
+				InResponseTo string    `xml:"InResponseTo,attr"`
+				Recipient    string    `xml:"Recipient,attr"`
+				NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+			} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmation"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
+	Conditions *struct {
+		NotBefore    time.Time `xml:"NotBefore,attr"`
+		NotOnOrAfter time.Time `xml:"NotOnOrAfter,attr"`
+		Audiences    []struct {
+			Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Conditions"`
+	AuthnStatements []struct {
+		AuthnInstant        time.Time `xml:"AuthnInstant,attr"`
+		SessionIndex        string    `xml:"SessionIndex,attr"`
+		SessionNotOnOrAfter time.Time `xml:"SessionNotOnOrAfter,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeValue"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:assertion AttributeStatement>Attribute"`
+}
+
+// ParseResponse reads the base64 SAMLResponse the IdP posted to the ACS
+// and checks it at now: the signature, the issuer, the status, and the
+// conditions, audience and subject confirmation of its one assertion.
+// Only what was signed is read. The caller must check that InResponseTo
+// is a request it sent and has not seen answered.
+func (sp *ServiceProvider) ParseResponse(encoded string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("saml: SAMLResponse: %w", err)
+	}
+	root, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if !root.is(nsProtocol, "Response") {
+		return nil, errors.New("saml: not a Response")
+	}
+	// A reference to an ID that two elements have could be checked on one
+	// and read from the other.
+	ids := map[string]bool{}
+	var duplicate bool
+	root.walk(func(e *element) {
+		if id := e.attr("ID"); id != "" {
+			duplicate = duplicate || ids[id]
+			ids[id] = true
+		}
+	})
+	if duplicate {
+		return nil, errors.New("saml: IDs are not unique")
+	}
+	// A failure is reported whether it is signed or not, as it signs
+	// nobody in.
+	var status xmlResponse
+	if err := xml.Unmarshal(root.canonical(nil, nil), &status); err != nil {
+		return nil, fmt.Errorf("saml: reading the response: %w", err)
+	}
+	if err := status.statusError(); err != nil {
+		return nil, err
+	}
+	if len(root.elements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("saml: encrypted assertions are not supported")
+	}
+	assertion, err := root.only(nsAssertion, "Assertion")
+	if err != nil {
+		return nil, err
+	}
+
+	var resp xmlResponse
+	signed, err := verify(root, sp.IdP.Certificates)
+	switch {
+	case err == nil:
+		if err := xml.Unmarshal(signed, &resp); err != nil {
+			return nil, fmt.Errorf("saml: reading the response: %w", err)
+		}
+	case errors.Is(err, errUnsigned):
+		signed, err := verify(assertion, sp.IdP.Certificates)
+		if errors.Is(err, errUnsigned) {
+			return nil, errors.New("saml: neither the response nor its assertion is signed")
+		}
+		if err != nil {
+			return nil, err
+		}
+		// Only the assertion is signed; the rest of the response is read
+		// for its destination and issuer, but nothing about the user.
+		if err := xml.Unmarshal(root.canonical(assertion, nil), &resp); err != nil {
+			return nil, fmt.Errorf("saml: reading the response: %w", err)
+		}
+		resp.Assertion = &xmlAssertion{}
+		if err := xml.Unmarshal(signed, resp.Assertion); err != nil {
+			return nil, fmt.Errorf("saml: reading the assertion: %w", err)
+		}
+	default:
+		return nil, err
+	}
+	return sp.check(&resp, now)
+}
+
+// statusError returns the failure the response reports, if any. The
+// innermost status code is the most specific.
+func (resp *xmlResponse) statusError() error {
+	code := resp.Status.Code
+	if code.Value == statusSuccess {
+		return nil
+	}
+	for code.Inner != nil {
+		code = *code.Inner
+	}
+	return &StatusError{Code: code.Value, Message: resp.Status.Message}
+}
+
+// check checks a response whose assertion was signed.
+func (sp *ServiceProvider) check(resp *xmlResponse, now time.Time) (*Assertion, error) {
+	if err := resp.statusError(); err != nil {
+		return nil, err
+	}
+	if resp.Destination != "" && resp.Destination != sp.ACSURL {
+		return nil, fmt.Errorf("saml: the response is for %q", resp.Destination)
+	}
+	if resp.Issuer != "" && resp.Issuer != sp.IdP.EntityID {
+		return nil, fmt.Errorf("saml: the response is from %q", resp.Issuer)
+	}
+
+	a := resp.Assertion
+	if a == nil {
+		return nil, errors.New("saml: the response has no assertion")
+	}
+	if a.Version != "2.0" {
+		return nil, fmt.Errorf("saml: unsupported version %q", a.Version)
+	}
+	if a.Issuer != sp.IdP.EntityID {
+		return nil, fmt.Errorf("saml: the assertion is from %q", a.Issuer)
+	}
+
+	c := a.Conditions
+	if c == nil {
+		return nil, errors.New("saml: the assertion has no conditions")
+	}
+	if !c.NotBefore.IsZero() && now.Add(ClockSkew).Before(c.NotBefore) {
+		return nil, errors.New("saml: the assertion is not valid yet")
+	}
+	if !c.NotOnOrAfter.IsZero() && !now.Add(-ClockSkew).Before(c.NotOnOrAfter) {
+		return nil, errors.New("saml: the assertion has expired")
+	}
+	// Each restriction must name the SP; there must be one.
+	if len(c.Audiences) == 0 {
+		return nil, errors.New("saml: the assertion has no audience")
+	}
+	for _, r := range c.Audiences {
+		if !slices.Contains(r.Audience, sp.EntityID) {
+			return nil, errors.New("saml: the assertion is for another audience")
+		}
+	}
+
+	// A bearer confirmation says who may present the assertion, where and
+	// until when; one of them must fit.
+	var inResponseTo string
+	for _, sc := range a.Subject.Confirmations {
+		d := sc.Data
+		if sc.Method == methodBearer && d.Recipient == sp.ACSURL && d.InResponseTo != "" &&
+			now.Add(-ClockSkew).Before(d.NotOnOrAfter) {
+			inResponseTo = d.InResponseTo
+			break
+		}
+	}
+	if inResponseTo == "" {
+		return nil, errors.New("saml: no subject confirmation fits this SP")
+	}
+	if resp.InResponseTo != "" && resp.InResponseTo != inResponseTo {
+		return nil, errors.New("saml: the response and the assertion answer different requests")
+	}
+	if strings.TrimSpace(a.Subject.NameID.Value) == "" {
+		return nil, errors.New("saml: the assertion has no NameID")
+	}
+
+	if len(a.AuthnStatements) == 0 {
+		return nil, errors.New("saml: the assertion has no authentication statement")
+	}
+	authn := a.AuthnStatements[0]
+	if !authn.SessionNotOnOrAfter.IsZero() && !now.Before(authn.SessionNotOnOrAfter) {
+		return nil, errors.New("saml: the session at the IdP has ended")
+	}
+
+	out := &Assertion{
+		ID:           a.ID,
+		InResponseTo: inResponseTo,
+		NameID:       strings.TrimSpace(a.Subject.NameID.Value),
+		NameIDFormat: a.Subject.NameID.Format,
+		AuthnInstant: authn.AuthnInstant,
+		SessionIndex: authn.SessionIndex,
+		Attributes:   map[string][]string{},
+	}
+	for _, attr := range a.Attributes {
+		for _, v := range attr.Values {
+			out.Attributes[attr.Name] = append(out.Attributes[attr.Name], strings.TrimSpace(v))
+		}
+	}
+	return out, nil
+}
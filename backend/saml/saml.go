@@ -0,0 +1,158 @@
+// Package saml signs users in as a SAML 2.0 service provider (SP) of the
+// identity providers (IdPs) of enterprise customers. It implements the Web
+// Browser SSO profile: AuthnRequests go out with the HTTP-Redirect binding,
+// signed, and responses come back with the HTTP-POST binding. Responses
+// must be signed, on the response or on the assertion; encrypted
+// assertions are not supported.
+package saml
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"ccz/oauth"
+)
+
+// Namespaces and other names the profile uses.
+const (
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+
+	bindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	bindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	statusSuccess = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer  = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// NameIDEmail is the NameID format of an email address.
+	NameIDEmail = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+)
+
+// ClockSkew is how far the IdP's clock may be off from ours.
+const ClockSkew = 3 * time.Minute
+
+// Config is what every tenant's service provider shares: where the
+// backend is reached and the key it signs AuthnRequests with.
+type Config struct {
+	// BaseURL is the backend's URL, without a trailing slash.
+	BaseURL     string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// ConfigFromEnv reads SAML_BASE_URL, SAML_KEY_FILE and
+// SAML_CERTIFICATE_FILE. SAML_BASE_URL defaults to OAUTH_ISSUER. Without
+// a key file a key and certificate are generated, and IdPs that check
+// AuthnRequest signatures need the SP metadata again after a restart.
+func ConfigFromEnv() (*Config, error) {
+	base := os.Getenv("SAML_BASE_URL")
+	if base == "" {
+		base = os.Getenv("OAUTH_ISSUER")
+	}
+	if base == "" {
+		port := os.Getenv("APP_PORT")
+		if port == "" {
+			port = "8081"
+		}
+		base = "http://localhost:" + port
+	}
+	c := &Config{BaseURL: strings.TrimSuffix(base, "/")}
+
+	keyFile, certFile := os.Getenv("SAML_KEY_FILE"), os.Getenv("SAML_CERTIFICATE_FILE")
+	if keyFile == "" {
+		if certFile != "" {
+			return nil, errors.New("saml: SAML_CERTIFICATE_FILE needs SAML_KEY_FILE")
+		}
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		cert, err := selfSigned(key, c.BaseURL)
+		if err != nil {
+			return nil, err
+		}
+		c.Key, c.Certificate = key, cert
+		slog.Warn("SAML_KEY_FILE is not set; SAML requests are signed with a temporary key")
+		return c, nil
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("saml: reading SAML_KEY_FILE: %w", err)
+	}
+	if c.Key, err = oauth.ParseKey(data); err != nil {
+		return nil, fmt.Errorf("saml: SAML_KEY_FILE: %w", err)
+	}
+	if certFile == "" {
+		c.Certificate, err = selfSigned(c.Key, c.BaseURL)
+		return c, err
+	}
+	if data, err = os.ReadFile(certFile); err != nil {
+		return nil, fmt.Errorf("saml: reading SAML_CERTIFICATE_FILE: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("saml: SAML_CERTIFICATE_FILE holds no PEM certificate")
+	}
+	if c.Certificate, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("saml: SAML_CERTIFICATE_FILE: %w", err)
+	}
+	if !c.Key.PublicKey.Equal(c.Certificate.PublicKey) {
+		return nil, errors.New("saml: SAML_CERTIFICATE_FILE is not the certificate of SAML_KEY_FILE")
+	}
+	return c, nil
+}
+
+// selfSigned makes a certificate for key. IdPs trust the certificate in
+// the SP metadata as it is, so nobody needs to issue it.
+func selfSigned(key *rsa.PrivateKey, name string) (*x509.Certificate, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// ServiceProvider is the SP of one tenant, which has its own entity ID
+// and assertion consumer service (ACS) so that an assertion for one tenant
+// cannot be used with another.
+type ServiceProvider struct {
+	EntityID    string
+	ACSURL      string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+	IdP         *IdentityProvider
+}
+
+// ServiceProvider returns the SP with entityID and acsURL that trusts idp.
+func (c *Config) ServiceProvider(entityID, acsURL string, idp *IdentityProvider) *ServiceProvider {
+	return &ServiceProvider{
+		EntityID:    entityID,
+		ACSURL:      acsURL,
+		Key:         c.Key,
+		Certificate: c.Certificate,
+		IdP:         idp,
+	}
+}
@@ -0,0 +1,284 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"ccz/saml/samltest"
+)
+
+func TestCanonical(t *testing.T) {
+	for name, tc := range map[string]struct {
+		in, want  string
+		inclusive []string
+	}{
+		"Attributes and Empty Elements": {
+			in:   `<a z="1" b='2' xmlns:u="urn:u" u:c="3"><b/></a>`,
+			want: `<a xmlns:u="urn:u" b="2" z="1" u:c="3"><b></b></a>`,
+		},
+		"Unused Namespaces Dropped": {
+			in:   `<p:a xmlns:p="urn:p" xmlns:q="urn:q"><p:b xmlns:p="urn:p"><q:c/></p:b></p:a>`,
+			want: `<p:a xmlns:p="urn:p"><p:b><q:c xmlns:q="urn:q"></q:c></p:b></p:a>`,
+		},
+		"Default Namespace": {
+			in:   `<a xmlns="urn:d"><b xmlns=""/><c/></a>`,
+			want: `<a xmlns="urn:d"><b xmlns=""></b><c></c></a>`,
+		},
+		"Escaping": {
+			in:   "<a v=\"&lt;&amp;&gt;&quot;&#9;\">&lt;&amp;&gt;\"<![CDATA[<x>]]></a>",
+			want: "<a v=\"&lt;&amp;>&quot;&#x9;\">&lt;&amp;&gt;\"&lt;x&gt;</a>",
+		},
+		"Comments Removed": {
+			in:   "<a><!-- note -->x</a>",
+			want: "<a>x</a>",
+		},
+		"Inclusive Prefixes": {
+			in:        `<a xmlns:xs="urn:xs" xmlns:xsi="urn:xsi"><b xsi:type="xs:string">v</b></a>`,
+			want:      `<a xmlns:xs="urn:xs"><b xmlns:xsi="urn:xsi" xsi:type="xs:string">v</b></a>`,
+			inclusive: []string{"xs"},
+		},
+	} {
+		root, err := parse([]byte(tc.in))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got := string(root.canonical(nil, tc.inclusive)); got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", name, got, tc.want)
+		}
+	}
+
+	for name, in := range map[string]string{
+		"DTD":          `<!DOCTYPE a [<!ENTITY x "y">]><a>&x;</a>`,
+		"Undeclared":   `<p:a></p:a>`,
+		"Mismatched":   `<a></b>`,
+		"Two Roots":    `<a></a><b></b>`,
+		"Incomplete":   `<a>`,
+		"Outside Text": `<a></a>text`,
+	} {
+		if _, err := parse([]byte(in)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestParseMetadata(t *testing.T) {
+	idp, err := samltest.New("https://idp.ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := ParseMetadata([]byte(idp.Metadata()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.EntityID != idp.EntityID || md.SSOURL != idp.SSOURL || len(md.Certificates) != 1 || !md.Certificates[0].Equal(idp.Certificate) {
+		t.Errorf("unexpected metadata %+v", md)
+	}
+
+	wrapped := `<md:EntitiesDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata">` +
+		strings.TrimPrefix(idp.Metadata(), `<?xml version="1.0" encoding="UTF-8"?>`) + `</md:EntitiesDescriptor>`
+	if md, err := ParseMetadata([]byte(wrapped)); err != nil || md.EntityID != idp.EntityID {
+		t.Errorf("expected the IdP in an EntitiesDescriptor, got %+v, %v", md, err)
+	}
+
+	for name, data := range map[string]string{
+		"No Certificate": strings.Replace(idp.Metadata(), `use="signing"`, `use="encryption"`, 1),
+		"No Redirect":    strings.Replace(idp.Metadata(), "HTTP-Redirect", "SOAP", 1),
+		"Not Metadata":   `<a></a>`,
+		"Garbage":        `not xml`,
+	} {
+		if _, err := ParseMetadata([]byte(data)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func testSP(t *testing.T) (*ServiceProvider, *samltest.IdP) {
+	t.Helper()
+	idp, err := samltest.New("https://idp.ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := ParseMetadata([]byte(idp.Metadata()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := selfSigned(key, "https://sp.ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Config{BaseURL: "https://sp.ex.com", Key: key, Certificate: cert}
+	return c.ServiceProvider("https://sp.ex.com/acme/metadata", "https://sp.ex.com/acme/acs", md), idp
+}
+
+func TestAuthnRequestURL(t *testing.T) {
+	sp, idp := testSP(t)
+	target, err := sp.AuthnRequestURL("_req1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(target, idp.SSOURL+"?SAMLRequest=") {
+		t.Fatalf("unexpected URL %s", target)
+	}
+
+	// The signature covers the query up to the Signature parameter.
+	rawQuery := target[strings.Index(target, "?")+1:]
+	signed := rawQuery[:strings.Index(rawQuery, "&Signature=")]
+	q, _ := url.ParseQuery(rawQuery)
+	sig, _ := base64.StdEncoding.DecodeString(q.Get("Signature"))
+	hashed := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(&sp.Key.PublicKey, crypto.SHA256, hashed[:], sig); err != nil {
+		t.Errorf("the signature does not verify: %v", err)
+	}
+	if q.Get("SigAlg") != algRSASHA256 {
+		t.Errorf("unexpected SigAlg %q", q.Get("SigAlg"))
+	}
+
+	deflated, _ := base64.StdEncoding.DecodeString(q.Get("SAMLRequest"))
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, _ := req.only(nsAssertion, "Issuer")
+	if !req.is(nsProtocol, "AuthnRequest") || req.attr("ID") != "_req1" || req.attr("Destination") != idp.SSOURL ||
+		req.attr("AssertionConsumerServiceURL") != sp.ACSURL || issuer == nil || issuer.text() != sp.EntityID {
+		t.Errorf("unexpected request %s", data)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	sp, _ := testSP(t)
+	root, err := parse(sp.Metadata())
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, err := root.only(nsMetadata, "SPSSODescriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acs, err := desc.only(nsMetadata, "AssertionConsumerService")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := desc.only(nsMetadata, "KeyDescriptor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.is(nsMetadata, "EntityDescriptor") || root.attr("entityID") != sp.EntityID || acs.attr("Location") != sp.ACSURL ||
+		acs.attr("Binding") != bindingPOST || !strings.Contains(key.text(), base64.StdEncoding.EncodeToString(sp.Certificate.Raw)) {
+		t.Errorf("unexpected metadata %s", sp.Metadata())
+	}
+}
+
+func TestParseResponse(t *testing.T) {
+	sp, idp := testSP(t)
+	now := time.Now()
+	assertion := samltest.Assertion{
+		InResponseTo: "_req1",
+		Recipient:    sp.ACSURL,
+		Audience:     sp.EntityID,
+		NameID:       "jo@acme.com",
+		Attributes:   map[string]string{"displayName": "Jo Smith", "phone": "+14155550100"},
+		Now:          now,
+	}
+	respond := func(t *testing.T, a samltest.Assertion, sign samltest.Signing, edit func(string) string) string {
+		t.Helper()
+		resp, err := idp.Response(a, sign, edit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	for name, sign := range map[string]samltest.Signing{
+		"Assertion Signed": samltest.SignAssertion,
+		"Response Signed":  samltest.SignResponse,
+		"Both Signed":      samltest.SignBoth,
+	} {
+		a, err := sp.ParseResponse(respond(t, assertion, sign, nil), now)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if a.NameID != "jo@acme.com" || a.InResponseTo != "_req1" || a.Attribute("displayName") != "Jo Smith" ||
+			a.Attribute("phone") != "+14155550100" || a.NameIDFormat != NameIDEmail || a.AuthnInstant.Unix() != now.Unix() {
+			t.Errorf("%s: unexpected assertion %+v", name, a)
+		}
+	}
+
+	t.Run("Refused", func(t *testing.T) {
+		other, err := samltest.New(idp.EntityID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		forged, err := other.Response(assertion, samltest.SignBoth, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		with := func(change func(*samltest.Assertion)) samltest.Assertion {
+			a := assertion
+			change(&a)
+			return a
+		}
+
+		for name, resp := range map[string]string{
+			"Unsigned":       respond(t, assertion, 0, nil),
+			"Other Key":      forged,
+			"Changed NameID": respond(t, assertion, samltest.SignAssertion, func(s string) string { return strings.Replace(s, "jo@acme.com", "boss@acme.com", 1) }),
+			"Changed Response": respond(t, assertion, samltest.SignResponse, func(s string) string {
+				return strings.Replace(s, "Jo Smith", "Someone Else", 1)
+			}),
+			"Wrapped": respond(t, assertion, samltest.SignAssertion, func(s string) string {
+				// A second, unsigned assertion next to the signed one.
+				i := strings.Index(s, "<saml:Assertion")
+				evil := strings.Replace(s[i:strings.Index(s, "</samlp:Response>")], "jo@acme.com", "boss@acme.com", 1)
+				evil = strings.Replace(evil, `ID="_a`, `ID="_evil`, 1)
+				return s[:i] + evil + s[i:]
+			}),
+			"Other Audience":  respond(t, with(func(a *samltest.Assertion) { a.Audience = "https://other.ex.com" }), samltest.SignBoth, nil),
+			"Other Recipient": respond(t, with(func(a *samltest.Assertion) { a.Recipient = "https://other.ex.com/acs" }), samltest.SignBoth, nil),
+			"Expired":         respond(t, with(func(a *samltest.Assertion) { a.NotOnOrAfter = now.Add(-ClockSkew - time.Second) }), samltest.SignBoth, nil),
+			"Not Yet Valid":   respond(t, with(func(a *samltest.Assertion) { a.NotBefore = now.Add(ClockSkew + time.Minute) }), samltest.SignBoth, nil),
+			"No Request":      respond(t, with(func(a *samltest.Assertion) { a.InResponseTo = "" }), samltest.SignBoth, nil),
+			"Garbage":         base64.StdEncoding.EncodeToString([]byte("<a>")),
+		} {
+			if a, err := sp.ParseResponse(resp, now); err == nil {
+				t.Errorf("%s: expected an error, got %+v", name, a)
+			}
+		}
+	})
+
+	t.Run("Clock Skew", func(t *testing.T) {
+		a := assertion
+		a.NotBefore = now.Add(time.Minute)
+		if _, err := sp.ParseResponse(respond(t, a, samltest.SignBoth, nil), now); err != nil {
+			t.Errorf("expected an IdP a minute ahead to be accepted, got %v", err)
+		}
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		_, err := sp.ParseResponse(idp.Failure("_req1", sp.ACSURL, "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed"), now)
+		var status *StatusError
+		if !errors.As(err, &status) || status.Code != "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed" {
+			t.Errorf("expected a status error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,219 @@
+// Package samltest is a SAML identity provider for tests. It signs
+// responses with a key it generates, as a real IdP would sign them.
+//
+// It writes its XML in canonical form, so what it signs is what it sends.
+// It does not share code with package saml, which therefore checks the
+// signatures against an independent implementation.
+package samltest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// IdP signs as EntityID, with a self-signed certificate.
+type IdP struct {
+	EntityID    string
+	SSOURL      string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// New returns an IdP with a new key.
+func New(entityID string) (*IdP, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: entityID},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &IdP{EntityID: entityID, SSOURL: entityID + "/sso", Key: key, Certificate: cert}, nil
+}
+
+// Metadata describes the IdP.
+func (idp *IdP) Metadata() string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="` + escape(idp.EntityID) + `">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(idp.Certificate.Raw) + `</ds:X509Certificate></ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="` + escape(idp.SSOURL) + `/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="` + escape(idp.SSOURL) + `"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>
+`
+}
+
+// Assertion is what a response asserts. Zero times are filled in from
+// Now.
+type Assertion struct {
+	// InResponseTo is the ID of the AuthnRequest answered.
+	InResponseTo string
+	// Recipient is the SP's ACS URL and Audience its entity ID.
+	Recipient string
+	Audience  string
+	NameID    string
+	// Attributes are sent in name order.
+	Attributes map[string]string
+
+	Now          time.Time
+	NotBefore    time.Time
+	NotOnOrAfter time.Time
+}
+
+// Signing says what a response signs.
+type Signing int
+
+const (
+	SignAssertion Signing = 1 << iota
+	SignResponse
+	SignBoth = SignAssertion | SignResponse
+)
+
+// Response returns a successful response carrying a, signed as sign says
+// and encoded as the HTTP-POST binding sends it. edit, when not nil, may
+// change the XML after it was signed, as an attacker would.
+func (idp *IdP) Response(a Assertion, sign Signing, edit func(string) string) (string, error) {
+	if a.Now.IsZero() {
+		a.Now = time.Now()
+	}
+	if a.NotBefore.IsZero() {
+		a.NotBefore = a.Now.Add(-time.Minute)
+	}
+	if a.NotOnOrAfter.IsZero() {
+		a.NotOnOrAfter = a.Now.Add(5 * time.Minute)
+	}
+	at := func(t time.Time) string { return t.UTC().Format(time.RFC3339) }
+
+	var attrs strings.Builder
+	if len(a.Attributes) > 0 {
+		attrs.WriteString("<saml:AttributeStatement>")
+		names := make([]string, 0, len(a.Attributes))
+		for name := range a.Attributes {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			fmt.Fprintf(&attrs, `<saml:Attribute Name="%s"><saml:AttributeValue>%s</saml:AttributeValue></saml:Attribute>`, escape(name), escape(a.Attributes[name]))
+		}
+		attrs.WriteString("</saml:AttributeStatement>")
+	}
+
+	// Attributes are in canonical order: by name, as none has a prefix.
+	assertionID := fmt.Sprintf("_a%d", a.Now.UnixNano())
+	assertion := fmt.Sprintf(`<saml:Assertion xmlns:saml="%s" ID="%s" IssueInstant="%s" Version="2.0">`, nsAssertion, escape(assertionID), at(a.Now)) +
+		fmt.Sprintf(`<saml:Issuer>%s</saml:Issuer>`, escape(idp.EntityID)) +
+		fmt.Sprintf(`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">%s</saml:NameID>`, escape(a.NameID)) +
+		fmt.Sprintf(`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s"></saml:SubjectConfirmationData></saml:SubjectConfirmation></saml:Subject>`,
+			escape(a.InResponseTo), at(a.NotOnOrAfter), escape(a.Recipient)) +
+		fmt.Sprintf(`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction><saml:Audience>%s</saml:Audience></saml:AudienceRestriction></saml:Conditions>`,
+			at(a.NotBefore), at(a.NotOnOrAfter), escape(a.Audience)) +
+		fmt.Sprintf(`<saml:AuthnStatement AuthnInstant="%s" SessionIndex="%s"><saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext></saml:AuthnStatement>`,
+			at(a.Now), escape(assertionID)) +
+		attrs.String() +
+		`</saml:Assertion>`
+	if sign&SignAssertion != 0 {
+		signed, err := idp.sign(assertion, assertionID, "</saml:Issuer>")
+		if err != nil {
+			return "", err
+		}
+		assertion = signed
+	}
+
+	responseID := fmt.Sprintf("_r%d", a.Now.UnixNano())
+	response := fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" Destination="%s" ID="%s" InResponseTo="%s" IssueInstant="%s" Version="2.0">`,
+		nsProtocol, escape(a.Recipient), escape(responseID), escape(a.InResponseTo), at(a.Now)) +
+		fmt.Sprintf(`<saml:Issuer xmlns:saml="%s">%s</saml:Issuer>`, nsAssertion, escape(idp.EntityID)) +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></samlp:StatusCode></samlp:Status>` +
+		assertion +
+		`</samlp:Response>`
+	if sign&SignResponse != 0 {
+		signed, err := idp.sign(response, responseID, "</saml:Issuer>")
+		if err != nil {
+			return "", err
+		}
+		response = signed
+	}
+	if edit != nil {
+		response = edit(response)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(response)), nil
+}
+
+// Failure returns a response in which the IdP reports status instead of
+// signing the user in.
+func (idp *IdP) Failure(inResponseTo, recipient, status string) string {
+	response := fmt.Sprintf(`<samlp:Response xmlns:samlp="%s" Destination="%s" ID="_failed" InResponseTo="%s" IssueInstant="%s" Version="2.0">`,
+		nsProtocol, escape(recipient), escape(inResponseTo), time.Now().UTC().Format(time.RFC3339)) +
+		fmt.Sprintf(`<saml:Issuer xmlns:saml="%s">%s</saml:Issuer>`, nsAssertion, escape(idp.EntityID)) +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Responder">` +
+		fmt.Sprintf(`<samlp:StatusCode Value="%s"></samlp:StatusCode></samlp:StatusCode></samlp:Status>`, escape(status)) +
+		`</samlp:Response>`
+	return base64.StdEncoding.EncodeToString([]byte(response))
+}
+
+// sign adds an enveloped signature of the element in canonical form
+// whose ID is id, after its first occurrence of after.
+func (idp *IdP) sign(element, id, after string) (string, error) {
+	digest := sha256.Sum256([]byte(element))
+	signedInfo := `<ds:SignedInfo xmlns:ds="` + nsDSig + `">` +
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + escape(id) + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:Transform>` +
+		`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+	hashed := sha256.Sum256([]byte(signedInfo))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.Key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return "", err
+	}
+	// Inside the signature, SignedInfo inherits the ds namespace.
+	signature := `<ds:Signature xmlns:ds="` + nsDSig + `">` +
+		strings.Replace(signedInfo, ` xmlns:ds="`+nsDSig+`"`, "", 1) +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue>` +
+		`<ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(idp.Certificate.Raw) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature>`
+	i := strings.Index(element, after) + len(after)
+	return element[:i] + signature + element[i:], nil
+}
+
+// escape escapes s for text and attribute values alike, as canonical
+// form would escape them. Values that canonical form escapes differently
+// in the two, such as ones with > or ", are not supported.
+func escape(s string) string { return escaper.Replace(s) }
+
+var escaper = strings.NewReplacer("&", "&amp;", "<", "&lt;")
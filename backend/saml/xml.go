@@ -0,0 +1,313 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// encoding/xml cannot reproduce the bytes a signature covers, so signed
+// documents are read into this small tree, which keeps prefixes and
+// namespace declarations as written and can be put in Exclusive XML
+// Canonicalization form.
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+type element struct {
+	prefix, local string
+	// ns holds the namespaces declared on the element, by prefix; the
+	// default namespace has the empty prefix.
+	ns       map[string]string
+	attrs    []attr
+	children []any // *element, text or procInst
+	parent   *element
+}
+
+type attr struct {
+	prefix, local, value string
+}
+
+type text string
+
+type procInst struct {
+	target, inst string
+}
+
+// parse reads a document into a tree. Documents with a DTD are refused:
+// SAML has no use for one, and entity expansion is a way to attack
+// parsers.
+func parse(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if cur == nil && root != nil {
+				return nil, errors.New("saml: more than one document element")
+			}
+			e := &element{prefix: t.Name.Space, local: t.Name.Local, parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.declare("", a.Value)
+				case a.Name.Space == "xmlns":
+					if a.Value == "" {
+						return nil, fmt.Errorf("saml: namespace prefix %s is undeclared", a.Name.Local)
+					}
+					e.declare(a.Name.Local, a.Value)
+				default:
+					e.attrs = append(e.attrs, attr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+				}
+			}
+			if _, ok := e.lookup(e.prefix); !ok && e.prefix != "" {
+				return nil, fmt.Errorf("saml: namespace prefix %s is undeclared", e.prefix)
+			}
+			for _, a := range e.attrs {
+				if _, ok := e.lookup(a.prefix); !ok && a.prefix != "" {
+					return nil, fmt.Errorf("saml: namespace prefix %s is undeclared", a.prefix)
+				}
+			}
+			if cur == nil {
+				root = e
+			} else {
+				cur.children = append(cur.children, e)
+			}
+			cur = e
+		case xml.EndElement:
+			// RawToken leaves matching end tags to the caller.
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.local {
+				return nil, errors.New("saml: mismatched end tag")
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, text(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("saml: text outside the document element")
+			}
+		case xml.ProcInst:
+			if cur != nil {
+				cur.children = append(cur.children, procInst{target: t.Target, inst: string(t.Inst)})
+			}
+		case xml.Directive:
+			return nil, errors.New("saml: documents with a DTD are not accepted")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("saml: incomplete document")
+	}
+	return root, nil
+}
+
+func (e *element) declare(prefix, uri string) {
+	if e.ns == nil {
+		e.ns = map[string]string{}
+	}
+	e.ns[prefix] = uri
+}
+
+// lookup returns the namespace prefix stands for at e.
+func (e *element) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for n := e; n != nil; n = n.parent {
+		if uri, ok := n.ns[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", prefix == ""
+}
+
+// space is the namespace of e.
+func (e *element) space() string {
+	uri, _ := e.lookup(e.prefix)
+	return uri
+}
+
+func (e *element) is(space, local string) bool {
+	return e.local == local && e.space() == space
+}
+
+// attr returns the value of the unqualified attribute name.
+func (e *element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.prefix == "" && a.local == name {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// elements returns the child elements of e in space named local.
+func (e *element) elements(space, local string) []*element {
+	var out []*element
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok && c.is(space, local) {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// only returns the single child element of e in space named local.
+func (e *element) only(space, local string) (*element, error) {
+	found := e.elements(space, local)
+	if len(found) != 1 {
+		return nil, fmt.Errorf("saml: expected one %s in %s, found %d", local, e.local, len(found))
+	}
+	return found[0], nil
+}
+
+// text returns the text content of e.
+func (e *element) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case text:
+			b.WriteString(string(c))
+		case *element:
+			b.WriteString(c.text())
+		}
+	}
+	return b.String()
+}
+
+// walk calls fn for e and every element below it.
+func (e *element) walk(fn func(*element)) {
+	fn(e)
+	for _, c := range e.children {
+		if c, ok := c.(*element); ok {
+			c.walk(fn)
+		}
+	}
+}
+
+// canonical writes e in Exclusive XML Canonicalization form, without
+// comments, leaving out skip and everything below it. Namespaces whose
+// prefix is in inclusive are rendered as by inclusive canonicalization;
+// "#default" stands for the default namespace.
+func (e *element) canonical(skip *element, inclusive []string) []byte {
+	var b bytes.Buffer
+	e.writeCanonical(&b, map[string]string{"": ""}, skip, inclusive)
+	return b.Bytes()
+}
+
+func (e *element) writeCanonical(b *bytes.Buffer, rendered map[string]string, skip *element, inclusive []string) {
+	// A namespace is rendered where it is visibly used and the nearest
+	// output ancestor did not already render it with the same value.
+	used := []string{e.prefix}
+	for _, a := range e.attrs {
+		if a.prefix != "" {
+			used = append(used, a.prefix)
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := e.lookup(p); ok {
+			used = append(used, p)
+		}
+	}
+	slices.Sort(used)
+	used = slices.Compact(used)
+
+	var decls []string
+	for _, p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri, _ := e.lookup(p)
+		if prev, ok := rendered[p]; ok && prev == uri || !ok && uri == "" {
+			continue
+		}
+		decls = append(decls, p)
+	}
+	if len(decls) > 0 {
+		// Copied, so the declarations stay out of the siblings' output.
+		rendered = maps.Clone(rendered)
+	}
+
+	b.WriteByte('<')
+	b.WriteString(qname(e.prefix, e.local))
+	for _, p := range decls {
+		uri, _ := e.lookup(p)
+		rendered[p] = uri
+		if p == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(" xmlns:" + p + `="`)
+		}
+		b.WriteString(escapeAttr(uri))
+		b.WriteByte('"')
+	}
+
+	attrs := slices.Clone(e.attrs)
+	slices.SortFunc(attrs, func(x, y attr) int {
+		xs, _ := e.lookup(x.prefix)
+		ys, _ := e.lookup(y.prefix)
+		if x.prefix == "" {
+			xs = ""
+		}
+		if y.prefix == "" {
+			ys = ""
+		}
+		if c := strings.Compare(xs, ys); c != 0 {
+			return c
+		}
+		return strings.Compare(x.local, y.local)
+	})
+	for _, a := range attrs {
+		b.WriteString(" " + qname(a.prefix, a.local) + `="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case *element:
+			if c != skip {
+				c.writeCanonical(b, rendered, skip, inclusive)
+			}
+		case text:
+			b.WriteString(escapeText(string(c)))
+		case procInst:
+			b.WriteString("<?" + c.target)
+			if c.inst != "" {
+				b.WriteString(" " + c.inst)
+			}
+			b.WriteString("?>")
+		}
+	}
+	b.WriteString("</" + qname(e.prefix, e.local) + ">")
+}
+
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+)
+
+func escapeAttr(s string) string { return attrEscaper.Replace(s) }
+
+func escapeText(s string) string { return textEscaper.Replace(s) }
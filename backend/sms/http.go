@@ -0,0 +1,58 @@
+package sms
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HTTP posts each message as JSON {"to", "from", "body"} to URL with Token
+// as a bearer token. Any 2xx answer counts as accepted. Most providers'
+// messaging APIs, or a small relay in front of them, fit this shape, and
+// cmd/smsstub implements it for local development.
+type HTTP struct {
+	URL   string
+	Token string
+	From  string
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type message struct {
+	To   string `json:"to"`
+	From string `json:"from,omitempty"`
+	Body string `json:"body"`
+}
+
+func (h *HTTP) Send(ctx context.Context, to, body string) error {
+	payload, err := json.Marshal(message{To: to, From: h.From, Body: body})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Token)
+	}
+
+	client := h.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sms: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("sms: provider answered %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
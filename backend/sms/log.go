@@ -0,0 +1,48 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Log delivers nothing. It appends each message to the file at Path as a
+// line of JSON, or logs it when Path is empty, so codes can be read back
+// in development and tests.
+type Log struct {
+	Path string
+
+	mu sync.Mutex
+}
+
+type logLine struct {
+	Time time.Time `json:"time"`
+	To   string    `json:"to"`
+	Body string    `json:"body"`
+}
+
+func (l *Log) Send(ctx context.Context, to, body string) error {
+	if l.Path == "" {
+		slog.InfoContext(ctx, "sms", "to", to, "body", body)
+		return nil
+	}
+	line, err := json.Marshal(logLine{Time: time.Now().UTC(), To: to, Body: body})
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,36 @@
+// Package sms delivers text messages through a pluggable Sender.
+package sms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Sender delivers body to the E.164 number to.
+type Sender interface {
+	Send(ctx context.Context, to, body string) error
+}
+
+// SenderFromEnv picks the driver from SMS_DRIVER: "log" (the default)
+// writes messages to SMS_LOG_FILE or the server log, "http" posts them to
+// the provider at SMS_HTTP_URL.
+func SenderFromEnv() (Sender, error) {
+	switch driver := os.Getenv("SMS_DRIVER"); driver {
+	case "", "log":
+		return &Log{Path: os.Getenv("SMS_LOG_FILE")}, nil
+	case "http":
+		h := &HTTP{
+			URL:   os.Getenv("SMS_HTTP_URL"),
+			Token: os.Getenv("SMS_HTTP_TOKEN"),
+			From:  os.Getenv("SMS_FROM"),
+		}
+		if h.URL == "" {
+			return nil, errors.New("sms: SMS_HTTP_URL is required for the http driver")
+		}
+		return h, nil
+	default:
+		return nil, fmt.Errorf("sms: unknown SMS_DRIVER %q", driver)
+	}
+}
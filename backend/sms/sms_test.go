@@ -0,0 +1,85 @@
+package sms
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sms.log")
+	l := &Log{Path: path}
+	for _, body := range []string{"first", "second"} {
+		if err := l.Send(context.Background(), "+14155550132", body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines, got %q", data)
+	}
+	var got logLine
+	if err := json.Unmarshal([]byte(lines[1]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.To != "+14155550132" || got.Body != "second" || got.Time.IsZero() {
+		t.Errorf("unexpected line %+v", got)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	var got message
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if got.To == "+15005550001" {
+			http.Error(w, "invalid destination", http.StatusUnprocessableEntity)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	h := &HTTP{URL: srv.URL, Token: "secret", From: "CCZ", Client: srv.Client()}
+	if err := h.Send(context.Background(), "+14155550132", "Your code is 123456"); err != nil {
+		t.Fatal(err)
+	}
+	if auth != "Bearer secret" || got != (message{To: "+14155550132", From: "CCZ", Body: "Your code is 123456"}) {
+		t.Errorf("unexpected request %q %+v", auth, got)
+	}
+
+	err := h.Send(context.Background(), "+15005550001", "x")
+	if err == nil || !strings.Contains(err.Error(), "invalid destination") {
+		t.Errorf("expected the provider's error, got %v", err)
+	}
+}
+
+func TestSenderFromEnv(t *testing.T) {
+	t.Setenv("SMS_DRIVER", "http")
+	t.Setenv("SMS_HTTP_URL", "")
+	if _, err := SenderFromEnv(); err == nil {
+		t.Error("expected an error without SMS_HTTP_URL")
+	}
+	t.Setenv("SMS_HTTP_URL", "http://localhost:8089/messages")
+	if s, err := SenderFromEnv(); err != nil || s.(*HTTP).URL != "http://localhost:8089/messages" {
+		t.Errorf("unexpected sender %v, %v", s, err)
+	}
+	t.Setenv("SMS_DRIVER", "pigeon")
+	if _, err := SenderFromEnv(); err == nil {
+		t.Error("expected an error for an unknown driver")
+	}
+}
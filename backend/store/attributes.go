@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+
+	"ccz/db"
+)
+
+// The value column is encrypted like the other profile data; attribute
+// names are schema and stay readable.
+
+func (s *SQL) AttributeDefinitions(ctx context.Context) ([]AttributeDefinition, error) {
+	defs := []AttributeDefinition{}
+	err := s.readRows(ctx, "", func(rows *sql.Rows) error {
+		var (
+			d     AttributeDefinition
+			rules string
+		)
+		if err := rows.Scan(&d.Name, &d.Label, &d.Type, &d.Required, &d.Visibility, &rules, &d.SortOrder); err != nil {
+			return err
+		}
+		if rules != "" {
+			if err := json.Unmarshal([]byte(rules), &d.Rules); err != nil {
+				return err
+			}
+		}
+		defs = append(defs, d)
+		return nil
+	}, "SELECT name, label, type, required, visibility, COALESCE(rules, ''), sort_order FROM attribute_definitions ORDER BY sort_order, name")
+	if err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+func (s *SQL) PutAttributeDefinition(ctx context.Context, def AttributeDefinition) error {
+	rules, err := json.Marshal(def.Rules)
+	if err != nil {
+		return err
+	}
+
+	query := "INSERT INTO attribute_definitions (name, label, type, required, visibility, rules, sort_order) VALUES (?, ?, ?, ?, ?, ?, ?) " +
+		"ON DUPLICATE KEY UPDATE label = VALUES(label), type = VALUES(type), required = VALUES(required), visibility = VALUES(visibility), rules = VALUES(rules), sort_order = VALUES(sort_order)"
+	if s.Dialect != db.MySQL {
+		query = "INSERT INTO attribute_definitions (name, label, type, required, visibility, rules, sort_order) VALUES (?, ?, ?, ?, ?, ?, ?) " +
+			"ON CONFLICT (name) DO UPDATE SET label = excluded.label, type = excluded.type, required = excluded.required, visibility = excluded.visibility, rules = excluded.rules, sort_order = excluded.sort_order"
+	}
+	return s.tx(ctx, "", func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, s.Dialect.Rebind(query), def.Name, def.Label, def.Type, def.Required, def.Visibility, string(rules), def.SortOrder)
+		if err != nil {
+			return wrap(err)
+		}
+		// The visibility and type decide how profiles with a value show it.
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"UPDATE users SET version=version+1 WHERE id IN (SELECT a.user_id FROM profile_attributes a JOIN attribute_definitions d ON d.id = a.attribute_id WHERE d.name=?)"), def.Name)
+		return wrap(err)
+	})
+}
+
+func (s *SQL) DeleteAttributeDefinition(ctx context.Context, name string) error {
+	return s.tx(ctx, "", func(tx *sql.Tx) error {
+		var id int64
+		err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT id FROM attribute_definitions WHERE name=?"), name).Scan(&id)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+
+		// Profiles that had a value change shape, so their ETags must too.
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"UPDATE users SET version=version+1 WHERE id IN (SELECT user_id FROM profile_attributes WHERE attribute_id=?)"), id)
+		if err != nil {
+			return wrap(err)
+		}
+		if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM profile_attributes WHERE attribute_id=?"), id); err != nil {
+			return wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM attribute_definitions WHERE id=?"), id)
+		return wrap(err)
+	})
+}
+
+func (s *SQL) Attributes(ctx context.Context, email string) (map[string]string, error) {
+	u, err := s.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]string{}
+	err = s.readRows(ctx, email, func(rows *sql.Rows) error {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return err
+		}
+		if values[name], err = s.Cipher.Decrypt("value", value); err != nil {
+			return err
+		}
+		return nil
+	}, "SELECT d.name, a.value FROM profile_attributes a JOIN attribute_definitions d ON d.id = a.attribute_id WHERE a.user_id=?", u.ID)
+	if err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// attributeIDs maps every defined attribute name to its id.
+func (s *SQL) attributeIDs(ctx context.Context, tx *sql.Tx) (map[string]int64, error) {
+	rows, err := tx.QueryContext(ctx, "SELECT id, name FROM attribute_definitions")
+	if err != nil {
+		return nil, wrap(err)
+	}
+	defer rows.Close()
+
+	ids := map[string]int64{}
+	for rows.Next() {
+		var (
+			id   int64
+			name string
+		)
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		ids[name] = id
+	}
+	return ids, wrap(rows.Err())
+}
+
+// loadAttributes reads a user's attribute values inside tx.
+func (s *SQL) loadAttributes(ctx context.Context, tx *sql.Tx, userID int64) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, s.Dialect.Rebind(
+		"SELECT d.name, a.value FROM profile_attributes a JOIN attribute_definitions d ON d.id = a.attribute_id WHERE a.user_id=?"), userID)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	defer rows.Close()
+
+	values := map[string]string{}
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		if values[name], err = s.Cipher.Decrypt("value", value); err != nil {
+			return nil, err
+		}
+	}
+	return values, wrap(rows.Err())
+}
+
+// storeAttribute sets one attribute value inside tx; an empty value
+// removes it.
+func (s *SQL) storeAttribute(ctx context.Context, tx *sql.Tx, userID, attributeID int64, value string) error {
+	if value == "" {
+		_, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM profile_attributes WHERE user_id=? AND attribute_id=?"), userID, attributeID)
+		return wrap(err)
+	}
+
+	sealed, err := s.Cipher.Encrypt("value", value)
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO profile_attributes (user_id, attribute_id, value) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value)"
+	if s.Dialect != db.MySQL {
+		query = "INSERT INTO profile_attributes (user_id, attribute_id, value) VALUES (?, ?, ?) ON CONFLICT (user_id, attribute_id) DO UPDATE SET value = excluded.value"
+	}
+	_, err = tx.ExecContext(ctx, s.Dialect.Rebind(query), userID, attributeID, sealed)
+	return wrap(err)
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Email changes keep both addresses encrypted, with a blind index each so
+// held addresses can be looked up.
+
+const emailChangeColumns = "id, user_id, old_email, new_email, token_hash, revert_token_hash, created_at, expires_at, revert_expires_at, confirmed_at, reverted_at"
+
+// loadEmailChange finds the change whose column holds hash inside tx and
+// returns it with the id of its user.
+func (s *SQL) loadEmailChange(ctx context.Context, tx *sql.Tx, column, hash string) (*EmailChange, int64, error) {
+	var (
+		c                       EmailChange
+		userID                  int64
+		confirmedAt, revertedAt sql.NullTime
+	)
+	err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT "+emailChangeColumns+" FROM email_changes WHERE "+column+"=?"+s.forUpdate()), hash).
+		Scan(&c.ID, &userID, &c.OldEmail, &c.NewEmail, &c.TokenHash, &c.RevertTokenHash, &c.CreatedAt, &c.ExpiresAt, &c.RevertExpiresAt, &confirmedAt, &revertedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, wrap(err)
+	}
+	c.ConfirmedAt, c.RevertedAt = confirmedAt.Time, revertedAt.Time
+	if c.OldEmail, err = s.Cipher.Decrypt("old_email", c.OldEmail); err != nil {
+		return nil, 0, err
+	}
+	if c.NewEmail, err = s.Cipher.Decrypt("new_email", c.NewEmail); err != nil {
+		return nil, 0, err
+	}
+	return &c, userID, nil
+}
+
+// emailTaken reports whether email belongs to a user other than userID, or
+// is held for one by a change they can still revert.
+func (s *SQL) emailTaken(ctx context.Context, tx *sql.Tx, email string, userID int64, now time.Time) (bool, error) {
+	var users, held int
+	indexes := s.emailIndexes(email)
+	err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT COUNT(*) FROM users WHERE "+byEmail+" AND id<>?"), append(indexes, userID)...).Scan(&users)
+	if err != nil {
+		return false, wrap(err)
+	}
+	err = tx.QueryRowContext(ctx, s.Dialect.Rebind(
+		"SELECT COUNT(*) FROM email_changes WHERE old_email_bidx IN (?, ?) AND user_id<>? AND confirmed_at IS NOT NULL AND reverted_at IS NULL AND revert_expires_at>?"),
+		append(indexes, userID, now.UTC())...).Scan(&held)
+	if err != nil {
+		return false, wrap(err)
+	}
+	return users+held > 0, nil
+}
+
+// setEmail moves the user to email and bumps their version. Reads for the
+// new address go to the primary for a while, like those for the old one.
+func (s *SQL) setEmail(ctx context.Context, tx *sql.Tx, userID int64, email string) error {
+	encEmail, err := s.Cipher.Encrypt("email", email)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET email=?, email_bidx=?, version=version+1 WHERE id=?"),
+		encEmail, s.Cipher.BlindIndex(email), userID)
+	if s.Dialect.IsUniqueViolation(err) {
+		return ErrConflict
+	}
+	if err != nil {
+		return wrap(err)
+	}
+	if s.Router != nil {
+		s.Router.Writer(email)
+	}
+	return nil
+}
+
+func (s *SQL) RequestEmailChange(ctx context.Context, email string, c EmailChange) error {
+	oldEmail, err := s.Cipher.Encrypt("old_email", email)
+	if err != nil {
+		return err
+	}
+	newEmail, err := s.Cipher.Encrypt("new_email", c.NewEmail)
+	if err != nil {
+		return err
+	}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		newBidx := s.Cipher.BlindIndex(c.NewEmail)
+		taken, err := s.emailTaken(ctx, tx, c.NewEmail, current.ID, c.CreatedAt)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM email_changes WHERE user_id=? AND confirmed_at IS NULL AND reverted_at IS NULL"), current.ID)
+		if err != nil {
+			return wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"INSERT INTO email_changes (user_id, old_email, old_email_bidx, new_email, new_email_bidx, token_hash, revert_token_hash, created_at, expires_at, revert_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			current.ID, oldEmail, s.Cipher.BlindIndex(email), newEmail, newBidx, c.TokenHash, c.RevertTokenHash,
+			c.CreatedAt.UTC(), c.ExpiresAt.UTC(), c.RevertExpiresAt.UTC())
+		return wrap(err)
+	})
+}
+
+func (s *SQL) ConfirmEmailChange(ctx context.Context, email, tokenHash string, now time.Time) (*EmailChange, error) {
+	var change *EmailChange
+	err := s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		c, userID, err := s.loadEmailChange(ctx, tx, "token_hash", tokenHash)
+		if err != nil {
+			return err
+		}
+		switch {
+		case userID != current.ID || !c.ConfirmedAt.IsZero() || !c.RevertedAt.IsZero():
+			return ErrNotFound
+		case !now.Before(c.ExpiresAt):
+			return ErrTokenExpired
+		}
+		taken, err := s.emailTaken(ctx, tx, c.NewEmail, current.ID, now)
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+
+		if err := s.setEmail(ctx, tx, current.ID, c.NewEmail); err != nil {
+			return err
+		}
+		c.ConfirmedAt = now.UTC()
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE email_changes SET confirmed_at=? WHERE id=?"), c.ConfirmedAt, c.ID)
+		change = c
+		return wrap(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+func (s *SQL) RevertEmailChange(ctx context.Context, revertTokenHash string, now time.Time) (*EmailChange, error) {
+	var change *EmailChange
+	err := s.tx(ctx, "", func(tx *sql.Tx) error {
+		c, userID, err := s.loadEmailChange(ctx, tx, "revert_token_hash", revertTokenHash)
+		if err != nil {
+			return err
+		}
+		switch {
+		case !c.RevertedAt.IsZero():
+			return ErrNotFound
+		case !now.Before(c.RevertExpiresAt):
+			return ErrTokenExpired
+		}
+
+		if !c.ConfirmedAt.IsZero() {
+			taken, err := s.emailTaken(ctx, tx, c.OldEmail, userID, now)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrConflict
+			}
+			if err := s.setEmail(ctx, tx, userID, c.OldEmail); err != nil {
+				return err
+			}
+		}
+		// Later changes by the same user are undone with it, so whoever
+		// made them cannot keep the account by changing the address again.
+		c.RevertedAt = now.UTC()
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE email_changes SET reverted_at=? WHERE user_id=? AND id>=? AND reverted_at IS NULL"), c.RevertedAt, userID, c.ID)
+		change = c
+		return wrap(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return change, nil
+}
@@ -0,0 +1,257 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const revisionColumns = "id, COALESCE(old_full_name, ''), COALESCE(old_telephone, ''), COALESCE(new_full_name, ''), COALESCE(new_telephone, ''), COALESCE(actor, ''), COALESCE(ip, ''), source, COALESCE(restored_from, 0), created_at, COALESCE(old_attributes, ''), COALESCE(new_attributes, '')"
+
+// lockUser loads the user inside tx, locking the row until tx ends.
+func (s *SQL) lockUser(ctx context.Context, tx *sql.Tx, email string) (*User, error) {
+	var u User
+	query := "SELECT " + userColumns + " FROM users WHERE " + byEmail + s.forUpdate()
+	err := scanUser(tx.QueryRowContext(ctx, s.Dialect.Rebind(query), s.emailIndexes(email)...), &u)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err := s.decryptUser(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// setProfile writes update over current, bumps its version and records the
+// revision. Writes that change nothing are skipped. A restore skips
+// attributes whose definition has since been deleted, and those the change
+// does not allow it to restore.
+func (s *SQL) setProfile(ctx context.Context, tx *sql.Tx, current *User, update ProfileUpdate, change Change, restoredFrom int64) error {
+	if change.IfVersion != 0 && change.IfVersion != current.Version {
+		return ErrVersionMismatch
+	}
+
+	var (
+		ids                map[string]int64
+		oldAttrs, newAttrs map[string]string
+	)
+	if len(update.Attributes) > 0 {
+		var err error
+		if ids, err = s.attributeIDs(ctx, tx); err != nil {
+			return err
+		}
+		stored, err := s.loadAttributes(ctx, tx, current.ID)
+		if err != nil {
+			return err
+		}
+		oldAttrs, newAttrs = map[string]string{}, map[string]string{}
+		for name, value := range update.Attributes {
+			if restoredFrom != 0 && !change.restores(name) {
+				continue
+			}
+			if _, ok := ids[name]; !ok {
+				if restoredFrom != 0 {
+					continue
+				}
+				return fmt.Errorf("%w: %q", ErrUnknownAttribute, name)
+			}
+			if stored[name] != value {
+				oldAttrs[name], newAttrs[name] = stored[name], value
+			}
+		}
+	}
+	profileChanged := current.FullName != update.FullName || current.Telephone != update.Telephone
+	if !profileChanged && len(newAttrs) == 0 {
+		return nil
+	}
+
+	plain := map[string]string{
+		"full_name":         update.FullName,
+		"telephone":         update.Telephone,
+		"telephone_display": TelephoneDisplay(update.Telephone),
+		"old_full_name":     current.FullName,
+		"old_telephone":     current.Telephone,
+		"new_full_name":     update.FullName,
+		"new_telephone":     update.Telephone,
+		"actor":             change.Actor,
+	}
+	if len(newAttrs) > 0 {
+		oldJSON, _ := json.Marshal(oldAttrs)
+		newJSON, _ := json.Marshal(newAttrs)
+		plain["old_attributes"], plain["new_attributes"] = string(oldJSON), string(newJSON)
+	}
+	sealed, err := s.encrypt(plain)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET full_name=?, telephone=?, telephone_display=?, version=version+1 WHERE id=?"),
+		sealed["full_name"], sealed["telephone"], sealed["telephone_display"], current.ID)
+	if err != nil {
+		return wrap(err)
+	}
+	if current.Telephone != update.Telephone {
+		if err := s.resetPhoneVerification(ctx, tx, current.ID); err != nil {
+			return err
+		}
+	}
+	for name, value := range newAttrs {
+		if err := s.storeAttribute(ctx, tx, current.ID, ids[name], value); err != nil {
+			return err
+		}
+	}
+
+	var restored any
+	if restoredFrom != 0 {
+		restored = restoredFrom
+	}
+	_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+		"INSERT INTO profile_revisions (user_id, old_full_name, old_telephone, new_full_name, new_telephone, actor, ip, source, restored_from, created_at, old_attributes, new_attributes) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+		current.ID, sealed["old_full_name"], sealed["old_telephone"], sealed["new_full_name"], sealed["new_telephone"],
+		sealed["actor"], change.IP, change.Source, restored, time.Now().UTC(), sealed["old_attributes"], sealed["new_attributes"])
+	return wrap(err)
+}
+
+// encrypt seals each value with its column name.
+func (s *SQL) encrypt(values map[string]string) (map[string]string, error) {
+	out := make(map[string]string, len(values))
+	for column, v := range values {
+		sealed, err := s.Cipher.Encrypt(column, v)
+		if err != nil {
+			return nil, err
+		}
+		out[column] = sealed
+	}
+	return out, nil
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func (s *SQL) scanRevision(row rowScanner) (Revision, error) {
+	var (
+		r                  Revision
+		oldAttrs, newAttrs string
+	)
+	err := row.Scan(&r.ID, &r.OldFullName, &r.OldTelephone, &r.NewFullName, &r.NewTelephone,
+		&r.Actor, &r.IP, &r.Source, &r.RestoredFrom, &r.CreatedAt, &oldAttrs, &newAttrs)
+	if err != nil {
+		return r, err
+	}
+	for column, field := range map[string]*string{
+		"old_full_name":  &r.OldFullName,
+		"old_telephone":  &r.OldTelephone,
+		"new_full_name":  &r.NewFullName,
+		"new_telephone":  &r.NewTelephone,
+		"actor":          &r.Actor,
+		"old_attributes": &oldAttrs,
+		"new_attributes": &newAttrs,
+	} {
+		if *field, err = s.Cipher.Decrypt(column, *field); err != nil {
+			return r, err
+		}
+	}
+	if oldAttrs != "" || newAttrs != "" {
+		if err := json.Unmarshal([]byte(oldAttrs), &r.OldAttributes); err != nil {
+			return r, fmt.Errorf("revision %d attributes: %w", r.ID, err)
+		}
+		if err := json.Unmarshal([]byte(newAttrs), &r.NewAttributes); err != nil {
+			return r, fmt.Errorf("revision %d attributes: %w", r.ID, err)
+		}
+	}
+	return r, nil
+}
+
+func (s *SQL) Revisions(ctx context.Context, email string, limit int) ([]Revision, error) {
+	u, err := s.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := []Revision{}
+	err = s.readRows(ctx, email, func(rows *sql.Rows) error {
+		r, err := s.scanRevision(rows)
+		if err != nil {
+			return err
+		}
+		revisions = append(revisions, r)
+		return nil
+	}, "SELECT "+revisionColumns+" FROM profile_revisions WHERE user_id=? ORDER BY id DESC LIMIT ?", u.ID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
+
+func (s *SQL) ProfileAt(ctx context.Context, email string, at time.Time) (*User, error) {
+	u, err := s.GetByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	// The last revision at or before at holds the values then in effect.
+	// Failing that, the first revision after it still has them as its old
+	// values; with no revisions at all the profile never changed.
+	var (
+		r     Revision
+		found bool
+	)
+	scan := func(row *sql.Row) error {
+		var err error
+		r, err = s.scanRevision(row)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		found = err == nil
+		return err
+	}
+	at = at.UTC()
+	err = s.read(ctx, email, scan,
+		"SELECT "+revisionColumns+" FROM profile_revisions WHERE user_id=? AND created_at<=? ORDER BY created_at DESC, id DESC LIMIT 1", u.ID, at)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if found {
+		u.FullName, u.Telephone = r.NewFullName, r.NewTelephone
+		u.TelephoneDisplay = TelephoneDisplay(u.Telephone)
+		return u, nil
+	}
+
+	err = s.read(ctx, email, scan,
+		"SELECT "+revisionColumns+" FROM profile_revisions WHERE user_id=? AND created_at>? ORDER BY created_at, id LIMIT 1", u.ID, at)
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if found {
+		u.FullName, u.Telephone = r.OldFullName, r.OldTelephone
+		u.TelephoneDisplay = TelephoneDisplay(u.Telephone)
+	}
+	return u, nil
+}
+
+func (s *SQL) RestoreRevision(ctx context.Context, email string, id int64, change Change) error {
+	change.Source = SourceRestore
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		r, err := s.scanRevision(tx.QueryRowContext(ctx, s.Dialect.Rebind(
+			"SELECT "+revisionColumns+" FROM profile_revisions WHERE id=? AND user_id=?"), id, current.ID))
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		update := ProfileUpdate{FullName: r.NewFullName, Telephone: r.NewTelephone, Attributes: r.NewAttributes}
+		return s.setProfile(ctx, tx, current, update, change, r.ID)
+	})
+}
@@ -0,0 +1,943 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"ccz/password"
+	"ccz/pii"
+)
+
+type memoryUser struct {
+	User
+	password  string   // bcrypt hash
+	passwords []string // password history, newest first
+	// sessionsRevokedAt is when the user last signed out every session.
+	sessionsRevokedAt time.Time
+	attributes        map[string]string
+	revisions         []Revision // oldest first
+	challenge         *PhoneChallenge
+	tokens            []AccessToken // oldest first
+}
+
+// Memory is a thread-safe in-process Store, useful for tests and local runs
+// without a database.
+type Memory struct {
+	mu         sync.RWMutex
+	nextID     int64
+	revisionID int64
+	changeID   int64
+	tokenID    int64
+	users      map[string]*memoryUser // by normalized email, as SQL matches them
+	defs       map[string]AttributeDefinition
+	changes    []*memoryEmailChange
+	clients    map[string]OAuthClient
+	codes      map[string]AuthorizationCode // by hash, with UserID set
+	revoked    map[string]time.Time         // OAuth token ids to their expiry
+	devices    map[string]DeviceCode        // by device code hash
+	tenants    map[string]SAMLTenant
+	requests   map[string]memorySAMLRequest // by AuthnRequest id
+}
+
+type memorySAMLRequest struct {
+	tenant    string
+	expiresAt time.Time
+}
+
+type memoryEmailChange struct {
+	EmailChange
+	userID int64
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		users:    map[string]*memoryUser{},
+		defs:     map[string]AttributeDefinition{},
+		clients:  map[string]OAuthClient{},
+		codes:    map[string]AuthorizationCode{},
+		revoked:  map[string]time.Time{},
+		devices:  map[string]DeviceCode{},
+		tenants:  map[string]SAMLTenant{},
+		requests: map[string]memorySAMLRequest{},
+	}
+}
+
+func (s *Memory) GetByEmail(ctx context.Context, email string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := u.User
+	return &out, nil
+}
+
+func (s *Memory) GetByID(ctx context.Context, id int64) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.ID == id {
+			out := u.User
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Memory) UpdateProfile(ctx context.Context, email string, update ProfileUpdate, change Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if u, ok := s.users[pii.Normalize(email)]; ok {
+		return s.setProfile(u, update, change, 0)
+	}
+	return nil
+}
+
+func (s *Memory) Attributes(ctx context.Context, email string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	values := map[string]string{}
+	maps.Copy(values, u.attributes)
+	return values, nil
+}
+
+func (s *Memory) AttributeDefinitions(ctx context.Context) ([]AttributeDefinition, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	defs := slices.Collect(maps.Values(s.defs))
+	slices.SortFunc(defs, func(a, b AttributeDefinition) int {
+		if a.SortOrder != b.SortOrder {
+			return a.SortOrder - b.SortOrder
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if defs == nil {
+		defs = []AttributeDefinition{}
+	}
+	return defs, nil
+}
+
+func (s *Memory) PutAttributeDefinition(ctx context.Context, def AttributeDefinition) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.defs[def.Name] = def
+	for _, u := range s.users {
+		if _, ok := u.attributes[def.Name]; ok {
+			u.Version++
+		}
+	}
+	return nil
+}
+
+func (s *Memory) DeleteAttributeDefinition(ctx context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.defs[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.defs, name)
+	for _, u := range s.users {
+		if _, ok := u.attributes[name]; ok {
+			delete(u.attributes, name)
+			u.Version++
+		}
+	}
+	return nil
+}
+
+func (s *Memory) Revisions(ctx context.Context, email string, limit int) ([]Revision, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := []Revision{}
+	for i := len(u.revisions) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, u.revisions[i])
+	}
+	return out, nil
+}
+
+func (s *Memory) ProfileAt(ctx context.Context, email string, at time.Time) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	out := u.User
+	for i := len(u.revisions) - 1; i >= 0; i-- {
+		r := u.revisions[i]
+		if !r.CreatedAt.After(at) {
+			out.FullName, out.Telephone = r.NewFullName, r.NewTelephone
+			out.TelephoneDisplay = TelephoneDisplay(out.Telephone)
+			return &out, nil
+		}
+		out.FullName, out.Telephone = r.OldFullName, r.OldTelephone
+		out.TelephoneDisplay = TelephoneDisplay(out.Telephone)
+	}
+	return &out, nil
+}
+
+func (s *Memory) RestoreRevision(ctx context.Context, email string, id int64, change Change) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	for _, r := range u.revisions {
+		if r.ID == id {
+			change.Source = SourceRestore
+			update := ProfileUpdate{FullName: r.NewFullName, Telephone: r.NewTelephone, Attributes: r.NewAttributes}
+			return s.setProfile(u, update, change, r.ID)
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *Memory) CreateLocal(ctx context.Context, email, pw string) error {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.emailTaken(email, 0, time.Now()) {
+		return ErrConflict
+	}
+	u := s.insert(email, "local")
+	u.password = hash
+	u.passwords = []string{hash}
+	u.HasPassword = true
+	return nil
+}
+
+func (s *Memory) SetPassword(ctx context.Context, email, pw string, revokeBefore time.Time) error {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	if !u.HasPassword {
+		u.Version++
+	}
+	u.password = hash
+	u.passwords = append([]string{hash}, u.passwords...)
+	u.HasPassword = true
+	u.sessionsRevokedAt = revokeBefore
+	return nil
+}
+
+func (s *Memory) SessionsRevokedAt(ctx context.Context, email string) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return time.Time{}, ErrNotFound
+	}
+	return u.sessionsRevokedAt, nil
+}
+
+func (s *Memory) Authenticate(ctx context.Context, email, pw string) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if ok, _ := password.Verify(u.password, pw); !ok {
+		return nil, ErrNotFound
+	}
+	out := u.User
+	return &out, nil
+}
+
+func (s *Memory) PasswordHistory(ctx context.Context, email string, limit int) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return []string{}, nil
+	}
+	return slices.Clone(u.passwords[:min(limit, len(u.passwords))]), nil
+}
+
+func (s *Memory) UpsertGoogle(ctx context.Context, email, fullName string, change Change) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		if s.emailTaken(email, 0, time.Now()) {
+			return false, ErrConflict
+		}
+		s.insert(email, "google").FullName = fullName
+		return true, nil
+	}
+	return false, s.setProfile(u, ProfileUpdate{FullName: fullName, Telephone: u.Telephone}, change, 0)
+}
+
+func (s *Memory) UpsertSAML(ctx context.Context, email string, update ProfileUpdate, change Change) (bool, error) {
+	return s.upsertExternal("saml", email, update, "", change)
+}
+
+func (s *Memory) UpsertLDAP(ctx context.Context, email string, update ProfileUpdate, role string, change Change) (bool, error) {
+	return s.upsertExternal("ldap", email, update, role, change)
+}
+
+func (s *Memory) upsertExternal(provider, email string, update ProfileUpdate, role string, change Change) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, created := s.users[pii.Normalize(email)], false
+	if u == nil {
+		if s.emailTaken(email, 0, time.Now()) {
+			return false, ErrConflict
+		}
+		u, created = s.insert(email, provider), true
+	}
+	if provider == SourceLDAP && (u.Provider != provider || u.HasPassword) {
+		u.Provider, u.password, u.HasPassword = provider, "", false
+		u.Version++
+	}
+	if role != "" && role != u.Role {
+		u.Role = role
+		u.Version++
+	}
+	return created, s.setProfile(u, u.externalUpdate(update), change, 0)
+}
+
+func (s *Memory) SetAvatar(ctx context.Context, email, id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	previous := u.Avatar
+	if previous != id {
+		u.Avatar = id
+		u.Version++
+	}
+	return previous, nil
+}
+
+func (s *Memory) StartPhoneChallenge(ctx context.Context, email string, c PhoneChallenge, limits PhoneLimits) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	if retryAfter := throttle(u.challenge, &c, limits); retryAfter > 0 {
+		return retryAfter, ErrThrottled
+	}
+	u.challenge = &c
+	return 0, nil
+}
+
+func (s *Memory) ConfirmPhone(ctx context.Context, email, codeHash string, limits PhoneLimits, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	outcome, wrong := checkCode(u.challenge, u.Telephone, codeHash, limits, now)
+	if wrong {
+		u.challenge.Attempts++
+	}
+	if outcome != nil {
+		return outcome
+	}
+	u.TelephoneVerifiedAt, u.challenge = now.UTC(), nil
+	u.Version++
+	return nil
+}
+
+func (s *Memory) RequestEmailChange(ctx context.Context, email string, c EmailChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	if s.emailTaken(c.NewEmail, u.ID, c.CreatedAt) {
+		return ErrConflict
+	}
+	s.changes = slices.DeleteFunc(s.changes, func(p *memoryEmailChange) bool {
+		return p.userID == u.ID && p.ConfirmedAt.IsZero() && p.RevertedAt.IsZero()
+	})
+	s.changeID++
+	c.ID, c.OldEmail = s.changeID, email
+	s.changes = append(s.changes, &memoryEmailChange{EmailChange: c, userID: u.ID})
+	return nil
+}
+
+func (s *Memory) ConfirmEmailChange(ctx context.Context, email, tokenHash string, now time.Time) (*EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	i := slices.IndexFunc(s.changes, func(c *memoryEmailChange) bool { return c.TokenHash == tokenHash })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	c := s.changes[i]
+	switch {
+	case c.userID != u.ID || !c.ConfirmedAt.IsZero() || !c.RevertedAt.IsZero():
+		return nil, ErrNotFound
+	case !now.Before(c.ExpiresAt):
+		return nil, ErrTokenExpired
+	case s.emailTaken(c.NewEmail, u.ID, now):
+		return nil, ErrConflict
+	}
+	s.move(u, c.NewEmail)
+	c.ConfirmedAt = now.UTC()
+	out := c.EmailChange
+	return &out, nil
+}
+
+func (s *Memory) RevertEmailChange(ctx context.Context, revertTokenHash string, now time.Time) (*EmailChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.changes, func(c *memoryEmailChange) bool { return c.RevertTokenHash == revertTokenHash })
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+	c := s.changes[i]
+	switch {
+	case !c.RevertedAt.IsZero():
+		return nil, ErrNotFound
+	case !now.Before(c.RevertExpiresAt):
+		return nil, ErrTokenExpired
+	}
+	if !c.ConfirmedAt.IsZero() {
+		if s.emailTaken(c.OldEmail, c.userID, now) {
+			return nil, ErrConflict
+		}
+		for _, u := range s.users {
+			if u.ID == c.userID {
+				s.move(u, c.OldEmail)
+				break
+			}
+		}
+	}
+	for _, later := range s.changes {
+		if later.userID == c.userID && later.ID >= c.ID && later.RevertedAt.IsZero() {
+			later.RevertedAt = now.UTC()
+		}
+	}
+	out := c.EmailChange
+	return &out, nil
+}
+
+func (s *Memory) CreateAccessToken(ctx context.Context, email string, t *AccessToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	if slices.ContainsFunc(u.tokens, func(other AccessToken) bool { return other.Name == t.Name }) {
+		return ErrConflict
+	}
+	s.tokenID++
+	t.ID = s.tokenID
+	stored := *t
+	stored.Scopes = slices.Clone(t.Scopes)
+	u.tokens = append(u.tokens, stored)
+	return nil
+}
+
+func (s *Memory) AccessTokens(ctx context.Context, email string) ([]AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return []AccessToken{}, nil
+	}
+	out := make([]AccessToken, 0, len(u.tokens))
+	for i := len(u.tokens) - 1; i >= 0; i-- {
+		t := u.tokens[i]
+		t.Email = email
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+func (s *Memory) DeleteAccessToken(ctx context.Context, email string, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	i := slices.IndexFunc(u.tokens, func(t AccessToken) bool { return t.ID == id })
+	if i < 0 {
+		return ErrNotFound
+	}
+	u.tokens = slices.Delete(u.tokens, i, i+1)
+	return nil
+}
+
+func (s *Memory) UseAccessToken(ctx context.Context, hash, ip string, now time.Time) (*AccessToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accessToken(hash, ip, now, true)
+}
+
+func (s *Memory) GetAccessToken(ctx context.Context, hash string, now time.Time) (*AccessToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.accessToken(hash, "", now, false)
+}
+
+// accessToken finds the token with hash, recording its use from ip when
+// use is set.
+func (s *Memory) accessToken(hash, ip string, now time.Time, use bool) (*AccessToken, error) {
+	for _, u := range s.users {
+		for i := range u.tokens {
+			t := &u.tokens[i]
+			if t.Hash != hash {
+				continue
+			}
+			if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+				return nil, ErrTokenExpired
+			}
+			if use {
+				t.LastUsedAt, t.LastUsedIP = now, ip
+			}
+			out := *t
+			out.Email = u.Email
+			return &out, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Memory) CreateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[c.ID]; ok {
+		return ErrConflict
+	}
+	stored := *c
+	stored.RedirectURIs, stored.Scopes, stored.GrantTypes = slices.Clone(c.RedirectURIs), slices.Clone(c.Scopes), slices.Clone(c.GrantTypes)
+	s.clients[c.ID] = stored
+	return nil
+}
+
+func (s *Memory) OAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.clients[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &c, nil
+}
+
+func (s *Memory) OAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	out := slices.Collect(maps.Values(s.clients))
+	slices.SortFunc(out, func(a, b OAuthClient) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	if out == nil {
+		out = []OAuthClient{}
+	}
+	return out, nil
+}
+
+func (s *Memory) DeleteOAuthClient(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.clients[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.clients, id)
+	maps.DeleteFunc(s.codes, func(_ string, c AuthorizationCode) bool { return c.ClientID == id })
+	maps.DeleteFunc(s.devices, func(_ string, c DeviceCode) bool { return c.ClientID == id })
+	return nil
+}
+
+func (s *Memory) CreateAuthorizationCode(ctx context.Context, email string, c AuthorizationCode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	c.UserID, c.Email = u.ID, ""
+	c.Scopes = slices.Clone(c.Scopes)
+	s.codes[c.Hash] = c
+	return nil
+}
+
+func (s *Memory) RedeemAuthorizationCode(ctx context.Context, hash string, now time.Time) (*AuthorizationCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.codes[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	delete(s.codes, hash)
+	if !now.Before(c.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	for _, u := range s.users {
+		if u.ID == c.UserID {
+			c.Email = u.Email
+			return &c, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Memory) RevokeOAuthToken(ctx context.Context, id string, expiresAt, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maps.DeleteFunc(s.revoked, func(_ string, exp time.Time) bool { return !now.Before(exp) })
+	if _, ok := s.revoked[id]; !ok {
+		s.revoked[id] = expiresAt
+	}
+	return nil
+}
+
+func (s *Memory) OAuthTokenRevoked(ctx context.Context, id string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revoked[id]
+	return ok, nil
+}
+
+func (s *Memory) CreateDeviceCode(ctx context.Context, c DeviceCode, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maps.DeleteFunc(s.devices, func(_ string, d DeviceCode) bool { return !now.Before(d.ExpiresAt) })
+	if _, ok := s.deviceByUserCode(c.UserCodeHash); ok {
+		return ErrConflict
+	}
+	c.Scopes, c.Status = slices.Clone(c.Scopes), DevicePending
+	c.UserID, c.AuthTime, c.LastPolledAt, c.SlowDown = 0, time.Time{}, time.Time{}, false
+	s.devices[c.Hash] = c
+	return nil
+}
+
+// deviceByUserCode must be called with mu held.
+func (s *Memory) deviceByUserCode(userCodeHash string) (DeviceCode, bool) {
+	for _, c := range s.devices {
+		if c.UserCodeHash == userCodeHash {
+			return c, true
+		}
+	}
+	return DeviceCode{}, false
+}
+
+func (s *Memory) PendingDeviceCode(ctx context.Context, userCodeHash string, now time.Time) (*DeviceCode, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	c, ok := s.deviceByUserCode(userCodeHash)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if err := c.pending(now); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *Memory) DecideDeviceCode(ctx context.Context, userCodeHash, email string, approve bool, authTime, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[pii.Normalize(email)]
+	if !ok {
+		return ErrNotFound
+	}
+	c, ok := s.deviceByUserCode(userCodeHash)
+	if !ok {
+		return ErrNotFound
+	}
+	if err := c.pending(now); err != nil {
+		return err
+	}
+	c.Status = DeviceDenied
+	if approve {
+		c.Status = DeviceApproved
+	}
+	c.UserID, c.AuthTime = u.ID, authTime
+	s.devices[c.Hash] = c
+	return nil
+}
+
+func (s *Memory) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*DeviceCode, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.devices[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if !now.Before(c.ExpiresAt) {
+		delete(s.devices, hash)
+		return nil, ErrTokenExpired
+	}
+	if c.Status != DevicePending {
+		delete(s.devices, hash)
+		return &c, nil
+	}
+	if c.SlowDown = !c.LastPolledAt.IsZero() && now.Sub(c.LastPolledAt) < c.Interval; c.SlowDown {
+		c.Interval += 5 * time.Second
+	}
+	c.LastPolledAt = now
+	s.devices[hash] = c
+	return &c, nil
+}
+
+func (s *Memory) PutSAMLTenant(ctx context.Context, t SAMLTenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, other := range s.tenants {
+		if other.ID != t.ID && slices.ContainsFunc(t.Domains, func(d string) bool { return slices.Contains(other.Domains, d) }) {
+			return ErrConflict
+		}
+	}
+	if current, ok := s.tenants[t.ID]; ok {
+		t.CreatedAt = current.CreatedAt
+	}
+	t.Domains = slices.Sorted(slices.Values(t.Domains))
+	s.tenants[t.ID] = t
+	return nil
+}
+
+func (s *Memory) SAMLTenant(ctx context.Context, id string) (*SAMLTenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	t, ok := s.tenants[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	t.Domains = slices.Clone(t.Domains)
+	return &t, nil
+}
+
+func (s *Memory) SAMLTenantByDomain(ctx context.Context, domain string) (*SAMLTenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, t := range s.tenants {
+		if slices.Contains(t.Domains, domain) {
+			t.Domains = slices.Clone(t.Domains)
+			return &t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Memory) SAMLTenants(ctx context.Context) ([]SAMLTenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tenants := []SAMLTenant{}
+	for _, t := range s.tenants {
+		t.Domains = slices.Clone(t.Domains)
+		tenants = append(tenants, t)
+	}
+	slices.SortFunc(tenants, func(a, b SAMLTenant) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+	return tenants, nil
+}
+
+func (s *Memory) DeleteSAMLTenant(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.tenants[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.tenants, id)
+	maps.DeleteFunc(s.requests, func(_ string, r memorySAMLRequest) bool { return r.tenant == id })
+	return nil
+}
+
+func (s *Memory) CreateSAMLRequest(ctx context.Context, id, tenant string, expiresAt, now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maps.DeleteFunc(s.requests, func(_ string, r memorySAMLRequest) bool { return !now.Before(r.expiresAt) })
+	s.requests[id] = memorySAMLRequest{tenant: tenant, expiresAt: expiresAt}
+	return nil
+}
+
+func (s *Memory) RedeemSAMLRequest(ctx context.Context, id string, now time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.requests[id]
+	if !ok {
+		return "", ErrNotFound
+	}
+	delete(s.requests, id)
+	if !now.Before(r.expiresAt) {
+		return "", ErrTokenExpired
+	}
+	return r.tenant, nil
+}
+
+// emailTaken reports whether email belongs to a user other than userID, or
+// is held for one by a change they can still revert. It must be called
+// with mu held.
+func (s *Memory) emailTaken(email string, userID int64, now time.Time) bool {
+	if u, ok := s.users[pii.Normalize(email)]; ok && u.ID != userID {
+		return true
+	}
+	return slices.ContainsFunc(s.changes, func(c *memoryEmailChange) bool {
+		return pii.Normalize(c.OldEmail) == pii.Normalize(email) && c.userID != userID && !c.ConfirmedAt.IsZero() && c.RevertedAt.IsZero() && now.Before(c.RevertExpiresAt)
+	})
+}
+
+// move re-keys u under a new email. It must be called with mu held.
+func (s *Memory) move(u *memoryUser, email string) {
+	delete(s.users, pii.Normalize(u.Email))
+	u.Email = email
+	u.Version++
+	s.users[pii.Normalize(email)] = u
+}
+
+// insert must be called with mu held.
+func (s *Memory) insert(email, provider string) *memoryUser {
+	s.nextID++
+	u := &memoryUser{User: User{ID: s.nextID, Email: email, Provider: provider, Role: RoleUser, Version: 1}}
+	s.users[pii.Normalize(email)] = u
+	return u
+}
+
+// setProfile must be called with mu held.
+func (s *Memory) setProfile(u *memoryUser, update ProfileUpdate, change Change, restoredFrom int64) error {
+	if change.IfVersion != 0 && change.IfVersion != u.Version {
+		return ErrVersionMismatch
+	}
+
+	var oldAttrs, newAttrs map[string]string
+	for name, value := range update.Attributes {
+		if restoredFrom != 0 && !change.restores(name) {
+			continue
+		}
+		if _, ok := s.defs[name]; !ok {
+			if restoredFrom != 0 {
+				continue
+			}
+			return fmt.Errorf("%w: %q", ErrUnknownAttribute, name)
+		}
+		if u.attributes[name] != value {
+			if newAttrs == nil {
+				oldAttrs, newAttrs = map[string]string{}, map[string]string{}
+			}
+			oldAttrs[name], newAttrs[name] = u.attributes[name], value
+		}
+	}
+	if u.FullName == update.FullName && u.Telephone == update.Telephone && len(newAttrs) == 0 {
+		return nil
+	}
+
+	s.revisionID++
+	u.revisions = append(u.revisions, Revision{
+		ID:            s.revisionID,
+		OldFullName:   u.FullName,
+		OldTelephone:  u.Telephone,
+		NewFullName:   update.FullName,
+		NewTelephone:  update.Telephone,
+		Actor:         change.Actor,
+		IP:            change.IP,
+		Source:        change.Source,
+		RestoredFrom:  restoredFrom,
+		CreatedAt:     time.Now().UTC(),
+		OldAttributes: oldAttrs,
+		NewAttributes: newAttrs,
+	})
+	u.FullName = update.FullName
+	if u.Telephone != update.Telephone {
+		u.TelephoneVerifiedAt, u.challenge = time.Time{}, nil
+	}
+	u.Telephone = update.Telephone
+	u.TelephoneDisplay = TelephoneDisplay(update.Telephone)
+	for name, value := range newAttrs {
+		if value == "" {
+			delete(u.attributes, name)
+			continue
+		}
+		if u.attributes == nil {
+			u.attributes = map[string]string{}
+		}
+		u.attributes[name] = value
+	}
+	u.Version++
+	return nil
+}
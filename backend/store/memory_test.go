@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"ccz/store"
+	"ccz/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.NewMemory()
+	})
+}
@@ -0,0 +1,285 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Redirect URIs, scopes and grant types are stored space separated; none
+// of them can hold a space.
+
+const oauthClientColumns = "id, name, COALESCE(secret_hash, ''), redirect_uris, scopes, grant_types, created_at"
+
+func scanOAuthClient(row rowScanner, c *OAuthClient) error {
+	var redirectURIs, scopes, grantTypes string
+	if err := row.Scan(&c.ID, &c.Name, &c.SecretHash, &redirectURIs, &scopes, &grantTypes, &c.CreatedAt); err != nil {
+		return err
+	}
+	c.RedirectURIs, c.Scopes, c.GrantTypes = strings.Fields(redirectURIs), strings.Fields(scopes), strings.Fields(grantTypes)
+	return nil
+}
+
+func (s *SQL) CreateOAuthClient(ctx context.Context, c *OAuthClient) error {
+	secretHash := sql.NullString{String: c.SecretHash, Valid: c.SecretHash != ""}
+	_, err := s.exec(ctx, "", "INSERT INTO oauth_clients (id, name, secret_hash, redirect_uris, scopes, grant_types, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		c.ID, c.Name, secretHash, strings.Join(c.RedirectURIs, " "), strings.Join(c.Scopes, " "), strings.Join(c.GrantTypes, " "), c.CreatedAt.UTC())
+	if s.Dialect.IsUniqueViolation(err) {
+		return ErrConflict
+	}
+	return wrap(err)
+}
+
+func (s *SQL) OAuthClient(ctx context.Context, id string) (*OAuthClient, error) {
+	var c OAuthClient
+	err := s.read(ctx, "", func(row *sql.Row) error {
+		return scanOAuthClient(row, &c)
+	}, "SELECT "+oauthClientColumns+" FROM oauth_clients WHERE id=?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	return &c, nil
+}
+
+func (s *SQL) OAuthClients(ctx context.Context) ([]OAuthClient, error) {
+	clients := []OAuthClient{}
+	err := s.readRows(ctx, "", func(rows *sql.Rows) error {
+		var c OAuthClient
+		if err := scanOAuthClient(rows, &c); err != nil {
+			return err
+		}
+		clients = append(clients, c)
+		return nil
+	}, "SELECT "+oauthClientColumns+" FROM oauth_clients ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	return clients, nil
+}
+
+func (s *SQL) DeleteOAuthClient(ctx context.Context, id string) error {
+	return s.tx(ctx, "", func(tx *sql.Tx) error {
+		for _, table := range []string{"oauth_codes", "oauth_device_codes"} {
+			if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM "+table+" WHERE client_id=?"), id); err != nil {
+				return wrap(err)
+			}
+		}
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM oauth_clients WHERE id=?"), id)
+		if err != nil {
+			return wrap(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *SQL) CreateAuthorizationCode(ctx context.Context, email string, c AuthorizationCode) error {
+	authTime := sql.NullTime{Time: c.AuthTime.UTC(), Valid: !c.AuthTime.IsZero()}
+	nonce := sql.NullString{String: c.Nonce, Valid: c.Nonce != ""}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, nonce, code_challenge, auth_time, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)"),
+			c.Hash, c.ClientID, u.ID, c.RedirectURI, strings.Join(c.Scopes, " "), nonce, c.CodeChallenge, authTime, c.ExpiresAt.UTC())
+		return wrap(err)
+	})
+}
+
+// RedeemAuthorizationCode deletes the code as it reads it: of two requests
+// racing to redeem one, only the one whose delete takes the row wins.
+// Expired codes are deleted too, which is how they are cleaned up.
+func (s *SQL) RedeemAuthorizationCode(ctx context.Context, hash string, now time.Time) (*AuthorizationCode, error) {
+	var c AuthorizationCode
+	err := s.tx(ctx, "", func(tx *sql.Tx) error {
+		var (
+			scopes   string
+			nonce    sql.NullString
+			authTime sql.NullTime
+		)
+		err := tx.QueryRowContext(ctx, s.Dialect.Rebind(
+			"SELECT c.code_hash, c.client_id, c.redirect_uri, c.scopes, c.nonce, c.code_challenge, c.auth_time, c.expires_at, u.id, u.email FROM oauth_codes c JOIN users u ON u.id = c.user_id WHERE c.code_hash=?"+s.forUpdate()), hash).
+			Scan(&c.Hash, &c.ClientID, &c.RedirectURI, &scopes, &nonce, &c.CodeChallenge, &authTime, &c.ExpiresAt, &c.UserID, &c.Email)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		c.Scopes, c.Nonce, c.AuthTime = strings.Fields(scopes), nonce.String, authTime.Time
+
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM oauth_codes WHERE code_hash=? OR expires_at<=?"), hash, now.UTC())
+		if err != nil {
+			return wrap(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(c.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	if c.Email, err = s.Cipher.Decrypt("email", c.Email); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// RevokeOAuthToken also deletes the records of tokens that have expired,
+// which is how they are cleaned up.
+func (s *SQL) RevokeOAuthToken(ctx context.Context, id string, expiresAt, now time.Time) error {
+	if _, err := s.exec(ctx, "", "DELETE FROM oauth_revocations WHERE expires_at<=?", now.UTC()); err != nil {
+		return wrap(err)
+	}
+	_, err := s.exec(ctx, "", "INSERT INTO oauth_revocations (jti, expires_at) VALUES (?, ?)", id, expiresAt.UTC())
+	if s.Dialect.IsUniqueViolation(err) {
+		return nil
+	}
+	return wrap(err)
+}
+
+// OAuthTokenRevoked reads the primary: a replica could still answer that
+// a token just revoked is good.
+func (s *SQL) OAuthTokenRevoked(ctx context.Context, id string) (bool, error) {
+	var n int
+	err := s.DB.QueryRowContext(ctx, s.Dialect.Rebind("SELECT COUNT(*) FROM oauth_revocations WHERE jti=?"), id).Scan(&n)
+	if err != nil {
+		return false, wrap(err)
+	}
+	return n > 0, nil
+}
+
+const deviceCodeColumns = "device_code_hash, user_code_hash, client_id, scopes, status, COALESCE(user_id, 0), auth_time, poll_interval, last_polled_at, expires_at"
+
+func scanDeviceCode(row rowScanner, c *DeviceCode) error {
+	var (
+		scopes             string
+		authTime, polledAt sql.NullTime
+		interval           int
+	)
+	if err := row.Scan(&c.Hash, &c.UserCodeHash, &c.ClientID, &scopes, &c.Status, &c.UserID, &authTime, &interval, &polledAt, &c.ExpiresAt); err != nil {
+		return err
+	}
+	c.Scopes, c.AuthTime, c.LastPolledAt = strings.Fields(scopes), authTime.Time, polledAt.Time
+	c.Interval = time.Duration(interval) * time.Second
+	return nil
+}
+
+func (s *SQL) CreateDeviceCode(ctx context.Context, c DeviceCode, now time.Time) error {
+	if _, err := s.exec(ctx, "", "DELETE FROM oauth_device_codes WHERE expires_at<=?", now.UTC()); err != nil {
+		return wrap(err)
+	}
+	_, err := s.exec(ctx, "", "INSERT INTO oauth_device_codes (device_code_hash, user_code_hash, client_id, scopes, status, poll_interval, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		c.Hash, c.UserCodeHash, c.ClientID, strings.Join(c.Scopes, " "), DevicePending, int(c.Interval/time.Second), c.ExpiresAt.UTC())
+	if s.Dialect.IsUniqueViolation(err) {
+		return ErrConflict
+	}
+	return wrap(err)
+}
+
+// PendingDeviceCode reads the primary: the user enters the code moments
+// after the device asked for it, sooner than a replica may have it.
+func (s *SQL) PendingDeviceCode(ctx context.Context, userCodeHash string, now time.Time) (*DeviceCode, error) {
+	var c DeviceCode
+	err := scanDeviceCode(s.DB.QueryRowContext(ctx, s.Dialect.Rebind("SELECT "+deviceCodeColumns+" FROM oauth_device_codes WHERE user_code_hash=?"), userCodeHash), &c)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err := c.pending(now); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// pending returns the error for deciding c at now, if any.
+func (c *DeviceCode) pending(now time.Time) error {
+	if c.Status != DevicePending {
+		return ErrNotFound
+	}
+	if !now.Before(c.ExpiresAt) {
+		return ErrTokenExpired
+	}
+	return nil
+}
+
+func (s *SQL) DecideDeviceCode(ctx context.Context, userCodeHash, email string, approve bool, authTime, now time.Time) error {
+	status := DeviceDenied
+	if approve {
+		status = DeviceApproved
+	}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		var c DeviceCode
+		err = scanDeviceCode(tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT "+deviceCodeColumns+" FROM oauth_device_codes WHERE user_code_hash=?"+s.forUpdate()), userCodeHash), &c)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		if err := c.pending(now); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE oauth_device_codes SET status=?, user_id=?, auth_time=? WHERE device_code_hash=?"),
+			status, u.ID, sql.NullTime{Time: authTime.UTC(), Valid: !authTime.IsZero()}, c.Hash)
+		return wrap(err)
+	})
+}
+
+// PollDeviceCode deletes decided and expired requests as it reads them,
+// as RedeemAuthorizationCode does codes.
+func (s *SQL) PollDeviceCode(ctx context.Context, hash string, now time.Time) (*DeviceCode, error) {
+	var c DeviceCode
+	err := s.tx(ctx, "", func(tx *sql.Tx) error {
+		err := scanDeviceCode(tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT "+deviceCodeColumns+" FROM oauth_device_codes WHERE device_code_hash=?"+s.forUpdate()), hash), &c)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		if c.Status != DevicePending || !now.Before(c.ExpiresAt) {
+			res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM oauth_device_codes WHERE device_code_hash=?"), hash)
+			if err != nil {
+				return wrap(err)
+			}
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				return ErrNotFound
+			}
+			return nil
+		}
+		if c.SlowDown = !c.LastPolledAt.IsZero() && now.Sub(c.LastPolledAt) < c.Interval; c.SlowDown {
+			c.Interval += 5 * time.Second
+		}
+		c.LastPolledAt = now
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE oauth_device_codes SET last_polled_at=?, poll_interval=? WHERE device_code_hash=?"),
+			now.UTC(), int(c.Interval/time.Second), hash)
+		return wrap(err)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !now.Before(c.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	return &c, nil
+}
@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"ccz/password"
+)
+
+// addPasswordHistory records hash as the user's newest password.
+func (s *SQL) addPasswordHistory(ctx context.Context, tx *sql.Tx, userID int64, hash string, at time.Time) error {
+	_, err := tx.ExecContext(ctx, s.Dialect.Rebind("INSERT INTO password_history (user_id, password_hash, created_at) VALUES (?, ?, ?)"),
+		userID, hash, at.UTC())
+	return wrap(err)
+}
+
+// rehash replaces a stored password Verify flagged with a fresh hash of
+// pw. A password kept in plain text from before hashing also starts the
+// user's history. Nothing changes if the password was changed meanwhile,
+// or if it is too long to hash, which only passwords from before the
+// policy can be.
+func (s *SQL) rehash(ctx context.Context, email string, userID int64, stored, pw string) error {
+	if len(pw) > password.MaxBytes {
+		return nil
+	}
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET password=? WHERE id=? AND password=?"), hash, userID, stored)
+		if err != nil {
+			return wrap(err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 || password.IsHash(stored) {
+			return nil
+		}
+		return s.addPasswordHistory(ctx, tx, userID, hash, time.Now())
+	})
+}
+
+func (s *SQL) SetPassword(ctx context.Context, email, pw string, revokeBefore time.Time) error {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		// The profile shows has_password, so a first password changes it.
+		bump := 0
+		if !u.HasPassword {
+			bump = 1
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET password=?, sessions_revoked_at=?, version=version+? WHERE id=?"),
+			hash, revokeBefore.UTC(), bump, u.ID)
+		if err != nil {
+			return wrap(err)
+		}
+		return s.addPasswordHistory(ctx, tx, u.ID, hash, time.Now())
+	})
+}
+
+func (s *SQL) SessionsRevokedAt(ctx context.Context, email string) (time.Time, error) {
+	var revokedAt sql.NullTime
+	err := s.read(ctx, email, func(row *sql.Row) error {
+		return row.Scan(&revokedAt)
+	}, "SELECT sessions_revoked_at FROM users WHERE "+byEmail, s.emailIndexes(email)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrNotFound
+	}
+	if err != nil {
+		return time.Time{}, wrap(err)
+	}
+	return revokedAt.Time, nil
+}
+
+func (s *SQL) PasswordHistory(ctx context.Context, email string, limit int) ([]string, error) {
+	hashes := []string{}
+	err := s.readRows(ctx, email, func(rows *sql.Rows) error {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+		return nil
+	}, "SELECT h.password_hash FROM password_history h JOIN users u ON u.id = h.user_id WHERE u."+byEmail+" ORDER BY h.id DESC LIMIT ?",
+		append(s.emailIndexes(email), limit)...)
+	if err != nil {
+		return nil, err
+	}
+	return hashes, nil
+}
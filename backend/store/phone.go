@@ -0,0 +1,151 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The telephone a code was sent to is encrypted like the profile's; the
+// code itself is only stored as a hash.
+
+// resetPhoneVerification forgets that the user's telephone was verified,
+// and any code sent to it, after the number changes.
+func (s *SQL) resetPhoneVerification(ctx context.Context, tx *sql.Tx, userID int64) error {
+	if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET telephone_verified_at=NULL WHERE id=?"), userID); err != nil {
+		return wrap(err)
+	}
+	_, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM phone_challenges WHERE user_id=?"), userID)
+	return wrap(err)
+}
+
+// loadChallenge returns the user's pending code inside tx, nil when there
+// is none.
+func (s *SQL) loadChallenge(ctx context.Context, tx *sql.Tx, userID int64) (*PhoneChallenge, error) {
+	var c PhoneChallenge
+	err := tx.QueryRowContext(ctx, s.Dialect.Rebind(
+		"SELECT telephone, code_hash, attempts, sends, window_start, sent_at, expires_at FROM phone_challenges WHERE user_id=?"), userID).
+		Scan(&c.Telephone, &c.CodeHash, &c.Attempts, &c.Sends, &c.WindowStart, &c.SentAt, &c.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if c.Telephone, err = s.Cipher.Decrypt("telephone", c.Telephone); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+func (s *SQL) StartPhoneChallenge(ctx context.Context, email string, c PhoneChallenge, limits PhoneLimits) (time.Duration, error) {
+	var retryAfter time.Duration
+	err := s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		prev, err := s.loadChallenge(ctx, tx, current.ID)
+		if err != nil {
+			return err
+		}
+		if retryAfter = throttle(prev, &c, limits); retryAfter > 0 {
+			return ErrThrottled
+		}
+
+		telephone, err := s.Cipher.Encrypt("telephone", c.Telephone)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM phone_challenges WHERE user_id=?"), current.ID); err != nil {
+			return wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"INSERT INTO phone_challenges (user_id, telephone, code_hash, attempts, sends, window_start, sent_at, expires_at) VALUES (?, ?, ?, 0, ?, ?, ?, ?)"),
+			current.ID, telephone, c.CodeHash, c.Sends, c.WindowStart.UTC(), c.SentAt.UTC(), c.ExpiresAt.UTC())
+		return wrap(err)
+	})
+	return retryAfter, err
+}
+
+// throttle checks whether c may replace the pending challenge prev under
+// limits. It returns how long to wait, or 0 after filling in c's send
+// window.
+func throttle(prev, c *PhoneChallenge, limits PhoneLimits) time.Duration {
+	now := c.SentAt
+	c.Sends, c.WindowStart = 1, now
+	if prev == nil {
+		return 0
+	}
+	if next := prev.SentAt.Add(limits.ResendAfter); now.Before(next) {
+		return next.Sub(now)
+	}
+	if end := prev.WindowStart.Add(limits.Window); now.Before(end) {
+		if prev.Sends >= limits.MaxSends {
+			return end.Sub(now)
+		}
+		c.Sends, c.WindowStart = prev.Sends+1, prev.WindowStart
+	}
+	return 0
+}
+
+// checkCode decides the outcome of entering a code for the pending
+// challenge c of a user whose telephone is now telephone. The returned
+// error is the outcome, nil for a match; wrong reports whether it counts
+// as a failed attempt.
+func checkCode(c *PhoneChallenge, telephone, codeHash string, limits PhoneLimits, now time.Time) (outcome error, wrong bool) {
+	switch {
+	case c == nil || c.Telephone != telephone:
+		return ErrNotFound, false
+	case c.Attempts >= limits.MaxAttempts:
+		return ErrTooManyAttempts, false
+	case !now.Before(c.ExpiresAt):
+		return ErrCodeExpired, false
+	case subtle.ConstantTimeCompare([]byte(c.CodeHash), []byte(codeHash)) != 1:
+		if c.Attempts+1 >= limits.MaxAttempts {
+			return ErrTooManyAttempts, true
+		}
+		return ErrCodeMismatch, true
+	}
+	return nil, false
+}
+
+func (s *SQL) ConfirmPhone(ctx context.Context, email, codeHash string, limits PhoneLimits, now time.Time) error {
+	// A wrong code must still be counted, so the transaction commits and
+	// the outcome is returned afterwards.
+	var outcome error
+	err := s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		c, err := s.loadChallenge(ctx, tx, current.ID)
+		if err != nil {
+			return err
+		}
+		var wrong bool
+		outcome, wrong = checkCode(c, current.Telephone, codeHash, limits, now)
+		switch {
+		case wrong:
+			_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE phone_challenges SET attempts=attempts+1 WHERE user_id=?"), current.ID)
+			return wrap(err)
+		case outcome != nil:
+			return nil
+		}
+
+		// Verifying changes what the profile shows, so it gets a new
+		// version like any other change.
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET telephone_verified_at=?, version=version+1 WHERE id=?"), now.UTC(), current.ID)
+		if err != nil {
+			return wrap(err)
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM phone_challenges WHERE user_id=?"), current.ID)
+		return wrap(err)
+	})
+	if err != nil {
+		return err
+	}
+	return outcome
+}
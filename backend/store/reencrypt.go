@@ -0,0 +1,148 @@
+package store
+
+import (
+	"context"
+	"strings"
+)
+
+// encryptedTable lists the columns of a table that pass through the Cipher.
+type encryptedTable struct {
+	name    string
+	columns []string
+	// blindIndex is set for users, whose email_bidx must be kept in step
+	// with the index key.
+	blindIndex bool
+}
+
+var (
+	usersTable        = encryptedTable{"users", []string{"email", "full_name", "telephone", "telephone_display"}, true}
+	revisionsTable    = encryptedTable{"profile_revisions", []string{"old_full_name", "old_telephone", "new_full_name", "new_telephone", "actor", "old_attributes", "new_attributes"}, false}
+	attributesTable   = encryptedTable{"profile_attributes", []string{"value"}, false}
+	challengesTable   = encryptedTable{"phone_challenges", []string{"telephone"}, false}
+	emailChangesTable = encryptedTable{"email_changes", []string{"old_email", "new_email"}, false}
+)
+
+// Reencrypt rewrites up to limit users with an id above afterID so their
+// encrypted columns are sealed with the current key and their blind index
+// matches the cipher. It returns the last id it looked at, 0 once there are
+// no more rows, and how many rows it changed. With dryRun set nothing is
+// written.
+func (s *SQL) Reencrypt(ctx context.Context, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	return s.reencrypt(ctx, usersTable, afterID, limit, dryRun)
+}
+
+// ReencryptRevisions is Reencrypt for the profile history.
+func (s *SQL) ReencryptRevisions(ctx context.Context, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	return s.reencrypt(ctx, revisionsTable, afterID, limit, dryRun)
+}
+
+// ReencryptAttributes is Reencrypt for custom attribute values.
+func (s *SQL) ReencryptAttributes(ctx context.Context, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	return s.reencrypt(ctx, attributesTable, afterID, limit, dryRun)
+}
+
+// ReencryptPhoneChallenges is Reencrypt for pending phone codes.
+func (s *SQL) ReencryptPhoneChallenges(ctx context.Context, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	return s.reencrypt(ctx, challengesTable, afterID, limit, dryRun)
+}
+
+// ReencryptEmailChanges is Reencrypt for email change requests.
+func (s *SQL) ReencryptEmailChanges(ctx context.Context, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	return s.reencrypt(ctx, emailChangesTable, afterID, limit, dryRun)
+}
+
+type encryptedRow struct {
+	id     int64
+	values []string
+	bidx   string
+}
+
+func (s *SQL) reencrypt(ctx context.Context, table encryptedTable, afterID int64, limit int, dryRun bool) (int64, int, error) {
+	selects := make([]string, 0, len(table.columns)+1)
+	for _, c := range table.columns {
+		selects = append(selects, "COALESCE("+c+", '')")
+	}
+	if table.blindIndex {
+		selects = append(selects, "COALESCE(email_bidx, '')")
+	}
+
+	rows, err := s.DB.QueryContext(ctx, s.Dialect.Rebind(
+		"SELECT id, "+strings.Join(selects, ", ")+" FROM "+table.name+" WHERE id > ? ORDER BY id LIMIT ?"),
+		afterID, limit)
+	if err != nil {
+		return 0, 0, wrap(err)
+	}
+	var batch []encryptedRow
+	for rows.Next() {
+		r := encryptedRow{values: make([]string, len(table.columns))}
+		dest := []any{&r.id}
+		for i := range r.values {
+			dest = append(dest, &r.values[i])
+		}
+		if table.blindIndex {
+			dest = append(dest, &r.bidx)
+		}
+		if err := rows.Scan(dest...); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		batch = append(batch, r)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, 0, wrap(err)
+	}
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	sets := make([]string, 0, len(table.columns)+1)
+	for _, c := range table.columns {
+		sets = append(sets, c+"=?")
+	}
+	if table.blindIndex {
+		sets = append(sets, "email_bidx=?")
+	}
+	update := s.Dialect.Rebind("UPDATE " + table.name + " SET " + strings.Join(sets, ", ") + " WHERE id=?")
+
+	changed := 0
+	for _, r := range batch {
+		plain := make([]string, len(r.values))
+		stale := false
+		for i, c := range table.columns {
+			if plain[i], err = s.Cipher.Decrypt(c, r.values[i]); err != nil {
+				return r.id, changed, err
+			}
+			stale = stale || s.Cipher.Stale(r.values[i])
+		}
+		// email is always the first column of users.
+		var bidx string
+		if table.blindIndex {
+			bidx = s.Cipher.BlindIndex(plain[0])
+			stale = stale || bidx != r.bidx
+		}
+		if !stale {
+			continue
+		}
+		changed++
+		if dryRun {
+			continue
+		}
+
+		args := make([]any, 0, len(sets)+1)
+		for i, c := range table.columns {
+			sealed, err := s.Cipher.Encrypt(c, plain[i])
+			if err != nil {
+				return r.id, changed, err
+			}
+			args = append(args, sealed)
+		}
+		if table.blindIndex {
+			args = append(args, bidx)
+		}
+		if _, err := s.DB.ExecContext(ctx, update, append(args, r.id)...); err != nil {
+			return r.id, changed, wrap(err)
+		}
+	}
+	return batch[len(batch)-1].id, changed, nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// externalUpdate is update with the fields it leaves empty taken from u:
+// an identity provider or directory that does not send a field does not
+// clear it.
+func (u *User) externalUpdate(update ProfileUpdate) ProfileUpdate {
+	if update.FullName == "" {
+		update.FullName = u.FullName
+	}
+	if update.Telephone == "" {
+		update.Telephone = u.Telephone
+	}
+	return update
+}
+
+const samlTenantColumns = "id, name, metadata, email_attribute, full_name_attribute, telephone_attribute, created_at, updated_at"
+
+func scanSAMLTenant(row rowScanner, t *SAMLTenant) error {
+	return row.Scan(&t.ID, &t.Name, &t.Metadata, &t.EmailAttribute, &t.FullNameAttribute, &t.TelephoneAttribute, &t.CreatedAt, &t.UpdatedAt)
+}
+
+func (s *SQL) PutSAMLTenant(ctx context.Context, t SAMLTenant) error {
+	return s.tx(ctx, "", func(tx *sql.Tx) error {
+		for _, domain := range t.Domains {
+			var owner string
+			err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT tenant_id FROM saml_domains WHERE domain=?"), domain).Scan(&owner)
+			if err == nil && owner != t.ID {
+				return ErrConflict
+			}
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				return wrap(err)
+			}
+		}
+
+		var n int
+		if err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT COUNT(*) FROM saml_tenants WHERE id=?"+s.forUpdate()), t.ID).Scan(&n); err != nil {
+			return wrap(err)
+		}
+		query := "UPDATE saml_tenants SET name=?, metadata=?, email_attribute=?, full_name_attribute=?, telephone_attribute=?, updated_at=? WHERE id=?"
+		args := []any{t.Name, t.Metadata, t.EmailAttribute, t.FullNameAttribute, t.TelephoneAttribute, t.UpdatedAt.UTC(), t.ID}
+		if n == 0 {
+			query = "INSERT INTO saml_tenants (name, metadata, email_attribute, full_name_attribute, telephone_attribute, updated_at, id, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)"
+			args = append(args, t.CreatedAt.UTC())
+		}
+		if _, err := tx.ExecContext(ctx, s.Dialect.Rebind(query), args...); err != nil {
+			return wrap(err)
+		}
+
+		if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM saml_domains WHERE tenant_id=?"), t.ID); err != nil {
+			return wrap(err)
+		}
+		for _, domain := range t.Domains {
+			_, err := tx.ExecContext(ctx, s.Dialect.Rebind("INSERT INTO saml_domains (domain, tenant_id) VALUES (?, ?)"), domain, t.ID)
+			if s.Dialect.IsUniqueViolation(err) {
+				return ErrConflict
+			}
+			if err != nil {
+				return wrap(err)
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQL) SAMLTenant(ctx context.Context, id string) (*SAMLTenant, error) {
+	var t SAMLTenant
+	err := s.read(ctx, "", func(row *sql.Row) error {
+		return scanSAMLTenant(row, &t)
+	}, "SELECT "+samlTenantColumns+" FROM saml_tenants WHERE id=?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	domains, err := s.samlDomains(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	t.Domains = domains[id]
+	return &t, nil
+}
+
+func (s *SQL) SAMLTenantByDomain(ctx context.Context, domain string) (*SAMLTenant, error) {
+	var id string
+	err := s.read(ctx, "", func(row *sql.Row) error {
+		return row.Scan(&id)
+	}, "SELECT tenant_id FROM saml_domains WHERE domain=?", domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	return s.SAMLTenant(ctx, id)
+}
+
+func (s *SQL) SAMLTenants(ctx context.Context) ([]SAMLTenant, error) {
+	tenants := []SAMLTenant{}
+	err := s.readRows(ctx, "", func(rows *sql.Rows) error {
+		var t SAMLTenant
+		if err := scanSAMLTenant(rows, &t); err != nil {
+			return err
+		}
+		tenants = append(tenants, t)
+		return nil
+	}, "SELECT "+samlTenantColumns+" FROM saml_tenants ORDER BY name, id")
+	if err != nil {
+		return nil, err
+	}
+	domains, err := s.samlDomains(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	for i := range tenants {
+		tenants[i].Domains = domains[tenants[i].ID]
+	}
+	return tenants, nil
+}
+
+// samlDomains returns the domains of the tenant with id, or of every
+// tenant when id is empty, by tenant and in order.
+func (s *SQL) samlDomains(ctx context.Context, id string) (map[string][]string, error) {
+	query, args := "SELECT tenant_id, domain FROM saml_domains ORDER BY domain", []any{}
+	if id != "" {
+		query, args = "SELECT tenant_id, domain FROM saml_domains WHERE tenant_id=? ORDER BY domain", []any{id}
+	}
+	domains := map[string][]string{}
+	err := s.readRows(ctx, "", func(rows *sql.Rows) error {
+		var tenant, domain string
+		if err := rows.Scan(&tenant, &domain); err != nil {
+			return err
+		}
+		domains[tenant] = append(domains[tenant], domain)
+		return nil
+	}, query, args...)
+	return domains, err
+}
+
+func (s *SQL) DeleteSAMLTenant(ctx context.Context, id string) error {
+	return s.tx(ctx, "", func(tx *sql.Tx) error {
+		for _, table := range []string{"saml_requests", "saml_domains"} {
+			if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM "+table+" WHERE tenant_id=?"), id); err != nil {
+				return wrap(err)
+			}
+		}
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM saml_tenants WHERE id=?"), id)
+		if err != nil {
+			return wrap(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+func (s *SQL) CreateSAMLRequest(ctx context.Context, id, tenant string, expiresAt, now time.Time) error {
+	if _, err := s.exec(ctx, "", "DELETE FROM saml_requests WHERE expires_at<=?", now.UTC()); err != nil {
+		return wrap(err)
+	}
+	_, err := s.exec(ctx, "", "INSERT INTO saml_requests (id, tenant_id, expires_at) VALUES (?, ?, ?)", id, tenant, expiresAt.UTC())
+	return wrap(err)
+}
+
+// RedeemSAMLRequest deletes the request as it reads it, as
+// RedeemAuthorizationCode does codes.
+func (s *SQL) RedeemSAMLRequest(ctx context.Context, id string, now time.Time) (string, error) {
+	var (
+		tenant    string
+		expiresAt time.Time
+	)
+	err := s.tx(ctx, "", func(tx *sql.Tx) error {
+		err := tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT tenant_id, expires_at FROM saml_requests WHERE id=?"+s.forUpdate()), id).Scan(&tenant, &expiresAt)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM saml_requests WHERE id=?"), id)
+		if err != nil {
+			return wrap(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if !now.Before(expiresAt) {
+		return "", ErrTokenExpired
+	}
+	return tenant, nil
+}
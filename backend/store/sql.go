@@ -0,0 +1,384 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"ccz/db"
+	"ccz/password"
+	"ccz/pii"
+)
+
+// SQL is the Store backed by a MySQL, PostgreSQL or SQLite database. When
+// Router is set, read-only lookups may be served by a replica. Email, full
+// name and telephone pass through Cipher on their way in and out, and users
+// are looked up by the email's blind index.
+type SQL struct {
+	DB      *sql.DB
+	Dialect db.Dialect
+	Router  *db.Router
+	Cipher  pii.Cipher
+}
+
+func NewSQL(conn *sql.DB, dialect db.Dialect) *SQL {
+	return &SQL{DB: conn, Dialect: dialect, Cipher: pii.Plain{}}
+}
+
+// wrap tags connectivity failures with ErrUnavailable so callers can tell
+// an unreachable database apart from a failed query.
+func wrap(err error) error {
+	if db.IsUnavailable(err) {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	return err
+}
+
+// exec runs a write on the primary. key identifies whose data changed so
+// their next reads avoid possibly stale replicas.
+func (s *SQL) exec(ctx context.Context, key, query string, args ...any) (sql.Result, error) {
+	conn := s.DB
+	if s.Router != nil {
+		conn = s.Router.Writer(key)
+	}
+	return conn.ExecContext(ctx, s.Dialect.Rebind(query), args...)
+}
+
+// read runs a single-row read-only query, on a replica when one is usable,
+// and retries on the primary if that replica cannot be reached.
+func (s *SQL) read(ctx context.Context, key string, scan func(*sql.Row) error, query string, args ...any) error {
+	query = s.Dialect.Rebind(query)
+	if s.Router == nil {
+		return scan(s.DB.QueryRowContext(ctx, query, args...))
+	}
+
+	conn := s.Router.Reader(key)
+	err := scan(conn.QueryRowContext(ctx, query, args...))
+	if conn != s.DB && db.IsUnavailable(err) && ctx.Err() == nil {
+		s.Router.MarkFailed(conn)
+		err = scan(s.DB.QueryRowContext(ctx, query, args...))
+	}
+	return err
+}
+
+// readRows is read for multi-row queries; scan is called once per row.
+func (s *SQL) readRows(ctx context.Context, key string, scan func(*sql.Rows) error, query string, args ...any) error {
+	query = s.Dialect.Rebind(query)
+	conn := s.DB
+	if s.Router != nil {
+		conn = s.Router.Reader(key)
+	}
+	rows, err := conn.QueryContext(ctx, query, args...)
+	if conn != s.DB && db.IsUnavailable(err) && ctx.Err() == nil {
+		s.Router.MarkFailed(conn)
+		rows, err = s.DB.QueryContext(ctx, query, args...)
+	}
+	if err != nil {
+		return wrap(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return wrap(rows.Err())
+}
+
+// tx runs fn in a transaction on the primary, committing if it returns nil.
+func (s *SQL) tx(ctx context.Context, key string, fn func(*sql.Tx) error) error {
+	conn := s.DB
+	if s.Router != nil {
+		conn = s.Router.Writer(key)
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return wrap(err)
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return wrap(tx.Commit())
+}
+
+// forUpdate locks the selected rows until the transaction ends. SQLite
+// has no row locks; its transactions already hold the database write lock.
+func (s *SQL) forUpdate() string {
+	if s.Dialect == db.SQLite {
+		return ""
+	}
+	return " FOR UPDATE"
+}
+
+// userColumns are the users columns scanUser reads, in its order.
+const userColumns = "id, email, COALESCE(full_name, ''), COALESCE(telephone, ''), COALESCE(telephone_display, ''), telephone_verified_at, COALESCE(provider, ''), CASE WHEN COALESCE(password, '') = '' THEN 0 ELSE 1 END, role, COALESCE(avatar, ''), version"
+
+func scanUser(row rowScanner, u *User) error {
+	var verifiedAt sql.NullTime
+	err := row.Scan(&u.ID, &u.Email, &u.FullName, &u.Telephone, &u.TelephoneDisplay, &verifiedAt, &u.Provider, &u.HasPassword, &u.Role, &u.Avatar, &u.Version)
+	u.TelephoneVerifiedAt = verifiedAt.Time
+	return err
+}
+
+// decryptUser opens the encrypted columns of u in place.
+func (s *SQL) decryptUser(u *User) error {
+	for column, field := range map[string]*string{
+		"email":             &u.Email,
+		"full_name":         &u.FullName,
+		"telephone":         &u.Telephone,
+		"telephone_display": &u.TelephoneDisplay,
+	} {
+		plain, err := s.Cipher.Decrypt(column, *field)
+		if err != nil {
+			return fmt.Errorf("decrypt %s: %w", column, err)
+		}
+		*field = plain
+	}
+	return nil
+}
+
+// byEmail matches the user with an email given by emailIndexes. Rows
+// indexed before a key file was configured keep the plain normalised email
+// as their index until cmd/reencrypt rewrites them, so lookups try both.
+const byEmail = "email_bidx IN (?, ?)"
+
+// emailIndexes are the arguments of byEmail.
+func (s *SQL) emailIndexes(email string) []any {
+	return []any{s.Cipher.BlindIndex(email), pii.Normalize(email)}
+}
+
+func (s *SQL) GetByEmail(ctx context.Context, email string) (*User, error) {
+	var u User
+	err := s.read(ctx, email, func(row *sql.Row) error {
+		return scanUser(row, &u)
+	}, "SELECT "+userColumns+" FROM users WHERE "+byEmail, s.emailIndexes(email)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err := s.decryptUser(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQL) GetByID(ctx context.Context, id int64) (*User, error) {
+	var u User
+	err := s.read(ctx, "", func(row *sql.Row) error {
+		return scanUser(row, &u)
+	}, "SELECT "+userColumns+" FROM users WHERE id=?", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if err := s.decryptUser(&u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (s *SQL) UpdateProfile(ctx context.Context, email string, update ProfileUpdate, change Change) error {
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return s.setProfile(ctx, tx, current, update, change, 0)
+	})
+}
+
+func (s *SQL) CreateLocal(ctx context.Context, email, pw string) error {
+	hash, err := password.Hash(pw)
+	if err != nil {
+		return err
+	}
+	encEmail, err := s.Cipher.Encrypt("email", email)
+	if err != nil {
+		return err
+	}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		// An address someone changed away from stays theirs while they can
+		// still revert the change.
+		taken, err := s.emailTaken(ctx, tx, email, 0, time.Now())
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("INSERT INTO users (email, email_bidx, password, provider) VALUES (?, ?, ?, ?)"),
+			encEmail, s.Cipher.BlindIndex(email), hash, "local")
+		if s.Dialect.IsUniqueViolation(err) {
+			return ErrConflict
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		return s.addPasswordHistory(ctx, tx, u.ID, hash, time.Now())
+	})
+}
+
+func (s *SQL) Authenticate(ctx context.Context, email, pw string) (*User, error) {
+	var id int64
+	var stored sql.NullString
+	err := s.read(ctx, email, func(row *sql.Row) error {
+		return row.Scan(&id, &stored)
+	}, "SELECT id, password FROM users WHERE "+byEmail, s.emailIndexes(email)...)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	ok, rehash := password.Verify(stored.String, pw)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if rehash {
+		if err := s.rehash(ctx, email, id, stored.String, pw); err != nil {
+			return nil, err
+		}
+	}
+	return s.GetByEmail(ctx, email)
+}
+
+func (s *SQL) UpsertGoogle(ctx context.Context, email, fullName string, change Change) (bool, error) {
+	encEmail, err := s.Cipher.Encrypt("email", email)
+	if err != nil {
+		return false, err
+	}
+	encName, err := s.Cipher.Encrypt("full_name", fullName)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err == nil {
+			// Existing users only get their name refreshed, which is a
+			// profile change like any other.
+			update := ProfileUpdate{FullName: fullName, Telephone: current.Telephone}
+			return s.setProfile(ctx, tx, current, update, change, 0)
+		}
+		if !errors.Is(err, ErrNotFound) {
+			return err
+		}
+		taken, err := s.emailTaken(ctx, tx, email, 0, time.Now())
+		if err != nil {
+			return err
+		}
+		if taken {
+			return ErrConflict
+		}
+
+		query := "INSERT INTO users (email, email_bidx, full_name, provider) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE full_name = VALUES(full_name)"
+		if s.Dialect != db.MySQL {
+			query = "INSERT INTO users (email, email_bidx, full_name, provider) VALUES (?, ?, ?, ?) ON CONFLICT (email_bidx) DO UPDATE SET full_name = excluded.full_name"
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(query), encEmail, s.Cipher.BlindIndex(email), encName, "google")
+		created = err == nil
+		return wrap(err)
+	})
+	return created, err
+}
+
+func (s *SQL) UpsertSAML(ctx context.Context, email string, update ProfileUpdate, change Change) (bool, error) {
+	return s.upsertExternal(ctx, "saml", email, update, "", change)
+}
+
+func (s *SQL) UpsertLDAP(ctx context.Context, email string, update ProfileUpdate, role string, change Change) (bool, error) {
+	return s.upsertExternal(ctx, "ldap", email, update, role, change)
+}
+
+// upsertExternal creates the user of an external provider on their first
+// sign-in and syncs their profile, and their role unless role is empty,
+// on every one.
+func (s *SQL) upsertExternal(ctx context.Context, provider, email string, update ProfileUpdate, role string, change Change) (bool, error) {
+	encEmail, err := s.Cipher.Encrypt("email", email)
+	if err != nil {
+		return false, err
+	}
+
+	created := false
+	err = s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if errors.Is(err, ErrNotFound) {
+			taken, err := s.emailTaken(ctx, tx, email, 0, time.Now())
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrConflict
+			}
+			_, err = tx.ExecContext(ctx, s.Dialect.Rebind("INSERT INTO users (email, email_bidx, provider) VALUES (?, ?, ?)"),
+				encEmail, s.Cipher.BlindIndex(email), provider)
+			if s.Dialect.IsUniqueViolation(err) {
+				return ErrConflict
+			}
+			if err != nil {
+				return wrap(err)
+			}
+			if current, err = s.lockUser(ctx, tx, email); err != nil {
+				return err
+			}
+			created = true
+		} else if err != nil {
+			return err
+		}
+		// The directory decides who signs in to an account it takes over, so
+		// a password kept here would be a way in it cannot disable.
+		if provider == SourceLDAP && (current.Provider != provider || current.HasPassword) {
+			_, err := tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET provider=?, password=NULL, version=version+1 WHERE id=?"), provider, current.ID)
+			if err != nil {
+				return wrap(err)
+			}
+		}
+		// The role decides which attributes the profile shows.
+		if role != "" && role != current.Role {
+			if _, err := tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET role=?, version=version+1 WHERE id=?"), role, current.ID); err != nil {
+				return wrap(err)
+			}
+		}
+		// The first values are recorded like any later change, so the
+		// history shows where they came from.
+		return s.setProfile(ctx, tx, current, current.externalUpdate(update), change, 0)
+	})
+	return created, err
+}
+
+func (s *SQL) SetAvatar(ctx context.Context, email, id string) (string, error) {
+	var previous string
+	err := s.tx(ctx, email, func(tx *sql.Tx) error {
+		current, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		previous = current.Avatar
+		if previous == id {
+			return nil
+		}
+		var avatar any
+		if id != "" {
+			avatar = id
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind("UPDATE users SET avatar=?, version=version+1 WHERE id=?"), avatar, current.ID)
+		return wrap(err)
+	})
+	return previous, err
+}
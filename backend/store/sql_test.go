@@ -0,0 +1,389 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"ccz/db"
+	"ccz/password"
+	"ccz/pii"
+	"ccz/store"
+	"ccz/store/storetest"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestSQLite(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return storetest.SQLite(t)
+	})
+}
+
+// TestMySQL and TestPostgres run the conformance suite against real servers
+// when TEST_MYSQL_DSN / TEST_POSTGRES_DSN point at disposable databases.
+func TestMySQL(t *testing.T) {
+	runExternal(t, "TEST_MYSQL_DSN")
+}
+
+func TestPostgres(t *testing.T) {
+	runExternal(t, "TEST_POSTGRES_DSN")
+}
+
+func runExternal(t *testing.T, env string) {
+	dsn := os.Getenv(env)
+	if dsn == "" {
+		t.Skip(env + " not set")
+	}
+	s := storetest.Open(t, dsn)
+	storetest.Run(t, func(t *testing.T) store.Store {
+		for _, table := range []string{"users", "attribute_definitions"} {
+			if _, err := s.DB.Exec("DELETE FROM " + table); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return s
+	})
+}
+
+func TestSQL_Errors(t *testing.T) {
+	conn, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer conn.Close()
+	s := store.NewSQL(conn, db.MySQL)
+	ctx := context.Background()
+
+	// Signups first check that the address is not held for an email
+	// change revert.
+	expectFree := func() {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT COUNT.*FROM users").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(0))
+		mock.ExpectQuery("SELECT COUNT.*FROM email_changes").WillReturnRows(sqlmock.NewRows([]string{"n"}).AddRow(0))
+	}
+
+	t.Run("Duplicate Entry", func(t *testing.T) {
+		expectFree()
+		mock.ExpectExec("INSERT INTO users").
+			WithArgs("a@ex.com", "a@ex.com", sqlmock.AnyArg(), "local").
+			WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+		mock.ExpectRollback()
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Other Insert Failure", func(t *testing.T) {
+		expectFree()
+		mock.ExpectExec("INSERT INTO users").WillReturnError(sql.ErrConnDone)
+		mock.ExpectRollback()
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); !errors.Is(err, sql.ErrConnDone) {
+			t.Errorf("expected connection error, got %v", err)
+		}
+	})
+
+	t.Run("No Rows", func(t *testing.T) {
+		mock.ExpectQuery("SELECT id, email").WithArgs("none@ex.com", "none@ex.com").WillReturnError(sql.ErrNoRows)
+		if _, err := s.GetByEmail(ctx, "none@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Revision Failure Rolls Back Update", func(t *testing.T) {
+		mock.ExpectBegin()
+		mock.ExpectQuery("SELECT id, email.*FOR UPDATE").WithArgs("a@ex.com", "a@ex.com").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "email", "full_name", "telephone", "telephone_display", "telephone_verified_at", "provider", "has_password", "role", "avatar", "version"}).
+				AddRow(1, "a@ex.com", "Old", "", "", nil, "local", 1, "user", "", 1))
+		mock.ExpectExec("UPDATE users").WithArgs("New", "", "", 1).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("INSERT INTO profile_revisions").WillReturnError(errors.New("disk full"))
+		mock.ExpectRollback()
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "New"}, store.Change{}); err == nil {
+			t.Error("expected error")
+		}
+	})
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQL_Passwords(t *testing.T) {
+	s := storetest.SQLite(t)
+	ctx := context.Background()
+
+	t.Run("Stored Hashed", func(t *testing.T) {
+		if err := s.CreateLocal(ctx, "a@ex.com", "correct horse"); err != nil {
+			t.Fatal(err)
+		}
+		var stored string
+		if err := s.DB.QueryRow("SELECT password FROM users WHERE email_bidx=?", "a@ex.com").Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if !password.IsHash(stored) {
+			t.Errorf("expected a bcrypt hash, got %q", stored)
+		}
+	})
+
+	t.Run("Plain Text Upgraded", func(t *testing.T) {
+		_, err := s.DB.Exec("INSERT INTO users (email, email_bidx, password, provider) VALUES (?, ?, ?, ?)", "old@ex.com", "old@ex.com", "pass", "local")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Authenticate(ctx, "old@ex.com", "pass"); err != nil {
+			t.Fatalf("expected a legacy password to still sign in: %v", err)
+		}
+		var stored string
+		if err := s.DB.QueryRow("SELECT password FROM users WHERE email_bidx=?", "old@ex.com").Scan(&stored); err != nil {
+			t.Fatal(err)
+		}
+		if !password.IsHash(stored) {
+			t.Errorf("expected the password to be hashed on sign-in, got %q", stored)
+		}
+		if _, err := s.Authenticate(ctx, "old@ex.com", "pass"); err != nil {
+			t.Errorf("expected the upgraded hash to sign in: %v", err)
+		}
+		if hashes, err := s.PasswordHistory(ctx, "old@ex.com", 5); err != nil || len(hashes) != 1 || hashes[0] != stored {
+			t.Errorf("expected the upgrade to start the history, got %v, %v", hashes, err)
+		}
+	})
+}
+
+func TestSQL_ReplicaRouting(t *testing.T) {
+	primary := storetest.SQLite(t)
+	replica := storetest.SQLite(t)
+	ctx := context.Background()
+
+	// The replica is never written to, so which database answered can be
+	// told from the data.
+	for _, s := range []*store.SQL{primary, replica} {
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := replica.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Stale"}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := db.DefaultConfig()
+	cfg.ReadAfterWrite = time.Minute
+	r := &db.Replica{Name: "replica-0", DB: replica.DB}
+	primary.Router = db.NewRouter(primary.DB, db.SQLite, []*db.Replica{r}, cfg)
+	primary.Router.Check(ctx)
+
+	u, err := primary.GetByEmail(ctx, "a@ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FullName != "Stale" {
+		t.Errorf("expected read from replica, got %q", u.FullName)
+	}
+
+	if err := primary.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Fresh"}, store.Change{}); err != nil {
+		t.Fatal(err)
+	}
+	u, err = primary.GetByEmail(ctx, "a@ex.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.FullName != "Fresh" {
+		t.Errorf("expected read-after-write from primary, got %q", u.FullName)
+	}
+
+	down, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("error opening mock: %s", err)
+	}
+	defer down.Close()
+	mock.ExpectQuery("SELECT id, email").
+		WillReturnError(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+	r.DB = down
+
+	u, err = primary.GetByEmail(ctx, "b@ex.com")
+	if !errors.Is(err, store.ErrNotFound) {
+		t.Errorf("expected fallback to primary when replica is unreachable, got %v %v", u, err)
+	}
+	if primary.Router.Stats()[0].Healthy {
+		t.Error("expected unreachable replica to leave rotation")
+	}
+}
+
+func testKeyring(t *testing.T, versions ...int) *pii.Keyring {
+	t.Helper()
+	masters := map[int][]byte{}
+	for _, v := range versions {
+		masters[v] = bytes.Repeat([]byte{byte(v)}, 32)
+	}
+	k, err := pii.NewKeyring(bytes.Repeat([]byte{0xAA}, 32), masters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSQLite_Encrypted(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s := storetest.SQLite(t)
+		s.Cipher = testKeyring(t, 1)
+		return s
+	})
+
+	t.Run("Columns Are Ciphertext", func(t *testing.T) {
+		s := storetest.SQLite(t)
+		s.Cipher = testKeyring(t, 1)
+		ctx := context.Background()
+		if err := s.CreateLocal(ctx, "enc@example.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "enc@example.com", store.ProfileUpdate{FullName: "Enc User", Telephone: "555"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var email, bidx, name, phone string
+		err := s.DB.QueryRow("SELECT email, email_bidx, full_name, telephone FROM users").Scan(&email, &bidx, &name, &phone)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, v := range []string{email, name, phone} {
+			if !pii.IsEncrypted(v) {
+				t.Errorf("expected ciphertext, got %q", v)
+			}
+		}
+		if bidx == "enc@example.com" {
+			t.Error("expected keyed blind index")
+		}
+	})
+}
+
+// Rows written without a key, like those 0002_encrypt_pii indexes with the
+// plain email, stay reachable once a key file is configured and before
+// cmd/reencrypt has run.
+func TestSQL_KeyringBeforeReencrypt(t *testing.T) {
+	s := storetest.SQLite(t)
+	ctx := context.Background()
+	for _, email := range []string{"a@example.com", "b@example.com"} {
+		if err := s.CreateLocal(ctx, email, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Cipher = testKeyring(t, 1)
+
+	if u, err := s.GetByEmail(ctx, "A@example.com"); err != nil || u.Email != "a@example.com" {
+		t.Fatalf("expected the user found, got %+v, %v", u, err)
+	}
+	if _, err := s.Authenticate(ctx, "a@example.com", "pass"); err != nil {
+		t.Errorf("expected the user to sign in, got %v", err)
+	}
+	if err := s.CreateLocal(ctx, "a@example.com", "other"); !errors.Is(err, store.ErrConflict) {
+		t.Errorf("expected signing up again refused, got %v", err)
+	}
+	if created, err := s.UpsertGoogle(ctx, "a@example.com", "Al", store.Change{}); err != nil || created {
+		t.Errorf("expected Google sign-in to find the user, got %v, %v", created, err)
+	}
+	if created, err := s.UpsertLDAP(ctx, "b@example.com", store.ProfileUpdate{}, "", store.Change{}); err != nil || created {
+		t.Errorf("expected LDAP sign-in to find the user, got %v, %v", created, err)
+	}
+	var users int
+	if err := s.DB.QueryRow("SELECT COUNT(*) FROM users").Scan(&users); err != nil || users != 2 {
+		t.Errorf("expected two users, got %d, %v", users, err)
+	}
+	if u, err := s.GetByEmail(ctx, "a@example.com"); err != nil || u.FullName != "Al" {
+		t.Errorf("expected the name updated, got %+v, %v", u, err)
+	}
+
+	if _, changed, err := s.Reencrypt(ctx, 0, 10, false); err != nil || changed != 2 {
+		t.Fatalf("expected the users re-encrypted, got %d, %v", changed, err)
+	}
+	if _, err := s.Authenticate(ctx, "a@example.com", "pass"); err != nil {
+		t.Errorf("expected the user to sign in after re-encryption, got %v", err)
+	}
+}
+
+func TestSQL_Reencrypt(t *testing.T) {
+	s := storetest.SQLite(t)
+	ctx := context.Background()
+	if err := s.PutAttributeDefinition(ctx, store.AttributeDefinition{Name: "title", Type: store.AttrString}); err != nil {
+		t.Fatal(err)
+	}
+	for _, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		if err := s.CreateLocal(ctx, email, "pass"); err != nil {
+			t.Fatal(err)
+		}
+		update := store.ProfileUpdate{FullName: "Name", Telephone: "555", Attributes: map[string]string{"title": "Engineer"}}
+		if err := s.UpdateProfile(ctx, email, update, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		c := store.PhoneChallenge{Telephone: "555", CodeHash: "h", SentAt: time.Now(), ExpiresAt: time.Now().Add(time.Minute)}
+		if _, err := s.StartPhoneChallenge(ctx, email, c, store.PhoneLimits{}); err != nil {
+			t.Fatal(err)
+		}
+		ec := store.EmailChange{NewEmail: "new-" + email, TokenHash: email, RevertTokenHash: "r-" + email, CreatedAt: time.Now(), ExpiresAt: time.Now(), RevertExpiresAt: time.Now()}
+		if err := s.RequestEmailChange(ctx, email, ec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Rows written without a key are migrated to key 1, then rotated to key 2.
+	for _, keyring := range []*pii.Keyring{testKeyring(t, 1), testKeyring(t, 1, 2)} {
+		s.Cipher = keyring
+
+		if _, changed, err := s.Reencrypt(ctx, 0, 10, true); err != nil || changed != 3 {
+			t.Fatalf("dry run: expected 3 stale rows, got %d, %v", changed, err)
+		}
+
+		for name, pass := range map[string]func(context.Context, int64, int, bool) (int64, int, error){
+			"users":      s.Reencrypt,
+			"revisions":  s.ReencryptRevisions,
+			"attributes": s.ReencryptAttributes,
+			"challenges": s.ReencryptPhoneChallenges,
+			"changes":    s.ReencryptEmailChanges,
+		} {
+			var after int64
+			total := 0
+			for {
+				last, changed, err := pass(ctx, after, 2, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if last == 0 {
+					break
+				}
+				total += changed
+				after = last
+			}
+			if total != 3 {
+				t.Errorf("%s: expected 3 rows re-encrypted, got %d", name, total)
+			}
+			if _, changed, _ := pass(ctx, 0, 10, false); changed != 0 {
+				t.Errorf("%s: expected nothing left to re-encrypt, got %d", name, changed)
+			}
+		}
+
+		u, err := s.GetByEmail(ctx, "B@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Email != "b@example.com" || u.FullName != "Name" || u.Telephone != "555" {
+			t.Errorf("unexpected user after re-encryption: %+v", u)
+		}
+	}
+
+	// Nothing depends on key 1 any more.
+	s.Cipher = testKeyring(t, 2)
+	revs, err := s.Revisions(ctx, "c@example.com", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 1 || revs[0].NewFullName != "Name" || revs[0].NewAttributes["title"] != "Engineer" {
+		t.Errorf("unexpected revisions after rotation: %+v", revs)
+	}
+	if attrs, err := s.Attributes(ctx, "c@example.com"); err != nil || attrs["title"] != "Engineer" {
+		t.Errorf("unexpected attributes after rotation: %v, %v", attrs, err)
+	}
+}
@@ -0,0 +1,532 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"ccz/phone"
+)
+
+var (
+	ErrNotFound = errors.New("store: not found")
+	ErrConflict = errors.New("store: already exists")
+
+	// ErrVersionMismatch is returned when a conditional update finds the
+	// profile was changed after the caller read it.
+	ErrVersionMismatch = errors.New("store: profile version mismatch")
+
+	// ErrUnknownAttribute is returned for a custom attribute that has no
+	// definition.
+	ErrUnknownAttribute = errors.New("store: unknown attribute")
+
+	// ErrThrottled is returned when another phone code may not be sent
+	// yet.
+	ErrThrottled = errors.New("store: too many codes sent")
+	// ErrCodeMismatch, ErrCodeExpired and ErrTooManyAttempts are the ways
+	// confirming a phone code can fail. A pending code that has expired or
+	// run out of attempts can only be replaced by a new one.
+	ErrCodeMismatch    = errors.New("store: wrong code")
+	ErrCodeExpired     = errors.New("store: code expired")
+	ErrTooManyAttempts = errors.New("store: too many attempts")
+
+	// ErrTokenExpired is returned for an email change link used too late,
+	// an expired access token and an expired authorization code.
+	ErrTokenExpired = errors.New("store: token expired")
+
+	// ErrUnavailable wraps errors caused by the backing database being
+	// unreachable rather than by the query itself.
+	ErrUnavailable = errors.New("store: database unavailable")
+)
+
+type User struct {
+	ID        int64
+	Email     string
+	FullName  string
+	Telephone string
+	// TelephoneDisplay is Telephone laid out for reading; see
+	// TelephoneDisplay.
+	TelephoneDisplay string
+	// TelephoneVerifiedAt is when the user proved they receive texts at
+	// Telephone, zero while it is unverified. Changing the number clears
+	// it.
+	TelephoneVerifiedAt time.Time
+	Provider            string
+	// HasPassword is false for users who only sign in with Google.
+	HasPassword bool
+	Role        string
+	// Avatar identifies the user's current avatar images, empty when they
+	// have none.
+	Avatar string
+	// Version goes up by one with every profile change.
+	Version int64
+}
+
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Sources of a profile revision.
+const (
+	SourceProfile = "profile"
+	SourceGoogle  = "google"
+	SourceSAML    = "saml"
+	SourceLDAP    = "ldap"
+	SourceRestore = "restore"
+	SourceAdmin   = "admin"
+)
+
+// Change says who made a profile mutation and from where. It is recorded
+// on the revision the mutation produces.
+type Change struct {
+	Actor  string // email of the user making the change
+	IP     string
+	Source string
+
+	// IfVersion, when set, makes the change conditional: it fails with
+	// ErrVersionMismatch unless the profile is still at this version.
+	IfVersion int64
+
+	// RestoreAttributes, when not nil, limits which custom attributes a
+	// restore puts back; the others keep their current values.
+	RestoreAttributes []string
+}
+
+func (c Change) restores(attribute string) bool {
+	return c.RestoreAttributes == nil || slices.Contains(c.RestoreAttributes, attribute)
+}
+
+// Revision is one recorded profile mutation, with the values before and
+// after it.
+type Revision struct {
+	ID           int64
+	OldFullName  string
+	OldTelephone string
+	NewFullName  string
+	NewTelephone string
+	Actor        string
+	IP           string
+	Source       string
+	RestoredFrom int64
+	CreatedAt    time.Time
+
+	// Custom attributes the change touched, by name. An empty value means
+	// the attribute was not set.
+	OldAttributes map[string]string
+	NewAttributes map[string]string
+}
+
+// ProfileUpdate is the new state of a user's editable profile.
+type ProfileUpdate struct {
+	FullName  string
+	Telephone string
+	// Attributes lists custom attributes to change; an empty value removes
+	// one. Attributes not listed keep their value.
+	Attributes map[string]string
+}
+
+// Attribute types.
+const (
+	AttrString  = "string"
+	AttrNumber  = "number"
+	AttrBoolean = "boolean"
+	AttrDate    = "date"
+	AttrEnum    = "enum"
+)
+
+// Attribute visibilities: who can see and change an attribute's value.
+// Admins can always do both.
+const (
+	VisibilityUser     = "user"      // the user sees and edits it
+	VisibilityReadOnly = "read_only" // the user sees it, only admins edit it
+	VisibilityAdmin    = "admin"     // only admins see it
+)
+
+// AttributeDefinition describes a custom profile attribute.
+type AttributeDefinition struct {
+	Name       string
+	Label      string
+	Type       string
+	Required   bool
+	Visibility string
+	Rules      AttributeRules
+	SortOrder  int
+}
+
+// AttributeRules constrain attribute values. Length and pattern rules apply
+// to strings, Min and Max to numbers, Options to enums.
+type AttributeRules struct {
+	MinLength int      `json:"min_length,omitempty"`
+	MaxLength int      `json:"max_length,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	Options   []string `json:"options,omitempty"`
+}
+
+// UserStore reads and updates profile data. Every update that changes a
+// value is recorded as a Revision.
+type UserStore interface {
+	GetByEmail(ctx context.Context, email string) (*User, error)
+	// GetByID finds a user by their id, which unlike their email never
+	// changes.
+	GetByID(ctx context.Context, id int64) (*User, error)
+	UpdateProfile(ctx context.Context, email string, update ProfileUpdate, change Change) error
+	// Attributes returns the user's custom attribute values by name.
+	Attributes(ctx context.Context, email string) (map[string]string, error)
+
+	// Revisions lists up to limit revisions of the user's profile, newest
+	// first.
+	Revisions(ctx context.Context, email string, limit int) ([]Revision, error)
+	// ProfileAt returns the user as their profile stood at the given time.
+	ProfileAt(ctx context.Context, email string, at time.Time) (*User, error)
+	// RestoreRevision sets the profile back to the values a revision left it
+	// with, recording the restore as a new revision.
+	RestoreRevision(ctx context.Context, email string, id int64, change Change) error
+
+	// SessionsRevokedAt is when the user last signed out every session,
+	// zero if they never did. Tokens issued before then are refused.
+	SessionsRevokedAt(ctx context.Context, email string) (time.Time, error)
+
+	// SetAvatar points the profile at new avatar images, or at none when id
+	// is empty, and returns the id it replaced. Avatars are not kept in the
+	// profile history.
+	SetAvatar(ctx context.Context, email, id string) (string, error)
+}
+
+// IdentityStore manages how users sign in: local credentials and
+// identities linked from external providers.
+type IdentityStore interface {
+	// CreateLocal stores only a hash of the password.
+	CreateLocal(ctx context.Context, email, password string) error
+	// Authenticate returns ErrNotFound unless the user has a password and
+	// it matches.
+	Authenticate(ctx context.Context, email, password string) (*User, error)
+	// SetPassword replaces the user's password, or gives a user who signs
+	// in with Google a first one, and adds it to their history. Sessions
+	// issued before revokeBefore stop working. It returns ErrNotFound for
+	// unknown users.
+	SetPassword(ctx context.Context, email, password string, revokeBefore time.Time) error
+	// PasswordHistory returns the hashes of up to limit of the user's
+	// passwords, newest first; the first is the current one.
+	PasswordHistory(ctx context.Context, email string, limit int) ([]string, error)
+	// UpsertGoogle creates the user on their first Google sign-in and
+	// refreshes their name afterwards. created reports which happened.
+	UpsertGoogle(ctx context.Context, email, fullName string, change Change) (created bool, err error)
+	// UpsertSAML creates the user on their first SAML sign-in and
+	// afterwards updates the profile fields update has a value for; an
+	// empty field keeps the user's. created reports which happened.
+	UpsertSAML(ctx context.Context, email string, update ProfileUpdate, change Change) (created bool, err error)
+	// UpsertLDAP is UpsertSAML for users of the LDAP directory, which also
+	// sets their role unless role is empty. An existing account of another
+	// provider becomes the directory's, and loses its password.
+	UpsertLDAP(ctx context.Context, email string, update ProfileUpdate, role string, change Change) (created bool, err error)
+}
+
+// SchemaStore manages the custom profile attribute definitions.
+type SchemaStore interface {
+	// AttributeDefinitions lists every definition by sort order, then name.
+	AttributeDefinitions(ctx context.Context) ([]AttributeDefinition, error)
+	// PutAttributeDefinition creates a definition or replaces the one with
+	// the same name.
+	PutAttributeDefinition(ctx context.Context, def AttributeDefinition) error
+	// DeleteAttributeDefinition removes a definition and every value stored
+	// for it.
+	DeleteAttributeDefinition(ctx context.Context, name string) error
+}
+
+// PhoneChallenge is a one-time code sent to verify a user's telephone.
+// Only a hash of the code is kept.
+type PhoneChallenge struct {
+	Telephone string
+	CodeHash  string
+	// Attempts counts wrong codes entered.
+	Attempts int
+	// Sends counts the codes sent since WindowStart.
+	Sends       int
+	WindowStart time.Time
+	SentAt      time.Time
+	ExpiresAt   time.Time
+}
+
+// PhoneLimits bound how often codes are sent and guessed.
+type PhoneLimits struct {
+	// ResendAfter is the least time between two codes.
+	ResendAfter time.Duration
+	// MaxSends codes may be sent per Window.
+	MaxSends int
+	Window   time.Duration
+	// MaxAttempts wrong codes are allowed per code.
+	MaxAttempts int
+}
+
+// PhoneStore keeps the state of telephone verifications.
+type PhoneStore interface {
+	// StartPhoneChallenge replaces the user's pending code with c, sent at
+	// c.SentAt, unless limits forbid sending another one yet. Then it
+	// returns ErrThrottled and how long to wait.
+	StartPhoneChallenge(ctx context.Context, email string, c PhoneChallenge, limits PhoneLimits) (retryAfter time.Duration, err error)
+	// ConfirmPhone checks codeHash against the pending code for the user's
+	// current telephone. On a match the telephone is marked verified at now
+	// and the code is used up; a wrong code counts as an attempt. It
+	// returns ErrNotFound when no code is pending.
+	ConfirmPhone(ctx context.Context, email, codeHash string, limits PhoneLimits, now time.Time) error
+}
+
+// EmailChange moves a user to a new login email. The confirmation token is
+// sent to NewEmail and the revert token to OldEmail; only their hashes are
+// kept.
+type EmailChange struct {
+	ID              int64
+	OldEmail        string
+	NewEmail        string
+	TokenHash       string
+	RevertTokenHash string
+	CreatedAt       time.Time
+	// ExpiresAt ends the time to confirm, RevertExpiresAt the time to
+	// revert. Until then the old address cannot be taken by anyone else.
+	ExpiresAt       time.Time
+	RevertExpiresAt time.Time
+	// ConfirmedAt and RevertedAt are zero until that happens.
+	ConfirmedAt time.Time
+	RevertedAt  time.Time
+}
+
+// EmailStore keeps the state of email changes.
+type EmailStore interface {
+	// RequestEmailChange records c for the user, replacing any change of
+	// theirs that is not confirmed yet. It returns ErrConflict when
+	// c.NewEmail belongs to another user or is held for a revert.
+	RequestEmailChange(ctx context.Context, email string, c EmailChange) error
+	// ConfirmEmailChange moves the user to the new address of their pending
+	// change with tokenHash and returns that change. It returns ErrNotFound
+	// for unknown or used tokens, ErrTokenExpired for late ones and
+	// ErrConflict when the address was taken in the meantime.
+	ConfirmEmailChange(ctx context.Context, email, tokenHash string, now time.Time) (*EmailChange, error)
+	// RevertEmailChange cancels the change with revertTokenHash if it is
+	// pending, or moves the user back to its old address if it was
+	// confirmed, and returns it. Errors are as for ConfirmEmailChange.
+	RevertEmailChange(ctx context.Context, revertTokenHash string, now time.Time) (*EmailChange, error)
+}
+
+// AccessToken is a personal access token. Only Hash of the token is kept,
+// and Prefix, its start, so the user can tell their tokens apart.
+type AccessToken struct {
+	ID int64
+	// Email is the owner's, set when a token is looked up by hash.
+	Email     string
+	Name      string
+	Prefix    string
+	Hash      string
+	Scopes    []string
+	CreatedAt time.Time
+	// ExpiresAt is zero for tokens that do not expire.
+	ExpiresAt time.Time
+	// LastUsedAt and LastUsedIP are zero until the token is used.
+	LastUsedAt time.Time
+	LastUsedIP string
+}
+
+// TokenStore keeps users' personal access tokens.
+type TokenStore interface {
+	// CreateAccessToken adds t for the user and sets its ID. It returns
+	// ErrConflict when they already have a token with that name.
+	CreateAccessToken(ctx context.Context, email string, t *AccessToken) error
+	// AccessTokens lists the user's tokens, newest first.
+	AccessTokens(ctx context.Context, email string) ([]AccessToken, error)
+	// DeleteAccessToken revokes the user's token with id. It returns
+	// ErrNotFound when they have none.
+	DeleteAccessToken(ctx context.Context, email string, id int64) error
+	// UseAccessToken returns the token with hash and records that it was
+	// used at now from ip. It returns ErrNotFound for unknown tokens and
+	// ErrTokenExpired for expired ones.
+	UseAccessToken(ctx context.Context, hash, ip string, now time.Time) (*AccessToken, error)
+	// GetAccessToken is UseAccessToken without recording the use, for
+	// looking at a token someone else holds.
+	GetAccessToken(ctx context.Context, hash string, now time.Time) (*AccessToken, error)
+}
+
+// OAuthClient is an application registered to sign users in through the
+// OAuth provider, or to call it on its own behalf.
+type OAuthClient struct {
+	ID   string
+	Name string
+	// SecretHash is empty for public clients, such as native apps, which
+	// cannot keep a secret and must use PKCE.
+	SecretHash   string
+	RedirectURIs []string
+	// Scopes are those the client may ask for.
+	Scopes     []string
+	GrantTypes []string
+	CreatedAt  time.Time
+}
+
+// AuthorizationCode is what a user granted a client, until the client
+// redeems it for tokens. Only Hash of the code is kept.
+type AuthorizationCode struct {
+	Hash        string
+	ClientID    string
+	RedirectURI string
+	Scopes      []string
+	Nonce       string
+	// CodeChallenge is the PKCE challenge the code verifier must answer.
+	CodeChallenge string
+	// AuthTime is when the user last signed in.
+	AuthTime  time.Time
+	ExpiresAt time.Time
+	// UserID and Email are the user's, set when the code is redeemed.
+	UserID int64
+	Email  string
+}
+
+// Statuses of a DeviceCode.
+const (
+	DevicePending  = "pending"
+	DeviceApproved = "approved"
+	DeviceDenied   = "denied"
+)
+
+// DeviceCode is a device authorization request (RFC 8628): a device
+// polls with the device code while its user enters the user code in a
+// browser. Only hashes of both codes are kept.
+type DeviceCode struct {
+	Hash         string
+	UserCodeHash string
+	ClientID     string
+	Scopes       []string
+	Status       string
+	// UserID and AuthTime are those of the user who decided.
+	UserID   int64
+	AuthTime time.Time
+	// Interval is how long the device must wait between polls.
+	Interval     time.Duration
+	LastPolledAt time.Time
+	ExpiresAt    time.Time
+	// SlowDown is set by PollDeviceCode when the device polled too soon.
+	SlowDown bool
+}
+
+// OAuthStore keeps the clients of the OAuth provider, the codes issued to
+// them and the access tokens revoked before they expire.
+type OAuthStore interface {
+	// CreateOAuthClient registers c. It returns ErrConflict when the id is
+	// taken.
+	CreateOAuthClient(ctx context.Context, c *OAuthClient) error
+	// OAuthClient returns the client with id, or ErrNotFound.
+	OAuthClient(ctx context.Context, id string) (*OAuthClient, error)
+	// OAuthClients lists every client by name.
+	OAuthClients(ctx context.Context) ([]OAuthClient, error)
+	// DeleteOAuthClient removes the client with id, its pending codes and
+	// its device requests. It returns ErrNotFound when there is none.
+	DeleteOAuthClient(ctx context.Context, id string) error
+	// CreateAuthorizationCode records c for the user. It returns
+	// ErrNotFound for unknown users.
+	CreateAuthorizationCode(ctx context.Context, email string, c AuthorizationCode) error
+	// RedeemAuthorizationCode returns the code with hash and uses it up, so
+	// it works once. It returns ErrNotFound for unknown or used codes and
+	// ErrTokenExpired for late ones.
+	RedeemAuthorizationCode(ctx context.Context, hash string, now time.Time) (*AuthorizationCode, error)
+	// RevokeOAuthToken records that the access token whose jti is id is
+	// revoked. The record is kept until the token would have expired at
+	// expiresAt; revoking a token twice is not an error.
+	RevokeOAuthToken(ctx context.Context, id string, expiresAt, now time.Time) error
+	// OAuthTokenRevoked reports whether the access token whose jti is id
+	// was revoked.
+	OAuthTokenRevoked(ctx context.Context, id string) (bool, error)
+
+	// CreateDeviceCode records c, a pending request. It returns
+	// ErrConflict when another request has the same user code. Requests
+	// that have expired are cleaned up.
+	CreateDeviceCode(ctx context.Context, c DeviceCode, now time.Time) error
+	// PendingDeviceCode returns the pending request with userCodeHash. It
+	// returns ErrNotFound for unknown or decided requests and
+	// ErrTokenExpired for late ones.
+	PendingDeviceCode(ctx context.Context, userCodeHash string, now time.Time) (*DeviceCode, error)
+	// DecideDeviceCode approves or denies the pending request with
+	// userCodeHash as the user. It returns the same errors as
+	// PendingDeviceCode, and ErrNotFound for unknown users.
+	DecideDeviceCode(ctx context.Context, userCodeHash, email string, approve bool, authTime, now time.Time) error
+	// PollDeviceCode returns the request with hash for the device polling
+	// it. Decided requests are used up, so they work once. A poll of a
+	// pending request sooner than its Interval after the last one
+	// lengthens the Interval by 5 seconds and sets SlowDown. It returns
+	// ErrNotFound for unknown requests and ErrTokenExpired for late ones.
+	PollDeviceCode(ctx context.Context, hash string, now time.Time) (*DeviceCode, error)
+}
+
+// SAMLTenant is an enterprise customer whose users sign in through the
+// customer's own SAML identity provider.
+type SAMLTenant struct {
+	// ID names the tenant in URLs.
+	ID   string
+	Name string
+	// Metadata is the identity provider's metadata XML, as imported.
+	Metadata string
+	// Domains are the email domains the identity provider signs users in
+	// for. A domain belongs to one tenant at most.
+	Domains []string
+	// EmailAttribute, FullNameAttribute and TelephoneAttribute name the
+	// SAML attributes profile fields are read from. Without an
+	// EmailAttribute the email is the NameID.
+	EmailAttribute     string
+	FullNameAttribute  string
+	TelephoneAttribute string
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+// SAMLStore keeps the tenants that sign in with SAML, and the requests
+// sent to their identity providers until they are answered.
+type SAMLStore interface {
+	// PutSAMLTenant creates t, or replaces the tenant with its ID but for
+	// CreatedAt. It returns ErrConflict when one of its domains belongs to
+	// another tenant.
+	PutSAMLTenant(ctx context.Context, t SAMLTenant) error
+	// SAMLTenant returns the tenant with id, or ErrNotFound.
+	SAMLTenant(ctx context.Context, id string) (*SAMLTenant, error)
+	// SAMLTenantByDomain returns the tenant the email domain belongs to,
+	// or ErrNotFound.
+	SAMLTenantByDomain(ctx context.Context, domain string) (*SAMLTenant, error)
+	// SAMLTenants lists every tenant by name.
+	SAMLTenants(ctx context.Context) ([]SAMLTenant, error)
+	// DeleteSAMLTenant removes the tenant with id and its pending
+	// requests. It returns ErrNotFound when there is none.
+	DeleteSAMLTenant(ctx context.Context, id string) error
+	// CreateSAMLRequest records that the AuthnRequest with id was sent to
+	// the identity provider of tenant. Requests that have expired are
+	// cleaned up.
+	CreateSAMLRequest(ctx context.Context, id, tenant string, expiresAt, now time.Time) error
+	// RedeemSAMLRequest uses up the request with id, so only one answer to
+	// it is accepted, and returns its tenant. It returns ErrNotFound for
+	// unknown or answered requests and ErrTokenExpired for late ones.
+	RedeemSAMLRequest(ctx context.Context, id string, now time.Time) (tenant string, err error)
+}
+
+// Store is the full set of persistence operations a backend provides.
+type Store interface {
+	UserStore
+	IdentityStore
+	SchemaStore
+	PhoneStore
+	EmailStore
+	TokenStore
+	OAuthStore
+	SAMLStore
+}
+
+// TelephoneDisplay is how a stored telephone number is shown: in the
+// national format of its region for E.164 numbers, and as stored for values
+// saved before numbers were normalised.
+func TelephoneDisplay(telephone string) string {
+	if !strings.HasPrefix(telephone, "+") {
+		return telephone
+	}
+	n, err := phone.Parse(telephone, "")
+	if err != nil {
+		return telephone
+	}
+	return n.NationalFormat()
+}
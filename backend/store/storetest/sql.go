@@ -0,0 +1,39 @@
+package storetest
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"ccz/db"
+	"ccz/migrate"
+	"ccz/store"
+)
+
+// Open connects to dsn, applies the embedded migrations and returns a SQL
+// store. The connection is closed when the test finishes.
+func Open(t *testing.T, dsn string) *store.SQL {
+	t.Helper()
+	conn, dialect, err := db.Open(dsn)
+	if err != nil {
+		t.Fatalf("open %s: %v", dsn, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	migrations, err := migrate.Embedded(dialect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrate.New(conn, dialect, migrations, io.Discard).Up(context.Background()); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	return store.NewSQL(conn, dialect)
+}
+
+// SQLite returns a migrated store backed by a fresh database file in the
+// test's temp dir, so tests need no database server.
+func SQLite(t *testing.T) *store.SQL {
+	t.Helper()
+	return Open(t, "sqlite://"+filepath.Join(t.TempDir(), "test.db"))
+}
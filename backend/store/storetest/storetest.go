@@ -0,0 +1,1294 @@
+// Package storetest holds the conformance suite every store.Store
+// implementation must pass.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"ccz/password"
+	"ccz/store"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Tests that import this package hash passwords at bcrypt's lowest cost;
+// the default makes every signup take tens of milliseconds.
+func init() {
+	password.Cost = bcrypt.MinCost
+}
+
+// Run exercises s against the behaviour handlers rely on. newStore must
+// return an empty store each time it is called.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	ctx := context.Background()
+
+	t.Run("Signup And Login", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		u, err := s.Authenticate(ctx, "a@ex.com", "pass")
+		if err != nil {
+			t.Fatalf("authenticate: %v", err)
+		}
+		if u.Email != "a@ex.com" || u.Provider != "local" || u.ID == 0 {
+			t.Errorf("unexpected user %+v", u)
+		}
+	})
+
+	t.Run("Duplicate Signup", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateLocal(ctx, "a@ex.com", "other"); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("expected ErrConflict, got %v", err)
+		}
+	})
+
+	t.Run("Email Case", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "Alice@Ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, " alice@ex.com")
+		if err != nil || u.Email != "Alice@Ex.com" {
+			t.Fatalf("expected a lookup in another case to find the user, got %+v, %v", u, err)
+		}
+		if _, err := s.Authenticate(ctx, "ALICE@EX.COM", "pass"); err != nil {
+			t.Errorf("expected a login in another case to work: %v", err)
+		}
+		if err := s.CreateLocal(ctx, "alice@ex.com", "other"); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("expected ErrConflict for the same email in another case, got %v", err)
+		}
+		if _, err := s.UpsertGoogle(ctx, "alice@EX.com", "Alice", store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := s.GetByEmail(ctx, "Alice@Ex.com"); err != nil || got.ID != u.ID || got.FullName != "Alice" || u.Provider != "local" {
+			t.Errorf("expected Google to sign in the same user, got %+v, %v", got, err)
+		}
+	})
+
+	t.Run("Wrong Password", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Authenticate(ctx, "a@ex.com", "nope"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.Authenticate(ctx, "missing@ex.com", "pass"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+		}
+	})
+
+	t.Run("Password History", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		hashes, err := s.PasswordHistory(ctx, "a@ex.com", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != 1 || !password.IsHash(hashes[0]) {
+			t.Fatalf("expected the hash of the first password, got %v", hashes)
+		}
+		if ok, _ := password.Verify(hashes[0], "pass"); !ok {
+			t.Error("expected the history to hold the current password")
+		}
+		if hashes, err := s.PasswordHistory(ctx, "missing@ex.com", 5); err != nil || len(hashes) != 0 {
+			t.Errorf("expected no history for an unknown user, got %v, %v", hashes, err)
+		}
+	})
+
+	t.Run("Profile Round Trip", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann", Telephone: "123"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Ann" || u.Telephone != "123" {
+			t.Errorf("unexpected profile %+v", u)
+		}
+	})
+
+	t.Run("Unknown User", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.GetByEmail(ctx, "missing@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Google Upsert", func(t *testing.T) {
+		s := newStore(t)
+		if created, err := s.UpsertGoogle(ctx, "g@ex.com", "First", store.Change{}); err != nil || !created {
+			t.Fatalf("expected first sign-in to create the user, got %v, %v", created, err)
+		}
+		if created, err := s.UpsertGoogle(ctx, "g@ex.com", "Second", store.Change{}); err != nil || created {
+			t.Fatalf("expected second sign-in to update the user, got %v, %v", created, err)
+		}
+		u, err := s.GetByEmail(ctx, "g@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Second" || u.Provider != "google" {
+			t.Errorf("unexpected user %+v", u)
+		}
+		if _, err := s.Authenticate(ctx, "g@ex.com", ""); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("google user must not authenticate with an empty password, got %v", err)
+		}
+	})
+
+	t.Run("Set Password", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		revokeBefore := time.Now().Truncate(time.Second)
+		if err := s.SetPassword(ctx, "a@ex.com", "new pass", revokeBefore); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.Authenticate(ctx, "a@ex.com", "pass"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected the old password to stop working, got %v", err)
+		}
+		if _, err := s.Authenticate(ctx, "a@ex.com", "new pass"); err != nil {
+			t.Errorf("expected the new password to work: %v", err)
+		}
+		hashes, err := s.PasswordHistory(ctx, "a@ex.com", 5)
+		if err != nil || len(hashes) != 2 {
+			t.Fatalf("expected two passwords in the history, got %v, %v", hashes, err)
+		}
+		if ok, _ := password.Verify(hashes[0], "new pass"); !ok {
+			t.Error("expected the newest password first")
+		}
+		if at, err := s.SessionsRevokedAt(ctx, "a@ex.com"); err != nil || !at.Equal(revokeBefore) {
+			t.Errorf("expected sessions revoked at %v, got %v, %v", revokeBefore, at, err)
+		}
+
+		if _, err := s.UpsertGoogle(ctx, "g@ex.com", "G", store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := s.GetByEmail(ctx, "g@ex.com"); err != nil || u.HasPassword {
+			t.Fatalf("expected a Google user without a password, got %+v, %v", u, err)
+		}
+		if at, err := s.SessionsRevokedAt(ctx, "g@ex.com"); err != nil || !at.IsZero() {
+			t.Errorf("expected no revocation yet, got %v, %v", at, err)
+		}
+		if err := s.SetPassword(ctx, "g@ex.com", "first pass", revokeBefore); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := s.Authenticate(ctx, "g@ex.com", "first pass"); err != nil || !u.HasPassword || u.Provider != "google" {
+			t.Errorf("expected the Google user to sign in with a password too, got %+v, %v", u, err)
+		}
+
+		if err := s.SetPassword(ctx, "missing@ex.com", "pass", revokeBefore); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Concurrent Updates", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: fmt.Sprintf("Name %d", i)}, store.Change{}); err != nil {
+					t.Error(err)
+				}
+				if _, err := s.GetByEmail(ctx, "a@ex.com"); err != nil {
+					t.Error(err)
+				}
+			}(i)
+		}
+		wg.Wait()
+	})
+
+	t.Run("Profile History", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		change := store.Change{Actor: "a@ex.com", IP: "192.0.2.1", Source: store.SourceProfile}
+
+		before := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann", Telephone: "123"}, change); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		between := time.Now()
+		time.Sleep(10 * time.Millisecond)
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann Lee", Telephone: "456"}, change); err != nil {
+			t.Fatal(err)
+		}
+		// Saving the same values again is not a change.
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann Lee", Telephone: "456"}, change); err != nil {
+			t.Fatal(err)
+		}
+
+		revs, err := s.Revisions(ctx, "a@ex.com", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 2 {
+			t.Fatalf("expected 2 revisions, got %+v", revs)
+		}
+		latest := revs[0]
+		if latest.OldFullName != "Ann" || latest.NewFullName != "Ann Lee" || latest.NewTelephone != "456" {
+			t.Errorf("unexpected latest revision %+v", latest)
+		}
+		if latest.Actor != "a@ex.com" || latest.IP != "192.0.2.1" || latest.Source != store.SourceProfile || latest.CreatedAt.IsZero() {
+			t.Errorf("unexpected revision metadata %+v", latest)
+		}
+		if limited, _ := s.Revisions(ctx, "a@ex.com", 1); len(limited) != 1 || limited[0].ID != latest.ID {
+			t.Errorf("expected limit to keep the newest revision, got %+v", limited)
+		}
+
+		for _, c := range []struct {
+			at        time.Time
+			name, tel string
+		}{
+			{before, "", ""},
+			{between, "Ann", "123"},
+			{time.Now(), "Ann Lee", "456"},
+		} {
+			u, err := s.ProfileAt(ctx, "a@ex.com", c.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u.FullName != c.name || u.Telephone != c.tel {
+				t.Errorf("profile at %s: got %q/%q, want %q/%q", c.at, u.FullName, u.Telephone, c.name, c.tel)
+			}
+		}
+
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[1].ID, change); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.FullName != "Ann" || u.Telephone != "123" {
+			t.Errorf("expected restored profile, got %+v", u)
+		}
+		revs, _ = s.Revisions(ctx, "a@ex.com", 10)
+		if len(revs) != 3 || revs[0].Source != store.SourceRestore || revs[0].RestoredFrom != revs[2].ID {
+			t.Errorf("expected a restore revision, got %+v", revs)
+		}
+	})
+
+	t.Run("Profile History Errors", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.Revisions(ctx, "missing@ex.com", 10); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound for unknown user, got %v", err)
+		}
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateLocal(ctx, "b@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "b@ex.com", store.ProfileUpdate{FullName: "Bob"}, store.Change{Source: store.SourceProfile}); err != nil {
+			t.Fatal(err)
+		}
+		revs, err := s.Revisions(ctx, "b@ex.com", 10)
+		if err != nil || len(revs) != 1 {
+			t.Fatalf("expected one revision, got %+v, %v", revs, err)
+		}
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[0].ID, store.Change{}); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound restoring another user's revision, got %v", err)
+		}
+		if revs, _ := s.Revisions(ctx, "a@ex.com", 10); len(revs) != 0 {
+			t.Errorf("expected no revisions, got %+v", revs)
+		}
+	})
+
+	t.Run("Google Name Change Is Recorded", func(t *testing.T) {
+		s := newStore(t)
+		change := store.Change{Actor: "g@ex.com", Source: store.SourceGoogle}
+		if _, err := s.UpsertGoogle(ctx, "g@ex.com", "First", change); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpsertGoogle(ctx, "g@ex.com", "Second", change); err != nil {
+			t.Fatal(err)
+		}
+		revs, err := s.Revisions(ctx, "g@ex.com", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 1 || revs[0].OldFullName != "First" || revs[0].NewFullName != "Second" || revs[0].Source != store.SourceGoogle {
+			t.Errorf("unexpected revisions %+v", revs)
+		}
+	})
+
+	t.Run("Conditional Update", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Version == 0 {
+			t.Fatal("expected a version on new users")
+		}
+		first := u.Version
+
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann"}, store.Change{IfVersion: first}); err != nil {
+			t.Fatalf("update at current version: %v", err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.Version != first+1 {
+			t.Errorf("expected version %d, got %d", first+1, u.Version)
+		}
+
+		// A second writer still holding the old version must not clobber.
+		err = s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Other"}, store.Change{IfVersion: first})
+		if !errors.Is(err, store.ErrVersionMismatch) {
+			t.Errorf("expected ErrVersionMismatch, got %v", err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.FullName != "Ann" {
+			t.Errorf("stale write was applied: %+v", u)
+		}
+
+		// Unconditional writes still go through, and unchanged saves do not
+		// bump the version.
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "Ann"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.Version != first+1 {
+			t.Errorf("no-op save changed version to %d", u.Version)
+		}
+	})
+
+	t.Run("Attribute Definitions", func(t *testing.T) {
+		s := newStore(t)
+		max := 120.0
+		defs := []store.AttributeDefinition{
+			{Name: "title", Label: "Job title", Type: store.AttrString, Visibility: store.VisibilityUser, SortOrder: 2},
+			{Name: "height", Label: "Height", Type: store.AttrNumber, Required: true, Visibility: store.VisibilityAdmin, Rules: store.AttributeRules{Max: &max}, SortOrder: 1},
+			{Name: "locale", Label: "Locale", Type: store.AttrEnum, Visibility: store.VisibilityReadOnly, Rules: store.AttributeRules{Options: []string{"en", "de"}}, SortOrder: 2},
+		}
+		for _, d := range defs {
+			if err := s.PutAttributeDefinition(ctx, d); err != nil {
+				t.Fatalf("put %s: %v", d.Name, err)
+			}
+		}
+		defs[0].Label = "Title"
+		if err := s.PutAttributeDefinition(ctx, defs[0]); err != nil {
+			t.Fatalf("replace: %v", err)
+		}
+
+		got, err := s.AttributeDefinitions(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 3 || got[0].Name != "height" || got[1].Name != "locale" || got[2].Name != "title" {
+			t.Fatalf("expected definitions by sort order then name, got %+v", got)
+		}
+		if got[0].Rules.Max == nil || *got[0].Rules.Max != max || !got[0].Required || got[0].Visibility != store.VisibilityAdmin {
+			t.Errorf("definition did not round trip: %+v", got[0])
+		}
+		if len(got[1].Rules.Options) != 2 || got[2].Label != "Title" {
+			t.Errorf("unexpected definitions %+v", got)
+		}
+
+		if err := s.DeleteAttributeDefinition(ctx, "locale"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteAttributeDefinition(ctx, "locale"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound deleting twice, got %v", err)
+		}
+	})
+
+	t.Run("Profile Attributes", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		for _, name := range []string{"title", "company"} {
+			def := store.AttributeDefinition{Name: name, Label: name, Type: store.AttrString, Visibility: store.VisibilityUser}
+			if err := s.PutAttributeDefinition(ctx, def); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		update := store.ProfileUpdate{FullName: "Ann", Attributes: map[string]string{"title": "Engineer", "company": "Acme"}}
+		if err := s.UpdateProfile(ctx, "a@ex.com", update, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		// Attributes left out keep their value; an empty one is removed.
+		update = store.ProfileUpdate{FullName: "Ann", Attributes: map[string]string{"title": "Manager"}}
+		if err := s.UpdateProfile(ctx, "a@ex.com", update, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		update = store.ProfileUpdate{FullName: "Ann", Attributes: map[string]string{"company": ""}}
+		if err := s.UpdateProfile(ctx, "a@ex.com", update, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.Attributes(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 1 || got["title"] != "Manager" {
+			t.Errorf("unexpected attributes %v", got)
+		}
+		if _, err := s.Attributes(ctx, "missing@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+
+		update = store.ProfileUpdate{FullName: "Ann", Attributes: map[string]string{"shoe_size": "42"}}
+		if err := s.UpdateProfile(ctx, "a@ex.com", update, store.Change{}); !errors.Is(err, store.ErrUnknownAttribute) {
+			t.Errorf("expected ErrUnknownAttribute, got %v", err)
+		}
+
+		revs, err := s.Revisions(ctx, "a@ex.com", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(revs) != 3 {
+			t.Fatalf("expected 3 revisions, got %+v", revs)
+		}
+		if revs[1].OldAttributes["title"] != "Engineer" || revs[1].NewAttributes["title"] != "Manager" || len(revs[1].NewAttributes) != 1 {
+			t.Errorf("unexpected attribute diff %+v", revs[1])
+		}
+		if revs[0].OldAttributes["company"] != "Acme" || revs[0].NewAttributes["company"] != "" {
+			t.Errorf("unexpected removal diff %+v", revs[0])
+		}
+
+		// Restoring the first revision puts back both values it set.
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[2].ID, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = s.Attributes(ctx, "a@ex.com"); got["company"] != "Acme" || got["title"] != "Engineer" {
+			t.Errorf("unexpected attributes after restore %v", got)
+		}
+
+		// A restore limited to no attributes leaves them alone.
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[1].ID, store.Change{RestoreAttributes: []string{}}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ = s.Attributes(ctx, "a@ex.com"); got["title"] != "Engineer" {
+			t.Errorf("restore changed an attribute it was not allowed to: %v", got)
+		}
+
+		// Dropping a definition drops its values and changes the version.
+		before, _ := s.GetByEmail(ctx, "a@ex.com")
+		if err := s.DeleteAttributeDefinition(ctx, "company"); err != nil {
+			t.Fatal(err)
+		}
+		after, _ := s.GetByEmail(ctx, "a@ex.com")
+		if after.Version == before.Version {
+			t.Error("expected deleting a definition in use to bump the version")
+		}
+		if got, _ = s.Attributes(ctx, "a@ex.com"); len(got) != 1 {
+			t.Errorf("expected values of deleted definition to go, got %v", got)
+		}
+		// Its revisions can still be restored; the stale attribute is skipped.
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[0].ID, store.Change{}); err != nil {
+			t.Errorf("restore across deleted definition: %v", err)
+		}
+	})
+
+	t.Run("Avatar", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		before, _ := s.GetByEmail(ctx, "a@ex.com")
+
+		if previous, err := s.SetAvatar(ctx, "a@ex.com", "first"); err != nil || previous != "" {
+			t.Fatalf("expected no previous avatar, got %q, %v", previous, err)
+		}
+		if previous, err := s.SetAvatar(ctx, "a@ex.com", "second"); err != nil || previous != "first" {
+			t.Fatalf("expected previous avatar first, got %q, %v", previous, err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Avatar != "second" || u.Version != before.Version+2 {
+			t.Errorf("unexpected user after avatar changes %+v", u)
+		}
+
+		if previous, err := s.SetAvatar(ctx, "a@ex.com", ""); err != nil || previous != "second" {
+			t.Fatalf("expected removal to return second, got %q, %v", previous, err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.Avatar != "" {
+			t.Errorf("expected avatar removed, got %q", u.Avatar)
+		}
+		if revs, _ := s.Revisions(ctx, "a@ex.com", 10); len(revs) != 0 {
+			t.Errorf("avatar changes must not be recorded as revisions, got %+v", revs)
+		}
+		if _, err := s.SetAvatar(ctx, "missing@ex.com", "x"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Telephone Display", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "A", Telephone: "+442079460018"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Telephone != "+442079460018" || u.TelephoneDisplay != "020 7946 0018" {
+			t.Errorf("unexpected telephone %q shown as %q", u.Telephone, u.TelephoneDisplay)
+		}
+
+		// Restoring an older number brings its display format back too.
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "A", Telephone: "+14155550132"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		revs, _ := s.Revisions(ctx, "a@ex.com", 10)
+		if err := s.RestoreRevision(ctx, "a@ex.com", revs[1].ID, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.TelephoneDisplay != "020 7946 0018" {
+			t.Errorf("expected restored display format, got %q", u.TelephoneDisplay)
+		}
+	})
+
+	t.Run("Phone Verification", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{Telephone: "+14155550132"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		limits := store.PhoneLimits{ResendAfter: time.Minute, MaxSends: 3, Window: time.Hour, MaxAttempts: 3}
+		start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+		send := func(at time.Time, hash string) (time.Duration, error) {
+			return s.StartPhoneChallenge(ctx, "a@ex.com", store.PhoneChallenge{
+				Telephone: "+14155550132", CodeHash: hash, SentAt: at, ExpiresAt: at.Add(10 * time.Minute),
+			}, limits)
+		}
+
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "x", limits, start); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("no code sent: expected ErrNotFound, got %v", err)
+		}
+		if _, err := send(start, "one"); err != nil {
+			t.Fatal(err)
+		}
+		if wait, err := send(start.Add(20*time.Second), "two"); !errors.Is(err, store.ErrThrottled) || wait != 40*time.Second {
+			t.Errorf("resend too soon: expected a 40s wait, got %v, %v", wait, err)
+		}
+		for i := 1; i < 3; i++ {
+			if _, err := send(start.Add(time.Duration(i)*time.Minute), "one"); err != nil {
+				t.Fatalf("send %d: %v", i+1, err)
+			}
+		}
+		if wait, err := send(start.Add(5*time.Minute), "one"); !errors.Is(err, store.ErrThrottled) || wait != 55*time.Minute {
+			t.Errorf("too many sends: expected a 55m wait, got %v, %v", wait, err)
+		}
+
+		now := start.Add(3 * time.Minute)
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "bad", limits, now); !errors.Is(err, store.ErrCodeMismatch) {
+			t.Errorf("expected ErrCodeMismatch, got %v", err)
+		}
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "one", limits, start.Add(time.Hour)); !errors.Is(err, store.ErrCodeExpired) {
+			t.Errorf("expected ErrCodeExpired, got %v", err)
+		}
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "one", limits, now); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !u.TelephoneVerifiedAt.Equal(now) || u.Version != 3 {
+			t.Errorf("expected verified at %v in version 3, got %v in version %d", now, u.TelephoneVerifiedAt, u.Version)
+		}
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "one", limits, now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("code reused: expected ErrNotFound, got %v", err)
+		}
+
+		// Saving the same number keeps it verified; a new one does not.
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "A", Telephone: "+14155550132"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); u.TelephoneVerifiedAt.IsZero() {
+			t.Error("expected verification to survive an unrelated change")
+		}
+		if _, err := send(start.Add(2*time.Hour), "three"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{FullName: "A", Telephone: "+442079460018"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if u, _ = s.GetByEmail(ctx, "a@ex.com"); !u.TelephoneVerifiedAt.IsZero() {
+			t.Error("expected a new number to be unverified")
+		}
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "three", limits, start.Add(2*time.Hour)); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("code for the old number: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Phone Verification Attempts", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "a@ex.com", store.ProfileUpdate{Telephone: "+14155550132"}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		limits := store.PhoneLimits{ResendAfter: time.Minute, MaxSends: 3, Window: time.Hour, MaxAttempts: 3}
+		now := time.Now()
+		c := store.PhoneChallenge{Telephone: "+14155550132", CodeHash: "right", SentAt: now, ExpiresAt: now.Add(time.Minute)}
+		if _, err := s.StartPhoneChallenge(ctx, "a@ex.com", c, limits); err != nil {
+			t.Fatal(err)
+		}
+		for i, want := range []error{store.ErrCodeMismatch, store.ErrCodeMismatch, store.ErrTooManyAttempts, store.ErrTooManyAttempts} {
+			if err := s.ConfirmPhone(ctx, "a@ex.com", "wrong", limits, now); !errors.Is(err, want) {
+				t.Errorf("attempt %d: expected %v, got %v", i+1, want, err)
+			}
+		}
+		if err := s.ConfirmPhone(ctx, "a@ex.com", "right", limits, now); !errors.Is(err, store.ErrTooManyAttempts) {
+			t.Errorf("right code after lockout: expected ErrTooManyAttempts, got %v", err)
+		}
+	})
+
+	t.Run("Email Change", func(t *testing.T) {
+		s := newStore(t)
+		for _, email := range []string{"a@ex.com", "b@ex.com"} {
+			if err := s.CreateLocal(ctx, email, "pass"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		now := time.Now()
+		change := func(token string) store.EmailChange {
+			return store.EmailChange{
+				NewEmail: "new@ex.com", TokenHash: token, RevertTokenHash: "revert-" + token,
+				CreatedAt: now, ExpiresAt: now.Add(time.Hour), RevertExpiresAt: now.Add(24 * time.Hour),
+			}
+		}
+
+		taken := change("t0")
+		taken.NewEmail = "b@ex.com"
+		if err := s.RequestEmailChange(ctx, "a@ex.com", taken); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("address in use: expected ErrConflict, got %v", err)
+		}
+		if err := s.RequestEmailChange(ctx, "a@ex.com", change("t1")); err != nil {
+			t.Fatal(err)
+		}
+		// A second request replaces the first.
+		if err := s.RequestEmailChange(ctx, "a@ex.com", change("t2")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ConfirmEmailChange(ctx, "a@ex.com", "t1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("replaced token: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.ConfirmEmailChange(ctx, "b@ex.com", "t2", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("another user's token: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.ConfirmEmailChange(ctx, "a@ex.com", "t2", now.Add(2*time.Hour)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("late token: expected ErrTokenExpired, got %v", err)
+		}
+
+		c, err := s.ConfirmEmailChange(ctx, "a@ex.com", "t2", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.OldEmail != "a@ex.com" || c.NewEmail != "new@ex.com" || c.ConfirmedAt.IsZero() {
+			t.Errorf("unexpected change %+v", c)
+		}
+		if _, err := s.GetByEmail(ctx, "a@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("old address: expected ErrNotFound, got %v", err)
+		}
+		u, err := s.GetByEmail(ctx, "new@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Email != "new@ex.com" || u.Version != 2 {
+			t.Errorf("unexpected user after the change: %+v", u)
+		}
+		if _, err := s.Authenticate(ctx, "new@ex.com", "pass"); err != nil {
+			t.Errorf("expected to log in with the new address, got %v", err)
+		}
+		if _, err := s.ConfirmEmailChange(ctx, "new@ex.com", "t2", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("used token: expected ErrNotFound, got %v", err)
+		}
+
+		// The old address is held for the revert.
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("signing up with a held address: expected ErrConflict, got %v", err)
+		}
+		if _, err := s.UpsertGoogle(ctx, "a@ex.com", "A", store.Change{}); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("Google sign-in with a held address: expected ErrConflict, got %v", err)
+		}
+		held := change("t3")
+		held.NewEmail = "a@ex.com"
+		if err := s.RequestEmailChange(ctx, "b@ex.com", held); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("changing to a held address: expected ErrConflict, got %v", err)
+		}
+
+		if _, err := s.RevertEmailChange(ctx, "revert-t2", now.Add(48*time.Hour)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("late revert: expected ErrTokenExpired, got %v", err)
+		}
+		if _, err := s.RevertEmailChange(ctx, "revert-t2", now); err != nil {
+			t.Fatal(err)
+		}
+		if u, err = s.GetByEmail(ctx, "a@ex.com"); err != nil || u.Version != 3 {
+			t.Errorf("expected the old address back in version 3, got %+v, %v", u, err)
+		}
+		if _, err := s.GetByEmail(ctx, "new@ex.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("new address after revert: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.RevertEmailChange(ctx, "revert-t2", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("second revert: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Email Change Cancelled", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		c := store.EmailChange{
+			NewEmail: "new@ex.com", TokenHash: "t", RevertTokenHash: "r",
+			CreatedAt: now, ExpiresAt: now.Add(time.Hour), RevertExpiresAt: now.Add(24 * time.Hour),
+		}
+		if err := s.RequestEmailChange(ctx, "a@ex.com", c); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RevertEmailChange(ctx, "r", now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ConfirmEmailChange(ctx, "a@ex.com", "t", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("cancelled change: expected ErrNotFound, got %v", err)
+		}
+		if u, err := s.GetByEmail(ctx, "a@ex.com"); err != nil || u.Version != 1 {
+			t.Errorf("expected the user unchanged, got %+v, %v", u, err)
+		}
+	})
+
+	t.Run("Access Tokens", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().Truncate(time.Second)
+		script := &store.AccessToken{
+			Name: "backup script", Prefix: "ccz_pat_abcdef", Hash: "h1",
+			Scopes: []string{"profile:read"}, CreatedAt: now,
+		}
+		if err := s.CreateAccessToken(ctx, "a@ex.com", script); err != nil {
+			t.Fatal(err)
+		}
+		expiring := &store.AccessToken{
+			Name: "ci", Prefix: "ccz_pat_ghijkl", Hash: "h2",
+			Scopes: []string{"profile:read", "profile:write"}, CreatedAt: now, ExpiresAt: now.Add(time.Hour),
+		}
+		if err := s.CreateAccessToken(ctx, "a@ex.com", expiring); err != nil {
+			t.Fatal(err)
+		}
+		if script.ID == 0 || expiring.ID == script.ID {
+			t.Fatalf("expected distinct ids, got %d and %d", script.ID, expiring.ID)
+		}
+		if err := s.CreateAccessToken(ctx, "a@ex.com", &store.AccessToken{Name: "ci", Hash: "h3", CreatedAt: now}); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("duplicate name: expected ErrConflict, got %v", err)
+		}
+		if err := s.CreateAccessToken(ctx, "nobody@ex.com", &store.AccessToken{Name: "x", Hash: "h4", CreatedAt: now}); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("unknown user: expected ErrNotFound, got %v", err)
+		}
+
+		used, err := s.UseAccessToken(ctx, "h2", "10.0.0.1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if used.ID != expiring.ID || used.Email != "a@ex.com" || len(used.Scopes) != 2 || used.Scopes[1] != "profile:write" {
+			t.Errorf("unexpected token %+v", used)
+		}
+		if _, err := s.UseAccessToken(ctx, "h2", "10.0.0.1", now.Add(time.Hour)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("expired token: expected ErrTokenExpired, got %v", err)
+		}
+		if _, err := s.UseAccessToken(ctx, "unknown", "10.0.0.1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("unknown token: expected ErrNotFound, got %v", err)
+		}
+		// Looking at a token does not count as using it.
+		if got, err := s.GetAccessToken(ctx, "h1", now); err != nil || got.ID != script.ID || got.Email != "a@ex.com" || !got.LastUsedAt.IsZero() {
+			t.Errorf("get: unexpected token %+v, %v", got, err)
+		}
+		if _, err := s.GetAccessToken(ctx, "h2", now.Add(time.Hour)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("get expired token: expected ErrTokenExpired, got %v", err)
+		}
+
+		tokens, err := s.AccessTokens(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tokens) != 2 || tokens[0].Name != "ci" || tokens[1].Name != "backup script" {
+			t.Fatalf("expected both tokens, newest first, got %+v", tokens)
+		}
+		if !tokens[0].LastUsedAt.Equal(now) || tokens[0].LastUsedIP != "10.0.0.1" || !tokens[0].ExpiresAt.Equal(now.Add(time.Hour)) {
+			t.Errorf("expected the use and expiry recorded, got %+v", tokens[0])
+		}
+		if !tokens[1].LastUsedAt.IsZero() || !tokens[1].ExpiresAt.IsZero() || tokens[1].Prefix != "ccz_pat_abcdef" {
+			t.Errorf("expected an unused token without expiry, got %+v", tokens[1])
+		}
+
+		if err := s.DeleteAccessToken(ctx, "a@ex.com", script.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteAccessToken(ctx, "a@ex.com", script.ID); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("deleted twice: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.UseAccessToken(ctx, "h1", "10.0.0.1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("revoked token: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("OAuth", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if byID, err := s.GetByID(ctx, u.ID); err != nil || byID.Email != "a@ex.com" {
+			t.Errorf("by id: expected a@ex.com, got %+v, %v", byID, err)
+		}
+		if _, err := s.GetByID(ctx, u.ID+100); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("unknown id: expected ErrNotFound, got %v", err)
+		}
+
+		now := time.Now().Truncate(time.Second)
+		wiki := &store.OAuthClient{
+			ID: "wiki", Name: "Wiki", SecretHash: "s1",
+			RedirectURIs: []string{"https://wiki.ex.com/callback", "http://localhost:3000/cb"},
+			Scopes:       []string{"openid", "email"}, GrantTypes: []string{"authorization_code"}, CreatedAt: now,
+		}
+		cli := &store.OAuthClient{
+			ID: "cli", Name: "CLI", RedirectURIs: []string{"http://127.0.0.1/cb"},
+			Scopes: []string{"openid"}, GrantTypes: []string{"authorization_code"}, CreatedAt: now,
+		}
+		for _, c := range []*store.OAuthClient{wiki, cli} {
+			if err := s.CreateOAuthClient(ctx, c); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.CreateOAuthClient(ctx, &store.OAuthClient{ID: "wiki", Name: "Other", CreatedAt: now}); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("duplicate id: expected ErrConflict, got %v", err)
+		}
+		got, err := s.OAuthClient(ctx, "wiki")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.SecretHash != "s1" || len(got.RedirectURIs) != 2 || got.RedirectURIs[1] != "http://localhost:3000/cb" || got.Scopes[1] != "email" {
+			t.Errorf("unexpected client %+v", got)
+		}
+		clients, err := s.OAuthClients(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(clients) != 2 || clients[0].ID != "cli" || clients[0].SecretHash != "" {
+			t.Errorf("expected both clients by name, got %+v", clients)
+		}
+
+		code := store.AuthorizationCode{
+			Hash: "c1", ClientID: "wiki", RedirectURI: "https://wiki.ex.com/callback",
+			Scopes: []string{"openid", "email"}, Nonce: "n", CodeChallenge: "challenge",
+			AuthTime: now.Add(-time.Minute), ExpiresAt: now.Add(time.Minute),
+		}
+		if err := s.CreateAuthorizationCode(ctx, "a@ex.com", code); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateAuthorizationCode(ctx, "nobody@ex.com", store.AuthorizationCode{Hash: "c2", ClientID: "wiki", ExpiresAt: now}); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("unknown user: expected ErrNotFound, got %v", err)
+		}
+		redeemed, err := s.RedeemAuthorizationCode(ctx, "c1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redeemed.UserID != u.ID || redeemed.Email != "a@ex.com" || redeemed.Nonce != "n" || redeemed.CodeChallenge != "challenge" ||
+			!redeemed.AuthTime.Equal(code.AuthTime) || len(redeemed.Scopes) != 2 {
+			t.Errorf("unexpected code %+v", redeemed)
+		}
+		if _, err := s.RedeemAuthorizationCode(ctx, "c1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("redeemed twice: expected ErrNotFound, got %v", err)
+		}
+
+		late := store.AuthorizationCode{Hash: "c3", ClientID: "wiki", RedirectURI: "https://wiki.ex.com/callback", CodeChallenge: "x", ExpiresAt: now.Add(time.Minute)}
+		if err := s.CreateAuthorizationCode(ctx, "a@ex.com", late); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.RedeemAuthorizationCode(ctx, "c3", now.Add(time.Minute)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("late code: expected ErrTokenExpired, got %v", err)
+		}
+
+		pending := store.AuthorizationCode{Hash: "c4", ClientID: "wiki", RedirectURI: "https://wiki.ex.com/callback", CodeChallenge: "x", ExpiresAt: now.Add(time.Minute)}
+		if err := s.CreateAuthorizationCode(ctx, "a@ex.com", pending); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteOAuthClient(ctx, "wiki"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.OAuthClient(ctx, "wiki"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("deleted client: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.RedeemAuthorizationCode(ctx, "c4", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("code of a deleted client: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DeleteOAuthClient(ctx, "wiki"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("deleted twice: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("OAuth Device Codes", func(t *testing.T) {
+		s := newStore(t)
+		if err := s.CreateLocal(ctx, "a@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now().Truncate(time.Second)
+		if err := s.CreateOAuthClient(ctx, &store.OAuthClient{ID: "cli", Name: "CLI", Scopes: []string{"openid"}, GrantTypes: []string{"device_code"}, CreatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+		device := store.DeviceCode{Hash: "d1", UserCodeHash: "u1", ClientID: "cli", Scopes: []string{"openid"}, Interval: 5 * time.Second, ExpiresAt: now.Add(10 * time.Minute)}
+		if err := s.CreateDeviceCode(ctx, device, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateDeviceCode(ctx, store.DeviceCode{Hash: "d2", UserCodeHash: "u1", ClientID: "cli", ExpiresAt: now.Add(time.Minute)}, now); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("same user code: expected ErrConflict, got %v", err)
+		}
+
+		pending, err := s.PendingDeviceCode(ctx, "u1", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pending.Hash != "d1" || pending.ClientID != "cli" || pending.Status != store.DevicePending || len(pending.Scopes) != 1 || pending.Interval != 5*time.Second {
+			t.Errorf("unexpected request %+v", pending)
+		}
+		if _, err := s.PendingDeviceCode(ctx, "u1", now.Add(10*time.Minute)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("late: expected ErrTokenExpired, got %v", err)
+		}
+
+		polled, err := s.PollDeviceCode(ctx, "d1", now)
+		if err != nil || polled.Status != store.DevicePending || polled.SlowDown {
+			t.Fatalf("first poll: expected pending, got %+v, %v", polled, err)
+		}
+		polled, err = s.PollDeviceCode(ctx, "d1", now.Add(time.Second))
+		if err != nil || !polled.SlowDown || polled.Interval != 10*time.Second {
+			t.Errorf("early poll: expected slow down to 10s, got %+v, %v", polled, err)
+		}
+		polled, err = s.PollDeviceCode(ctx, "d1", now.Add(12*time.Second))
+		if err != nil || polled.SlowDown || polled.Interval != 10*time.Second {
+			t.Errorf("poll after the interval: expected no slow down, got %+v, %v", polled, err)
+		}
+
+		authTime := now.Add(-time.Minute)
+		if err := s.DecideDeviceCode(ctx, "u1", "nobody@ex.com", true, authTime, now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("unknown user: expected ErrNotFound, got %v", err)
+		}
+		if err := s.DecideDeviceCode(ctx, "u1", "a@ex.com", true, authTime, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DecideDeviceCode(ctx, "u1", "a@ex.com", false, authTime, now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("decided twice: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.PendingDeviceCode(ctx, "u1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("decided: expected ErrNotFound, got %v", err)
+		}
+		u, err := s.GetByEmail(ctx, "a@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		polled, err = s.PollDeviceCode(ctx, "d1", now.Add(30*time.Second))
+		if err != nil || polled.Status != store.DeviceApproved || polled.UserID != u.ID || !polled.AuthTime.Equal(authTime) {
+			t.Errorf("approved: unexpected request %+v, %v", polled, err)
+		}
+		if _, err := s.PollDeviceCode(ctx, "d1", now.Add(time.Minute)); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("used: expected ErrNotFound, got %v", err)
+		}
+
+		// Expired requests are cleaned up by the next one created.
+		late := store.DeviceCode{Hash: "d3", UserCodeHash: "u3", ClientID: "cli", Interval: 5 * time.Second, ExpiresAt: now.Add(time.Minute)}
+		if err := s.CreateDeviceCode(ctx, late, now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PollDeviceCode(ctx, "d3", now.Add(time.Minute)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("late poll: expected ErrTokenExpired, got %v", err)
+		}
+		if err := s.CreateDeviceCode(ctx, store.DeviceCode{Hash: "d4", UserCodeHash: "u4", ClientID: "cli", ExpiresAt: now.Add(time.Minute)}, now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreateDeviceCode(ctx, store.DeviceCode{Hash: "d5", UserCodeHash: "u4", ClientID: "cli", ExpiresAt: now.Add(3 * time.Minute)}, now.Add(2*time.Minute)); err != nil {
+			t.Errorf("user code of an expired request: expected it freed, got %v", err)
+		}
+		if err := s.DeleteOAuthClient(ctx, "cli"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PollDeviceCode(ctx, "d5", now.Add(2*time.Minute)); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("request of a deleted client: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("OAuth Revocation", func(t *testing.T) {
+		s := newStore(t)
+		now := time.Now().Truncate(time.Second)
+		for _, id := range []string{"t1", "t1"} {
+			if err := s.RevokeOAuthToken(ctx, id, now.Add(time.Minute), now); err != nil {
+				t.Fatalf("revoking %s: %v", id, err)
+			}
+		}
+		if revoked, err := s.OAuthTokenRevoked(ctx, "t1"); err != nil || !revoked {
+			t.Errorf("expected t1 revoked, got %v, %v", revoked, err)
+		}
+		if revoked, err := s.OAuthTokenRevoked(ctx, "t2"); err != nil || revoked {
+			t.Errorf("expected t2 not revoked, got %v, %v", revoked, err)
+		}
+		// Once t1 has expired the next revocation cleans it up.
+		if err := s.RevokeOAuthToken(ctx, "t2", now.Add(2*time.Minute), now.Add(time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+		if revoked, err := s.OAuthTokenRevoked(ctx, "t1"); err != nil || revoked {
+			t.Errorf("expected the expired t1 cleaned up, got %v, %v", revoked, err)
+		}
+	})
+
+	t.Run("SAML Tenants", func(t *testing.T) {
+		s := newStore(t)
+		now := time.Now().Truncate(time.Second)
+		acme := store.SAMLTenant{ID: "acme", Name: "Acme", Metadata: "<md/>", Domains: []string{"acme.com", "acme.org"}, EmailAttribute: "mail", CreatedAt: now, UpdatedAt: now}
+		if err := s.PutSAMLTenant(ctx, acme); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutSAMLTenant(ctx, store.SAMLTenant{ID: "other", Name: "Other", Domains: []string{"acme.org"}, CreatedAt: now, UpdatedAt: now}); !errors.Is(err, store.ErrConflict) {
+			t.Errorf("taking another tenant's domain: expected ErrConflict, got %v", err)
+		}
+		if err := s.PutSAMLTenant(ctx, store.SAMLTenant{ID: "beta", Name: "Beta", Domains: []string{"beta.com"}, CreatedAt: now, UpdatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Replacing keeps the creation time and the domains follow.
+		acme.Name, acme.Domains, acme.CreatedAt, acme.UpdatedAt = "Acme Corp", []string{"acme.com"}, now.Add(time.Hour), now.Add(time.Minute)
+		if err := s.PutSAMLTenant(ctx, acme); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.SAMLTenant(ctx, "acme")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != "Acme Corp" || got.EmailAttribute != "mail" || len(got.Domains) != 1 || !got.CreatedAt.Equal(now) || !got.UpdatedAt.Equal(now.Add(time.Minute)) {
+			t.Errorf("unexpected tenant %+v", got)
+		}
+		if got, err := s.SAMLTenantByDomain(ctx, "acme.com"); err != nil || got.ID != "acme" {
+			t.Errorf("by domain: got %+v, %v", got, err)
+		}
+		if _, err := s.SAMLTenantByDomain(ctx, "acme.org"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("released domain: expected ErrNotFound, got %v", err)
+		}
+
+		tenants, err := s.SAMLTenants(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(tenants) != 2 || tenants[0].ID != "acme" || tenants[1].ID != "beta" || len(tenants[1].Domains) != 1 {
+			t.Errorf("unexpected tenants %+v", tenants)
+		}
+
+		if err := s.CreateSAMLRequest(ctx, "r1", "acme", now.Add(time.Minute), now); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteSAMLTenant(ctx, "acme"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteSAMLTenant(ctx, "acme"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("deleting twice: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.SAMLTenantByDomain(ctx, "acme.com"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("domain of a deleted tenant: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.RedeemSAMLRequest(ctx, "r1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("request of a deleted tenant: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("SAML Requests", func(t *testing.T) {
+		s := newStore(t)
+		now := time.Now().Truncate(time.Second)
+		if err := s.PutSAMLTenant(ctx, store.SAMLTenant{ID: "acme", Name: "Acme", CreatedAt: now, UpdatedAt: now}); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"r1", "r2"} {
+			if err := s.CreateSAMLRequest(ctx, id, "acme", now.Add(time.Minute), now); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if tenant, err := s.RedeemSAMLRequest(ctx, "r1", now); err != nil || tenant != "acme" {
+			t.Errorf("redeeming: got %q, %v", tenant, err)
+		}
+		if _, err := s.RedeemSAMLRequest(ctx, "r1", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("redeeming twice: expected ErrNotFound, got %v", err)
+		}
+		if _, err := s.RedeemSAMLRequest(ctx, "r2", now.Add(time.Minute)); !errors.Is(err, store.ErrTokenExpired) {
+			t.Errorf("redeeming late: expected ErrTokenExpired, got %v", err)
+		}
+		if _, err := s.RedeemSAMLRequest(ctx, "r2", now); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("an expired request is used up: expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("SAML Users", func(t *testing.T) {
+		s := newStore(t)
+		change := store.Change{Actor: "s@acme.com", Source: store.SourceSAML}
+		created, err := s.UpsertSAML(ctx, "s@acme.com", store.ProfileUpdate{FullName: "First", Telephone: "+15550100"}, change)
+		if err != nil || !created {
+			t.Fatalf("create: got %v, %v", created, err)
+		}
+		created, err = s.UpsertSAML(ctx, "s@acme.com", store.ProfileUpdate{FullName: "Second"}, change)
+		if err != nil || created {
+			t.Fatalf("update: got %v, %v", created, err)
+		}
+		u, err := s.GetByEmail(ctx, "s@acme.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Provider != "saml" || u.FullName != "Second" || u.Telephone != "+15550100" {
+			t.Errorf("unexpected user %+v", u)
+		}
+		revs, err := s.Revisions(ctx, "s@acme.com", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Provisioning is recorded too, as the profile came from the IdP.
+		if len(revs) != 2 || revs[0].NewFullName != "Second" || revs[1].NewTelephone != "+15550100" || revs[0].Source != store.SourceSAML {
+			t.Errorf("unexpected revisions %+v", revs)
+		}
+
+		if err := s.CreateLocal(ctx, "l@acme.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		if created, err := s.UpsertSAML(ctx, "l@acme.com", store.ProfileUpdate{FullName: "Local"}, change); err != nil || created {
+			t.Errorf("existing local user: got %v, %v", created, err)
+		}
+	})
+
+	t.Run("LDAP Users", func(t *testing.T) {
+		s := newStore(t)
+		change := store.Change{Actor: "d@ex.com", Source: store.SourceLDAP}
+		created, err := s.UpsertLDAP(ctx, "d@ex.com", store.ProfileUpdate{FullName: "Dee"}, store.RoleAdmin, change)
+		if err != nil || !created {
+			t.Fatalf("create: got %v, %v", created, err)
+		}
+		u, err := s.GetByEmail(ctx, "d@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Provider != "ldap" || u.FullName != "Dee" || u.Role != store.RoleAdmin || u.HasPassword {
+			t.Errorf("unexpected user %+v", u)
+		}
+		// An empty role leaves the user's as it is.
+		if _, err := s.UpsertLDAP(ctx, "d@ex.com", store.ProfileUpdate{}, "", change); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := s.GetByEmail(ctx, "d@ex.com"); err != nil || u.Role != store.RoleAdmin || u.FullName != "Dee" {
+			t.Errorf("expected the role and name kept, got %+v, %v", u, err)
+		}
+		if _, err := s.UpsertLDAP(ctx, "d@ex.com", store.ProfileUpdate{}, store.RoleUser, change); err != nil {
+			t.Fatal(err)
+		}
+		if u, err := s.GetByEmail(ctx, "d@ex.com"); err != nil || u.Role != store.RoleUser {
+			t.Errorf("expected the role taken away, got %+v, %v", u, err)
+		}
+
+		// A local account of the same email becomes the directory's.
+		if err := s.CreateLocal(ctx, "l@ex.com", "pass"); err != nil {
+			t.Fatal(err)
+		}
+		before, err := s.GetByEmail(ctx, "l@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created, err := s.UpsertLDAP(ctx, "l@ex.com", store.ProfileUpdate{}, "", change); err != nil || created {
+			t.Fatalf("take over: got %v, %v", created, err)
+		}
+		u, err = s.GetByEmail(ctx, "l@ex.com")
+		if err != nil || u.ID != before.ID || u.Provider != "ldap" || u.HasPassword || u.Version == before.Version {
+			t.Errorf("expected the account taken over without its password, got %+v, %v", u, err)
+		}
+		if _, err := s.Authenticate(ctx, "l@ex.com", "pass"); !errors.Is(err, store.ErrNotFound) {
+			t.Errorf("expected the local password refused, got %v", err)
+		}
+	})
+
+	// The version backs the profile's ETag, so everything the profile
+	// shows must bump it.
+	t.Run("Version Follows What The Profile Shows", func(t *testing.T) {
+		s := newStore(t)
+		if _, err := s.UpsertGoogle(ctx, "g@ex.com", "Gee", store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutAttributeDefinition(ctx, store.AttributeDefinition{Name: "title", Type: store.AttrString, Visibility: store.VisibilityUser}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateProfile(ctx, "g@ex.com", store.ProfileUpdate{FullName: "Gee", Attributes: map[string]string{"title": "Engineer"}}, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		version := func() int64 {
+			t.Helper()
+			u, err := s.GetByEmail(ctx, "g@ex.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return u.Version
+		}
+
+		before := version()
+		if err := s.SetPassword(ctx, "g@ex.com", "first pass", time.Time{}); err != nil {
+			t.Fatal(err)
+		}
+		if v := version(); v == before {
+			t.Error("expected a first password to bump the version")
+		} else if err := s.SetPassword(ctx, "g@ex.com", "second pass", time.Time{}); err != nil || version() != v {
+			t.Errorf("expected a new password to keep the version, got %v", err)
+		}
+
+		before = version()
+		if err := s.PutAttributeDefinition(ctx, store.AttributeDefinition{Name: "title", Type: store.AttrString, Visibility: store.VisibilityAdmin}); err != nil {
+			t.Fatal(err)
+		}
+		if version() == before {
+			t.Error("expected a visibility change to bump the version")
+		}
+
+		if _, err := s.UpsertLDAP(ctx, "l@ex.com", store.ProfileUpdate{}, store.RoleUser, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		u, err := s.GetByEmail(ctx, "l@ex.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.UpsertLDAP(ctx, "l@ex.com", store.ProfileUpdate{}, store.RoleAdmin, store.Change{}); err != nil {
+			t.Fatal(err)
+		}
+		if after, err := s.GetByEmail(ctx, "l@ex.com"); err != nil || after.Version == u.Version {
+			t.Errorf("expected a role change to bump the version, got %+v, %v", after, err)
+		}
+	})
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Access token scopes are stored space separated, as OAuth writes them.
+
+const accessTokenColumns = "t.id, t.name, t.prefix, t.token_hash, t.scopes, t.created_at, t.expires_at, t.last_used_at, t.last_used_ip"
+
+// scanAccessToken reads accessTokenColumns, followed by extra.
+func scanAccessToken(row rowScanner, t *AccessToken, extra ...any) error {
+	var (
+		scopes              string
+		expiresAt, lastUsed sql.NullTime
+		lastUsedIP          sql.NullString
+	)
+	dest := append([]any{&t.ID, &t.Name, &t.Prefix, &t.Hash, &scopes, &t.CreatedAt, &expiresAt, &lastUsed, &lastUsedIP}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return err
+	}
+	t.Scopes = strings.Fields(scopes)
+	t.ExpiresAt, t.LastUsedAt, t.LastUsedIP = expiresAt.Time, lastUsed.Time, lastUsedIP.String
+	return nil
+}
+
+func (s *SQL) CreateAccessToken(ctx context.Context, email string, t *AccessToken) error {
+	expiresAt := sql.NullTime{Time: t.ExpiresAt.UTC(), Valid: !t.ExpiresAt.IsZero()}
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, s.Dialect.Rebind(
+			"INSERT INTO access_tokens (user_id, name, prefix, token_hash, scopes, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)"),
+			u.ID, t.Name, t.Prefix, t.Hash, strings.Join(t.Scopes, " "), t.CreatedAt.UTC(), expiresAt)
+		if s.Dialect.IsUniqueViolation(err) {
+			return ErrConflict
+		}
+		if err != nil {
+			return wrap(err)
+		}
+		// The hash is unique, and unlike LastInsertId works on PostgreSQL.
+		return wrap(tx.QueryRowContext(ctx, s.Dialect.Rebind("SELECT id FROM access_tokens WHERE token_hash=?"), t.Hash).Scan(&t.ID))
+	})
+}
+
+func (s *SQL) AccessTokens(ctx context.Context, email string) ([]AccessToken, error) {
+	tokens := []AccessToken{}
+	err := s.readRows(ctx, email, func(rows *sql.Rows) error {
+		var t AccessToken
+		if err := scanAccessToken(rows, &t); err != nil {
+			return err
+		}
+		t.Email = email
+		tokens = append(tokens, t)
+		return nil
+	}, "SELECT "+accessTokenColumns+" FROM access_tokens t JOIN users u ON u.id = t.user_id WHERE u."+byEmail+" ORDER BY t.id DESC",
+		s.emailIndexes(email)...)
+	if err != nil {
+		return nil, err
+	}
+	return tokens, nil
+}
+
+func (s *SQL) DeleteAccessToken(ctx context.Context, email string, id int64) error {
+	return s.tx(ctx, email, func(tx *sql.Tx) error {
+		u, err := s.lockUser(ctx, tx, email)
+		if err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, s.Dialect.Rebind("DELETE FROM access_tokens WHERE id=? AND user_id=?"), id, u.ID)
+		if err != nil {
+			return wrap(err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// usedEvery is how often the last use of a token is written when it keeps
+// being used from the same address.
+const usedEvery = time.Minute
+
+// UseAccessToken reads from the primary: a token revoked a moment ago must
+// not keep working on a lagging replica.
+func (s *SQL) UseAccessToken(ctx context.Context, hash, ip string, now time.Time) (*AccessToken, error) {
+	t, err := s.GetAccessToken(ctx, hash, now)
+	if err != nil {
+		return nil, err
+	}
+	if ip != t.LastUsedIP || now.Sub(t.LastUsedAt) >= usedEvery {
+		_, err = s.DB.ExecContext(ctx, s.Dialect.Rebind("UPDATE access_tokens SET last_used_at=?, last_used_ip=? WHERE id=?"), now.UTC(), ip, t.ID)
+		if err != nil {
+			return nil, wrap(err)
+		}
+		t.LastUsedAt, t.LastUsedIP = now, ip
+	}
+	return t, nil
+}
+
+// GetAccessToken reads from the primary, like UseAccessToken.
+func (s *SQL) GetAccessToken(ctx context.Context, hash string, now time.Time) (*AccessToken, error) {
+	var t AccessToken
+	row := s.DB.QueryRowContext(ctx, s.Dialect.Rebind(
+		"SELECT "+accessTokenColumns+", u.email FROM access_tokens t JOIN users u ON u.id = t.user_id WHERE t.token_hash=?"), hash)
+	err := scanAccessToken(row, &t, &t.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, wrap(err)
+	}
+	if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+		return nil, ErrTokenExpired
+	}
+	if t.Email, err = s.Cipher.Decrypt("email", t.Email); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
@@ -0,0 +1,31 @@
+package validate
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// MaxEmail is the longest address a mail server has to accept (RFC 5321).
+const MaxEmail = 254
+
+// NormalizeEmail trims addr and lower-cases its domain, and reports
+// whether it is a bare address such as name@example.com: no display name,
+// no angle brackets, and a domain with at least one dot. The local part
+// keeps its case, since servers may treat it as case sensitive; lookups by
+// address ignore case anyway.
+func NormalizeEmail(addr string) (string, bool) {
+	addr = strings.TrimSpace(addr)
+	if len(addr) > MaxEmail {
+		return addr, false
+	}
+	parsed, err := mail.ParseAddress(addr)
+	if err != nil || parsed.Address != addr {
+		return addr, false
+	}
+	at := strings.LastIndexByte(addr, '@')
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+	if !strings.Contains(domain, ".") || strings.HasSuffix(domain, ".") {
+		return addr, false
+	}
+	return local + "@" + domain, true
+}
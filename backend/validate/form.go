@@ -0,0 +1,39 @@
+package validate
+
+import (
+	"net/url"
+	"reflect"
+)
+
+// DecodeForm copies form values into the string fields of the struct v
+// points to, matching keys to JSON names. Keys v has no string field for
+// are reported as Errors, as DecodeJSON does for unknown members.
+func DecodeForm(values url.Values, v any) error {
+	fields := map[string]reflect.Value{}
+	stringFields(reflect.ValueOf(v).Elem(), fields)
+	errs := Errors{}
+	for key, vals := range values {
+		fv, ok := fields[key]
+		if !ok {
+			errs.Add(key, "Unknown field "+key)
+			continue
+		}
+		if len(vals) > 0 {
+			fv.SetString(vals[0])
+		}
+	}
+	return errs.Err()
+}
+
+func stringFields(rv reflect.Value, fields map[string]reflect.Value) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		switch {
+		case sf.Anonymous && sf.Type.Kind() == reflect.Struct:
+			stringFields(rv.Field(i), fields)
+		case sf.IsExported() && sf.Type.Kind() == reflect.String:
+			fields[jsonName(sf)] = rv.Field(i)
+		}
+	}
+}
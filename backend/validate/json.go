@@ -0,0 +1,53 @@
+package validate
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrBody is returned by DecodeJSON for a body that is not a single JSON
+// object.
+var ErrBody = errors.New("validate: body is not a JSON object")
+
+// DecodeJSON decodes the JSON object in body into v. Members v has no
+// field for, and members of the wrong type, are reported as Errors naming
+// the member; anything else that is not one JSON object is ErrBody.
+func DecodeJSON(body io.Reader, v any) error {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeErr) && typeErr.Field != "":
+			return Errors{typeErr.Field: fmt.Sprintf("%s must be a %s", Label(typeErr.Field), jsonType(typeErr.Type.Kind().String()))}
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+			return Errors{field: "Unknown field " + field}
+		}
+		return fmt.Errorf("%w: %w", ErrBody, err)
+	}
+	if dec.More() {
+		return fmt.Errorf("%w: data after the object", ErrBody)
+	}
+	return nil
+}
+
+// jsonType names a Go kind the way a JSON client knows it.
+func jsonType(kind string) string {
+	switch {
+	case kind == "string":
+		return "string"
+	case kind == "bool":
+		return "boolean"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "map", kind == "struct":
+		return "object"
+	case kind == "slice", kind == "array":
+		return "list"
+	}
+	return kind
+}
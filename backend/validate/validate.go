@@ -0,0 +1,248 @@
+// Package validate checks request input against rules declared in struct
+// tags and reports every field that fails at once, keyed by the field's
+// JSON name, so forms can mark each input.
+//
+// Rules go in a `validate` tag, separated by commas:
+//
+//	trim      remove surrounding white space before the other rules
+//	required  not empty, or not zero for numbers
+//	email     an address such as name@example.com; normalized in place
+//	min=N     at least N characters, or at least N for numbers
+//	max=N     at most N characters, or at most N for numbers
+//	len=N     exactly N characters
+//	digits    only the digits 0-9
+//
+// A `message` tag replaces the message of every rule on the field. Empty
+// optional fields skip every rule but required. Pointer fields that are nil
+// count as empty.
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Errors maps field names to what is wrong with them.
+type Errors map[string]string
+
+// Add records msg for field. A field keeps its first message, so the
+// first rule it fails is the one reported.
+func (e Errors) Add(field, msg string) {
+	if _, ok := e[field]; !ok {
+		e[field] = msg
+	}
+}
+
+// Err returns e as an error, or nil when no field failed.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+func (e Errors) Error() string {
+	fields := make([]string, 0, len(e))
+	for field := range e {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	var b strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(field + ": " + e[field])
+	}
+	return b.String()
+}
+
+// Struct checks the fields of the struct v points to and returns the
+// failures as Errors, or nil. trim and email rewrite the fields they
+// apply to. Struct panics if a tag names an unknown rule, since that is a
+// programming error rather than bad input.
+func Struct(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		panic("validate: Struct needs a pointer to a struct")
+	}
+	errs := Errors{}
+	errs.checkStruct(rv.Elem())
+	return errs.Err()
+}
+
+// Check is Struct for callers that collect failures from several checks
+// before answering: it adds the failures to e.
+func (e Errors) Check(v any) {
+	e.Merge(Struct(v))
+}
+
+// Merge adds the field errors in err to e. It returns err when err is
+// some other error, and nil otherwise.
+func (e Errors) Merge(err error) error {
+	var errs Errors
+	if !errors.As(err, &errs) {
+		return err
+	}
+	for field, msg := range errs {
+		e.Add(field, msg)
+	}
+	return nil
+}
+
+func (e Errors) checkStruct(rv reflect.Value) {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct {
+			e.checkStruct(rv.Field(i))
+			continue
+		}
+		tag, ok := sf.Tag.Lookup("validate")
+		if !ok || !sf.IsExported() {
+			continue
+		}
+		name := jsonName(sf)
+		if msg := checkField(rv.Field(i), name, strings.Split(tag, ",")); msg != "" {
+			if custom := sf.Tag.Get("message"); custom != "" {
+				msg = custom
+			}
+			e.Add(name, msg)
+		}
+	}
+}
+
+// jsonName is the name a field has in JSON bodies and form posts.
+func jsonName(sf reflect.StructField) string {
+	name, _, _ := strings.Cut(sf.Tag.Get("json"), ",")
+	if name == "" || name == "-" {
+		return sf.Name
+	}
+	return name
+}
+
+// Label turns a field name such as full_name into "Full name" for
+// messages.
+func Label(field string) string {
+	label := strings.ReplaceAll(field, "_", " ")
+	if label == "" {
+		return label
+	}
+	return strings.ToUpper(label[:1]) + label[1:]
+}
+
+func checkField(fv reflect.Value, name string, rules []string) string {
+	if fv.Kind() == reflect.Pointer {
+		if fv.IsNil() {
+			if hasRule(rules, "required") {
+				return Label(name) + " is required"
+			}
+			return ""
+		}
+		fv = fv.Elem()
+	}
+	switch fv.Kind() {
+	case reflect.String:
+		return checkString(fv, name, rules)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return checkInt(fv.Int(), name, rules)
+	}
+	panic("validate: unsupported field type " + fv.Type().String())
+}
+
+func checkString(fv reflect.Value, name string, rules []string) string {
+	label := Label(name)
+	s := fv.String()
+	if hasRule(rules, "trim") {
+		s = strings.TrimSpace(s)
+		fv.SetString(s)
+	}
+	if s == "" {
+		if hasRule(rules, "required") {
+			return label + " is required"
+		}
+		return ""
+	}
+	n := utf8.RuneCountInString(s)
+	for _, rule := range rules {
+		key, arg, _ := strings.Cut(rule, "=")
+		switch key {
+		case "trim", "required":
+		case "email":
+			addr, ok := NormalizeEmail(s)
+			if !ok {
+				return "Enter an email address such as name@example.com"
+			}
+			s = addr
+			fv.SetString(s)
+		case "min":
+			if n < number(rule, arg) {
+				return fmt.Sprintf("%s must be at least %s characters", label, arg)
+			}
+		case "max":
+			if n > number(rule, arg) {
+				return fmt.Sprintf("%s must be at most %s characters", label, arg)
+			}
+		case "len":
+			if n != number(rule, arg) {
+				return fmt.Sprintf("%s must be %s characters", label, arg)
+			}
+		case "digits":
+			if strings.Trim(s, "0123456789") != "" {
+				return label + " must contain only digits"
+			}
+		default:
+			panic("validate: unknown rule " + strconv.Quote(rule))
+		}
+	}
+	return ""
+}
+
+func checkInt(v int64, name string, rules []string) string {
+	label := Label(name)
+	if v == 0 {
+		if hasRule(rules, "required") {
+			return label + " is required"
+		}
+		return ""
+	}
+	for _, rule := range rules {
+		key, arg, _ := strings.Cut(rule, "=")
+		switch key {
+		case "required":
+		case "min":
+			if v < int64(number(rule, arg)) {
+				return fmt.Sprintf("%s must be at least %s", label, arg)
+			}
+		case "max":
+			if v > int64(number(rule, arg)) {
+				return fmt.Sprintf("%s must be at most %s", label, arg)
+			}
+		default:
+			panic("validate: rule " + strconv.Quote(rule) + " does not apply to numbers")
+		}
+	}
+	return ""
+}
+
+func hasRule(rules []string, want string) bool {
+	for _, rule := range rules {
+		if rule == want {
+			return true
+		}
+	}
+	return false
+}
+
+func number(rule, arg string) int {
+	n, err := strconv.Atoi(arg)
+	if err != nil {
+		panic("validate: rule " + strconv.Quote(rule) + " needs a number")
+	}
+	return n
+}
@@ -0,0 +1,132 @@
+package validate
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStruct(t *testing.T) {
+	type signup struct {
+		Email    string  `json:"email" validate:"required,email,max=255"`
+		Password string  `json:"password" validate:"required,min=8"`
+		FullName string  `json:"full_name" validate:"trim,max=10"`
+		Code     *string `json:"code" validate:"len=6,digits" message:"Enter the 6-digit code"`
+		Revision int64   `json:"revision_id" validate:"required,min=1"`
+	}
+
+	t.Run("Valid", func(t *testing.T) {
+		code := "123456"
+		in := signup{Email: " Jane@Example.COM ", Password: "long enough", FullName: "  Jane  ", Code: &code, Revision: 3}
+		if err := Struct(&in); err != nil {
+			t.Fatal(err)
+		}
+		if in.Email != "Jane@example.com" || in.FullName != "Jane" {
+			t.Errorf("expected normalized fields, got %+v", in)
+		}
+	})
+
+	t.Run("Every Failure", func(t *testing.T) {
+		code := "12ab"
+		err := Struct(&signup{Email: "jane", Password: "short", FullName: strings.Repeat("x", 11), Code: &code, Revision: -1})
+		var errs Errors
+		if !errors.As(err, &errs) {
+			t.Fatalf("expected Errors, got %v", err)
+		}
+		want := Errors{
+			"email":       "Enter an email address such as name@example.com",
+			"password":    "Password must be at least 8 characters",
+			"full_name":   "Full name must be at most 10 characters",
+			"code":        "Enter the 6-digit code",
+			"revision_id": "Revision id must be at least 1",
+		}
+		for field, msg := range want {
+			if errs[field] != msg {
+				t.Errorf("%s: expected %q, got %q", field, msg, errs[field])
+			}
+		}
+		if len(errs) != len(want) {
+			t.Errorf("unexpected errors %v", errs)
+		}
+	})
+
+	t.Run("Required", func(t *testing.T) {
+		err := Struct(&signup{})
+		var errs Errors
+		errors.As(err, &errs)
+		if errs["email"] != "Email is required" || errs["password"] != "Password is required" || errs["revision_id"] == "" {
+			t.Errorf("unexpected errors %v", errs)
+		}
+		if _, ok := errs["code"]; ok {
+			t.Error("an absent optional field must not be checked")
+		}
+	})
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for in, want := range map[string]string{
+		"name@example.com":                 "name@example.com",
+		"  Name@Example.COM\n":             "Name@example.com",
+		"first.last+tag@sub.io":            "first.last+tag@sub.io",
+		"Jane <jane@example.com>":          "",
+		"jane@localhost":                   "",
+		"jane@example.com.":                "",
+		"@example.com":                     "",
+		"jane":                             "",
+		strings.Repeat("a", 250) + "@b.co": "",
+	} {
+		got, ok := NormalizeEmail(in)
+		if ok != (want != "") || (ok && got != want) {
+			t.Errorf("%q: expected %q, got %q (ok %v)", in, want, got, ok)
+		}
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type body struct {
+		FullName string `json:"full_name"`
+		Age      int    `json:"age"`
+	}
+
+	var b body
+	if err := DecodeJSON(strings.NewReader(`{"full_name":"Jane","age":3}`), &b); err != nil || b.FullName != "Jane" {
+		t.Fatalf("unexpected result %+v, %v", b, err)
+	}
+
+	for in, want := range map[string]Errors{
+		`{"full_name":"Jane","role":"admin"}`: {"role": "Unknown field role"},
+		`{"age":"three"}`:                     {"age": "Age must be a number"},
+	} {
+		var errs Errors
+		if err := DecodeJSON(strings.NewReader(in), &body{}); !errors.As(err, &errs) || len(errs) != 1 {
+			t.Errorf("%s: expected field errors, got %v", in, err)
+			continue
+		}
+		for field, msg := range want {
+			if errs[field] != msg {
+				t.Errorf("%s: expected %q, got %q", in, msg, errs[field])
+			}
+		}
+	}
+
+	for _, in := range []string{`not json`, `[1]`, `{"full_name":"a"} {}`, ``} {
+		if err := DecodeJSON(strings.NewReader(in), &body{}); !errors.Is(err, ErrBody) {
+			t.Errorf("%q: expected ErrBody, got %v", in, err)
+		}
+	}
+}
+
+func TestDecodeForm(t *testing.T) {
+	var in struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	err := DecodeForm(map[string][]string{"email": {"a@b.co"}, "password": {"secret"}}, &in)
+	if err != nil || in.Email != "a@b.co" || in.Password != "secret" {
+		t.Fatalf("unexpected result %+v, %v", in, err)
+	}
+	var errs Errors
+	if err := DecodeForm(map[string][]string{"role": {"admin"}}, &in); !errors.As(err, &errs) || errs["role"] == "" {
+		t.Errorf("expected an unknown field error, got %v", err)
+	}
+}
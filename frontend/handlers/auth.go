@@ -3,6 +3,7 @@ package handlers
 import (
 	"encoding/json"
 	"html/template"
+	"io"
 	"net/http"
 	"net/url"
 	"time"
@@ -14,13 +15,44 @@ type AuthHandler struct {
 	Client     *http.Client
 }
 
+// AuthPage is what the login and signup forms show after a failed
+// attempt: the message for the whole form, messages for single fields and
+// the email typed, so it need not be typed again.
+type AuthPage struct {
+	Error  string
+	Fields map[string]string
+	Email  string
+}
+
+// authPage describes a login or signup the backend refused. Field errors
+// are shown next to their inputs; anything else above the form.
+func authPage(r *http.Request, p *Problem) AuthPage {
+	page := AuthPage{Email: r.FormValue("email"), Fields: p.FieldErrors()}
+	if len(page.Fields) == 0 {
+		page.Error = p.Message()
+	}
+	return page
+}
+
+func (h *AuthHandler) renderAuth(w http.ResponseWriter, name string, page AuthPage) {
+	if err := h.Tmpl.ExecuteTemplate(w, name, page); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// loginErrors are the messages for the errors sign-in providers send the
+// user back to the login page with.
+var loginErrors = map[string]string{
+	"sso": "Single sign-on did not work. Check the email you typed, or ask your administrator whether your organization uses it.",
+}
+
 func (h *AuthHandler) ShowLogin(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie("session_token")
 	if err == nil && cookie.Value != "" {
 		http.Redirect(w, r, "/profile", http.StatusSeeOther)
 		return
 	}
-	if err := h.Tmpl.ExecuteTemplate(w, "login.html", nil); err != nil {
+	if err := h.Tmpl.ExecuteTemplate(w, "login.html", AuthPage{Error: loginErrors[r.URL.Query().Get("error")]}); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -37,15 +69,15 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 	form.Add("password", r.FormValue("password"))
 
 	resp, err := h.Client.PostForm(h.APIBaseURL+"/auth/login", form)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		if e := h.Tmpl.ExecuteTemplate(w, "login.html", map[string]string{
-			"Error": "Invalid credentials",
-		}); e != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+	if err != nil {
+		h.renderAuth(w, "login.html", AuthPage{Email: r.FormValue("email"), Error: "Login is unavailable right now. Please try again."})
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		h.renderAuth(w, "login.html", authPage(r, decodeProblem(resp)))
+		return
+	}
 
 	var result struct {
 		Token string `json:"token"`
@@ -65,7 +97,21 @@ func (h *AuthHandler) Login(w http.ResponseWriter, r *http.Request) {
 		MaxAge:   86400,
 	})
 
-	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	http.Redirect(w, r, loginNext(w, r), http.StatusSeeOther)
+}
+
+// loginNextCookie remembers a page that sent the user to sign in, such as
+// an OAuth consent page, to return to afterwards.
+const loginNextCookie = "login_next"
+
+// loginNext returns the page to go to after signing in and forgets it.
+func loginNext(w http.ResponseWriter, r *http.Request) string {
+	c, err := r.Cookie(loginNextCookie)
+	if err != nil {
+		return "/profile"
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginNextCookie, Path: "/", MaxAge: -1})
+	return localPath(c.Value)
 }
 
 func (h *AuthHandler) AuthCallback(w http.ResponseWriter, r *http.Request) {
@@ -85,11 +131,16 @@ func (h *AuthHandler) AuthCallback(w http.ResponseWriter, r *http.Request) {
 		MaxAge:   86400,
 	})
 
-	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	next := loginNext(w, r)
+	if c, err := r.Cookie(reauthNextCookie); err == nil {
+		next = localPath(c.Value)
+		http.SetCookie(w, &http.Cookie{Name: reauthNextCookie, Path: "/auth/callback", MaxAge: -1})
+	}
+	http.Redirect(w, r, next, http.StatusSeeOther)
 }
 
 func (h *AuthHandler) ShowSignup(w http.ResponseWriter, r *http.Request) {
-	if err := h.Tmpl.ExecuteTemplate(w, "signup.html", nil); err != nil {
+	if err := h.Tmpl.ExecuteTemplate(w, "signup.html", AuthPage{}); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
@@ -106,19 +157,49 @@ func (h *AuthHandler) Signup(w http.ResponseWriter, r *http.Request) {
 	form.Add("password", r.FormValue("password"))
 
 	resp, err := h.Client.PostForm(h.APIBaseURL+"/auth/signup", form)
-	if err != nil || resp.StatusCode != http.StatusCreated {
-		if e := h.Tmpl.ExecuteTemplate(w, "signup.html", map[string]string{
-			"Error": "Signup failed. Please try again.",
-		}); e != nil {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
-		}
+	if err != nil {
+		h.renderAuth(w, "signup.html", AuthPage{Email: r.FormValue("email"), Error: "Signup failed. Please try again."})
 		return
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		h.renderAuth(w, "signup.html", authPage(r, decodeProblem(resp)))
+		return
+	}
 
 	http.Redirect(w, r, "/login?signup=success", http.StatusSeeOther)
 }
 
+// PasswordStrength relays the backend's rating of the password typed on
+// the signup page to the meter under it.
+func (h *AuthHandler) PasswordStrength(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	form := url.Values{}
+	form.Add("email", r.FormValue("email"))
+	form.Add("password", r.FormValue("password"))
+
+	resp, err := h.Client.PostForm(h.APIBaseURL+"/auth/password/strength", form)
+	if err != nil {
+		http.Error(w, "Password rating is unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		p := decodeProblem(resp)
+		http.Error(w, p.Message(), p.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_, _ = io.Copy(w, io.LimitReader(resp.Body, 64<<10))
+}
+
 func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     "session_token",
@@ -131,6 +212,26 @@ func (h *AuthHandler) Logout(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
 
+// GoogleAuth signs in with Google. With reauth set, Google asks the user
+// to sign in even when they already are, and the callback returns to next.
 func (h *AuthHandler) GoogleAuth(w http.ResponseWriter, r *http.Request) {
-	http.Redirect(w, r, h.APIBaseURL+"/auth/google", http.StatusSeeOther)
+	if r.URL.Query().Get("reauth") == "" {
+		http.Redirect(w, r, h.APIBaseURL+"/auth/google", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     reauthNextCookie,
+		Value:    localPath(r.URL.Query().Get("next")),
+		Path:     "/auth/callback",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, h.APIBaseURL+"/auth/google?reauth=1", http.StatusSeeOther)
+}
+
+// SAMLAuth signs in with the SAML identity provider of the organization
+// that owns the domain of the email typed.
+func (h *AuthHandler) SAMLAuth(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, h.APIBaseURL+"/auth/saml?email="+url.QueryEscape(r.FormValue("email")), http.StatusSeeOther)
 }
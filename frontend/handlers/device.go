@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// DevicePage is where users approve a device, such as a command line
+// tool, that showed them a code. Without ClientName it asks for the code.
+type DevicePage struct {
+	UserCode   string
+	ClientName string
+	Scopes     []string
+	// Done says what was decided, once the user has.
+	Done  string
+	Error string
+}
+
+// Describe is what scope lets the client see, for the template.
+func (p DevicePage) Describe(scope string) string {
+	return describeScope(scope)
+}
+
+// Device asks for the code a device shows on GET, and once there is one,
+// which client asks for what. POST passes the user's decision to the
+// backend. Users who are not signed in sign in first and come back here.
+func (h *ProfileHandler) Device(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimSpace(r.FormValue("user_code"))
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		h.loginFirst(w, r, "/device?user_code="+url.QueryEscape(code))
+		return
+	}
+	page := DevicePage{UserCode: code}
+	if code == "" {
+		h.render(w, "device.html", page)
+		return
+	}
+
+	var req *http.Request
+	baseURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/oauth/device"
+	if r.Method == http.MethodPost {
+		approve := r.FormValue("decision") == "approve"
+		reqBody, _ := json.Marshal(map[string]any{"user_code": code, "approve": approve})
+		req, err = http.NewRequestWithContext(r.Context(), http.MethodPost, baseURL, bytes.NewReader(reqBody))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		page.Done = "You denied the request. You can close this page."
+		if approve {
+			page.Done = "Your device is signed in. You can close this page and go back to it."
+		}
+	} else {
+		req, err = http.NewRequestWithContext(r.Context(), http.MethodGet, baseURL+"?user_code="+url.QueryEscape(code), nil)
+	}
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		page.Done, page.Error = "", "Signing in the device failed. Please try again."
+		h.render(w, "device.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		h.render(w, "device.html", page)
+		return
+	case http.StatusOK:
+		var result struct {
+			ClientName string   `json:"client_name"`
+			Scopes     []string `json:"scopes"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			page.Error = "Signing in the device failed. Please try again."
+		}
+		page.ClientName, page.Scopes = result.ClientName, result.Scopes
+		h.render(w, "device.html", page)
+		return
+	case http.StatusUnauthorized:
+		h.loginFirst(w, r, "/device?user_code="+url.QueryEscape(code))
+		return
+	}
+
+	p := decodeProblem(resp)
+	page.Done, page.Error = "", p.Field("user_code")
+	if page.Error == "" {
+		page.Error = p.Message()
+	}
+	w.WriteHeader(p.Status)
+	h.render(w, "device.html", page)
+}
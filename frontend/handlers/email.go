@@ -0,0 +1,190 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EmailPage is what the email confirm and revert pages show.
+type EmailPage struct {
+	Token   string
+	Email   string
+	Error   string
+	Message string
+}
+
+// linkErrors are the messages for a confirm or revert link the backend
+// refused, by problem code.
+var linkErrors = map[string]string{
+	"link_invalid": "This link is not valid or was already used.",
+	"link_expired": "This link has expired.",
+	"email_taken":  "That email address is now used by another account.",
+}
+
+// RequestEmail asks the backend to move the user to the address in the
+// form; the change takes effect once it is confirmed from the new inbox.
+func (h *ProfileHandler) RequestEmail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"email": r.FormValue("email")})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/email"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile/edit?error=email_failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		http.Redirect(w, r, "/profile/edit?notice=email_sent", http.StatusSeeOther)
+		return
+	}
+	switch decodeProblem(resp).Code {
+	case "reauthentication_required":
+		// Back to the form with the address filled in, to send again.
+		next := "/profile/edit?email=" + url.QueryEscape(r.FormValue("email"))
+		http.Redirect(w, r, reauthURL(next), http.StatusSeeOther)
+	case "validation_failed":
+		http.Redirect(w, r, "/profile/edit?error=email_invalid", http.StatusSeeOther)
+	case "email_taken":
+		http.Redirect(w, r, "/profile/edit?error=email_taken", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/profile/edit?error=email_failed", http.StatusSeeOther)
+	}
+}
+
+// ConfirmEmail shows the link from the new inbox as a button on GET, so
+// mail scanners that fetch links do not use it up, and completes the
+// change on POST.
+func (h *ProfileHandler) ConfirmEmail(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	page := EmailPage{Token: r.FormValue("token")}
+	if r.Method != http.MethodPost {
+		h.render(w, "email_confirm.html", page)
+		return
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"token": page.Token})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/email/confirm"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		page.Error = "Confirming your new email failed. Please try again."
+		h.render(w, "email_confirm.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		page.Error = linkErrors[decodeProblem(resp).Code]
+		if page.Error == "" {
+			page.Error = "Confirming your new email failed. Please try again."
+		}
+		page.Token = ""
+		h.render(w, "email_confirm.html", page)
+		return
+	}
+
+	// The old session names the old address; switch to the new one.
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Token == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    result.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   86400,
+	})
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// RevertEmail cancels or undoes an email change from the link sent to the
+// old address. Like ConfirmEmail it only acts on POST; it needs no login.
+func (h *ProfileHandler) RevertEmail(w http.ResponseWriter, r *http.Request) {
+	page := EmailPage{Token: r.FormValue("token")}
+	if r.Method != http.MethodPost {
+		h.render(w, "email_revert.html", page)
+		return
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"token": page.Token})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/email/revert"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	page.Token = ""
+	if err != nil {
+		page.Error = "Undoing the change failed. Please try again."
+		h.render(w, "email_revert.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		page.Error = linkErrors[decodeProblem(resp).Code]
+		if page.Error == "" {
+			page.Error = "Undoing the change failed. Please try again."
+		}
+		h.render(w, "email_revert.html", page)
+		return
+	}
+	var result struct {
+		Email string `json:"email"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	page.Email = result.Email
+	page.Message = "Your account uses " + result.Email + " again. If you did not ask for the change, change your password too."
+	h.render(w, "email_revert.html", page)
+}
+
+func (h *ProfileHandler) render(w http.ResponseWriter, name string, data any) {
+	if err := h.Tmpl.ExecuteTemplate(w, name, data); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
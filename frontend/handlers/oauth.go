@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ConsentPage asks the user whether a client may sign them in and read
+// what its scopes release.
+type ConsentPage struct {
+	ClientName string
+	Scopes     []string
+	// Action posts the decision back with the authorization request.
+	Action string
+	Error  string
+}
+
+// scopeDescriptions say what each scope lets a client see.
+var scopeDescriptions = map[string]string{
+	"openid":  "Know who you are",
+	"profile": "See your name and profile picture",
+	"email":   "See your email address",
+	"phone":   "See your telephone number",
+}
+
+// Describe is what scope lets the client see, for the template.
+func (p ConsentPage) Describe(scope string) string {
+	return describeScope(scope)
+}
+
+func describeScope(scope string) string {
+	if d, ok := scopeDescriptions[scope]; ok {
+		return d
+	}
+	return scope
+}
+
+// Consent is where the backend sends users signing in to an OAuth client.
+// GET shows what the client asks for; POST passes the user's decision to
+// the backend, which says where the browser goes next. Users who are not
+// signed in sign in first and come back here.
+func (h *ProfileHandler) Consent(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		h.loginFirst(w, r, "/oauth/consent?"+r.URL.RawQuery)
+		return
+	}
+	page := ConsentPage{Action: "/oauth/consent?" + r.URL.RawQuery}
+
+	method, body := http.MethodGet, io.Reader(nil)
+	if r.Method == http.MethodPost {
+		reqBody, _ := json.Marshal(map[string]bool{"approve": r.FormValue("decision") == "approve"})
+		method, body = http.MethodPost, bytes.NewReader(reqBody)
+	}
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/oauth/authorize?" + r.URL.RawQuery
+	req, err := http.NewRequestWithContext(r.Context(), method, fullURL, body)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		page.Error = "Signing in to the application failed. Please try again."
+		h.render(w, "oauth_consent.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		h.loginFirst(w, r, "/oauth/consent?"+r.URL.RawQuery)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		p := decodeProblem(resp)
+		page.Error = p.Message()
+		w.WriteHeader(p.Status)
+		h.render(w, "oauth_consent.html", page)
+		return
+	}
+
+	var result struct {
+		ClientName string   `json:"client_name"`
+		Scopes     []string `json:"scopes"`
+		RedirectTo string   `json:"redirect_to"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		page.Error = "Signing in to the application failed. Please try again."
+		h.render(w, "oauth_consent.html", page)
+		return
+	}
+	if result.RedirectTo != "" {
+		// The backend checked this is a redirect URI registered for the
+		// client.
+		http.Redirect(w, r, result.RedirectTo, http.StatusSeeOther)
+		return
+	}
+	page.ClientName, page.Scopes = result.ClientName, result.Scopes
+	h.render(w, "oauth_consent.html", page)
+}
+
+// loginFirst sends the user to sign in, then back to next.
+func (h *ProfileHandler) loginFirst(w http.ResponseWriter, r *http.Request, next string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginNextCookie,
+		Value:    next,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   600,
+	})
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
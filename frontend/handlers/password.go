@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var passwordErrors = map[string]string{
+	"failed": "Changing your password failed. Please try again.",
+}
+
+// ChangePassword shows the password form on GET and passes it on to the
+// backend on POST. The backend signs out every other session and answers
+// with a new token for this one.
+func (h *ProfileHandler) ChangePassword(w http.ResponseWriter, r *http.Request) {
+	vm, ok := h.getProfile(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodPost {
+		h.render(w, "profile_password.html", vm)
+		return
+	}
+
+	cookie, _ := r.Cookie("session_token")
+	reqBody, _ := json.Marshal(map[string]string{
+		"current_password": r.FormValue("current_password"),
+		"new_password":     r.FormValue("new_password"),
+	})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/account/password"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		vm.Error = passwordErrors["failed"]
+		h.render(w, "profile_password.html", vm)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		p := decodeProblem(resp)
+		if p.Code == "reauthentication_required" {
+			http.Redirect(w, r, reauthURL("/profile/password"), http.StatusSeeOther)
+			return
+		}
+		vm.FieldErrors = p.FieldErrors()
+		vm.Error = passwordErrors[p.Code]
+		if vm.Error == "" && len(vm.FieldErrors) == 0 {
+			vm.Error = passwordErrors["failed"]
+		}
+		w.WriteHeader(p.Status)
+		h.render(w, "profile_password.html", vm)
+		return
+	}
+
+	// Every other session, including the one in this cookie, was signed out.
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Token == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    result.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   86400,
+	})
+	http.Redirect(w, r, "/profile?notice=password_changed", http.StatusSeeOther)
+}
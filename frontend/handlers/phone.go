@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var telephoneErrors = map[string]string{
+	"code":      "That code is not right, or it has expired. Check the message and try again, or send a new code.",
+	"attempts":  "Too many incorrect codes. Send a new code to try again.",
+	"throttled": "A code was sent recently. Wait a minute before asking for another one.",
+	"failed":    "The code could not be sent. Please try again later.",
+}
+
+// Telephone shows the form for entering the code texted to the user.
+func (h *ProfileHandler) Telephone(w http.ResponseWriter, r *http.Request) {
+	vm, ok := h.getProfile(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if vm.TelephoneVerified {
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	vm.ViewerRegion = viewerRegion(r)
+	vm.Error = telephoneErrors[r.URL.Query().Get("error")]
+	if r.URL.Query().Get("sent") != "" {
+		vm.Notice = "We sent you a new code. It is valid for 10 minutes."
+	}
+	if err := h.Tmpl.ExecuteTemplate(w, "profile_telephone.html", vm); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+// VerifyTelephone asks the backend to text a code to the user's telephone.
+func (h *ProfileHandler) VerifyTelephone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/telephone/verify"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, nil)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile/telephone?error=failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusAccepted {
+		http.Redirect(w, r, "/profile/telephone?sent=1", http.StatusSeeOther)
+		return
+	}
+	switch decodeProblem(resp).Code {
+	case "throttled":
+		http.Redirect(w, r, "/profile/telephone?error=throttled", http.StatusSeeOther)
+	case "already_verified":
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+	case "telephone_required":
+		// No telephone, or one saved without a country code.
+		http.Redirect(w, r, "/profile/edit?error=telephone", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/profile/telephone?error=failed", http.StatusSeeOther)
+	}
+}
+
+// ConfirmTelephone passes the code from the form on to the backend.
+func (h *ProfileHandler) ConfirmTelephone(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	reqBody, _ := json.Marshal(map[string]string{"code": r.FormValue("code")})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/telephone/confirm"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile/telephone?error=failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	switch decodeProblem(resp).Code {
+	case "validation_failed":
+		http.Redirect(w, r, "/profile/telephone?error=code", http.StatusSeeOther)
+	case "too_many_attempts":
+		http.Redirect(w, r, "/profile/telephone?error=attempts", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/profile/telephone?error=failed", http.StatusSeeOther)
+	}
+}
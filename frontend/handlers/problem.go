@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+const problemContentType = "application/problem+json"
+
+// Problem is an error response from the backend (RFC 9457). Pages branch
+// on Code, which is stable, and show Detail or the field errors, which are
+// written for users.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"request_id"`
+	Errors    []FieldError `json:"errors"`
+}
+
+// FieldError is what is wrong with one field of a request.
+type FieldError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+// decodeProblem reads the problem from a failed backend response. Bodies
+// that are not problems, such as those of a proxy in between, give a
+// Problem with only the status and its text.
+func decodeProblem(resp *http.Response) *Problem {
+	p := &Problem{Status: resp.StatusCode, Title: http.StatusText(resp.StatusCode)}
+	if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt == problemContentType {
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(p); err != nil {
+			slog.Warn("decoding backend problem failed", "status", resp.StatusCode, "error", err)
+		}
+	}
+	if p.Status == 0 {
+		p.Status = resp.StatusCode
+	}
+	if p.Status >= http.StatusInternalServerError {
+		slog.Error("backend request failed", "status", p.Status, "code", p.Code, "request_id", p.RequestID)
+	}
+	return p
+}
+
+// Message is the text to show for the problem as a whole.
+func (p *Problem) Message() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// Field returns the error for the named field, or "".
+func (p *Problem) Field(name string) string {
+	for _, e := range p.Errors {
+		if e.Field == name {
+			return e.Detail
+		}
+	}
+	return ""
+}
+
+// FieldErrors returns the field errors keyed by field, for templates.
+func (p *Problem) FieldErrors() map[string]string {
+	fields := make(map[string]string, len(p.Errors))
+	for _, e := range p.Errors {
+		fields[e.Field] = e.Detail
+	}
+	return fields
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"encoding/json"
 	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type ProfileHandler struct {
@@ -15,10 +19,134 @@ type ProfileHandler struct {
 }
 
 type ProfileViewModel struct {
-	FullName      string `json:"full_name"`
-	Telephone     string `json:"telephone"`
-	Email         string `json:"email"`
-	EmailDisabled bool   `json:"email_disabled"`
+	FullName  string `json:"full_name"`
+	Telephone string `json:"telephone"`
+	// The stored telephone in national and international format, and the
+	// region it belongs to.
+	TelephoneDisplay       string            `json:"telephone_display"`
+	TelephoneInternational string            `json:"telephone_international"`
+	TelephoneRegion        string            `json:"telephone_region"`
+	TelephoneVerified      bool              `json:"telephone_verified"`
+	Email                  string            `json:"email"`
+	EmailDisabled          bool              `json:"email_disabled"`
+	HasPassword            bool              `json:"has_password"`
+	Avatar                 map[string]string `json:"avatar"`
+	Version                int64             `json:"version"`
+	Attributes             map[string]any    `json:"attributes"`
+
+	Fields        []AttributeField    `json:"-"`
+	ViewerRegion  string              `json:"-"`
+	RecentChanges []RevisionViewModel `json:"-"`
+	Error         string              `json:"-"`
+	Notice        string              `json:"-"`
+	// NewEmail fills in the change email form.
+	NewEmail string `json:"-"`
+	// FieldErrors are the backend's messages for single form fields.
+	FieldErrors map[string]string `json:"-"`
+}
+
+// LocalTelephone is the telephone as the viewer would dial it: in national
+// format when they are in the number's region, international otherwise.
+func (vm *ProfileViewModel) LocalTelephone() string {
+	if vm.TelephoneRegion != "" && vm.TelephoneRegion == vm.ViewerRegion {
+		return vm.TelephoneDisplay
+	}
+	if vm.TelephoneInternational != "" {
+		return vm.TelephoneInternational
+	}
+	if vm.TelephoneDisplay != "" {
+		return vm.TelephoneDisplay
+	}
+	return vm.Telephone
+}
+
+// viewerRegion is the region of the browser's preferred language, such as
+// "GB" for "en-GB,en;q=0.8", or "" when it names none.
+func viewerRegion(r *http.Request) string {
+	for _, tag := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ = strings.Cut(strings.TrimSpace(tag), ";")
+		parts := strings.Split(tag, "-")
+		for _, sub := range parts[1:] {
+			if len(sub) == 2 {
+				return strings.ToUpper(sub)
+			}
+		}
+	}
+	return ""
+}
+
+// AvatarURL is where the browser loads the avatar thumbnail of the given
+// size through this server, or "" when there is none.
+func (vm *ProfileViewModel) AvatarURL(size string) string {
+	path, ok := vm.Avatar[size]
+	if !ok {
+		return ""
+	}
+	return "/avatars/" + strings.TrimPrefix(path, "/api/avatars/")
+}
+
+// AttributeSchema is one custom attribute as GET /profile/schema describes
+// it.
+type AttributeSchema struct {
+	Name     string `json:"name"`
+	Label    string `json:"label"`
+	Type     string `json:"type"`
+	Required bool   `json:"required"`
+	Editable bool   `json:"editable"`
+	Rules    struct {
+		MinLength int      `json:"min_length"`
+		MaxLength int      `json:"max_length"`
+		Pattern   string   `json:"pattern"`
+		Min       *float64 `json:"min"`
+		Max       *float64 `json:"max"`
+		Options   []string `json:"options"`
+	} `json:"rules"`
+}
+
+// AttributeField is a custom attribute with the user's value, ready for a
+// template.
+type AttributeField struct {
+	AttributeSchema
+	Value string
+}
+
+// InputType is the HTML input type that fits the attribute.
+func (f AttributeField) InputType() string {
+	switch f.Type {
+	case "number":
+		return "number"
+	case "date":
+		return "date"
+	case "boolean":
+		return "checkbox"
+	}
+	return "text"
+}
+
+type RevisionViewModel struct {
+	ID           int64     `json:"id"`
+	OldFullName  string    `json:"old_full_name"`
+	OldTelephone string    `json:"old_telephone"`
+	NewFullName  string    `json:"new_full_name"`
+	NewTelephone string    `json:"new_telephone"`
+	Actor        string    `json:"actor"`
+	Source       string    `json:"source"`
+	RestoredFrom int64     `json:"restored_from"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+const recentChangesLimit = 5
+
+// forwardFor passes the browser's address on so the backend records it in
+// the profile history instead of the frontend's, and its languages so
+// telephone numbers without a country code are read in the user's region.
+func forwardFor(req, r *http.Request) {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		req.Header.Set("X-Forwarded-For", host)
+	}
+	if lang := r.Header.Get("Accept-Language"); lang != "" {
+		req.Header.Set("Accept-Language", lang)
+	}
 }
 
 func (h *ProfileHandler) getProfile(r *http.Request) (*ProfileViewModel, bool) {
@@ -52,23 +180,158 @@ func (h *ProfileHandler) getProfile(r *http.Request) (*ProfileViewModel, bool) {
 	return &vm, true
 }
 
+// getSchema fetches the custom attributes the user can see. Like the recent
+// changes it is best effort: without it the attributes are just not shown.
+func (h *ProfileHandler) getSchema(r *http.Request) ([]AttributeSchema, bool) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		return nil, false
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, h.APIBaseURL+"/profile/schema", nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+
+	var schema struct {
+		Attributes []AttributeSchema `json:"attributes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, false
+	}
+	return schema.Attributes, true
+}
+
+// fields pairs the schema with the profile's attribute values.
+func (h *ProfileHandler) fields(r *http.Request, vm *ProfileViewModel) []AttributeField {
+	schema, _ := h.getSchema(r)
+	fields := make([]AttributeField, 0, len(schema))
+	for _, a := range schema {
+		f := AttributeField{AttributeSchema: a}
+		switch v := vm.Attributes[a.Name].(type) {
+		case string:
+			f.Value = v
+		case float64:
+			f.Value = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			f.Value = strconv.FormatBool(v)
+		}
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+// attributeInput reads the form value for an attribute as the JSON type the
+// backend expects. Empty fields clear the attribute; numbers that do not
+// parse are passed on as text for the backend to reject.
+func attributeInput(a AttributeSchema, r *http.Request) any {
+	v := strings.TrimSpace(r.FormValue("attr_" + a.Name))
+	switch {
+	case a.Type == "boolean":
+		return v != ""
+	case v == "":
+		return nil
+	case a.Type == "number":
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			return n
+		}
+	}
+	return v
+}
+
+// getRecentChanges fetches the latest profile revisions. The list is
+// informational, so failures leave it empty rather than failing the page.
+func (h *ProfileHandler) getRecentChanges(r *http.Request) []RevisionViewModel {
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		return nil
+	}
+
+	url := h.APIBaseURL + "/profile/history?limit=" + strconv.Itoa(recentChangesLimit)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, url, nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	var history struct {
+		Revisions []RevisionViewModel `json:"revisions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&history); err != nil {
+		return nil
+	}
+	return history.Revisions
+}
+
 func (h *ProfileHandler) View(w http.ResponseWriter, r *http.Request) {
 	vm, ok := h.getProfile(r)
 	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	vm.Fields = h.fields(r, vm)
+	vm.ViewerRegion = viewerRegion(r)
+	vm.RecentChanges = h.getRecentChanges(r)
+	vm.Notice = viewNotices[r.URL.Query().Get("notice")]
 	if err := h.Tmpl.ExecuteTemplate(w, "profile_view.html", vm); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
+var viewNotices = map[string]string{
+	"password_changed": "Your password was saved. Every other device was signed out.",
+}
+
+var editErrors = map[string]string{
+	"conflict":      "Your profile was changed elsewhere. The form now shows the latest version; re-apply your edits and save again.",
+	"update_failed": "Saving your profile failed. Please try again.",
+	"parse_failed":  "The form could not be read. Please try again.",
+	"invalid":       "Some of the values were not accepted. Check the fields and save again.",
+	"telephone":     "The telephone number is not valid. Numbers from outside your country need their country code, such as +44.",
+	"avatar_type":   "The picture must be a JPEG, PNG, GIF or WebP image.",
+	"avatar_size":   "The picture is too large. Pictures can be up to 5 MB.",
+	"avatar_failed": "Updating your picture failed. Please try again.",
+	"email_invalid": "Enter a valid email address that differs from your current one.",
+	"email_taken":   "That email address is already used by another account.",
+	"email_failed":  "Changing your email failed. Please try again.",
+}
+
+var editNotices = map[string]string{
+	"email_sent": "We sent a confirmation link to your new address. Your email changes once you open it. Your current address got a notice with a link to cancel.",
+}
+
 func (h *ProfileHandler) Edit(w http.ResponseWriter, r *http.Request) {
 	vm, ok := h.getProfile(r)
 	if !ok {
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
+	vm.Fields = h.fields(r, vm)
+	vm.ViewerRegion = viewerRegion(r)
+	vm.Error = editErrors[r.URL.Query().Get("error")]
+	vm.Notice = editNotices[r.URL.Query().Get("notice")]
+	vm.NewEmail = r.URL.Query().Get("email")
 	if err := h.Tmpl.ExecuteTemplate(w, "profile_edit.html", vm); err != nil {
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -91,16 +354,27 @@ func (h *ProfileHandler) Save(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	payload := map[string]string{
+	payload := map[string]any{
 		"full_name": r.FormValue("full_name"),
 		"telephone": r.FormValue("telephone"),
 	}
+	// PUT replaces every editable attribute, so they are only sent when the
+	// schema is known; otherwise they are left as they are.
+	if schema, ok := h.getSchema(r); ok {
+		attributes := map[string]any{}
+		for _, a := range schema {
+			if a.Editable {
+				attributes[a.Name] = attributeInput(a, r)
+			}
+		}
+		payload["attributes"] = attributes
+	}
 
 	reqBody, _ := json.Marshal(payload)
 	baseURL := strings.TrimSuffix(h.APIBaseURL, "/")
-	fullURL := baseURL + "/profile/save"
+	fullURL := baseURL + "/profile"
 
-	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPut, fullURL, bytes.NewReader(reqBody))
 	if err != nil {
 		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
@@ -108,6 +382,12 @@ func (h *ProfileHandler) Save(w http.ResponseWriter, r *http.Request) {
 
 	req.Header.Set("Authorization", "Bearer "+cookie.Value)
 	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+	// The version the form was rendered with; the backend refuses the save
+	// if the profile has changed since.
+	if version := r.FormValue("version"); version != "" {
+		req.Header.Set("If-Match", `"`+version+`"`)
+	}
 
 	resp, err := h.Client.Do(req)
 	if err != nil {
@@ -116,13 +396,215 @@ func (h *ProfileHandler) Save(w http.ResponseWriter, r *http.Request) {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode == http.StatusOK {
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	switch p := decodeProblem(resp); p.Code {
+	case "version_mismatch":
+		http.Redirect(w, r, "/profile/edit?error=conflict", http.StatusSeeOther)
+	case "validation_failed", "unknown_attribute":
+		h.editAgain(w, r, p)
+	default:
 		http.Redirect(w, r, "/profile/edit?error=update_failed", http.StatusSeeOther)
+	}
+}
+
+// editAgain shows the edit form again with what was typed and what the
+// backend found wrong with it, next to each field it named.
+func (h *ProfileHandler) editAgain(w http.ResponseWriter, r *http.Request, p *Problem) {
+	vm, ok := h.getProfile(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	vm.FullName = r.FormValue("full_name")
+	// Shown as typed rather than formatted.
+	vm.Telephone = r.FormValue("telephone")
+	vm.TelephoneDisplay, vm.TelephoneInternational, vm.TelephoneRegion = "", "", ""
+	vm.Fields = h.fields(r, vm)
+	for i, f := range vm.Fields {
+		if f.Editable {
+			vm.Fields[i].Value = r.FormValue("attr_" + f.Name)
+		}
+	}
+	vm.ViewerRegion = viewerRegion(r)
+	vm.FieldErrors = p.FieldErrors()
+	vm.Error = editErrors["invalid"]
+	if len(vm.FieldErrors) == 0 {
+		vm.Error = p.Message()
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	if err := h.Tmpl.ExecuteTemplate(w, "profile_edit.html", vm); err != nil {
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
+
+func (h *ProfileHandler) Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("revision_id"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/profile?error=restore_failed", http.StatusSeeOther)
+		return
+	}
+
+	reqBody, _ := json.Marshal(map[string]int64{"revision_id": id})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/history/restore"
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile?error=restore_failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		http.Redirect(w, r, "/profile?error=restore_failed", http.StatusSeeOther)
+		return
+	}
+
+	http.Redirect(w, r, "/profile", http.StatusSeeOther)
+}
+
+// maxAvatarUpload bounds the multipart body passed on to the backend, which
+// accepts pictures of up to 5 MB.
+const maxAvatarUpload = 5<<20 + 64<<10
+
+// UploadAvatar passes the multipart avatar form on to the backend as is.
+func (h *ProfileHandler) UploadAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if r.ContentLength > maxAvatarUpload {
+		http.Redirect(w, r, "/profile/edit?error=avatar_size", http.StatusSeeOther)
+		return
+	}
+
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/avatar"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, http.MaxBytesReader(w, r.Body, maxAvatarUpload))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
 		return
 	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile/edit?error=avatar_failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusOK {
+		http.Redirect(w, r, "/profile", http.StatusSeeOther)
+		return
+	}
+	switch decodeProblem(resp).Code {
+	case "unsupported_media_type", "validation_failed":
+		http.Redirect(w, r, "/profile/edit?error=avatar_type", http.StatusSeeOther)
+	case "payload_too_large":
+		http.Redirect(w, r, "/profile/edit?error=avatar_size", http.StatusSeeOther)
+	default:
+		http.Redirect(w, r, "/profile/edit?error=avatar_failed", http.StatusSeeOther)
+	}
+}
+
+func (h *ProfileHandler) RemoveAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/profile/avatar"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodDelete, fullURL, nil)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Redirect(w, r, "/profile/edit?error=avatar_failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		http.Redirect(w, r, "/profile/edit?error=avatar_failed", http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/profile", http.StatusSeeOther)
 }
+
+// avatarHeaders are passed back from the backend's avatar responses.
+var avatarHeaders = []string{"Content-Type", "Content-Length", "Cache-Control", "ETag", "X-Content-Type-Options"}
+
+// Avatar serves /avatars/{id}/{size} from the backend, keeping its caching
+// headers so browsers can reuse the thumbnails.
+func (h *ProfileHandler) Avatar(w http.ResponseWriter, r *http.Request) {
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/avatars/" + r.PathValue("id") + "/" + r.PathValue("size")
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, fullURL, nil)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		req.Header.Set("If-None-Match", inm)
+	}
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		http.Error(w, "Avatar unavailable", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for _, name := range avatarHeaders {
+		if v := resp.Header.Get(name); v != "" {
+			w.Header().Set(name, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
 func (h *ProfileHandler) Cancel(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/profile", http.StatusSeeOther)
 }
@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// reauthNextCookie remembers where to return after confirming with
+// Google, which comes back through /auth/callback.
+const reauthNextCookie = "reauth_next"
+
+// ReauthPage is the form for confirming it is the user before a sensitive
+// change.
+type ReauthPage struct {
+	Email       string
+	HasPassword bool
+	// Next is the page to return to, a path on this site.
+	Next  string
+	Error string
+}
+
+// reauthURL is the page that asks the user to confirm it is them and then
+// goes on to next.
+func reauthURL(next string) string {
+	return "/reauth?next=" + url.QueryEscape(next)
+}
+
+// localPath returns next when it is a path on this site, and /profile
+// otherwise, so the return address cannot send the user elsewhere.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/profile"
+	}
+	return next
+}
+
+// Reauth asks the signed-in user for their password again on GET, and
+// passes it to the backend on POST. The backend answers with a session
+// that counts as a fresh sign-in, and the user goes back to what they
+// were doing. Users without a password confirm with Google instead.
+func (h *ProfileHandler) Reauth(w http.ResponseWriter, r *http.Request) {
+	vm, ok := h.getProfile(r)
+	if !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	page := ReauthPage{Email: vm.Email, HasPassword: vm.HasPassword, Next: localPath(r.FormValue("next"))}
+	if r.Method != http.MethodPost {
+		h.render(w, "reauth.html", page)
+		return
+	}
+
+	cookie, _ := r.Cookie("session_token")
+	reqBody, _ := json.Marshal(map[string]string{"password": r.FormValue("password")})
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/auth/reauth"
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodPost, fullURL, bytes.NewReader(reqBody))
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	req.Header.Set("Authorization", "Bearer "+cookie.Value)
+	req.Header.Set("Content-Type", "application/json")
+	forwardFor(req, r)
+
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		page.Error = "Confirming failed. Please try again."
+		h.render(w, "reauth.html", page)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		p := decodeProblem(resp)
+		page.Error = p.Field("password")
+		if page.Error == "" {
+			page.Error = p.Message()
+		}
+		w.WriteHeader(p.Status)
+		h.render(w, "reauth.html", page)
+		return
+	}
+
+	var result struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil || result.Token == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session_token",
+		Value:    result.Token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   false,
+		SameSite: http.SameSiteLaxMode,
+		MaxAge:   86400,
+	})
+	http.Redirect(w, r, page.Next, http.StatusSeeOther)
+}
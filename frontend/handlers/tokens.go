@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AccessToken is a personal access token as the backend lists it. Token
+// is only set in the response that created it.
+type AccessToken struct {
+	ID         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	Token      string     `json:"token"`
+}
+
+// TokensViewModel is the personal access tokens page.
+type TokensViewModel struct {
+	Tokens []AccessToken `json:"tokens"`
+	Scopes []string      `json:"scopes"`
+
+	// Created is the token just created, shown this once.
+	Created     *AccessToken      `json:"-"`
+	Error       string            `json:"-"`
+	Notice      string            `json:"-"`
+	FieldErrors map[string]string `json:"-"`
+}
+
+var tokenErrors = map[string]string{
+	"failed":          "Managing your access tokens failed. Please try again.",
+	"token_not_found": "That token was already revoked.",
+}
+
+// tokenLifetimes are the expiries offered for a new token, in days.
+var tokenLifetimes = []int{7, 30, 90, 366}
+
+// Lifetimes is tokenLifetimes for the template.
+func (vm *TokensViewModel) Lifetimes() []int { return tokenLifetimes }
+
+// Tokens lists the user's personal access tokens on GET and creates one on
+// POST. Creating needs a recent sign-in; the backend answers
+// reauthentication_required otherwise.
+func (h *ProfileHandler) Tokens(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	vm := &TokensViewModel{}
+	resp, err := h.tokensRequest(r, cookie.Value, http.MethodGet, "", nil)
+	if err != nil {
+		http.Error(w, "The backend could not be reached", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		vm.Error = tokenErrors["failed"]
+	} else if err := json.NewDecoder(resp.Body).Decode(vm); err != nil {
+		vm.Error = tokenErrors["failed"]
+	}
+
+	if r.Method != http.MethodPost {
+		if msg := tokenErrors[r.URL.Query().Get("error")]; msg != "" {
+			vm.Error = msg
+		}
+		if r.URL.Query().Get("notice") == "revoked" {
+			vm.Notice = "The token was revoked. Anything still using it is refused from now on."
+		}
+		h.render(w, "profile_tokens.html", vm)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		vm.Error = tokenErrors["failed"]
+		h.render(w, "profile_tokens.html", vm)
+		return
+	}
+	days, _ := strconv.Atoi(r.FormValue("expires_in_days"))
+	reqBody, _ := json.Marshal(map[string]any{
+		"name":            r.FormValue("name"),
+		"scopes":          append([]string{}, r.Form["scopes"]...),
+		"expires_in_days": days,
+	})
+	created, err := h.tokensRequest(r, cookie.Value, http.MethodPost, "", bytes.NewReader(reqBody))
+	if err != nil {
+		vm.Error = tokenErrors["failed"]
+		h.render(w, "profile_tokens.html", vm)
+		return
+	}
+	defer created.Body.Close()
+
+	if created.StatusCode != http.StatusCreated {
+		p := decodeProblem(created)
+		if p.Code == "reauthentication_required" {
+			http.Redirect(w, r, reauthURL("/profile/tokens"), http.StatusSeeOther)
+			return
+		}
+		vm.FieldErrors = p.FieldErrors()
+		if len(vm.FieldErrors) == 0 {
+			vm.Error = tokenErrors["failed"]
+		}
+		w.WriteHeader(p.Status)
+		h.render(w, "profile_tokens.html", vm)
+		return
+	}
+
+	var t AccessToken
+	if err := json.NewDecoder(created.Body).Decode(&t); err != nil {
+		vm.Error = tokenErrors["failed"]
+		h.render(w, "profile_tokens.html", vm)
+		return
+	}
+	vm.Created = &t
+	vm.Tokens = append([]AccessToken{t}, vm.Tokens...)
+	// The page holds the token itself; it must not outlive this response.
+	w.Header().Set("Cache-Control", "no-store")
+	h.render(w, "profile_tokens.html", vm)
+}
+
+// RevokeToken deletes the personal access token named by the id form
+// value.
+func (h *ProfileHandler) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Redirect(w, r, "/profile/tokens?error=token_not_found", http.StatusSeeOther)
+		return
+	}
+	resp, err := h.tokensRequest(r, cookie.Value, http.MethodDelete, "/"+strconv.FormatInt(id, 10), nil)
+	if err != nil {
+		http.Redirect(w, r, "/profile/tokens?error=failed", http.StatusSeeOther)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		p := decodeProblem(resp)
+		code := p.Code
+		if tokenErrors[code] == "" {
+			code = "failed"
+		}
+		http.Redirect(w, r, "/profile/tokens?error="+code, http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/profile/tokens?notice=revoked", http.StatusSeeOther)
+}
+
+// tokensRequest sends a request to the backend's access token routes.
+func (h *ProfileHandler) tokensRequest(r *http.Request, session, method, path string, body io.Reader) (*http.Response, error) {
+	fullURL := strings.TrimSuffix(h.APIBaseURL, "/") + "/account/tokens" + path
+	req, err := http.NewRequestWithContext(r.Context(), method, fullURL, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+session)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	forwardFor(req, r)
+	return h.Client.Do(req)
+}
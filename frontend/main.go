@@ -78,12 +78,30 @@ func main() {
 		}
 	})
 
+	mux.HandleFunc("/signup/strength", authHandler.PasswordStrength)
 	mux.HandleFunc("/logout", authHandler.Logout)
 	mux.HandleFunc("/auth/google", authHandler.GoogleAuth)
+	mux.HandleFunc("/auth/saml", authHandler.SAMLAuth)
 	mux.HandleFunc("/profile", profileHandler.View)
 	mux.HandleFunc("/profile/edit", profileHandler.Edit)
 	mux.HandleFunc("/profile/save", profileHandler.Save)
+	mux.HandleFunc("/profile/restore", profileHandler.Restore)
 	mux.HandleFunc("/profile/cancel", profileHandler.Cancel)
+	mux.HandleFunc("/profile/avatar", profileHandler.UploadAvatar)
+	mux.HandleFunc("/profile/avatar/remove", profileHandler.RemoveAvatar)
+	mux.HandleFunc("/profile/telephone", profileHandler.Telephone)
+	mux.HandleFunc("/profile/telephone/verify", profileHandler.VerifyTelephone)
+	mux.HandleFunc("/profile/telephone/confirm", profileHandler.ConfirmTelephone)
+	mux.HandleFunc("/profile/password", profileHandler.ChangePassword)
+	mux.HandleFunc("/profile/tokens", profileHandler.Tokens)
+	mux.HandleFunc("/profile/tokens/revoke", profileHandler.RevokeToken)
+	mux.HandleFunc("/reauth", profileHandler.Reauth)
+	mux.HandleFunc("/oauth/consent", profileHandler.Consent)
+	mux.HandleFunc("/device", profileHandler.Device)
+	mux.HandleFunc("/profile/email", profileHandler.RequestEmail)
+	mux.HandleFunc("/profile/email/confirm", profileHandler.ConfirmEmail)
+	mux.HandleFunc("/email/revert", profileHandler.RevertEmail)
+	mux.HandleFunc("GET /avatars/{id}/{size}", profileHandler.Avatar)
 	mux.HandleFunc("/auth/callback", authHandler.AuthCallback)
 
 	srv := &http.Server{